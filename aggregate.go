@@ -1,6 +1,9 @@
 package rarlist
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // FileEntry summarizes a file within a volume.
 type FileEntry struct {
@@ -56,34 +59,82 @@ type AggregatedFilePart struct {
 	UnpackedSize int64  `json:"unpackedSize"`
 	Stored       bool   `json:"stored"`
 	Encrypted    bool   `json:"encrypted"`
+	// Checksums from the part header: for a part continuing in the next volume they cover this
+	// part's packed data, for the last (or only) part the whole unpacked file.
+	CRC32    uint32    `json:"crc32"`
+	HasCRC32 bool      `json:"hasCRC32"`
+	Hash     *FileHash `json:"hash,omitempty"` // RAR5 BLAKE2sp record
+
+	Encryption       *Encryption `json:"encryption,omitempty"` // RAR5 AES-256 parameters of encrypted data
+	Salt             []byte      `json:"salt,omitempty"`       // RAR 2.9-4.x salt of encrypted data
+	AlgorithmVersion uint8       `json:"algorithmVersion"`     // RAR5 algorithm version or RAR 1.5-4.x UNP_VER
+	Method           uint8       `json:"method"`               // compression method, 0 (store) .. 5 (best)
+	Solid            bool        `json:"solid"`                // data continues the solid stream of the previous file
+	DictSize         int64       `json:"dictSize"`             // dictionary size needed to unpack
 }
 
 // AggregatedFile groups all parts (headers) for a given file name across volumes.
 type AggregatedFile struct {
 	Name              string               `json:"name"`
+	Version           string               `json:"version"` // archive format of the volumes (VersionRar5, VersionRar3, ...)
 	TotalPackedSize   int64                `json:"totalPackedSize"`
 	TotalUnpackedSize int64                `json:"totalUnpackedSize"`
 	Parts             []AggregatedFilePart `json:"parts"`
 	AnyEncrypted      bool                 `json:"anyEncrypted"`
 	AllStored         bool                 `json:"allStored"`
+	Incomplete        bool                 `json:"incomplete"` // split chain is broken (a preceding or following part is missing)
+	IsDir             bool                 `json:"isDir"`
+	ModTime           time.Time            `json:"modTime"`
+}
+
+// aggChain tracks an AggregatedFile while parts are being chained together.
+type aggChain struct {
+	af       *AggregatedFile
+	pending  bool // last part continues in the next volume
+	lastVol  int  // index of the volume holding the last part
+	hasSplit bool // any part carried split flags
 }
 
 // AggregateFiles builds aggregated file listing from volume indexes.
+// Parts are chained using the split-before/split-after flags: a part continuing from the previous
+// volume is appended to the pending file of the same name, and a file whose chain is broken is
+// reported as Incomplete. Headers without any split flags are grouped by name.
 func AggregateFiles(vs []*VolumeIndex) []AggregatedFile {
-	m := make(map[string]*AggregatedFile)
-	order := []string{}
-	for _, v := range vs {
+	m := make(map[string]*aggChain)
+	order := []*aggChain{}
+	for vi, v := range vs {
 		for _, fb := range v.FileBlocks {
 			if fb.Name == "" {
 				continue
 			}
-			ag, ok := m[fb.Name]
-			if !ok {
-				ag = &AggregatedFile{Name: fb.Name, AllStored: true}
-				m[fb.Name] = ag
-				order = append(order, fb.Name)
+			split := fb.ContinuedFrom || fb.ContinuedTo
+			ch, ok := m[fb.Name]
+			switch {
+			case ok && ch.pending && fb.ContinuedFrom:
+				// next piece of the pending chain; it must come from the very next volume
+				if vi != ch.lastVol+1 {
+					ch.af.Incomplete = true
+				}
+			case ok && !ch.pending && !ch.hasSplit && !split:
+				// no split information on either side: group by name
+			default:
+				if ok && ch.pending { // expected a continuation but a new file started
+					ch.af.Incomplete = true
+				}
+				ch = &aggChain{af: &AggregatedFile{Name: fb.Name, Version: v.Version, AllStored: true, IsDir: fb.IsDir, ModTime: fb.ModTime}}
+				if fb.ContinuedFrom { // first part we see continues from a volume we don't have
+					ch.af.Incomplete = true
+				}
+				m[fb.Name] = ch
+				order = append(order, ch)
 			}
-			ag.Parts = append(ag.Parts, AggregatedFilePart{Path: v.Path, DataOffset: fb.DataPos, PackedSize: fb.VolumeDataSize, UnpackedSize: fb.UnpackedSize, Stored: fb.Stored, Encrypted: fb.Encrypted})
+			ch.pending = fb.ContinuedTo
+			ch.lastVol = vi
+			ch.hasSplit = ch.hasSplit || split
+			ag := ch.af
+			ag.Parts = append(ag.Parts, AggregatedFilePart{Path: v.Path, DataOffset: fb.DataPos, PackedSize: fb.VolumeDataSize, UnpackedSize: fb.UnpackedSize, Stored: fb.Stored, Encrypted: fb.Encrypted,
+				CRC32: fb.CRC32, HasCRC32: hasPartCRC32(v, fb), Hash: fb.Hash, Encryption: fb.Encryption, Salt: fb.Salt, AlgorithmVersion: fb.AlgorithmVersion,
+				Method: fb.Method, Solid: fb.Solid, DictSize: fb.DictSize})
 			ag.TotalPackedSize += fb.VolumeDataSize
 			// Only take first reported unpacked size (do not sum across parts)
 			if ag.TotalUnpackedSize == 0 && fb.UnpackedSize > 0 {
@@ -98,29 +149,58 @@ func AggregateFiles(vs []*VolumeIndex) []AggregatedFile {
 		}
 	}
 	out := make([]AggregatedFile, 0, len(order))
-	for _, name := range order {
-		out = append(out, *m[name])
+	for _, ch := range order {
+		if ch.pending { // last part still expects a following volume
+			ch.af.Incomplete = true
+		}
+		out = append(out, *ch.af)
 	}
 	return out
 }
 
-// ListFiles lists all files in the RAR archive starting from the specified volume.
-func ListFilesFS(fs FileSystem, first string) ([]AggregatedFile, error) {
+// hasPartCRC32 reports whether the header CRC32 can be checked against the part data. RAR 1.5 (UNP_VER
+// below 20) split parts and parts flagged with 0xFFFFFFFF carry no packed data CRC.
+func hasPartCRC32(v *VolumeIndex, fb FileBlock) bool {
+	if !fb.HasCRC32 {
+		return false
+	}
+	if v.Version == VersionRar3 && fb.ContinuedTo && (fb.AlgorithmVersion < 20 || fb.CRC32 == 0xFFFFFFFF) {
+		return false
+	}
+	return true
+}
+
+// ListFilesFS lists all files in the RAR archive starting from the specified volume. Compressed files
+// are rejected unless a native unpacker handles their algorithm (RAR5, RAR 1.3-4.x) or a Decompressor
+// is registered for their method, and encrypted ones unless
+// WithPassword supplies their password (RAR5, or RAR 2.9-4.x AES).
+func ListFilesFS(fs FileSystem, first string, opts ...Option) ([]AggregatedFile, error) {
 	vols, err := DiscoverVolumesFS(fs, first)
 	if err != nil {
 		return nil, err
 	}
-	idx, err := IndexVolumesParallel(fs, vols, 0)
+	idx, err := IndexVolumesParallel(fs, vols, 0, opts...)
 	if err != nil {
 		return nil, err
 	}
-	// Validate that files are not compressed or password protected
+	// Validate that files can be unpacked, and are password protected only if the password opens them
+	o := newOptions(opts)
+	keys := newKeyCache(o.password)
 	for _, v := range idx {
 		for _, fb := range v.FileBlocks {
 			if fb.Encrypted {
-				return nil, fmt.Errorf("%w: %s (%s)", ErrPasswordProtected, fb.Name, v.Path)
+				switch {
+				case o.password != "" && fb.Encryption != nil:
+					if _, err := keys.rar5(fb.Encryption); err != nil {
+						return nil, fmt.Errorf("%w: %s (%s)", err, fb.Name, v.Path)
+					}
+				case o.password != "" && v.Version == VersionRar3 && isRar3AES(fb.AlgorithmVersion):
+					// RAR 2.9-4.x stores no password check: a wrong password shows in the data CRC
+				default:
+					return nil, fmt.Errorf("%w: %s (%s)", ErrPasswordProtected, fb.Name, v.Path)
+				}
 			}
-			if !fb.Stored {
+			if !fb.Stored && !canUnpack(v.Version, fb.AlgorithmVersion) && decompressorFor(v.Version, fb.Method) == nil {
 				return nil, fmt.Errorf("%w: %s (%s)", ErrCompressedNotSupported, fb.Name, v.Path)
 			}
 		}
@@ -129,4 +209,6 @@ func ListFilesFS(fs FileSystem, first string) ([]AggregatedFile, error) {
 }
 
 // ListFiles is a convenience using the default filesystem.
-func ListFiles(first string) ([]AggregatedFile, error) { return ListFilesFS(defaultFS, first) }
+func ListFiles(first string, opts ...Option) ([]AggregatedFile, error) {
+	return ListFilesFS(defaultFS, first, opts...)
+}
@@ -0,0 +1,79 @@
+package rarlist
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// ErrHeaderCRC is returned in CRCStrict mode when a block header fails its CRC check, and in any mode
+// when a RAR3 encrypted header does (a wrong password).
+type ErrHeaderCRC struct {
+	Volume    string
+	Offset    int64 // volume offset of the block header
+	BlockType uint8 // RAR3 HEAD_TYPE or RAR5 header type
+	Want      uint32
+	Got       uint32
+}
+
+func (e *ErrHeaderCRC) Error() string {
+	return fmt.Sprintf("%s: header CRC mismatch at %d (block type 0x%02x): stored %08x, computed %08x", e.Volume, e.Offset, e.BlockType, e.Want, e.Got)
+}
+
+// headerCRCMismatch handles a header CRC check result according to the configured mode.
+func (v *VolumeIndex) headerCRCMismatch(o options, offset int64, blockType uint8, want, got uint32) error {
+	if o.headerCRC == CRCIgnore || want == got {
+		return nil
+	}
+	e := &ErrHeaderCRC{Volume: v.Path, Offset: offset, BlockType: blockType, Want: want, Got: got}
+	if o.headerCRC == CRCStrict {
+		return e
+	}
+	v.warnf(WarningHeaderCRC, offset, "block type 0x%02x: stored %08x, computed %08x", blockType, want, got)
+	return nil
+}
+
+// checkRar3HeaderCRC verifies HEAD_CRC, the low 16 bits of the CRC32 of the header from HEAD_TYPE to HEAD_SIZE.
+// RAR 1.5/2.x computed the CRC of main, comment and file headers over the fixed fields (and the name) only,
+// so that shorter span is accepted too. AV and SIGN blocks carry no usable CRC.
+func (v *VolumeIndex) checkRar3HeaderCRC(o options, offset int64, hdr []byte) error {
+	if o.headerCRC == CRCIgnore || len(hdr) < 7 {
+		return nil
+	}
+	want, got := rar3HeaderCRC(hdr)
+	return v.headerCRCMismatch(o, offset, hdr[2], want, got)
+}
+
+// rar3HeaderCRC returns the stored and computed HEAD_CRC of a complete block header (at least 7 bytes).
+// Blocks without a usable CRC report the stored value for both.
+func rar3HeaderCRC(hdr []byte) (want, got uint32) {
+	want = uint32(binary.LittleEndian.Uint16(hdr[0:2]))
+	if typ := hdr[2]; typ == rar3BlockTypeAV || typ == rar3BlockTypeSign {
+		return want, want
+	}
+	got = crc32.ChecksumIEEE(hdr[2:]) & 0xFFFF
+	if got != want {
+		if n := rar3ShortCRCSpan(hdr); n > 0 && n < len(hdr) && crc32.ChecksumIEEE(hdr[2:n])&0xFFFF == want {
+			got = want
+		}
+	}
+	return want, got
+}
+
+// rar3ShortCRCSpan returns the header length covered by RAR 1.5/2.x CRCs, or 0 if not applicable.
+func rar3ShortCRCSpan(hdr []byte) int {
+	switch hdr[2] {
+	case rar3BlockTypeMain, rar3BlockTypeComment:
+		return 13
+	case rar3BlockTypeFile, rar3BlockTypeNewSub:
+		if len(hdr) < 32 {
+			return 0
+		}
+		n := 32 + int(binary.LittleEndian.Uint16(hdr[7+19:7+21]))
+		if binary.LittleEndian.Uint16(hdr[3:5])&0x0100 != 0 {
+			n += 8
+		}
+		return n
+	}
+	return 0
+}
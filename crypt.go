@@ -0,0 +1,182 @@
+package rarlist
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"io"
+
+	"github.com/javi11/rarlist/internal/rar3kdf"
+)
+
+// keyCache memoizes password checks by encryption parameters: a volume set normally reuses one salt,
+// and each derivation costs thousands of HMAC rounds.
+type keyCache struct {
+	password string
+	keys     map[string]rar5Keys
+	errs     map[string]error
+	rar3     map[string][32]byte // AES-128 key and IV by salt
+}
+
+func newKeyCache(password string) *keyCache {
+	return &keyCache{password: password, keys: map[string]rar5Keys{}, errs: map[string]error{}, rar3: map[string][32]byte{}}
+}
+
+func (c *keyCache) rar5(e *Encryption) (rar5Keys, error) {
+	id := fmt.Sprintf("%d/%d/%x/%x", e.Version, e.KDFCount, e.Salt, e.CheckValue)
+	if err, ok := c.errs[id]; ok {
+		return rar5Keys{}, err
+	}
+	if k, ok := c.keys[id]; ok {
+		return k, nil
+	}
+	k, err := rar5PasswordKeys(e, c.password)
+	if err != nil {
+		c.errs[id] = err
+		return rar5Keys{}, err
+	}
+	c.keys[id] = k
+	return k, nil
+}
+
+// rar3Keys returns the AES-128 key and IV derived from the password and a RAR 2.9-4.x salt.
+func (c *keyCache) rar3Keys(salt []byte) (key, iv [16]byte) {
+	id := string(salt)
+	if k, ok := c.rar3[id]; ok {
+		copy(key[:], k[:16])
+		copy(iv[:], k[16:])
+		return key, iv
+	}
+	key, iv = rar3kdf.Keys(c.password, salt)
+	var k [32]byte
+	copy(k[:16], key[:])
+	copy(k[16:], iv[:])
+	c.rar3[id] = k
+	return key, iv
+}
+
+// DecryptReader gives random access to the plain contents of an encrypted stored file. The packed data
+// of all parts forms one AES-CBC stream, so any 16 byte block is decrypted from the block preceding it.
+type DecryptReader struct {
+	src   io.ReaderAt
+	block cipher.Block
+	iv    []byte
+	size  int64 // plain size; the cipher stream is padded to the AES block size
+	off   int64
+}
+
+// DecryptFileFS returns a reader of the plain contents of an encrypted stored file: RAR5 AES-256, whose
+// password is checked first (a rejected password yields ErrWrongPassword), or RAR 2.9-4.x AES-128,
+// which stores no password check, so a wrong password only shows as a CRC32 mismatch of the contents.
+// Compressed or incomplete files report ErrCompressedNotSupported and ErrIncompleteVolumeSet.
+func DecryptFileFS(fs FileSystem, af AggregatedFile, password string) (*DecryptReader, error) {
+	if len(af.Parts) == 0 || !af.AnyEncrypted {
+		return nil, fmt.Errorf("%s: not encrypted", af.Name)
+	}
+	if !af.AllStored {
+		return nil, fmt.Errorf("%w: %s", ErrCompressedNotSupported, af.Name)
+	}
+	if af.Incomplete {
+		return nil, fmt.Errorf("%w: %s", ErrIncompleteVolumeSet, af.Name)
+	}
+	block, iv, err := fileCipher(af, newKeyCache(password))
+	if err != nil {
+		return nil, err
+	}
+	src := newPartReader(fs, af.Parts)
+	if src.size()%aes.BlockSize != 0 || af.TotalUnpackedSize > src.size() {
+		return nil, fmt.Errorf("%s: encrypted data size %d does not hold %d plain bytes", af.Name, src.size(), af.TotalUnpackedSize)
+	}
+	return &DecryptReader{src: src, block: block, iv: iv, size: af.TotalUnpackedSize}, nil
+}
+
+// fileCipher returns the AES cipher and IV of the packed data of an encrypted file.
+func fileCipher(af AggregatedFile, keys *keyCache) (cipher.Block, []byte, error) {
+	switch p := af.Parts[0]; {
+	case p.Encryption != nil && len(p.Encryption.IV) == aes.BlockSize:
+		k, err := keys.rar5(p.Encryption)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", af.Name, err)
+		}
+		block, err := aes.NewCipher(k.key[:])
+		return block, p.Encryption.IV, err
+	case p.Encryption == nil && isRar3AES(p.AlgorithmVersion):
+		key, iv := keys.rar3Keys(p.Salt)
+		block, err := aes.NewCipher(key[:])
+		return block, iv[:], err
+	}
+	return nil, nil, fmt.Errorf("%w: %s: unsupported encryption", ErrPasswordProtected, af.Name)
+}
+
+// isRar3AES reports whether a RAR 1.5-4.x UNP_VER encrypts with AES-128 (RAR 2.9 and later); older
+// versions use the RAR 1.5 and 2.0 ciphers, which are not supported.
+func isRar3AES(unpVer uint8) bool { return unpVer >= 29 && unpVer <= 36 }
+
+// DecryptFile is a convenience using the default filesystem.
+func DecryptFile(af AggregatedFile, password string) (*DecryptReader, error) {
+	return DecryptFileFS(defaultFS, af, password)
+}
+
+// Size returns the plain size of the file.
+func (d *DecryptReader) Size() int64 { return d.size }
+
+// ReadAt implements io.ReaderAt.
+func (d *DecryptReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= d.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), d.size)
+	first := off / aes.BlockSize * aes.BlockSize
+	last := (end + aes.BlockSize - 1) / aes.BlockSize * aes.BlockSize
+	// the block before first is the CBC chaining value
+	buf := make([]byte, last-first+aes.BlockSize)
+	if first == 0 {
+		copy(buf, d.iv)
+		if _, err := d.src.ReadAt(buf[aes.BlockSize:], 0); err != nil {
+			return 0, err
+		}
+	} else if _, err := d.src.ReadAt(buf, first-aes.BlockSize); err != nil {
+		return 0, err
+	}
+	plain := buf[aes.BlockSize:]
+	cipher.NewCBCDecrypter(d.block, buf[:aes.BlockSize]).CryptBlocks(plain, plain)
+	n := copy(p, plain[off-first:end-first])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Read implements io.Reader.
+func (d *DecryptReader) Read(p []byte) (int, error) {
+	if d.off >= d.size {
+		return 0, io.EOF
+	}
+	n, err := d.ReadAt(p, d.off)
+	d.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (d *DecryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.off
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	d.off = offset
+	return offset, nil
+}
@@ -0,0 +1,73 @@
+package rarlist
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+// rar5MaxKDFCount is the largest binary logarithm of the PBKDF2 iterations accepted, as in unrar.
+const rar5MaxKDFCount = 24
+
+// rar5Keys holds the values derived from a password and salt: the AES-256 key, the key turning
+// checksums into MACs and the password check value.
+type rar5Keys struct {
+	key     [32]byte
+	hashKey [32]byte
+	check   [8]byte
+}
+
+// deriveRar5Keys runs PBKDF2-HMAC-SHA256 for 2^count iterations to obtain the AES key, then 16 more for
+// the hash key and 16 more for the password check (the last value XOR-folded to 8 bytes).
+func deriveRar5Keys(password string, salt []byte, count uint8) rar5Keys {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	var fn [32]byte
+	copy(fn[:], u)
+	var k rar5Keys
+	var v2 [32]byte
+	for i, rounds := range []int{1<<count - 1, 16, 16} {
+		for j := 0; j < rounds; j++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(u[:0])
+			for b := range fn {
+				fn[b] ^= u[b]
+			}
+		}
+		switch i {
+		case 0:
+			k.key = fn
+		case 1:
+			k.hashKey = fn
+		case 2:
+			v2 = fn
+		}
+	}
+	for i, b := range v2 {
+		k.check[i%8] ^= b
+	}
+	return k
+}
+
+// rar5PasswordKeys derives the keys of e and checks the password against the check value when the
+// record has one whose checksum is intact.
+func rar5PasswordKeys(e *Encryption, password string) (rar5Keys, error) {
+	if e.Version != 0 {
+		return rar5Keys{}, fmt.Errorf("%w: unknown RAR5 encryption version %d", ErrPasswordProtected, e.Version)
+	}
+	if e.KDFCount > rar5MaxKDFCount {
+		return rar5Keys{}, fmt.Errorf("%w: KDF count 2^%d too large", ErrPasswordProtected, e.KDFCount)
+	}
+	k := deriveRar5Keys(password, e.Salt, e.KDFCount)
+	if len(e.CheckValue) == 12 {
+		sum := sha256.Sum256(e.CheckValue[:8])
+		if bytes.Equal(sum[:4], e.CheckValue[8:]) && !bytes.Equal(k.check[:], e.CheckValue[:8]) {
+			return rar5Keys{}, ErrWrongPassword
+		}
+	}
+	return k, nil
+}
@@ -0,0 +1,56 @@
+package rarlist
+
+import (
+	"io"
+	"sync"
+)
+
+// Decompressor unpacks the compressed data of files, for instance by wrapping an external library or
+// an unrar process. Register it with RegisterDecompressor.
+type Decompressor interface {
+	// Decompress returns a reader of the unpacked contents of af, whose packed data (decrypted when
+	// encrypted) is read from packed. The reader must yield the af.TotalUnpackedSize bytes of the file;
+	// they are compared with the header checksums like those of the native unpackers. A solid file
+	// continues the stream of the files before it: an Extractor hands them over in archive order.
+	Decompress(packed io.Reader, af AggregatedFile) (io.Reader, error)
+}
+
+// DecompressorFunc adapts a function to a Decompressor.
+type DecompressorFunc func(packed io.Reader, af AggregatedFile) (io.Reader, error)
+
+// Decompress calls f(packed, af).
+func (f DecompressorFunc) Decompress(packed io.Reader, af AggregatedFile) (io.Reader, error) {
+	return f(packed, af)
+}
+
+type decompressorKey struct {
+	version string
+	method  uint8
+}
+
+var (
+	decompressorsMu sync.RWMutex
+	decompressors   = map[decompressorKey]Decompressor{}
+)
+
+// RegisterDecompressor makes d unpack the files of the archive format version (VersionRar5,
+// VersionRar3, ...) compressed with method (1 fastest .. 5 best, the Method of the file parts). It takes
+// precedence over the native unpacker of the format, and ListFilesFS no longer rejects the files it
+// claims. A nil d removes the registration. It is safe to call concurrently with reads.
+func RegisterDecompressor(version string, method uint8, d Decompressor) {
+	decompressorsMu.Lock()
+	defer decompressorsMu.Unlock()
+	k := decompressorKey{version, method}
+	if d == nil {
+		delete(decompressors, k)
+		return
+	}
+	decompressors[k] = d
+}
+
+// decompressorFor returns the Decompressor registered for a format and method, or nil.
+func decompressorFor(version string, method uint8) Decompressor {
+	decompressorsMu.RLock()
+	defer decompressorsMu.RUnlock()
+	return decompressors[decompressorKey{version, method}]
+}
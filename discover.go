@@ -2,11 +2,16 @@ package rarlist
 
 import (
 	"fmt"
+	iofs "io/fs"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 )
 
+// volumePartRe matches new style volume names (name.part01.rar, name_part1.rar, ...).
+var volumePartRe = regexp.MustCompile(`(?i)(?P<prefix>.*?)(?P<sep>[_.-]?)(?:part)(?P<num>\d+)(?P<suffix>\.rar)`)
+
 // DiscoverVolumes attempts to find all parts given the first volume path.
 // Supports patterns like name.part01.rar / .part1.rar / .r00 style.
 func DiscoverVolumes(first string) ([]string, error) {
@@ -17,8 +22,7 @@ func DiscoverVolumes(first string) ([]string, error) {
 func DiscoverVolumesFS(fs FileSystem, first string) ([]string, error) {
 	base := filepath.Base(first)
 	// Patterns we attempt to generalize: partXX.rar, partX.rar, .r00
-	partRe := regexp.MustCompile(`(?i)(?P<prefix>.*?)(?P<sep>[_.-]?)(?:part)(?P<num>\d+)(?P<suffix>\.rar)`)
-	if m := partRe.FindStringSubmatch(base); m != nil {
+	if m := volumePartRe.FindStringSubmatch(base); m != nil {
 		prefix := m[1]
 		sep := m[2]
 		num := m[3]
@@ -63,3 +67,64 @@ func DiscoverVolumesFS(fs FileSystem, first string) ([]string, error) {
 	}
 	return []string{first}, nil
 }
+
+// volumeName returns the path of the i-th (0-based) volume of the set whose first volume is first,
+// following the same naming schemes as DiscoverVolumesFS.
+func volumeName(first string, i int) string {
+	dir, base := filepath.Dir(first), filepath.Base(first)
+	if m := volumePartRe.FindStringSubmatch(base); m != nil {
+		return filepath.Join(dir, fmt.Sprintf("%s%spart%0*d%s", m[1], m[2], len(m[3]), i+1, m[4]))
+	}
+	if i == 0 || !strings.HasSuffix(strings.ToLower(base), ".rar") {
+		return first
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s.r%02d", strings.TrimSuffix(base, filepath.Ext(base)), i-1))
+}
+
+// DiscoverRecoveryVolumes lists the .rev recovery volumes of the set whose first volume is first.
+func DiscoverRecoveryVolumes(first string) ([]string, error) {
+	return DiscoverRecoveryVolumesFS(defaultFS, first)
+}
+
+// DiscoverRecoveryVolumesFS works like DiscoverRecoveryVolumes on the provided FileSystem. It accepts
+// name.partNN.rev (RAR3 and RAR5) and, for name.rar / name.rNN sets, name.rev and name_N_M.rev names.
+// The first volume itself may be missing. When the directory cannot be listed through fs, the
+// name.partNN.rev names are probed instead.
+func DiscoverRecoveryVolumesFS(fs FileSystem, first string) ([]string, error) {
+	dir, base := filepath.Dir(first), filepath.Base(first)
+	prefix, sep, width := strings.TrimSuffix(base, filepath.Ext(base)), "", 0
+	if m := volumePartRe.FindStringSubmatch(base); m != nil {
+		prefix, sep, width = m[1], m[2], len(m[3])
+	}
+	revRe := regexp.MustCompile(`(?i)^` + regexp.QuoteMeta(prefix) + `(?:[_.-]?part\d+|[_.-]\d+(?:_\d+)*)?\.rev$`)
+	var revs []string
+	if d, err := fs.Open(dir); err == nil {
+		rd, ok := d.(iofs.ReadDirFile)
+		if ok {
+			entries, _ := rd.ReadDir(-1)
+			for _, e := range entries {
+				if !e.IsDir() && revRe.MatchString(e.Name()) {
+					revs = append(revs, filepath.Join(dir, e.Name()))
+				}
+			}
+		}
+		_ = d.Close()
+		if ok {
+			sort.Strings(revs)
+			return revs, nil
+		}
+	}
+	if width == 0 {
+		sep, width = ".", 1
+		if _, err := fs.Stat(filepath.Join(dir, prefix+".rev")); err == nil {
+			revs = append(revs, filepath.Join(dir, prefix+".rev"))
+		}
+	}
+	for i := 1; i < 1000; i++ {
+		p := filepath.Join(dir, fmt.Sprintf("%s%spart%0*d.rev", prefix, sep, width, i))
+		if _, err := fs.Stat(p); err == nil {
+			revs = append(revs, p)
+		}
+	}
+	return revs, nil
+}
@@ -10,11 +10,11 @@ import (
 	"github.com/javi11/rarlist"
 )
 
-// This example demonstrates how to reconstruct (concatenate) file contents from a
-// multi‑part RAR archive using the structural metadata gathered by AggregateFromFirst.
-// IMPORTANT: This only works correctly for files stored (no compression / encryption) in
-// the archive, because this code just concatenates raw stored data segments.
-// If the archive used compression you would need to invoke an actual RAR decompressor.
+// This example demonstrates how to reconstruct file contents from a multi‑part RAR archive
+// using the structural metadata gathered by ListFiles. OpenFile reads the raw stored data
+// segments of each file across volumes.
+// IMPORTANT: This only works for files stored (no compression / encryption) in the archive;
+// use rarlist.UnpackFile or rarlist.NewExtractor for the others.
 func main() {
 	if len(os.Args) < 3 {
 		log.Fatalf("usage: %s <first-volume>.part1.rar <output-dir>", os.Args[0])
@@ -35,20 +35,18 @@ func main() {
 		if len(af.Parts) == 0 {
 			continue
 		}
-		// Skip if any part is not stored (simplistic: require all parts stored)
-		allStored := true
-		var totalPacked int64
-		for _, p := range af.Parts {
-			if !p.Stored {
-				allStored = false
-				break
-			}
-			if p.PackedSize > 0 {
-				totalPacked += p.PackedSize
+		if af.IsDir {
+			if err := os.MkdirAll(filepath.Join(outDir, af.Name), 0o755); err != nil {
+				log.Fatalf("create dir %s: %v", af.Name, err)
 			}
+			continue
 		}
-		if !allStored {
-			fmt.Printf("Skipping %s (not stored / compressed)\n", af.Name)
+		if af.Incomplete {
+			fmt.Printf("Skipping %s (incomplete: missing volume parts)\n", af.Name)
+			continue
+		}
+		if !af.AllStored || af.AnyEncrypted {
+			fmt.Printf("Skipping %s (not stored / compressed or encrypted)\n", af.Name)
 			continue
 		}
 		outPath := filepath.Join(outDir, af.Name)
@@ -58,40 +56,24 @@ func main() {
 			log.Fatalf("create output dir: %v", err)
 		}
 
+		// OpenFile maps the file's logical offsets onto its parts, crossing volumes as needed
+		src, err := rarlist.OpenFile(rarlist.DefaultFS(), af)
+		if err != nil {
+			log.Fatalf("open %s: %v", af.Name, err)
+		}
 		// Create (or truncate) output file for this aggregated logical file
 		outF, err := os.Create(outPath)
 		if err != nil {
 			log.Fatalf("create %s: %v", outPath, err)
 		}
-		// Ensure closure per file (log on close error)
-		func() {
-			defer func() {
-				if cerr := outF.Close(); cerr != nil {
-					log.Printf("close %s: %v", outPath, cerr)
-				}
-			}()
-			var written int64
-			for idx, part := range af.Parts {
-				f, err := os.Open(part.Path)
-				if err != nil {
-					log.Fatalf("open volume %s: %v", part.Path, err)
-				}
-				// Close volume file after this part
-				func() {
-					defer func() { _ = f.Close() }()
-					// Seek to the data offset inside this volume
-					if _, err := f.Seek(part.DataOffset, io.SeekStart); err != nil {
-						log.Fatalf("seek %s: %v", part.Path, err)
-					}
-					// Copy exactly the packed size bytes (only valid for stored, non‑compressed data)
-					copied, err := io.CopyN(outF, f, part.PackedSize)
-					if err != nil {
-						log.Fatalf("copy part %d of %s from %s: %v", idx, af.Name, part.Path, err)
-					}
-					written += copied
-				}()
-			}
-			fmt.Printf("Extracted %s (%d bytes written, expected around %d) from %d stored part(s)\n", af.Name, written, totalPacked, len(af.Parts))
-		}()
+		written, err := io.Copy(outF, src)
+		if err != nil {
+			log.Fatalf("copy %s: %v", af.Name, err)
+		}
+		if cerr := outF.Close(); cerr != nil {
+			log.Printf("close %s: %v", outPath, cerr)
+		}
+		_ = src.Close()
+		fmt.Printf("Extracted %s (%d bytes written) from %d stored part(s)\n", af.Name, written, len(af.Parts))
 	}
 }
@@ -0,0 +1,238 @@
+package rarlist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/javi11/rarlist/internal/unpack"
+)
+
+// canUnpack reports whether a native unpacker handles the compression algorithm of a file.
+func canUnpack(version string, algorithm uint8) bool {
+	switch version {
+	case VersionRar5:
+		return algorithm <= 1
+	case VersionRar3:
+		return algorithm >= 13 && algorithm <= 15 || algorithm == 20 || algorithm == 26 || algorithm == 29 || algorithm == 36
+	case VersionRar14:
+		return algorithm == 13
+	}
+	return false
+}
+
+// newDecoder returns the native unpacker of a compressed file. total bounds the bytes it will produce,
+// -1 when unknown.
+func newDecoder(version string, p AggregatedFilePart, total int64) (unpack.Decoder, error) {
+	if !canUnpack(version, p.AlgorithmVersion) {
+		return nil, fmt.Errorf("%w: %s algorithm %d, method %d", ErrCompressedNotSupported, version, p.AlgorithmVersion, p.Method)
+	}
+	switch {
+	case version == VersionRar5:
+		return unpack.NewRar5(p.AlgorithmVersion, p.DictSize, total)
+	case p.AlgorithmVersion <= 15:
+		return unpack.NewRar15(p.DictSize, total), nil
+	case p.AlgorithmVersion <= 26:
+		return unpack.NewRar20(p.DictSize, total), nil
+	}
+	return unpack.NewRar3(p.DictSize, total), nil
+}
+
+// UnpackFileFS returns a reader of the contents of a file: stored data is read from the volumes,
+// compressed data is unpacked (RAR5 and RAR 1.3-4.x, or by a registered Decompressor) and encrypted data decrypted with the WithPassword
+// option. Once the whole file is read its CRC32 and BLAKE2sp are compared with the header, a mismatch
+// reported as ErrChecksumMismatch in place of io.EOF. A file continuing a solid stream can only be unpacked after
+// the files before it: read it through an Extractor.
+func UnpackFileFS(fs FileSystem, af AggregatedFile, opts ...Option) (io.Reader, error) {
+	o := newOptions(opts)
+	r, _, err := openFile(fs, af, newKeyCache(o.password), nil, af.TotalUnpackedSize)
+	return r, err
+}
+
+// UnpackFile is a convenience using the default filesystem.
+func UnpackFile(af AggregatedFile, opts ...Option) (io.Reader, error) {
+	return UnpackFileFS(defaultFS, af, opts...)
+}
+
+// openFile returns the reader of the contents of af. prev is the unpacker of the preceding compressed
+// file, continued when af is solid; total bounds the bytes a new unpacker will produce. It also returns
+// the unpacker of af (nil for stored files and files of a registered Decompressor).
+func openFile(fs FileSystem, af AggregatedFile, keys *keyCache, prev unpack.Decoder, total int64) (io.Reader, unpack.Decoder, error) {
+	if af.IsDir || len(af.Parts) == 0 {
+		return eofReader{}, nil, nil
+	}
+	switch {
+	case af.Incomplete:
+		return nil, nil, fmt.Errorf("%w: %s", ErrIncompleteVolumeSet, af.Name)
+	case af.AnyEncrypted && keys.password == "":
+		return nil, nil, fmt.Errorf("%w: %s", ErrPasswordProtected, af.Name)
+	}
+	first, last := af.Parts[0], af.Parts[len(af.Parts)-1]
+	var ext Decompressor
+	var dec unpack.Decoder
+	if !af.AllStored {
+		switch ext = decompressorFor(af.Version, first.Method); {
+		case ext != nil: // the Decompressor keeps the state of solid streams itself
+		case !first.Solid:
+			var err error
+			if dec, err = newDecoder(af.Version, first, total); err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", af.Name, err)
+			}
+		case prev == nil:
+			return nil, nil, fmt.Errorf("%w: %s continues a solid stream, unpack the files before it first", ErrCompressedNotSupported, af.Name)
+		default:
+			dec = prev
+		}
+	}
+	src := newPartReader(fs, af.Parts)
+	var packed io.Reader = io.NewSectionReader(src, 0, src.size())
+	if af.AnyEncrypted {
+		block, iv, err := fileCipher(af, keys)
+		if err != nil {
+			return nil, nil, err
+		}
+		packed = &DecryptReader{src: src, block: block, iv: iv, size: src.size()}
+	}
+	r := packed
+	switch {
+	case ext != nil:
+		var err error
+		if r, err = ext.Decompress(packed, af); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", af.Name, err)
+		}
+	case dec != nil:
+		dec.Init(bufio.NewReaderSize(packed, 1<<16), af.TotalUnpackedSize, first.Solid)
+		r = dec
+	}
+	fr := &fileReader{name: af.Name, r: r, left: af.TotalUnpackedSize}
+	// RAR5 encrypted files may store checksums turned into MACs with the hash key
+	if e := last.Encryption; e == nil || !e.TweakedChecksums {
+		fr.sum = newChecksum(last)
+		fr.w = fr.sum.writer()
+	}
+	return fr, dec, nil
+}
+
+// fileReader reads the unpacked contents of a file and compares the checksums once all are read.
+type fileReader struct {
+	name string
+	r    io.Reader
+	left int64
+	sum  *checksum // nil when the checksums cannot be compared
+	w    io.Writer
+	err  error
+}
+
+func (f *fileReader) Read(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	var n int
+	var err error
+	if f.left > 0 {
+		if int64(len(p)) > f.left {
+			p = p[:f.left]
+		}
+		n, err = f.r.Read(p)
+		f.left -= int64(n)
+		if f.w != nil {
+			_, _ = f.w.Write(p[:n])
+		}
+	}
+	switch {
+	case f.left == 0:
+		err = io.EOF
+		if f.sum != nil && f.sum.active() && !f.sum.match() {
+			err = fmt.Errorf("%w: %s", ErrChecksumMismatch, f.name)
+		}
+	case err == io.EOF:
+		err = fmt.Errorf("%s: %w", f.name, io.ErrUnexpectedEOF)
+	case err != nil:
+		err = fmt.Errorf("%s: %w", f.name, err)
+	}
+	f.err = err
+	return n, err
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+// errReader fails every read with err.
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// Extractor reads the files of a volume set in archive order, like archive/tar.Reader: Next advances to
+// the next file and Read returns its contents as UnpackFileFS does. The unpacker is kept from file to
+// file, so solid archives unpack, and a file skipped before a solid one is unpacked and discarded.
+// Files that cannot be read (incomplete, unsupported or without their password) report the error from
+// Read, and the files after them can still be read unless they continue their solid stream.
+type Extractor struct {
+	fs    FileSystem
+	files []AggregatedFile
+	keys  *keyCache
+	next  int
+	cur   io.Reader
+	dec   unpack.Decoder // unpacker of the last compressed file
+	total int64          // unpacked bytes of the files from next on
+}
+
+// NewExtractorFS indexes the volume set starting at first and returns an Extractor of its files.
+func NewExtractorFS(fs FileSystem, first string, opts ...Option) (*Extractor, error) {
+	vols, err := DiscoverVolumesFS(fs, first)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := IndexVolumesParallel(fs, vols, 0, opts...)
+	if err != nil {
+		return nil, err
+	}
+	e := &Extractor{fs: fs, files: AggregateFiles(idx), keys: newKeyCache(newOptions(opts).password)}
+	for _, af := range e.files {
+		e.total += af.TotalUnpackedSize
+	}
+	return e, nil
+}
+
+// NewExtractor is a convenience using the default filesystem.
+func NewExtractor(first string, opts ...Option) (*Extractor, error) {
+	return NewExtractorFS(defaultFS, first, opts...)
+}
+
+// Files returns all files of the set in archive order.
+func (e *Extractor) Files() []AggregatedFile { return e.files }
+
+// Next advances to the next file and returns it, or io.EOF after the last one.
+func (e *Extractor) Next() (*AggregatedFile, error) {
+	if e.next >= len(e.files) {
+		e.cur = nil
+		return nil, io.EOF
+	}
+	af := &e.files[e.next]
+	e.next++
+	if e.cur != nil && !af.AllStored && len(af.Parts) > 0 && af.Parts[0].Solid {
+		if _, err := io.Copy(io.Discard, e.cur); err != nil {
+			e.dec = nil // the stream cannot be continued
+		}
+	}
+	total := e.total
+	e.total -= af.TotalUnpackedSize
+	r, dec, err := openFile(e.fs, *af, e.keys, e.dec, total)
+	if !af.AllStored && !af.IsDir {
+		e.dec = dec
+	}
+	if err != nil {
+		r = errReader{err}
+	}
+	e.cur = r
+	return af, nil
+}
+
+// Read reads the contents of the current file.
+func (e *Extractor) Read(p []byte) (int, error) {
+	if e.cur == nil {
+		return 0, io.EOF
+	}
+	return e.cur.Read(p)
+}
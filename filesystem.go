@@ -17,3 +17,6 @@ func (osFS) Stat(p string) (fs.FileInfo, error) { return os.Stat(p) }
 func (osFS) Open(p string) (fs.File, error)     { return os.Open(p) }
 
 var defaultFS osFS
+
+// DefaultFS returns the FileSystem used by the convenience functions, backed by the os package.
+func DefaultFS() FileSystem { return defaultFS }
@@ -2,19 +2,22 @@ package rarlist
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 )
 
 // IndexVolumes parses each volume to compute header sizes. Stops at first error.
-func IndexVolumes(fs FileSystem, volPaths []string) ([]*VolumeIndex, error) {
+func IndexVolumes(fs FileSystem, volPaths []string, opts ...Option) ([]*VolumeIndex, error) {
+	o := newOptions(opts)
 	var res []*VolumeIndex
 	for _, p := range volPaths {
-		v, err := indexSingle(fs, p)
+		v, err := indexSingle(fs, p, o)
 		if err != nil {
 			return nil, fmt.Errorf("%s: %w", p, err)
 		}
@@ -25,10 +28,11 @@ func IndexVolumes(fs FileSystem, volPaths []string) ([]*VolumeIndex, error) {
 
 // IndexVolumesParallel indexes volumes concurrently. Results preserve input order.
 // workers<=0 uses runtime.NumCPU(). Stops scheduling new work after first error, but in-flight tasks may finish.
-func IndexVolumesParallel(fs FileSystem, volPaths []string, workers int) ([]*VolumeIndex, error) {
+func IndexVolumesParallel(fs FileSystem, volPaths []string, workers int, opts ...Option) ([]*VolumeIndex, error) {
 	if len(volPaths) == 0 {
 		return nil, nil
 	}
+	o := newOptions(opts)
 	if workers <= 0 {
 		workers = runtime.NumCPU()
 	}
@@ -42,7 +46,7 @@ func IndexVolumesParallel(fs FileSystem, volPaths []string, workers int) ([]*Vol
 			if firstErr.Load() != nil { // skip work after error recorded
 				continue
 			}
-			v, err := indexSingle(fs, volPaths[i])
+			v, err := indexSingle(fs, volPaths[i], o)
 			if err != nil {
 				// record first error
 				if firstErr.Load() == nil {
@@ -71,7 +75,40 @@ func IndexVolumesParallel(fs FileSystem, volPaths []string, workers int) ([]*Vol
 	return res, nil
 }
 
-func indexSingle(fs FileSystem, path string) (*VolumeIndex, error) {
+// OrderVolumes returns the volumes sorted by the volume number recorded in their archive headers.
+// If any volume lacks a volume number the input order is returned unchanged.
+func OrderVolumes(vs []*VolumeIndex) []*VolumeIndex {
+	out := append([]*VolumeIndex(nil), vs...)
+	for _, v := range out {
+		if !v.Archive.HasVolumeNumber {
+			return out
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Archive.VolumeNumber < out[j].Archive.VolumeNumber })
+	return out
+}
+
+// CheckVolumeSet verifies, from archive header metadata only, that vs is a complete set in order:
+// volume numbers (when known) must be 0..n-1 and only the last volume may lack the "next volume" flag.
+// It returns an error wrapping ErrIncompleteVolumeSet describing the first problem found.
+func CheckVolumeSet(vs []*VolumeIndex) error {
+	for i, v := range vs {
+		a := v.Archive
+		if a.HasVolumeNumber && a.VolumeNumber != i {
+			return fmt.Errorf("%w: %s has volume number %d, expected %d", ErrIncompleteVolumeSet, v.Path, a.VolumeNumber, i)
+		}
+		last := i == len(vs)-1
+		if a.HasEnd && a.NextVolume && last {
+			return fmt.Errorf("%w: %s expects a following volume", ErrIncompleteVolumeSet, v.Path)
+		}
+		if a.HasEnd && !a.NextVolume && !last && a.IsVolume {
+			return fmt.Errorf("%w: %s is marked as the last volume but %d more follow", ErrIncompleteVolumeSet, v.Path, len(vs)-1-i)
+		}
+	}
+	return nil
+}
+
+func indexSingle(fs FileSystem, path string, o options) (*VolumeIndex, error) {
 	f, err := fs.Open(path)
 	if err != nil {
 		return nil, err
@@ -82,7 +119,14 @@ func indexSingle(fs FileSystem, path string) (*VolumeIndex, error) {
 	br := bufio.NewReader(f)
 	version, sigOffset, err := detectSignature(br)
 	if err != nil {
-		return nil, err
+		// Self-extracting volume with a stub larger than the peek window: measure the executable image.
+		rs, ok := f.(io.ReadSeeker)
+		if !ok {
+			return nil, err
+		}
+		if version, sigOffset, err = findSFXSignature(rs, o.sfxScanLimit); err != nil {
+			return nil, err
+		}
 	}
 	if s, ok := f.(io.Seeker); ok {
 		if _, err := s.Seek(sigOffset, io.SeekStart); err != nil {
@@ -101,17 +145,18 @@ func indexSingle(fs FileSystem, path string) (*VolumeIndex, error) {
 		if rs, ok := f.(io.ReadSeeker); ok {
 			seeker = rs
 		}
-		if err := parseRar3(br, seeker, vi, sigOffset, fileSize); err != nil {
-			// If headers are encrypted/password-protected, don't attempt legacy fallback; bubble up immediately.
-			if errors.Is(err, ErrPasswordProtected) {
+		if err := parseRar3(br, seeker, vi, sigOffset, fileSize, o); err != nil {
+			// If headers are encrypted/password-protected or fail a strict CRC check, don't attempt legacy fallback; bubble up immediately.
+			var crcErr *ErrHeaderCRC
+			if errors.Is(err, ErrPasswordProtected) || errors.Is(err, ErrWrongPassword) || errors.As(err, &crcErr) {
 				return nil, err
 			}
 			// fallback attempt for legacy (RAR 1.5/2.x) layout using existing handle
 			if rs, ok := f.(io.ReadSeeker); ok {
-				if err2 := parseRarLegacySeeker(rs, vi, sigOffset); err2 == nil && len(vi.FileBlocks) > 0 {
+				if err2 := parseRarLegacySeeker(rs, vi, sigOffset, fileSize, o); err2 == nil && len(vi.FileBlocks) > 0 {
 					return vi, nil
 				}
-			} else if err2 := parseRarLegacy(fs, path, vi, sigOffset); err2 == nil && len(vi.FileBlocks) > 0 {
+			} else if err2 := parseRarLegacy(fs, path, vi, sigOffset, o); err2 == nil && len(vi.FileBlocks) > 0 {
 				return vi, nil
 			}
 			return nil, err
@@ -119,10 +164,10 @@ func indexSingle(fs FileSystem, path string) (*VolumeIndex, error) {
 
 		if len(vi.FileBlocks) == 0 { // try legacy if no file headers parsed
 			if rs, ok := f.(io.ReadSeeker); ok {
-				if err := parseRarLegacySeeker(rs, vi, sigOffset); err != nil && len(vi.FileBlocks) == 0 {
+				if err := parseRarLegacySeeker(rs, vi, sigOffset, fileSize, o); err != nil && len(vi.FileBlocks) == 0 {
 					return nil, err
 				}
-			} else if err := parseRarLegacy(fs, path, vi, sigOffset); err != nil && len(vi.FileBlocks) == 0 {
+			} else if err := parseRarLegacy(fs, path, vi, sigOffset, o); err != nil && len(vi.FileBlocks) == 0 {
 				return nil, err
 			}
 		}
@@ -132,7 +177,15 @@ func indexSingle(fs FileSystem, path string) (*VolumeIndex, error) {
 		if rs, ok := f.(io.ReadSeeker); ok {
 			seeker = rs
 		}
-		if err := parseRar5(br, seeker, vi, sigOffset, fileSize); err != nil {
+		if err := parseRar5(br, seeker, vi, sigOffset, fileSize, o); err != nil {
+			return nil, err
+		}
+	case VersionRar14:
+		var seeker io.ReadSeeker
+		if rs, ok := f.(io.ReadSeeker); ok {
+			seeker = rs
+		}
+		if err := parseRar14(br, seeker, vi, sigOffset, fileSize); err != nil {
 			return nil, err
 		}
 	default:
@@ -143,6 +196,11 @@ func indexSingle(fs FileSystem, path string) (*VolumeIndex, error) {
 
 func detectSignature(br *bufio.Reader) (string, int64, error) {
 	buf, _ := br.Peek(1024)
+	// The short RAR 1.4 mark is only trusted at offset 0; past it (SFX stubs), findSFXSignature accepts
+	// it at the start of the executable overlay.
+	if bytes.HasPrefix(buf, rarrSigV14) {
+		return VersionRar14, 0, nil
+	}
 	// search
 	for i := 0; i+7 < len(buf); i++ {
 		if i+len(rarrSigV5) <= len(buf) && string(buf[i:i+len(rarrSigV5)]) == string(rarrSigV5) {
@@ -0,0 +1,185 @@
+// Package blake2sp implements BLAKE2sp, the 8-way parallel BLAKE2s-256 tree hash used by RAR5 file hash records.
+package blake2sp
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// Size is the BLAKE2sp digest size in bytes.
+const Size = 32
+
+// BlockSize is the BLAKE2s block size; input is dealt to the leaves one block at a time.
+const BlockSize = 64
+
+const leaves = 8
+
+var iv = [8]uint32{
+	0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A,
+	0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+var sigma = [10][16]byte{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3},
+	{11, 8, 12, 0, 5, 2, 15, 13, 10, 14, 3, 6, 7, 1, 9, 4},
+	{7, 9, 3, 1, 13, 12, 11, 14, 2, 6, 5, 10, 4, 0, 15, 8},
+	{9, 0, 5, 7, 2, 4, 10, 15, 14, 1, 11, 12, 6, 8, 3, 13},
+	{2, 12, 6, 10, 0, 11, 8, 3, 4, 13, 7, 5, 15, 14, 1, 9},
+	{12, 5, 1, 15, 14, 13, 4, 10, 0, 7, 6, 3, 9, 2, 8, 11},
+	{13, 11, 7, 14, 12, 1, 3, 9, 5, 0, 15, 4, 8, 6, 2, 10},
+	{6, 15, 14, 9, 11, 3, 0, 8, 12, 2, 13, 7, 1, 4, 10, 5},
+	{10, 2, 8, 4, 7, 6, 1, 5, 15, 11, 9, 14, 3, 12, 13, 0},
+}
+
+// node is one BLAKE2s-256 instance of the tree. The last block is kept buffered until sum so it can be
+// compressed with the finalization flags.
+type node struct {
+	h    [8]uint32
+	t    uint64
+	buf  [BlockSize]byte
+	n    int
+	last bool // last node of its level (sets the second finalization flag)
+}
+
+func (s *node) init(offset uint32, depth byte, last bool) {
+	// parameter block: digest 32, no key, fanout 8, depth 2, leaf length 0, node offset, node depth, inner length 32
+	s.h = iv
+	s.h[0] ^= Size | leaves<<16 | 2<<24
+	s.h[2] ^= offset
+	s.h[3] ^= uint32(depth)<<16 | Size<<24
+	s.t, s.n, s.last = 0, 0, last
+}
+
+func (s *node) write(p []byte) {
+	for len(p) > 0 {
+		if s.n == BlockSize {
+			s.t += BlockSize
+			s.compress(&s.buf, false)
+			s.n = 0
+		}
+		k := copy(s.buf[s.n:], p)
+		s.n += k
+		p = p[k:]
+	}
+}
+
+func (s *node) sum() [Size]byte {
+	s.t += uint64(s.n)
+	for i := s.n; i < BlockSize; i++ {
+		s.buf[i] = 0
+	}
+	s.compress(&s.buf, true)
+	var out [Size]byte
+	for i, w := range s.h {
+		binary.LittleEndian.PutUint32(out[i*4:], w)
+	}
+	return out
+}
+
+func (s *node) compress(block *[BlockSize]byte, final bool) {
+	var m [16]uint32
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint32(block[i*4:])
+	}
+	var v [16]uint32
+	copy(v[:8], s.h[:])
+	copy(v[8:], iv[:])
+	v[12] ^= uint32(s.t)
+	v[13] ^= uint32(s.t >> 32)
+	if final {
+		v[14] = ^v[14]
+		if s.last {
+			v[15] = ^v[15]
+		}
+	}
+	g := func(a, b, c, d int, x, y uint32) {
+		v[a] += v[b] + x
+		v[d] = bits.RotateLeft32(v[d]^v[a], -16)
+		v[c] += v[d]
+		v[b] = bits.RotateLeft32(v[b]^v[c], -12)
+		v[a] += v[b] + y
+		v[d] = bits.RotateLeft32(v[d]^v[a], -8)
+		v[c] += v[d]
+		v[b] = bits.RotateLeft32(v[b]^v[c], -7)
+	}
+	for r := 0; r < 10; r++ {
+		s := &sigma[r]
+		g(0, 4, 8, 12, m[s[0]], m[s[1]])
+		g(1, 5, 9, 13, m[s[2]], m[s[3]])
+		g(2, 6, 10, 14, m[s[4]], m[s[5]])
+		g(3, 7, 11, 15, m[s[6]], m[s[7]])
+		g(0, 5, 10, 15, m[s[8]], m[s[9]])
+		g(1, 6, 11, 12, m[s[10]], m[s[11]])
+		g(2, 7, 8, 13, m[s[12]], m[s[13]])
+		g(3, 4, 9, 14, m[s[14]], m[s[15]])
+	}
+	for i := range s.h {
+		s.h[i] ^= v[i] ^ v[i+8]
+	}
+}
+
+// digest deals consecutive 64 byte blocks of the input to the eight leaves round robin; the root hashes
+// the concatenated leaf digests.
+type digest struct {
+	leaf  [leaves]node
+	total uint64
+}
+
+// New returns a hash.Hash computing the unkeyed BLAKE2sp-256 checksum.
+func New() hash.Hash {
+	d := &digest{}
+	d.Reset()
+	return d
+}
+
+// Sum returns the BLAKE2sp-256 checksum of data.
+func Sum(data []byte) [Size]byte {
+	var d digest
+	d.Reset()
+	_, _ = d.Write(data)
+	return d.checksum()
+}
+
+func (d *digest) Reset() {
+	for i := range d.leaf {
+		d.leaf[i].init(uint32(i), 0, i == leaves-1)
+	}
+	d.total = 0
+}
+
+func (d *digest) Size() int      { return Size }
+func (d *digest) BlockSize() int { return BlockSize }
+
+func (d *digest) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := (d.total / BlockSize) % leaves
+		k := BlockSize - int(d.total%BlockSize)
+		if k > len(p) {
+			k = len(p)
+		}
+		d.leaf[i].write(p[:k])
+		d.total += uint64(k)
+		p = p[k:]
+	}
+	return n, nil
+}
+
+func (d *digest) Sum(b []byte) []byte {
+	sum := d.checksum()
+	return append(b, sum[:]...)
+}
+
+// checksum finalizes copies of the leaves so the digest can keep absorbing input.
+func (d *digest) checksum() [Size]byte {
+	var root node
+	root.init(0, 1, true)
+	for i := range d.leaf {
+		l := d.leaf[i]
+		sum := l.sum()
+		root.write(sum[:])
+	}
+	return root.sum()
+}
@@ -0,0 +1,51 @@
+package blake2sp
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func pattern(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+func TestSum(t *testing.T) {
+	cases := []struct {
+		in   []byte
+		want string
+	}{
+		{nil, "dd0e891776933f43c7d032b08a917e25741f8aa9a12c12e1cac8801500f2ca4f"},
+		{[]byte("abc"), "70f75b58f1fecab821db43c88ad84edde5a52600616cd22517b7bb14d440a7d5"},
+		{pattern(1000), "611f1af6610cdaf674ec2c9178f6376ebe234ef50998a3be3f1fa698fb779274"},
+		{pattern(4096), "dd02c617ddc87d204cbcb5795b637368467fa516710f880e9c782b00b0dca78c"},
+	}
+	for _, c := range cases {
+		got := Sum(c.in)
+		if hex.EncodeToString(got[:]) != c.want {
+			t.Fatalf("len %d: want %s got %x", len(c.in), c.want, got)
+		}
+	}
+}
+
+func TestWriteChunks(t *testing.T) {
+	data := pattern(4096)
+	want := Sum(data)
+	h := New()
+	for i := 0; i < len(data); i += 37 {
+		end := i + 37
+		if end > len(data) {
+			end = len(data)
+		}
+		_, _ = h.Write(data[i:end])
+		if i == 370 {
+			_ = h.Sum(nil) // intermediate sums must not disturb the state
+		}
+	}
+	if got := h.Sum(nil); string(got) != string(want[:]) {
+		t.Fatalf("chunked write mismatch: %x vs %x", got, want)
+	}
+}
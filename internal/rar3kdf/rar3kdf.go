@@ -0,0 +1,121 @@
+// Package rar3kdf implements the RAR 2.9-4.x key derivation: 2^18 SHA-1 rounds over the UTF-16LE
+// password, the salt and the round number, giving the AES-128 key and IV.
+//
+// The password and salt are hashed with the SHA-1 variant of RAR 2.9, which writes the expanded message
+// schedule of every block hashed straight from the input back into that input. The buffer is reused by
+// the following rounds, so the difference shows for passwords of 29 characters or more.
+package rar3kdf
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"unicode/utf16"
+)
+
+// Rounds is the number of SHA-1 rounds.
+const Rounds = 0x40000
+
+// SaltSize is the size of RAR 2.9-4.x salts.
+const SaltSize = 8
+
+// Keys derives the AES-128 key and IV from password and salt (nil for unsalted data).
+func Keys(password string, salt []byte) (key, iv [16]byte) {
+	raw := make([]byte, 0, 2*len(password)+len(salt))
+	for _, u := range utf16.Encode([]rune(password)) {
+		raw = binary.LittleEndian.AppendUint16(raw, u)
+	}
+	raw = append(raw, salt...)
+	var d digest
+	d.reset()
+	for i := 0; i < Rounds; i++ {
+		d.write(raw, true)
+		d.write([]byte{byte(i), byte(i >> 8), byte(i >> 16)}, false)
+		if i%(Rounds/16) == 0 {
+			c := d
+			sum := c.sum()
+			iv[i/(Rounds/16)] = byte(sum[4])
+		}
+	}
+	sum := d.sum()
+	for i := 0; i < 4; i++ {
+		binary.LittleEndian.PutUint32(key[i*4:], sum[i])
+	}
+	return key, iv
+}
+
+type digest struct {
+	h   [5]uint32
+	n   uint64 // bytes hashed
+	buf [64]byte
+}
+
+func (d *digest) reset() {
+	d.h = [5]uint32{0x67452301, 0xEFCDAB89, 0x98BADCFE, 0x10325476, 0xC3D2E1F0}
+	d.n = 0
+}
+
+// write hashes p. With rar29 set, blocks compressed directly from p are overwritten with their final
+// message schedule words (little endian), as RAR 2.9 does.
+func (d *digest) write(p []byte, rar29 bool) {
+	j := int(d.n & 63)
+	d.n += uint64(len(p))
+	i := 0
+	if j+len(p) > 63 {
+		i = copy(d.buf[j:], p)
+		var w [16]uint32
+		block(&d.h, &w, d.buf[:])
+		for ; i+63 < len(p); i += 64 {
+			block(&d.h, &w, p[i:i+64])
+			if rar29 {
+				for k, v := range w {
+					binary.LittleEndian.PutUint32(p[i+k*4:], v)
+				}
+			}
+		}
+		j = 0
+	}
+	copy(d.buf[j:], p[i:])
+}
+
+// sum pads the message and returns the five state words.
+func (d *digest) sum() [5]uint32 {
+	bitLen := d.n << 3
+	pad := []byte{0x80}
+	for (d.n+uint64(len(pad)))&63 != 56 {
+		pad = append(pad, 0)
+	}
+	d.write(pad, false)
+	d.write(binary.BigEndian.AppendUint64(nil, bitLen), false)
+	return d.h
+}
+
+// block compresses one 64 byte block, leaving the last 16 message schedule words in w.
+func block(h *[5]uint32, w *[16]uint32, p []byte) {
+	for i := range w {
+		w[i] = binary.BigEndian.Uint32(p[i*4:])
+	}
+	a, b, c, d, e := h[0], h[1], h[2], h[3], h[4]
+	for i := 0; i < 80; i++ {
+		if i >= 16 {
+			w[i&15] = bits.RotateLeft32(w[(i+13)&15]^w[(i+8)&15]^w[(i+2)&15]^w[i&15], 1)
+		}
+		var f, k uint32
+		switch {
+		case i < 20:
+			f, k = b&c|^b&d, 0x5A827999
+		case i < 40:
+			f, k = b^c^d, 0x6ED9EBA1
+		case i < 60:
+			f, k = b&c|b&d|c&d, 0x8F1BBCDC
+		default:
+			f, k = b^c^d, 0xCA62C1D6
+		}
+		t := bits.RotateLeft32(a, 5) + f + e + k + w[i&15]
+		a, b, c, d, e = t, a, bits.RotateLeft32(b, 30), c, d
+	}
+	h[0] += a
+	h[1] += b
+	h[2] += c
+	h[3] += d
+	h[4] += e
+}
@@ -0,0 +1,66 @@
+package rar3kdf
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+)
+
+// reference derives the keys with crypto/sha1; it matches Keys for passwords short enough that no
+// block is hashed straight from the password buffer.
+func reference(password string, salt []byte) (key, iv [16]byte) {
+	var raw []byte
+	for _, u := range utf16.Encode([]rune(password)) {
+		raw = binary.LittleEndian.AppendUint16(raw, u)
+	}
+	raw = append(raw, salt...)
+	h := sha1.New()
+	for i := 0; i < Rounds; i++ {
+		h.Write(raw)
+		h.Write([]byte{byte(i), byte(i >> 8), byte(i >> 16)})
+		if i%(Rounds/16) == 0 {
+			iv[i/(Rounds/16)] = h.Sum(nil)[19]
+		}
+	}
+	sum := h.Sum(nil)
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			key[i*4+j] = sum[i*4+3-j]
+		}
+	}
+	return key, iv
+}
+
+func TestKeysMatchSHA1(t *testing.T) {
+	salt := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	for _, pw := range []string{"", "secret", "pässwörd", "0123456789012345678901234567"} {
+		k, iv := Keys(pw, salt)
+		rk, riv := reference(pw, salt)
+		if k != rk || iv != riv {
+			t.Fatalf("%q: key %x iv %x, want %x %x", pw, k, iv, rk, riv)
+		}
+	}
+	if k, _ := Keys("secret", nil); k == [16]byte{} {
+		t.Fatal("unsalted key is zero")
+	}
+}
+
+func TestRar29WriteBack(t *testing.T) {
+	p := bytes.Repeat([]byte{0xAB}, 200)
+	orig := append([]byte(nil), p...)
+	var d digest
+	d.reset()
+	d.write(p, false)
+	if !bytes.Equal(p, orig) {
+		t.Fatal("standard write modified its input")
+	}
+	// After 10 buffered bytes, 54 more fill the buffer and p[64:192] is hashed straight from p.
+	d.reset()
+	d.write(p[:10], true)
+	d.write(p[10:], true)
+	if !bytes.Equal(p[:64], orig[:64]) || !bytes.Equal(p[192:], orig[192:]) || bytes.Equal(p[64:128], orig[64:128]) || bytes.Equal(p[128:192], orig[128:192]) {
+		t.Fatal("only the blocks hashed from the input should be rewritten")
+	}
+}
@@ -0,0 +1,72 @@
+package unpack
+
+import "io"
+
+// bitReader reads bits most significant first. Past the end of the input it yields zero bits; consuming
+// any of them is reported by err as io.ErrUnexpectedEOF.
+type bitReader struct {
+	r    io.ByteReader
+	v    uint64 // buffered bits, left aligned
+	n    uint   // number of buffered bits
+	pos  int64  // bits consumed
+	in   int64  // bytes read from r
+	rerr error  // read error other than io.EOF
+}
+
+func (b *bitReader) reset(r io.ByteReader) { *b = bitReader{r: r} }
+
+// fill buffers at least n bits, n <= 56.
+func (b *bitReader) fill(n uint) {
+	for b.n < n {
+		c, err := b.r.ReadByte()
+		if err != nil {
+			if err != io.EOF && b.rerr == nil {
+				b.rerr = err
+			}
+			c = 0
+		} else {
+			b.in++
+		}
+		b.v |= uint64(c) << (56 - b.n)
+		b.n += 8
+	}
+}
+
+// peek returns the next n bits, n <= 56, without consuming them.
+func (b *bitReader) peek(n uint) uint64 {
+	b.fill(n)
+	return b.v >> (64 - n)
+}
+
+func (b *bitReader) skip(n uint) {
+	b.fill(n)
+	b.v <<= n
+	b.n -= n
+	b.pos += int64(n)
+}
+
+// bits consumes and returns the next n bits, n <= 56.
+func (b *bitReader) bits(n uint) uint64 {
+	v := b.peek(n)
+	b.skip(n)
+	return v
+}
+
+// align skips to the next byte boundary.
+func (b *bitReader) align() { b.skip(uint(-b.pos & 7)) }
+
+// more reports whether at least n bytes of input, n <= 7, follow from the byte holding the next bit.
+func (b *bitReader) more(n int) bool {
+	b.fill(uint(n) * 8)
+	return b.in-b.pos/8 >= int64(n)
+}
+
+func (b *bitReader) err() error {
+	if b.rerr != nil {
+		return b.rerr
+	}
+	if b.pos > b.in*8 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
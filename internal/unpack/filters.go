@@ -0,0 +1,64 @@
+package unpack
+
+import "encoding/binary"
+
+// e8Filter undoes the x86 call (0xE8, and with e9 also jump 0xE9) transform: the 32 bit operand following
+// the opcode was turned from a relative into an absolute address within a 16 MiB range. RAR5 wraps the
+// position of the operand at that range, RAR3 does not.
+func e8Filter(e9, wrap bool) func([]byte, int64) []byte {
+	const fileSize = 0x1000000
+	return func(data []byte, offset int64) []byte {
+		for i := 0; i+4 < len(data); {
+			c := data[i]
+			i++
+			if c != 0xe8 && !(e9 && c == 0xe9) {
+				continue
+			}
+			pos := uint32(offset) + uint32(i)
+			if wrap {
+				pos %= fileSize
+			}
+			addr := binary.LittleEndian.Uint32(data[i:])
+			if addr&0x80000000 != 0 { // addr < 0
+				if (addr+pos)&0x80000000 == 0 { // addr+pos >= 0
+					binary.LittleEndian.PutUint32(data[i:], addr+fileSize)
+				}
+			} else if (addr-fileSize)&0x80000000 != 0 { // addr < fileSize
+				binary.LittleEndian.PutUint32(data[i:], addr-pos)
+			}
+			i += 4
+		}
+		return data
+	}
+}
+
+// armFilter undoes the RAR5 transform of ARM BL instructions, whose 24 bit word offset was made absolute.
+func armFilter(data []byte, offset int64) []byte {
+	for i := 0; i+3 < len(data); i += 4 {
+		if data[i+3] != 0xeb { // BL with the "always" condition
+			continue
+		}
+		v := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16
+		v -= (uint32(offset) + uint32(i)) / 4
+		data[i], data[i+1], data[i+2] = byte(v), byte(v>>8), byte(v>>16)
+	}
+	return data
+}
+
+// deltaFilter undoes the delta transform of interleaved channels: the block stores the differences of
+// each channel in turn, which are summed back into their interleaved positions.
+func deltaFilter(channels int) func([]byte, int64) []byte {
+	return func(data []byte, _ int64) []byte {
+		out := make([]byte, len(data))
+		src := 0
+		for ch := 0; ch < channels; ch++ {
+			var prev byte
+			for i := ch; i < len(data); i += channels {
+				prev -= data[src]
+				out[i] = prev
+				src++
+			}
+		}
+		return out
+	}
+}
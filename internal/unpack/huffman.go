@@ -0,0 +1,118 @@
+package unpack
+
+import "fmt"
+
+// huffman decodes the canonical prefix codes of RAR 2.0 and later: codes are assigned by increasing
+// length, then by symbol number, and are at most 15 bits long. Incomplete codes are accepted.
+type huffman struct {
+	limit [16]uint32 // left aligned 16 bit bound of the codes of each length
+	pos   [16]uint32 // index in syms of the first symbol of each length
+	syms  []uint16
+}
+
+// init builds the table from the code length of every symbol (0 for unused symbols).
+func (h *huffman) init(lengths []byte) {
+	var count [16]uint32
+	for _, l := range lengths {
+		count[l&15]++
+	}
+	count[0] = 0
+	var upper uint32
+	for i := 1; i < 16; i++ {
+		upper += count[i]
+		h.limit[i] = upper << (16 - i)
+		upper *= 2
+		h.pos[i] = h.pos[i-1] + count[i-1]
+	}
+	if cap(h.syms) < len(lengths) {
+		h.syms = make([]uint16, len(lengths))
+	}
+	h.syms = h.syms[:len(lengths)]
+	clear(h.syms)
+	next := h.pos
+	for sym, l := range lengths {
+		if l &= 15; l != 0 {
+			h.syms[next[l]] = uint16(sym)
+			next[l]++
+		}
+	}
+}
+
+// decode reads one symbol.
+func (h *huffman) decode(br *bitReader) int {
+	code := uint32(br.peek(16)) & 0xfffe
+	n := 15
+	for i := 1; i < 15; i++ {
+		if code < h.limit[i] {
+			n = i
+			break
+		}
+	}
+	br.skip(uint(n))
+	p := h.pos[n] + (code-h.limit[n-1])>>(16-n)
+	if p >= uint32(len(h.syms)) {
+		p = 0
+	}
+	return int(h.syms[p])
+}
+
+// readCodeLengths reads the code lengths of the RAR 2.9 and RAR5 tables: 20 precode lengths of 4 bits
+// (15 followed by a nonzero count n stands for n+2 zeros), then the lengths coded with the precode,
+// where 16 and 17 repeat the previous length and 18 and 19 write zeros. RAR 2.9 codes each length as
+// its difference to the one in prev, the lengths of the previous tables; RAR5 passes nil.
+func readCodeLengths(br *bitReader, lengths, prev []byte) error {
+	var bl [20]byte
+	for i := 0; i < len(bl); i++ {
+		l := byte(br.bits(4))
+		if l == 15 {
+			if zeros := int(br.bits(4)); zeros != 0 {
+				for j := 0; j < zeros+2 && i < len(bl); j++ {
+					bl[i] = 0
+					i++
+				}
+				i--
+				continue
+			}
+		}
+		bl[i] = l
+	}
+	var bd huffman
+	bd.init(bl[:])
+	for i := 0; i < len(lengths); {
+		sym := bd.decode(br)
+		switch {
+		case sym < 16:
+			if prev != nil {
+				sym = (sym + int(prev[i])) & 15
+			}
+			lengths[i] = byte(sym)
+			i++
+		case sym < 18:
+			var n int
+			if sym == 16 {
+				n = 3 + int(br.bits(3))
+			} else {
+				n = 11 + int(br.bits(7))
+			}
+			if i == 0 {
+				return fmt.Errorf("%w: code table starts with a repeat", ErrCorrupt)
+			}
+			for ; n > 0 && i < len(lengths); n-- {
+				lengths[i] = lengths[i-1]
+				i++
+			}
+		default:
+			var n int
+			if sym == 18 {
+				n = 3 + int(br.bits(3))
+			} else {
+				n = 11 + int(br.bits(7))
+			}
+			for ; n > 0 && i < len(lengths); n-- {
+				lengths[i] = 0
+				i++
+			}
+		}
+	}
+	return br.err()
+}
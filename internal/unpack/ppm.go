@@ -0,0 +1,1044 @@
+package unpack
+
+import "encoding/binary"
+
+// PPMd variant H, the context modelling compression of RAR 2.9-4.x, ported from unrar. The model must
+// run out of memory and restart exactly where the compressor's did, so its contexts and states live in
+// a byte heap laid out like the 32 bit original: 12 byte units holding a context or two 6 byte states,
+// addressed by offsets.
+
+const (
+	ppmMaxO       = 64 // longest context
+	ppmIntBits    = 7
+	ppmPeriodBits = 7
+	ppmTotBits    = ppmIntBits + ppmPeriodBits
+	ppmInterval   = 1 << ppmIntBits
+	ppmBinScale   = 1 << ppmTotBits
+	ppmMaxFreq    = 124
+
+	ppmTop = 1 << 24
+	ppmBot = 1 << 15
+
+	unitSize  = 12
+	stateSize = 6
+	ppmN1     = 4
+	ppmN2     = 4
+	ppmN3     = 4
+	ppmN4     = (128 + 3 - 1*ppmN1 - 2*ppmN2 - 3*ppmN3) / 4
+	nIndexes  = ppmN1 + ppmN2 + ppmN3 + ppmN4
+)
+
+// Offsets of the context fields: the number of states, then either the sum of their frequencies and
+// the offset of the state array, or the only state inline; then the offset of the suffix context.
+const (
+	ctxNumStats = 0
+	ctxSummFreq = 2
+	ctxOneState = 2
+	ctxStats    = 4
+	ctxSuffix   = 8
+)
+
+var (
+	ppmInitBinEsc = [8]uint16{0x3CDD, 0x1F3F, 0x59BF, 0x48F3, 0x64A1, 0x5ABC, 0x6632, 0x6051}
+	ppmExpEscape  = [16]byte{25, 14, 9, 7, 5, 5, 4, 4, 4, 3, 3, 3, 2, 2, 2, 2}
+)
+
+// ppmState is a state held outside the heap: a symbol, its frequency and the successor context, or
+// the text position the context will be built from.
+type ppmState struct {
+	sym, freq byte
+	succ      uint32
+}
+
+// subAllocator hands out units of the model heap: contexts from the top, state arrays from the
+// bottom of the units area, below which the text area grows with the symbols the model has seen.
+// Freed blocks are kept in lists by size and merged when an allocation fails.
+type subAllocator struct {
+	heap       []byte
+	size       uint32 // model memory requested by the stream
+	indx2Units [nIndexes]byte
+	units2Indx [128]byte
+	glueCount  int
+	freeList   [nIndexes]uint32
+
+	// Heap offsets. Offset 0 is the null context; the list head used while merging blocks lives there.
+	heapStart, heapEnd         uint32
+	loUnit, hiUnit             uint32
+	pText                      uint32
+	unitsStart, fakeUnitsStart uint32
+}
+
+func (a *subAllocator) u16(off uint32) uint16 { return binary.LittleEndian.Uint16(a.heap[off:]) }
+func (a *subAllocator) u32(off uint32) uint32 { return binary.LittleEndian.Uint32(a.heap[off:]) }
+func (a *subAllocator) setU16(off uint32, v uint16) {
+	binary.LittleEndian.PutUint16(a.heap[off:], v)
+}
+func (a *subAllocator) setU32(off uint32, v uint32) {
+	binary.LittleEndian.PutUint32(a.heap[off:], v)
+}
+
+// start allocates mb MiB of model memory, keeping the heap when its size does not change.
+func (a *subAllocator) start(mb int) {
+	t := uint32(mb) << 20
+	if a.size == t {
+		return
+	}
+	a.heapStart = unitSize
+	allocSize := t/unitSize*unitSize + 2*unitSize
+	a.heap = make([]byte, a.heapStart+allocSize)
+	a.heapEnd = a.heapStart + allocSize - unitSize
+	a.size = t
+}
+
+// init empties the heap.
+func (a *subAllocator) init() {
+	a.freeList = [nIndexes]uint32{}
+	a.pText = a.heapStart
+	size2 := unitSize * (a.size / 8 / unitSize * 7)
+	size1 := a.size - size2
+	a.unitsStart = a.heapStart + size1
+	a.loUnit = a.unitsStart
+	a.fakeUnitsStart = a.unitsStart
+	a.hiUnit = a.loUnit + size2
+	i, k := 0, 1
+	for ; i < ppmN1; i, k = i+1, k+1 {
+		a.indx2Units[i] = byte(k)
+	}
+	for k++; i < ppmN1+ppmN2; i, k = i+1, k+2 {
+		a.indx2Units[i] = byte(k)
+	}
+	for k++; i < ppmN1+ppmN2+ppmN3; i, k = i+1, k+3 {
+		a.indx2Units[i] = byte(k)
+	}
+	for k++; i < nIndexes; i, k = i+1, k+4 {
+		a.indx2Units[i] = byte(k)
+	}
+	a.glueCount = 0
+	i = 0
+	for k := 0; k < 128; k++ {
+		if int(a.indx2Units[i]) < k+1 {
+			i++
+		}
+		a.units2Indx[k] = byte(i)
+	}
+}
+
+func u2b(nu int) uint32 { return uint32(unitSize * nu) }
+
+func (a *subAllocator) insertNode(p uint32, indx int) {
+	a.setU32(p, a.freeList[indx])
+	a.freeList[indx] = p
+}
+
+func (a *subAllocator) removeNode(indx int) uint32 {
+	p := a.freeList[indx]
+	a.freeList[indx] = a.u32(p)
+	return p
+}
+
+// splitBlock returns the units of block p beyond those of index newIndx to the free lists.
+func (a *subAllocator) splitBlock(p uint32, oldIndx, newIndx int) {
+	diff := int(a.indx2Units[oldIndx]) - int(a.indx2Units[newIndx])
+	p += u2b(int(a.indx2Units[newIndx]))
+	if i := int(a.units2Indx[diff-1]); int(a.indx2Units[i]) != diff {
+		i--
+		a.insertNode(p, i)
+		k := int(a.indx2Units[i])
+		p += u2b(k)
+		diff -= k
+	}
+	a.insertNode(p, int(a.units2Indx[diff-1]))
+}
+
+// Free blocks being merged are linked in a list: a 0xFFFF stamp, their number of units, and the
+// offsets of the next and previous blocks.
+func (a *subAllocator) blkNext(p uint32) uint32 { return a.u32(p + 4) }
+
+func (a *subAllocator) blkInsertAt(p, at uint32) {
+	next := a.blkNext(at)
+	a.setU32(p+8, at)
+	a.setU32(p+4, next)
+	a.setU32(at+4, p)
+	a.setU32(next+8, p)
+}
+
+func (a *subAllocator) blkRemove(p uint32) {
+	prev, next := a.u32(p+8), a.blkNext(p)
+	a.setU32(prev+4, next)
+	a.setU32(next+8, prev)
+}
+
+// glueFreeBlocks merges adjacent free blocks and sorts them back into the free lists.
+func (a *subAllocator) glueFreeBlocks() {
+	const head = 0
+	if a.loUnit != a.hiUnit {
+		a.heap[a.loUnit] = 0
+	}
+	a.setU32(head+4, head)
+	a.setU32(head+8, head)
+	for i := 0; i < nIndexes; i++ {
+		for a.freeList[i] != 0 {
+			p := a.removeNode(i)
+			a.blkInsertAt(p, head)
+			a.setU16(p, 0xffff)
+			a.setU16(p+2, uint16(a.indx2Units[i]))
+		}
+	}
+	for p := a.blkNext(head); p != head; p = a.blkNext(p) {
+		for {
+			nu := uint32(a.u16(p + 2))
+			p1 := p + nu*unitSize
+			if a.u16(p1) != 0xffff || nu+uint32(a.u16(p1+2)) >= 0x10000 {
+				break
+			}
+			a.blkRemove(p1)
+			a.setU16(p+2, uint16(nu)+a.u16(p1+2))
+		}
+	}
+	for {
+		p := a.blkNext(head)
+		if p == head {
+			break
+		}
+		a.blkRemove(p)
+		sz := int(a.u16(p + 2))
+		for ; sz > 128; sz, p = sz-128, p+u2b(128) {
+			a.insertNode(p, nIndexes-1)
+		}
+		i := int(a.units2Indx[sz-1])
+		if int(a.indx2Units[i]) != sz {
+			i--
+			k := sz - int(a.indx2Units[i])
+			a.insertNode(p+u2b(sz-k), k-1)
+		}
+		a.insertNode(p, i)
+	}
+}
+
+// allocUnitsRare allocates a block of index indx when its free list and the units area are empty:
+// from a larger free block, after merging the free blocks every 255 calls, or from the text area.
+// It returns 0 when the memory is exhausted.
+func (a *subAllocator) allocUnitsRare(indx int) uint32 {
+	if a.glueCount == 0 {
+		a.glueCount = 255
+		a.glueFreeBlocks()
+		if a.freeList[indx] != 0 {
+			return a.removeNode(indx)
+		}
+	}
+	i := indx
+	for {
+		if i++; i == nIndexes {
+			a.glueCount--
+			n := u2b(int(a.indx2Units[indx]))
+			if int64(a.fakeUnitsStart)-int64(a.pText) > int64(n) {
+				a.fakeUnitsStart -= n
+				a.unitsStart -= n
+				return a.unitsStart
+			}
+			return 0
+		}
+		if a.freeList[i] != 0 {
+			break
+		}
+	}
+	p := a.removeNode(i)
+	a.splitBlock(p, i, indx)
+	return p
+}
+
+func (a *subAllocator) allocUnits(nu int) uint32 {
+	indx := int(a.units2Indx[nu-1])
+	if a.freeList[indx] != 0 {
+		return a.removeNode(indx)
+	}
+	p := a.loUnit
+	a.loUnit += u2b(int(a.indx2Units[indx]))
+	if a.loUnit <= a.hiUnit {
+		return p
+	}
+	a.loUnit -= u2b(int(a.indx2Units[indx]))
+	return a.allocUnitsRare(indx)
+}
+
+func (a *subAllocator) allocContext() uint32 {
+	if a.hiUnit != a.loUnit {
+		a.hiUnit -= unitSize
+		return a.hiUnit
+	}
+	if a.freeList[0] != 0 {
+		return a.removeNode(0)
+	}
+	return a.allocUnitsRare(0)
+}
+
+// expandUnits grows the block p of oldNU units by one unit, moving it if needed.
+func (a *subAllocator) expandUnits(p uint32, oldNU int) uint32 {
+	i0, i1 := int(a.units2Indx[oldNU-1]), int(a.units2Indx[oldNU])
+	if i0 == i1 {
+		return p
+	}
+	np := a.allocUnits(oldNU + 1)
+	if np != 0 {
+		copy(a.heap[np:np+u2b(oldNU)], a.heap[p:])
+		a.insertNode(p, i0)
+	}
+	return np
+}
+
+// shrinkUnits shrinks the block p from oldNU to newNU units, moving it if a block of that size is free.
+func (a *subAllocator) shrinkUnits(p uint32, oldNU, newNU int) uint32 {
+	i0, i1 := int(a.units2Indx[oldNU-1]), int(a.units2Indx[newNU-1])
+	if i0 == i1 {
+		return p
+	}
+	if a.freeList[i1] != 0 {
+		np := a.removeNode(i1)
+		copy(a.heap[np:np+u2b(newNU)], a.heap[p:])
+		a.insertNode(p, i0)
+		return np
+	}
+	a.splitBlock(p, i0, i1)
+	return p
+}
+
+func (a *subAllocator) freeUnits(p uint32, nu int) { a.insertNode(p, int(a.units2Indx[nu-1])) }
+
+// see2Context adapts the escape frequency of contexts with masked symbols.
+type see2Context struct {
+	summ         uint16
+	shift, count byte
+}
+
+func (s *see2Context) init(v int) {
+	s.shift = ppmPeriodBits - 4
+	s.summ = uint16(v << s.shift)
+	s.count = 4
+}
+
+func (s *see2Context) mean() uint32 {
+	r := uint32(s.summ >> s.shift)
+	s.summ -= uint16(r)
+	if r == 0 {
+		return 1
+	}
+	return r
+}
+
+func (s *see2Context) update() {
+	if s.shift < ppmPeriodBits {
+		if s.count--; s.count == 0 {
+			s.summ += s.summ
+			s.count = byte(3 << s.shift)
+			s.shift++
+		}
+	}
+}
+
+// rangeDecoder is the carry-less range decoder of PPMd, reading whole bytes from the bit reader.
+type rangeDecoder struct {
+	br                         *bitReader
+	low, code, rng             uint32
+	lowCount, highCount, scale uint32
+}
+
+func (c *rangeDecoder) init(br *bitReader) {
+	c.br = br
+	c.low, c.code, c.rng = 0, 0, 0xffffffff
+	for i := 0; i < 4; i++ {
+		c.code = c.code<<8 | uint32(br.bits(8))
+	}
+}
+
+func (c *rangeDecoder) currentCount() uint32 {
+	c.rng /= c.scale
+	return (c.code - c.low) / c.rng
+}
+
+func (c *rangeDecoder) currentShiftCount(shift uint) uint32 {
+	c.rng >>= shift
+	return (c.code - c.low) / c.rng
+}
+
+// decode removes the interval of the decoded symbol.
+func (c *rangeDecoder) decode() {
+	c.low += c.rng * c.lowCount
+	c.rng *= c.highCount - c.lowCount
+}
+
+func (c *rangeDecoder) normalize() {
+	for {
+		if c.low^(c.low+c.rng) >= ppmTop {
+			if c.rng >= ppmBot {
+				return
+			}
+			c.rng = -c.low & (ppmBot - 1)
+		}
+		c.code = c.code<<8 | uint32(c.br.bits(8))
+		c.rng <<= 8
+		c.low <<= 8
+	}
+}
+
+// ppmModel is the PPMd variant H model with its range decoder.
+type ppmModel struct {
+	subAllocator
+	rc rangeDecoder
+
+	see2      [25][16]see2Context
+	dummySee2 see2Context
+	binSumm   [128][64]uint16
+
+	minContext, maxContext uint32
+	foundState             uint32
+	numMasked, initEsc     int
+	orderFall, maxOrder    int
+	runLength, initRL      int32
+	charMask               [256]byte
+	ns2Indx, ns2BSIndx     [256]byte
+	hb2Flag                [256]byte
+	escCount, prevSuccess  byte
+	hiBitsFlag             byte
+}
+
+func (m *ppmModel) numStats(ctx uint32) int    { return int(m.u16(ctx + ctxNumStats)) }
+func (m *ppmModel) summFreq(ctx uint32) uint32 { return uint32(m.u16(ctx + ctxSummFreq)) }
+func (m *ppmModel) stats(ctx uint32) uint32    { return m.u32(ctx + ctxStats) }
+func (m *ppmModel) suffix(ctx uint32) uint32   { return m.u32(ctx + ctxSuffix) }
+func (m *ppmModel) setSummFreq(ctx, v uint32)  { m.setU16(ctx+ctxSummFreq, uint16(v)) }
+func (m *ppmModel) sym(s uint32) byte          { return m.heap[s] }
+func (m *ppmModel) freq(s uint32) uint32       { return uint32(m.heap[s+1]) }
+func (m *ppmModel) setFreq(s, v uint32)        { m.heap[s+1] = byte(v) }
+func (m *ppmModel) successor(s uint32) uint32  { return m.u32(s + 2) }
+func (m *ppmModel) setSuccessor(s, v uint32)   { m.setU32(s+2, v) }
+func (m *ppmModel) state(s uint32) ppmState    { return ppmState{m.heap[s], m.heap[s+1], m.successor(s)} }
+func (m *ppmModel) setState(s uint32, v ppmState) {
+	m.heap[s], m.heap[s+1] = v.sym, v.freq
+	m.setSuccessor(s, v.succ)
+}
+
+func (m *ppmModel) swapStates(s, t uint32) {
+	var tmp [stateSize]byte
+	copy(tmp[:], m.heap[s:s+stateSize])
+	copy(m.heap[s:s+stateSize], m.heap[t:t+stateSize])
+	copy(m.heap[t:t+stateSize], tmp[:])
+}
+
+// init starts a model, as the first byte of a PPMd block requests: maxOrder 2..64 and mb MiB of
+// memory.
+func (m *ppmModel) init(maxOrder, mb int) {
+	m.start(mb)
+	m.escCount = 1
+	m.maxOrder = maxOrder
+	m.restart()
+	m.ns2BSIndx[0], m.ns2BSIndx[1] = 0, 2
+	for i := 2; i < 11; i++ {
+		m.ns2BSIndx[i] = 4
+	}
+	for i := 11; i < 256; i++ {
+		m.ns2BSIndx[i] = 6
+	}
+	for i := 0; i < 3; i++ {
+		m.ns2Indx[i] = byte(i)
+	}
+	for i, n, k, step := 3, 3, 1, 1; i < 256; i++ {
+		m.ns2Indx[i] = byte(n)
+		if k--; k == 0 {
+			step++
+			k = step
+			n++
+		}
+	}
+	for i := range m.hb2Flag {
+		m.hb2Flag[i] = 0
+		if i >= 0x40 {
+			m.hb2Flag[i] = 8
+		}
+	}
+	m.dummySee2.shift = ppmPeriodBits
+}
+
+// restart empties the heap and starts over from the order 0 context of all 256 symbols.
+func (m *ppmModel) restart() {
+	m.charMask = [256]byte{}
+	m.subAllocator.init()
+	m.initRL = -int32(min(m.maxOrder, 12)) - 1
+	ctx := m.allocContext()
+	m.minContext, m.maxContext = ctx, ctx
+	m.setU32(ctx+ctxSuffix, 0)
+	m.orderFall = m.maxOrder
+	m.setU16(ctx+ctxNumStats, 256)
+	m.setSummFreq(ctx, 257)
+	st := m.allocUnits(256 / 2)
+	m.foundState = st
+	m.setU32(ctx+ctxStats, st)
+	m.runLength, m.prevSuccess = m.initRL, 0
+	for i := uint32(0); i < 256; i++ {
+		m.setState(st+i*stateSize, ppmState{sym: byte(i), freq: 1})
+	}
+	for i := range m.binSumm {
+		for k := 0; k < 8; k++ {
+			for j := 0; j < 64; j += 8 {
+				m.binSumm[i][k+j] = ppmBinScale - ppmInitBinEsc[k]/uint16(i+2)
+			}
+		}
+	}
+	for i := range m.see2 {
+		for k := range m.see2[i] {
+			m.see2[i][k].init(5*i + 10)
+		}
+	}
+}
+
+// decodeChar decodes one symbol, or returns -1 on corrupt data.
+func (m *ppmModel) decodeChar() (c int) {
+	defer func() {
+		if recover() != nil { // offsets out of the heap, division by zero
+			c = -1
+		}
+	}()
+	if m.minContext <= m.pText || m.minContext > m.heapEnd {
+		return -1
+	}
+	if m.numStats(m.minContext) != 1 {
+		if st := m.stats(m.minContext); st <= m.pText || st > m.heapEnd {
+			return -1
+		}
+		if !m.decodeSymbol1() {
+			return -1
+		}
+	} else {
+		m.decodeBinSymbol()
+	}
+	m.rc.decode()
+	for m.foundState == 0 {
+		m.rc.normalize()
+		for {
+			m.orderFall++
+			m.minContext = m.suffix(m.minContext)
+			if m.minContext <= m.pText || m.minContext > m.heapEnd {
+				return -1
+			}
+			if m.numStats(m.minContext) != m.numMasked {
+				break
+			}
+		}
+		if !m.decodeSymbol2() {
+			return -1
+		}
+		m.rc.decode()
+	}
+	sym := m.sym(m.foundState)
+	if succ := m.successor(m.foundState); m.orderFall == 0 && succ > m.pText {
+		m.minContext, m.maxContext = succ, succ
+	} else {
+		m.updateModel()
+		if m.escCount == 0 {
+			m.clearMask()
+		}
+	}
+	m.rc.normalize()
+	return int(sym)
+}
+
+func (m *ppmModel) clearMask() {
+	m.escCount = 1
+	m.charMask = [256]byte{}
+}
+
+// binSummFor returns the adaptive probability of the state of the binary context ctx.
+func (m *ppmModel) binSummFor(ctx uint32) *uint16 {
+	rs := ctx + ctxOneState
+	m.hiBitsFlag = m.hb2Flag[m.sym(m.foundState)]
+	return &m.binSumm[m.freq(rs)-1][int(m.prevSuccess)+int(m.ns2BSIndx[m.numStats(m.suffix(ctx))-1])+
+		int(m.hiBitsFlag)+2*int(m.hb2Flag[m.sym(rs)])+int(m.runLength>>26&0x20)]
+}
+
+func binMean(bs uint16) uint16 { return uint16((uint32(bs) + 1<<(ppmPeriodBits-2)) >> ppmPeriodBits) }
+
+// decodeBinSymbol decodes in a context with a single state: either that symbol or an escape.
+func (m *ppmModel) decodeBinSymbol() {
+	rs := m.minContext + ctxOneState
+	bs := m.binSummFor(m.minContext)
+	if m.rc.currentShiftCount(ppmTotBits) < uint32(*bs) {
+		m.binHit(rs, bs)
+	} else {
+		m.binEscape(rs, bs)
+	}
+}
+
+func (m *ppmModel) binHit(rs uint32, bs *uint16) {
+	m.foundState = rs
+	if f := m.freq(rs); f < 128 {
+		m.setFreq(rs, f+1)
+	}
+	m.rc.lowCount, m.rc.highCount = 0, uint32(*bs)
+	*bs += ppmInterval - binMean(*bs)
+	m.prevSuccess = 1
+	m.runLength++
+}
+
+func (m *ppmModel) binEscape(rs uint32, bs *uint16) {
+	m.rc.lowCount = uint32(*bs)
+	*bs -= binMean(*bs)
+	m.rc.highCount = ppmBinScale
+	m.initEsc = int(ppmExpEscape[*bs>>10])
+	m.numMasked = 1
+	m.charMask[m.sym(rs)] = m.escCount
+	m.prevSuccess = 0
+	m.foundState = 0
+}
+
+// decodeSymbol1 decodes in a context with several states, none masked.
+func (m *ppmModel) decodeSymbol1() bool {
+	ctx := m.minContext
+	m.rc.scale = m.summFreq(ctx)
+	count := m.rc.currentCount()
+	if count >= m.rc.scale {
+		return false
+	}
+	p := m.stats(ctx)
+	hiCnt := m.freq(p)
+	if count < hiCnt {
+		m.firstHit(ctx, p)
+		return true
+	}
+	if m.foundState == 0 {
+		return false
+	}
+	m.prevSuccess = 0
+	for i := m.numStats(ctx) - 1; ; {
+		p += stateSize
+		if hiCnt += m.freq(p); hiCnt > count {
+			break
+		}
+		if i--; i == 0 {
+			m.escape1(ctx, p, hiCnt)
+			return true
+		}
+	}
+	m.rc.lowCount, m.rc.highCount = hiCnt-m.freq(p), hiCnt
+	m.update1(ctx, p)
+	return true
+}
+
+// firstHit updates the model for the first, most probable, state p of ctx.
+func (m *ppmModel) firstHit(ctx, p uint32) {
+	hiCnt := m.freq(p)
+	m.rc.highCount = hiCnt
+	m.prevSuccess = 0
+	if 2*hiCnt > m.rc.scale {
+		m.prevSuccess = 1
+	}
+	m.runLength += int32(m.prevSuccess)
+	m.foundState = p
+	hiCnt += 4
+	m.setFreq(p, hiCnt)
+	m.setSummFreq(ctx, m.summFreq(ctx)+4)
+	if hiCnt > ppmMaxFreq {
+		m.rescale(ctx)
+	}
+	m.rc.lowCount = 0
+}
+
+// escape1 masks all states of ctx after an escape; last is the last state and total their frequencies.
+func (m *ppmModel) escape1(ctx, last, total uint32) {
+	m.hiBitsFlag = m.hb2Flag[m.sym(m.foundState)]
+	m.rc.lowCount = total
+	m.numMasked = m.numStats(ctx)
+	for p := m.stats(ctx); p <= last; p += stateSize {
+		m.charMask[m.sym(p)] = m.escCount
+	}
+	m.foundState = 0
+	m.rc.highCount = m.rc.scale
+}
+
+func (m *ppmModel) update1(ctx, p uint32) {
+	m.foundState = p
+	m.setFreq(p, m.freq(p)+4)
+	m.setSummFreq(ctx, m.summFreq(ctx)+4)
+	if m.freq(p) > m.freq(p-stateSize) {
+		m.swapStates(p, p-stateSize)
+		p -= stateSize
+		m.foundState = p
+		if m.freq(p) > ppmMaxFreq {
+			m.rescale(ctx)
+		}
+	}
+}
+
+// escFreq2 selects the SEE context estimating the escape frequency of ctx with diff unmasked states,
+// and sets the coder scale to it.
+func (m *ppmModel) escFreq2(ctx uint32, diff int) *see2Context {
+	ns := m.numStats(ctx)
+	if ns == 256 {
+		m.rc.scale = 1
+		return &m.dummySee2
+	}
+	i := int(m.hiBitsFlag)
+	if diff < m.numStats(m.suffix(ctx))-ns {
+		i++
+	}
+	if m.summFreq(ctx) < uint32(11*ns) {
+		i += 2
+	}
+	if m.numMasked > diff {
+		i += 4
+	}
+	see := &m.see2[m.ns2Indx[diff-1]][i]
+	m.rc.scale = see.mean()
+	return see
+}
+
+// unmasked returns the states of ctx not masked by the contexts escaped from, and their frequencies.
+func (m *ppmModel) unmasked(ctx uint32, ps *[256]uint32) (int, uint32) {
+	n := m.numStats(ctx) - m.numMasked
+	p := m.stats(ctx) - stateSize
+	var hiCnt uint32
+	for i := 0; i < n; i++ {
+		for p += stateSize; m.charMask[m.sym(p)] == m.escCount; p += stateSize {
+		}
+		hiCnt += m.freq(p)
+		ps[i] = p
+	}
+	return n, hiCnt
+}
+
+// decodeSymbol2 decodes in a context after an escape, leaving out the masked symbols.
+func (m *ppmModel) decodeSymbol2() bool {
+	ctx := m.minContext
+	diff := m.numStats(ctx) - m.numMasked
+	if diff <= 0 {
+		return false
+	}
+	see := m.escFreq2(ctx, diff)
+	var ps [256]uint32
+	n, hiCnt := m.unmasked(ctx, &ps)
+	m.rc.scale += hiCnt
+	count := m.rc.currentCount()
+	if count >= m.rc.scale {
+		return false
+	}
+	if count >= hiCnt {
+		m.escape2(ctx, see, ps[:n], hiCnt)
+		return true
+	}
+	hiCnt = 0
+	i := 0
+	for ; ; i++ {
+		if hiCnt += m.freq(ps[i]); hiCnt > count {
+			break
+		}
+	}
+	m.rc.lowCount, m.rc.highCount = hiCnt-m.freq(ps[i]), hiCnt
+	see.update()
+	m.update2(ctx, ps[i])
+	return true
+}
+
+func (m *ppmModel) escape2(ctx uint32, see *see2Context, ps []uint32, total uint32) {
+	m.rc.lowCount, m.rc.highCount = total, m.rc.scale
+	for _, p := range ps {
+		m.charMask[m.sym(p)] = m.escCount
+	}
+	see.summ += uint16(m.rc.scale)
+	m.numMasked = m.numStats(ctx)
+}
+
+func (m *ppmModel) update2(ctx, p uint32) {
+	m.foundState = p
+	m.setFreq(p, m.freq(p)+4)
+	m.setSummFreq(ctx, m.summFreq(ctx)+4)
+	if m.freq(p) > ppmMaxFreq {
+		m.rescale(ctx)
+	}
+	m.escCount++
+	m.runLength = m.initRL
+}
+
+// rescale halves the frequencies of ctx, moving the found state first and dropping states that reach
+// zero.
+func (m *ppmModel) rescale(ctx uint32) {
+	oldNS := m.numStats(ctx)
+	stats := m.stats(ctx)
+	p := m.foundState
+	for ; p != stats; p -= stateSize {
+		m.swapStates(p, p-stateSize)
+	}
+	m.setFreq(stats, m.freq(stats)+4)
+	m.setSummFreq(ctx, m.summFreq(ctx)+4)
+	escFreq := int(m.summFreq(ctx)) - int(m.freq(p))
+	adder := 0
+	if m.orderFall != 0 {
+		adder = 1
+	}
+	m.setFreq(p, uint32(int(m.freq(p))+adder)>>1)
+	summ := m.freq(p)
+	for i := oldNS - 1; i > 0; i-- {
+		p += stateSize
+		escFreq -= int(m.freq(p))
+		m.setFreq(p, uint32(int(m.freq(p))+adder)>>1)
+		summ += m.freq(p)
+		if m.freq(p) > m.freq(p-stateSize) {
+			tmp := m.state(p)
+			p1 := p
+			for {
+				copy(m.heap[p1:p1+stateSize], m.heap[p1-stateSize:p1])
+				if p1 -= stateSize; p1 == stats || uint32(tmp.freq) <= m.freq(p1-stateSize) {
+					break
+				}
+			}
+			m.setState(p1, tmp)
+		}
+	}
+	if m.freq(p) == 0 {
+		i := 0
+		for {
+			i++
+			if p -= stateSize; m.freq(p) != 0 {
+				break
+			}
+		}
+		escFreq += i
+		ns := oldNS - i
+		m.setU16(ctx+ctxNumStats, uint16(ns))
+		if ns == 1 {
+			tmp := m.state(stats)
+			for {
+				tmp.freq -= tmp.freq >> 1
+				if escFreq >>= 1; escFreq <= 1 {
+					break
+				}
+			}
+			m.freeUnits(stats, (oldNS+1)>>1)
+			m.foundState = ctx + ctxOneState
+			m.setState(m.foundState, tmp)
+			return
+		}
+	}
+	escFreq -= escFreq >> 1
+	m.setSummFreq(ctx, summ+uint32(escFreq))
+	if n0, n1 := (oldNS+1)>>1, (m.numStats(ctx)+1)>>1; n0 != n1 {
+		m.setU32(ctx+ctxStats, m.shrinkUnits(stats, n0, n1))
+	}
+	m.foundState = m.stats(ctx)
+}
+
+// createChild adds a context of the single state first below ctx, the successor of state ps.
+func (m *ppmModel) createChild(ctx, ps uint32, first ppmState) uint32 {
+	pc := m.allocContext()
+	if pc != 0 {
+		m.setU16(pc+ctxNumStats, 1)
+		m.setState(pc+ctxOneState, first)
+		m.setU32(pc+ctxSuffix, ctx)
+		m.setSuccessor(ps, pc)
+	}
+	return pc
+}
+
+// createSuccessors builds the contexts following the found state in the suffixes of the current
+// context that still point to the text. p1 is the found symbol's state in the suffix, when known.
+func (m *ppmModel) createSuccessors(skip bool, p1 uint32) uint32 {
+	pc := m.minContext
+	upBranch := m.successor(m.foundState)
+	fsym := m.sym(m.foundState)
+	var ps [ppmMaxO]uint32
+	n := 0
+	if !skip {
+		ps[n] = m.foundState
+		n++
+	}
+	if skip || m.suffix(pc) != 0 {
+		for {
+			pc = m.suffix(pc)
+			var p uint32
+			switch {
+			case p1 != 0:
+				p, p1 = p1, 0
+			case m.numStats(pc) != 1:
+				for p = m.stats(pc); m.sym(p) != fsym; p += stateSize {
+				}
+			default:
+				p = pc + ctxOneState
+			}
+			if m.successor(p) != upBranch {
+				pc = m.successor(p)
+				break
+			}
+			if n >= len(ps) {
+				return 0
+			}
+			ps[n] = p
+			n++
+			if m.suffix(pc) == 0 {
+				break
+			}
+		}
+	}
+	if n == 0 {
+		return pc
+	}
+	up := ppmState{sym: m.heap[upBranch], succ: upBranch + 1}
+	if m.numStats(pc) != 1 {
+		if pc <= m.pText {
+			return 0
+		}
+		p := m.stats(pc)
+		for ; m.sym(p) != up.sym; p += stateSize {
+		}
+		cf := m.freq(p) - 1
+		s0 := m.summFreq(pc) - uint32(m.numStats(pc)) - cf
+		var f uint32
+		switch {
+		case 2*cf > s0:
+			f = (2*cf + 3*s0 - 1) / (2 * s0)
+		case 5*cf > s0:
+			f = 1
+		}
+		up.freq = byte(1 + f)
+	} else {
+		up.freq = byte(m.freq(pc + ctxOneState))
+	}
+	for n > 0 {
+		n--
+		if pc = m.createChild(pc, ps[n], up); pc == 0 {
+			return 0
+		}
+	}
+	return pc
+}
+
+// updateModel adds the found symbol to the contexts from the longest one down to the one it was found
+// in, restarting the model when the memory runs out.
+func (m *ppmModel) updateModel() {
+	fs := m.state(m.foundState)
+	var p uint32
+	if fs.freq < ppmMaxFreq/4 {
+		if pc := m.suffix(m.minContext); pc != 0 {
+			if m.numStats(pc) != 1 {
+				if p = m.stats(pc); m.sym(p) != fs.sym {
+					for p += stateSize; m.sym(p) != fs.sym; p += stateSize {
+					}
+					if m.freq(p) >= m.freq(p-stateSize) {
+						m.swapStates(p, p-stateSize)
+						p -= stateSize
+					}
+				}
+				if m.freq(p) < ppmMaxFreq-9 {
+					m.setFreq(p, m.freq(p)+2)
+					m.setSummFreq(pc, m.summFreq(pc)+2)
+				}
+			} else {
+				p = pc + ctxOneState
+				if m.freq(p) < 32 {
+					m.setFreq(p, m.freq(p)+1)
+				}
+			}
+		}
+	}
+	if m.orderFall == 0 {
+		m.minContext = m.createSuccessors(true, p)
+		m.maxContext = m.minContext
+		if m.minContext == 0 {
+			m.restartModel()
+			return
+		}
+		m.setSuccessor(m.foundState, m.minContext)
+		return
+	}
+	m.heap[m.pText] = fs.sym
+	m.pText++
+	successor := m.pText
+	if m.pText >= m.fakeUnitsStart {
+		m.restartModel()
+		return
+	}
+	if fs.succ != 0 {
+		if fs.succ <= m.pText {
+			if fs.succ = m.createSuccessors(false, p); fs.succ == 0 {
+				m.restartModel()
+				return
+			}
+		}
+		if m.orderFall--; m.orderFall == 0 {
+			successor = fs.succ
+			if m.maxContext != m.minContext {
+				m.pText--
+			}
+		}
+	} else {
+		m.setSuccessor(m.foundState, successor)
+		fs.succ = m.minContext
+	}
+	ns := m.numStats(m.minContext)
+	s0 := m.summFreq(m.minContext) - uint32(ns) - (uint32(fs.freq) - 1)
+	for pc := m.maxContext; pc != m.minContext; pc = m.suffix(pc) {
+		ns1 := m.numStats(pc)
+		if ns1 != 1 {
+			if ns1&1 == 0 {
+				st := m.expandUnits(m.stats(pc), ns1>>1)
+				if st == 0 {
+					m.restartModel()
+					return
+				}
+				m.setU32(pc+ctxStats, st)
+			}
+			inc := uint32(0)
+			if 2*ns1 < ns {
+				inc++
+			}
+			if 4*ns1 <= ns && m.summFreq(pc) <= uint32(8*ns1) {
+				inc += 2
+			}
+			m.setSummFreq(pc, m.summFreq(pc)+inc)
+		} else {
+			st := m.allocUnits(1)
+			if st == 0 {
+				m.restartModel()
+				return
+			}
+			copy(m.heap[st:st+stateSize], m.heap[pc+ctxOneState:])
+			m.setU32(pc+ctxStats, st)
+			if f := m.freq(st); f < ppmMaxFreq/4-1 {
+				m.setFreq(st, 2*f)
+			} else {
+				m.setFreq(st, ppmMaxFreq-4)
+			}
+			summ := m.freq(st) + uint32(m.initEsc)
+			if ns > 3 {
+				summ++
+			}
+			m.setSummFreq(pc, summ)
+		}
+		cf := 2 * uint32(fs.freq) * (m.summFreq(pc) + 6)
+		sf := s0 + m.summFreq(pc)
+		if cf < 6*sf {
+			n := uint32(1)
+			if cf > sf {
+				n++
+			}
+			if cf >= 4*sf {
+				n++
+			}
+			cf = n
+			m.setSummFreq(pc, m.summFreq(pc)+3)
+		} else {
+			n := uint32(4)
+			for _, k := range []uint32{9, 12, 15} {
+				if cf >= k*sf {
+					n++
+				}
+			}
+			cf = n
+			m.setSummFreq(pc, m.summFreq(pc)+cf)
+		}
+		m.setState(m.stats(pc)+uint32(ns1)*stateSize, ppmState{sym: fs.sym, freq: byte(cf), succ: successor})
+		m.setU16(pc+ctxNumStats, uint16(ns1+1))
+	}
+	m.maxContext, m.minContext = fs.succ, fs.succ
+}
+
+func (m *ppmModel) restartModel() {
+	m.restart()
+	m.escCount = 0
+}
@@ -0,0 +1,472 @@
+package unpack
+
+import "io"
+
+// rar15MaxCopy bounds the bytes one RAR 1.5 step decodes: a long match takes at most 255+12 bytes.
+const rar15MaxCopy = 0x110
+
+// rar15Code is a code table of decodeNum: a code starts with start bits and grows by one bit for each
+// boundary of dec the next 16 bits of input reach; pos maps the codes of each length to their numbers.
+type rar15Code struct {
+	start    int
+	dec, pos []uint32
+}
+
+// Code tables of RAR 1.5: match lengths, and places in the adaptive orders (Hf0 favours low places).
+var (
+	rar15L1  = rar15Code{2, []uint32{0x8000, 0xa000, 0xc000, 0xd000, 0xe000, 0xea00, 0xee00, 0xf000, 0xf200, 0xf200, 0xffff}, []uint32{0, 0, 0, 2, 3, 5, 7, 11, 16, 20, 24, 32, 32}}
+	rar15L2  = rar15Code{3, []uint32{0xa000, 0xc000, 0xd000, 0xe000, 0xea00, 0xee00, 0xf000, 0xf200, 0xf240, 0xffff}, []uint32{0, 0, 0, 0, 5, 7, 9, 13, 18, 22, 26, 34, 36}}
+	rar15Hf0 = rar15Code{4, []uint32{0x8000, 0xc000, 0xe000, 0xf200, 0xf200, 0xf200, 0xf200, 0xf200, 0xffff}, []uint32{0, 0, 0, 0, 0, 8, 16, 24, 33, 33, 33, 33, 33}}
+	rar15Hf1 = rar15Code{5, []uint32{0x2000, 0xc000, 0xe000, 0xf000, 0xf200, 0xf200, 0xf7e0, 0xffff}, []uint32{0, 0, 0, 0, 0, 0, 4, 44, 60, 76, 80, 80, 127}}
+	rar15Hf2 = rar15Code{5, []uint32{0x1000, 0x2400, 0x8000, 0xc000, 0xfa00, 0xffff, 0xffff, 0xffff}, []uint32{0, 0, 0, 0, 0, 0, 2, 7, 53, 117, 233, 0, 0}}
+	rar15Hf3 = rar15Code{6, []uint32{0x800, 0x2400, 0xee00, 0xfe80, 0xffff, 0xffff, 0xffff}, []uint32{0, 0, 0, 0, 0, 0, 0, 2, 16, 218, 251, 0, 0}}
+	rar15Hf4 = rar15Code{8, []uint32{0xff00, 0xffff, 0xffff, 0xffff, 0xffff, 0xffff}, []uint32{0, 0, 0, 0, 0, 0, 0, 0, 0, 255, 0, 0, 0}}
+)
+
+var (
+	// Short match lengths: the codes, left aligned in a byte, and their bit lengths for the two
+	// length statistics. Index 1 (table 1) and 3 (table 2) take Buf60+3 bits.
+	rar15ShortLen1 = [16]uint{1, 3, 4, 4, 5, 6, 7, 8, 8, 4, 4, 5, 6, 6, 4, 0}
+	rar15ShortXor1 = [16]uint32{0, 0xa0, 0xd0, 0xe0, 0xf0, 0xf8, 0xfc, 0xfe, 0xff, 0xc0, 0x80, 0x90, 0x98, 0x9c, 0xb0}
+	rar15ShortLen2 = [16]uint{2, 3, 3, 3, 4, 4, 5, 6, 6, 4, 4, 5, 6, 6, 4, 0}
+	rar15ShortXor2 = [16]uint32{0, 0x40, 0x60, 0xa0, 0xd0, 0xe0, 0xf0, 0xf8, 0xfc, 0xc0, 0x80, 0x90, 0x98, 0x9c, 0xb0}
+)
+
+// rar15 decodes the RAR 1.5 format (UNP_VER 15 and older, RAR 1.3/1.4 archives included): literals
+// and matches are selected by adaptive flag bytes and coded against adaptive symbol orders, and long
+// runs of literals switch to a Huffman only mode.
+type rar15 struct {
+	br   bitReader
+	w    window
+	dict int64
+
+	chSet, chSetA, chSetB, chSetC [256]uint16 // symbols in the high byte, use counts in the low one
+	nToPl, nToPlB, nToPlC         [256]byte
+
+	avrPlc, avrPlcB, avrLn1, avrLn2, avrLn3 int
+	nhfb, nlzb                              int
+	maxDist3                                uint32
+	buf60, numHuf, lCount                   int
+	stMode                                  bool
+	flagBuf, flagsCnt                       int
+
+	oldDist    [4]uint32
+	oldDistPtr int
+	lastDist   uint32
+	lastLength int
+
+	begin, eof bool
+	err        error
+}
+
+// NewRar15 returns a decoder of RAR 1.5 compressed data with the dictionary size of its file header.
+// total bounds the bytes the decoder will produce across all the files it decodes; pass -1 when unknown.
+func NewRar15(dict, total int64) Decoder {
+	return &rar15{dict: windowSize(dict, total)}
+}
+
+func (d *rar15) Init(r io.Reader, size int64, solid bool) {
+	d.br.reset(byteReader(r))
+	d.w.init(d.dict, size, solid)
+	if !solid {
+		d.avrPlcB, d.avrLn1, d.avrLn2, d.avrLn3, d.numHuf, d.buf60 = 0, 0, 0, 0, 0, 0
+		d.avrPlc, d.maxDist3 = 0x3500, 0x2001
+		d.nhfb, d.nlzb = 0x80, 0x80
+		d.oldDist, d.oldDistPtr, d.lastDist, d.lastLength = [4]uint32{}, 0, 0, 0
+		d.initHuff()
+	}
+	d.flagsCnt, d.flagBuf, d.stMode, d.lCount = 0, 0, false, 0
+	d.begin, d.eof, d.err = true, size == 0, nil
+}
+
+func (d *rar15) Read(p []byte) (int, error) {
+	for !d.w.buffered() {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.eof {
+			return 0, io.EOF
+		}
+		d.err = d.decode(d.w.pos + max(int64(len(d.w.buf))/4, rar15MaxCopy))
+		d.w.flush()
+	}
+	return d.w.read(p), nil
+}
+
+// decode decodes until the window position reaches limit or the file is complete. Each flag bit
+// selects a step; a set bit picks the more frequent of literals and long matches.
+func (d *rar15) decode(limit int64) error {
+	if d.begin {
+		d.begin = false
+		d.getFlagsBuf()
+		d.flagsCnt = 8
+	}
+	for d.w.pos < limit {
+		if d.w.decoded() >= d.w.size {
+			d.eof = true
+			return nil
+		}
+		if err := d.br.err(); err != nil {
+			return err
+		}
+		if d.w.full(rar15MaxCopy) {
+			d.w.flush()
+		}
+		if d.stMode {
+			d.huffDecode()
+			continue
+		}
+		if d.flagBit() {
+			if d.nlzb > d.nhfb {
+				d.longLZ()
+			} else {
+				d.huffDecode()
+			}
+		} else if d.flagBit() {
+			if d.nlzb > d.nhfb {
+				d.huffDecode()
+			} else {
+				d.longLZ()
+			}
+		} else {
+			d.shortLZ()
+		}
+	}
+	return nil
+}
+
+// flagBit consumes the next flag bit, reading a new flag byte after every 8.
+func (d *rar15) flagBit() bool {
+	if d.flagsCnt--; d.flagsCnt < 0 {
+		d.getFlagsBuf()
+		d.flagsCnt = 7
+	}
+	bit := d.flagBuf&0x80 != 0
+	d.flagBuf <<= 1
+	return bit
+}
+
+// decodeNum decodes a number with code c from num, the next 16 bits of input.
+func (d *rar15) decodeNum(num uint32, c rar15Code) uint32 {
+	num &= 0xfff0
+	n, i := c.start, 0
+	for ; c.dec[i] <= num; i++ {
+		n++
+	}
+	d.br.skip(uint(n))
+	var base uint32
+	if i > 0 {
+		base = c.dec[i-1]
+	}
+	return (num-base)>>(16-n) + c.pos[n]
+}
+
+func (d *rar15) copyString(dist uint32, length int) {
+	d.w.copyMatch(length, int64(dist))
+}
+
+func (d *rar15) shortLen1(i int) uint {
+	if i == 1 {
+		return uint(d.buf60) + 3
+	}
+	return rar15ShortLen1[i]
+}
+
+func (d *rar15) shortLen2(i int) uint {
+	if i == 3 {
+		return uint(d.buf60) + 3
+	}
+	return rar15ShortLen2[i]
+}
+
+// shortLZ decodes a short match: a length code, which also selects repeats of the last match or of
+// one of the last four distances, then a distance up to 256 from an adaptive order.
+func (d *rar15) shortLZ() {
+	d.numHuf = 0
+	bitField := uint32(d.br.peek(16))
+	if d.lCount == 2 {
+		d.br.skip(1)
+		if bitField >= 0x8000 {
+			d.copyString(d.lastDist, d.lastLength)
+			return
+		}
+		bitField <<= 1
+		d.lCount = 0
+	}
+	bitField >>= 8
+	length := 0
+	if d.avrLn1 < 37 {
+		for ; (bitField^rar15ShortXor1[length])&^(0xff>>d.shortLen1(length)) != 0; length++ {
+		}
+		d.br.skip(d.shortLen1(length))
+	} else {
+		for ; (bitField^rar15ShortXor2[length])&^(0xff>>d.shortLen2(length)) != 0; length++ {
+		}
+		d.br.skip(d.shortLen2(length))
+	}
+
+	if length >= 9 {
+		if length == 9 {
+			d.lCount++
+			d.copyString(d.lastDist, d.lastLength)
+			return
+		}
+		d.lCount = 0
+		if length == 14 {
+			length = int(d.decodeNum(uint32(d.br.peek(16)), rar15L2)) + 5
+			dist := uint32(d.br.peek(16))>>1 | 0x8000
+			d.br.skip(15)
+			d.lastLength, d.lastDist = length, dist
+			d.copyString(dist, length)
+			return
+		}
+		save := length
+		dist := d.oldDist[(d.oldDistPtr-(length-9))&3]
+		length = int(d.decodeNum(uint32(d.br.peek(16)), rar15L1)) + 2
+		if length == 0x101 && save == 10 {
+			d.buf60 ^= 1
+			return
+		}
+		if dist > 256 {
+			length++
+		}
+		if dist >= d.maxDist3 {
+			length++
+		}
+		d.insertOldDist(dist)
+		d.lastLength, d.lastDist = length, dist
+		d.copyString(dist, length)
+		return
+	}
+
+	d.lCount = 0
+	d.avrLn1 += length
+	d.avrLn1 -= d.avrLn1 >> 4
+	place := int(d.decodeNum(uint32(d.br.peek(16)), rar15Hf2)) & 0xff
+	dist := uint32(d.chSetA[place])
+	if place > 0 { // move the distance one place up
+		d.chSetA[place], d.chSetA[place-1] = d.chSetA[place-1], uint16(dist)
+	}
+	length += 2
+	dist++
+	d.insertOldDist(dist)
+	d.lastLength, d.lastDist = length, dist
+	d.copyString(dist, length)
+}
+
+func (d *rar15) insertOldDist(dist uint32) {
+	d.oldDist[d.oldDistPtr] = dist
+	d.oldDistPtr = (d.oldDistPtr + 1) & 3
+}
+
+// longLZ decodes a long match: a length whose code depends on the average length, then the high bits
+// of the distance from an adaptive order and its 7 low bits.
+func (d *rar15) longLZ() {
+	d.numHuf = 0
+	if d.nlzb += 16; d.nlzb > 0xff {
+		d.nlzb = 0x90
+		d.nhfb >>= 1
+	}
+	oldAvr2 := d.avrLn2
+	bitField := uint32(d.br.peek(16))
+	var length int
+	if c, ok := d.longLengthCode(); ok {
+		length = int(d.decodeNum(bitField, c))
+	} else if bitField < 0x100 {
+		length = int(bitField)
+		d.br.skip(16)
+	} else {
+		for bitField<<length&0x8000 == 0 {
+			length++
+		}
+		d.br.skip(uint(length + 1))
+	}
+	d.avrLn2 += length
+	d.avrLn2 -= d.avrLn2 >> 5
+
+	place := d.decodeNum(uint32(d.br.peek(16)), d.distPlaceCode())
+	d.avrPlcB += int(place)
+	d.avrPlcB -= d.avrPlcB >> 8
+	place &= 0xff
+	var dist uint32
+	var newPlace byte
+	for {
+		dist = uint32(d.chSetB[place])
+		newPlace = d.nToPlB[dist&0xff]
+		d.nToPlB[dist&0xff]++
+		if dist++; dist&0xff != 0 {
+			break
+		}
+		corrHuff(&d.chSetB, &d.nToPlB)
+	}
+	d.chSetB[place] = d.chSetB[newPlace]
+	d.chSetB[newPlace] = uint16(dist)
+	dist = (dist&0xff00 | uint32(d.br.peek(16))>>8) >> 1
+	d.br.skip(7)
+
+	oldAvr3 := d.avrLn3
+	if length != 1 && length != 4 {
+		if length == 0 && dist <= d.maxDist3 {
+			d.avrLn3++
+			d.avrLn3 -= d.avrLn3 >> 8
+		} else if d.avrLn3 > 0 {
+			d.avrLn3--
+		}
+	}
+	length += 3
+	if dist >= d.maxDist3 {
+		length++
+	}
+	if dist <= 256 {
+		length += 8
+	}
+	if oldAvr3 > 0xb0 || d.avrPlc >= 0x2a00 && oldAvr2 < 0x40 {
+		d.maxDist3 = 0x7f00
+	} else {
+		d.maxDist3 = 0x2001
+	}
+	d.insertOldDist(dist)
+	d.lastLength, d.lastDist = length, dist
+	d.copyString(dist, length)
+}
+
+// longLengthCode returns the code of long match lengths, which gets shorter for long lengths as their
+// average grows. Small averages use no table (ok false): a length up to 7 is coded in unary, 8 bits
+// after 8 zero bits otherwise.
+func (d *rar15) longLengthCode() (c rar15Code, ok bool) {
+	switch {
+	case d.avrLn2 >= 122:
+		return rar15L2, true
+	case d.avrLn2 >= 64:
+		return rar15L1, true
+	}
+	return rar15Code{}, false
+}
+
+// distPlaceCode returns the code of places in the order of long distances, chosen by their average.
+func (d *rar15) distPlaceCode() rar15Code {
+	switch {
+	case d.avrPlcB > 0x28ff:
+		return rar15Hf2
+	case d.avrPlcB > 0x6ff:
+		return rar15Hf1
+	}
+	return rar15Hf0
+}
+
+// byteCode returns the code of places in the order of literals, chosen by their average.
+func (d *rar15) byteCode() rar15Code {
+	switch {
+	case d.avrPlc > 0x75ff:
+		return rar15Hf4
+	case d.avrPlc > 0x5dff:
+		return rar15Hf3
+	case d.avrPlc > 0x35ff:
+		return rar15Hf2
+	case d.avrPlc > 0x0dff:
+		return rar15Hf1
+	}
+	return rar15Hf0
+}
+
+// huffDecode decodes a literal from an adaptive order of the byte values. In the Huffman only mode,
+// entered after a run of literals, place 0 escapes to leave the mode or to a short match.
+func (d *rar15) huffDecode() {
+	bitField := uint32(d.br.peek(16))
+	place := int(d.decodeNum(bitField, d.byteCode()))
+	place &= 0xff
+	if d.stMode {
+		if place == 0 && bitField > 0xfff {
+			place = 0x100
+		}
+		if place--; place == -1 {
+			bitField = uint32(d.br.peek(16))
+			d.br.skip(1)
+			if bitField&0x8000 != 0 {
+				d.numHuf, d.stMode = 0, false
+				return
+			}
+			length := 3
+			if bitField&0x4000 != 0 {
+				length = 4
+			}
+			d.br.skip(1)
+			dist := d.decodeNum(uint32(d.br.peek(16)), rar15Hf2)
+			dist = dist<<5 | uint32(d.br.peek(16))>>11
+			d.br.skip(5)
+			d.copyString(dist, length)
+			return
+		}
+	} else {
+		if d.numHuf >= 16 && d.flagsCnt == 0 {
+			d.stMode = true
+		}
+		d.numHuf++
+	}
+	d.avrPlc += place
+	d.avrPlc -= d.avrPlc >> 8
+	if d.nhfb += 16; d.nhfb > 0xff {
+		d.nhfb = 0x90
+		d.nlzb >>= 1
+	}
+	d.w.putByte(byte(d.chSet[place] >> 8))
+
+	var cur uint32
+	var newPlace byte
+	for {
+		cur = uint32(d.chSet[place])
+		newPlace = d.nToPl[cur&0xff]
+		d.nToPl[cur&0xff]++
+		if cur++; cur&0xff <= 0xa1 {
+			break
+		}
+		corrHuff(&d.chSet, &d.nToPl)
+	}
+	d.chSet[place] = d.chSet[newPlace]
+	d.chSet[newPlace] = uint16(cur)
+}
+
+// getFlagsBuf decodes the next flag byte from its adaptive order.
+func (d *rar15) getFlagsBuf() {
+	place := d.decodeNum(uint32(d.br.peek(16)), rar15Hf2)
+	if place >= uint32(len(d.chSetC)) { // only on corrupt data
+		return
+	}
+	var flags uint32
+	var newPlace byte
+	for {
+		flags = uint32(d.chSetC[place])
+		d.flagBuf = int(flags >> 8)
+		newPlace = d.nToPlC[flags&0xff]
+		d.nToPlC[flags&0xff]++
+		if flags++; flags&0xff != 0 {
+			break
+		}
+		corrHuff(&d.chSetC, &d.nToPlC)
+	}
+	d.chSetC[place] = d.chSetC[newPlace]
+	d.chSetC[newPlace] = uint16(flags)
+}
+
+func (d *rar15) initHuff() {
+	for i := range d.chSet {
+		d.chSet[i] = uint16(i) << 8
+		d.chSetB[i] = uint16(i) << 8
+		d.chSetA[i] = uint16(i)
+		d.chSetC[i] = uint16(-i&0xff) << 8
+	}
+	d.nToPl, d.nToPlB, d.nToPlC = [256]byte{}, [256]byte{}, [256]byte{}
+	corrHuff(&d.chSetB, &d.nToPlB)
+}
+
+// corrHuff resets the use counts of an adaptive order once one overflows: the counts restart from the
+// rank of each group of 32 places.
+func corrHuff(set *[256]uint16, toPlace *[256]byte) {
+	for i := range set {
+		set[i] = set[i]&^0xff | uint16(7-i/32)
+	}
+	*toPlace = [256]byte{}
+	for i := 0; i < 7; i++ {
+		toPlace[i] = byte((7 - i) * 32)
+	}
+}
@@ -0,0 +1,349 @@
+package unpack
+
+import (
+	"fmt"
+	"io"
+)
+
+// Sizes of the RAR 2.0 code tables: main (literals, repeats, short distances, new tables, match
+// lengths), distance, repeat lengths, precode and the per channel tables of audio blocks.
+const (
+	rar20NC = 298
+	rar20DC = 48
+	rar20RC = 28
+	rar20BC = 19
+	rar20MC = 257
+
+	rar20MaxCopy = 0x104 // longest match: 255+5 bytes
+)
+
+// audioVars is the predictor state of one channel of RAR 2.0 audio blocks.
+type audioVars struct {
+	k1, k2, k3, k4, k5 int32 // weights
+	d1, d2, d3, d4     int32 // last deltas
+	lastDelta          int32
+	dif                [11]uint32 // errors of the weight candidates
+	byteCount          uint32
+	lastChar           int32
+}
+
+// rar20 decodes the RAR 2.0 format (UNP_VER 20 and 26): LZ blocks of Huffman coded symbols and
+// multimedia (audio) blocks, where each byte of up to 4 interleaved channels is coded as its difference
+// to a prediction. A file ends with its unpacked size.
+type rar20 struct {
+	br   bitReader
+	w    window
+	dict int64
+
+	ld, dd, rd huffman
+	md         [4]huffman
+	oldTable   [rar20MC * 4]byte // lengths of the last tables, the base of the next ones
+	tables     bool              // tables are read, or a solid file continues with them
+	begin      bool              // a new file starts
+
+	audio        bool
+	channels     int
+	curChannel   int
+	channelDelta int32
+	aud          [4]audioVars
+
+	oldDist    [4]int64
+	oldDistPtr int
+	lastDist   int64
+	lastLength int
+
+	eof bool
+	err error
+}
+
+// NewRar20 returns a decoder of RAR 2.0 compressed data with the dictionary size of its file header.
+// total bounds the bytes the decoder will produce across all the files it decodes; pass -1 when unknown.
+func NewRar20(dict, total int64) Decoder {
+	return &rar20{dict: windowSize(dict, total)}
+}
+
+func (d *rar20) Init(r io.Reader, size int64, solid bool) {
+	d.br.reset(byteReader(r))
+	d.w.init(d.dict, size, solid)
+	if !solid {
+		d.tables, d.audio = false, false
+		d.channels, d.curChannel, d.channelDelta = 1, 0, 0
+		d.aud = [4]audioVars{}
+		d.oldTable = [rar20MC * 4]byte{}
+		d.oldDist, d.oldDistPtr, d.lastDist, d.lastLength = [4]int64{}, 0, 0, 0
+	}
+	d.begin, d.eof, d.err = true, size == 0, nil
+}
+
+func (d *rar20) Read(p []byte) (int, error) {
+	for !d.w.buffered() {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.eof {
+			return 0, io.EOF
+		}
+		d.err = d.decode(d.w.pos + max(int64(len(d.w.buf))/4, rar20MaxCopy))
+		d.w.flush()
+	}
+	return d.w.read(p), nil
+}
+
+// decode decodes symbols until the window position reaches limit or the file is complete.
+func (d *rar20) decode(limit int64) error {
+	if d.begin {
+		d.begin = false
+		if !d.tables {
+			if err := d.readTables(); err != nil {
+				return err
+			}
+		}
+	}
+	for d.w.pos < limit {
+		if d.w.decoded() >= d.w.size {
+			d.eof = true
+			d.readLastTables()
+			return nil
+		}
+		if err := d.br.err(); err != nil {
+			return err
+		}
+		if d.w.full(rar20MaxCopy) {
+			d.w.flush()
+		}
+		if d.audio {
+			sym := d.md[d.curChannel].decode(&d.br)
+			if sym == 256 {
+				if err := d.readTables(); err != nil {
+					return err
+				}
+				continue
+			}
+			d.w.putByte(d.decodeAudio(int32(sym)))
+			if d.curChannel++; d.curChannel == d.channels {
+				d.curChannel = 0
+			}
+			continue
+		}
+		sym := d.ld.decode(&d.br)
+		switch {
+		case sym < 256:
+			d.w.putByte(byte(sym))
+		case sym >= 270:
+			sym -= 270
+			length := int(rar3LengthBase[sym]) + 3 + int(d.br.bits(uint(rar3LengthBits[sym])))
+			slot := d.dd.decode(&d.br)
+			dist := rar3DistBase[slot] + 1 + int64(d.br.bits(uint(rar3DistBits[slot])))
+			if dist >= 0x2000 {
+				length++
+				if dist >= 0x40000 {
+					length++
+				}
+			}
+			d.copyString(length, dist)
+		case sym == 269:
+			if err := d.readTables(); err != nil {
+				return err
+			}
+		case sym == 256:
+			d.copyString(d.lastLength, d.lastDist)
+		case sym < 261: // one of the last four distances
+			dist := d.oldDist[(d.oldDistPtr-(sym-256))&3]
+			slot := d.rd.decode(&d.br)
+			length := int(rar3LengthBase[slot]) + 2 + int(d.br.bits(uint(rar3LengthBits[slot])))
+			if dist >= 0x101 {
+				length++
+				if dist >= 0x2000 {
+					length++
+					if dist >= 0x40000 {
+						length++
+					}
+				}
+			}
+			d.copyString(length, dist)
+		default: // 261..268: two bytes from a short distance
+			sym -= 261
+			dist := int64(rar3ShortBase[sym]) + 1 + int64(d.br.bits(uint(rar3ShortBits[sym])))
+			d.copyString(2, dist)
+		}
+	}
+	return nil
+}
+
+func (d *rar20) copyString(length int, dist int64) {
+	d.oldDist[d.oldDistPtr&3] = dist
+	d.oldDistPtr++
+	d.lastDist, d.lastLength = dist, length
+	d.w.copyMatch(length, dist)
+}
+
+// readTables reads the header of a block: the audio flag, whether the lengths are differences to the
+// previous tables, the channel count of audio blocks, then the code lengths. Lengths are coded with a
+// precode of 19 lengths of 4 bits: 16 repeats the previous length, 17 and 18 write zeros.
+func (d *rar20) readTables() error {
+	bitField := d.br.peek(16)
+	d.audio = bitField&0x8000 != 0
+	if bitField&0x4000 == 0 {
+		d.oldTable = [rar20MC * 4]byte{}
+	}
+	d.br.skip(2)
+	size := rar20NC + rar20DC + rar20RC
+	if d.audio {
+		d.channels = int(bitField>>12&3) + 1
+		if d.curChannel >= d.channels {
+			d.curChannel = 0
+		}
+		d.br.skip(2)
+		size = rar20MC * d.channels
+	}
+	var pre [rar20BC]byte
+	for i := range pre {
+		pre[i] = byte(d.br.bits(4))
+	}
+	var bd huffman
+	bd.init(pre[:])
+	var lengths [rar20MC * 4]byte
+	for i := 0; i < size; {
+		sym := bd.decode(&d.br)
+		switch {
+		case sym < 16:
+			lengths[i] = (byte(sym) + d.oldTable[i]) & 15
+			i++
+		case sym == 16:
+			if i == 0 {
+				return fmt.Errorf("%w: repeated code length without a previous one", ErrCorrupt)
+			}
+			for n := 3 + int(d.br.bits(2)); n > 0 && i < size; n-- {
+				lengths[i] = lengths[i-1]
+				i++
+			}
+		default:
+			var n int
+			if sym == 17 {
+				n = 3 + int(d.br.bits(3))
+			} else {
+				n = 11 + int(d.br.bits(7))
+			}
+			for ; n > 0 && i < size; n-- {
+				lengths[i] = 0
+				i++
+			}
+		}
+	}
+	if err := d.br.err(); err != nil {
+		return err
+	}
+	d.tables = true
+	if d.audio {
+		for i := range d.channels {
+			d.md[i].init(lengths[i*rar20MC : (i+1)*rar20MC])
+		}
+	} else {
+		d.ld.init(lengths[:rar20NC])
+		d.dd.init(lengths[rar20NC : rar20NC+rar20DC])
+		d.rd.init(lengths[rar20NC+rar20DC : size])
+	}
+	copy(d.oldTable[:], lengths[:size])
+	return nil
+}
+
+// readLastTables reads the tables a solid stream may store after the last symbol of a file, as unrar
+// does when at least 5 bytes of packed data remain.
+func (d *rar20) readLastTables() {
+	if !d.br.more(5) {
+		return
+	}
+	if d.audio {
+		if d.md[d.curChannel].decode(&d.br) == 256 {
+			d.readTables()
+		}
+	} else if d.ld.decode(&d.br) == 269 {
+		d.readTables()
+	}
+}
+
+// decodeAudio returns the byte delta codes in the current channel: the difference to a prediction from
+// the last deltas of the channel and the last delta of any channel. Every 32 bytes the weight whose
+// change would have given the smallest errors is adjusted.
+func (d *rar20) decodeAudio(delta int32) byte {
+	v := &d.aud[d.curChannel]
+	v.byteCount++
+	v.d4 = v.d3
+	v.d3 = v.d2
+	v.d2 = v.lastDelta - v.d1
+	v.d1 = v.lastDelta
+	pch := 8*v.lastChar + v.k1*v.d1 + v.k2*v.d2 + v.k3*v.d3 + v.k4*v.d4 + v.k5*d.channelDelta
+	pch = pch >> 3 & 0xff
+	ch := pch - delta
+
+	dd := int32(int8(delta)) * 8
+	v.dif[0] += abs32(dd)
+	v.dif[1] += abs32(dd - v.d1)
+	v.dif[2] += abs32(dd + v.d1)
+	v.dif[3] += abs32(dd - v.d2)
+	v.dif[4] += abs32(dd + v.d2)
+	v.dif[5] += abs32(dd - v.d3)
+	v.dif[6] += abs32(dd + v.d3)
+	v.dif[7] += abs32(dd - v.d4)
+	v.dif[8] += abs32(dd + v.d4)
+	v.dif[9] += abs32(dd - d.channelDelta)
+	v.dif[10] += abs32(dd + d.channelDelta)
+
+	v.lastDelta = int32(int8(ch - v.lastChar))
+	d.channelDelta = v.lastDelta
+	v.lastChar = ch
+
+	if v.byteCount&0x1f != 0 {
+		return byte(ch)
+	}
+	best := 0
+	for i := 1; i < len(v.dif); i++ {
+		if v.dif[i] < v.dif[best] {
+			best = i
+		}
+	}
+	v.dif = [11]uint32{}
+	switch best {
+	case 1:
+		if v.k1 >= -16 {
+			v.k1--
+		}
+	case 2:
+		if v.k1 < 16 {
+			v.k1++
+		}
+	case 3:
+		if v.k2 >= -16 {
+			v.k2--
+		}
+	case 4:
+		if v.k2 < 16 {
+			v.k2++
+		}
+	case 5:
+		if v.k3 >= -16 {
+			v.k3--
+		}
+	case 6:
+		if v.k3 < 16 {
+			v.k3++
+		}
+	case 7:
+		if v.k4 >= -16 {
+			v.k4--
+		}
+	case 8:
+		if v.k4 < 16 {
+			v.k4++
+		}
+	case 9:
+		if v.k5 >= -16 {
+			v.k5--
+		}
+	case 10:
+		if v.k5 < 16 {
+			v.k5++
+		}
+	}
+	return byte(ch)
+}
@@ -0,0 +1,476 @@
+package unpack
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Sizes of the RAR 2.9 code tables: main (literals, end of block, filter, repeats, short distances,
+// match lengths), distance, low distance bits and repeat lengths.
+const (
+	rar3NC  = 299
+	rar3DC  = 60
+	rar3LDC = 17
+	rar3RC  = 28
+
+	rar3TableSize = rar3NC + rar3DC + rar3LDC + rar3RC
+	rar3MaxCopy   = 0x120 // longest copy: 255+32 bytes in a PPMd block
+)
+
+var (
+	rar3LengthBase = [28]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 10, 12, 14, 16, 20, 24, 28, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224}
+	rar3LengthBits = [28]byte{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5}
+	rar3ShortBase  = [8]byte{0, 4, 8, 16, 32, 64, 128, 192}
+	rar3ShortBits  = [8]byte{2, 2, 3, 4, 5, 6, 6, 6}
+
+	rar3DistBase, rar3DistBits = rar3DistTables()
+)
+
+// rar3DistTables builds the base and extra bits of the distance slots: 4 slots without extra bits,
+// two for each count of 1 to 15 bits, then 14 slots of 16 and 12 of 18 bits.
+func rar3DistTables() (base [rar3DC]int64, bits [rar3DC]byte) {
+	counts := [...]int{4, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 14, 0, 12}
+	var dist int64
+	slot := 0
+	for n, c := range counts {
+		for ; c > 0; c-- {
+			base[slot], bits[slot] = dist, byte(n)
+			dist += 1 << n
+			slot++
+		}
+	}
+	return base, bits
+}
+
+// vmParent is a filter program defined in the stream, invoked again by its number.
+type vmParent struct {
+	typ    int    // standard filter of the code
+	length uint32 // block length of the last invocation
+}
+
+// rar3 decodes the RAR 2.9-4.x format (UNP_VER 29): LZ blocks of Huffman coded symbols and PPMd blocks,
+// with RarVM filters over the output.
+type rar3 struct {
+	br   bitReader
+	w    window
+	dict int64
+
+	ld, dd, ldd, rd huffman
+	oldTable        [rar3TableSize]byte // lengths of the last tables, the base of the next ones
+	tables          bool                // tables are read, or a solid file continues with them
+	begin           bool                // a new file starts
+	ppmBlock        bool
+	ppm             *ppmModel
+	ppmEsc          int
+
+	oldDist    [4]int64
+	lastLen    int
+	lowDist    int64 // low distance bits of the last long distance
+	lowDistRep int   // times lowDist repeats
+
+	progs      []vmParent
+	lastFilter int
+
+	eof bool
+	err error
+}
+
+// NewRar3 returns a decoder of RAR 2.9-4.x compressed data with the dictionary size of its file header.
+// total bounds the bytes the decoder will produce across all the files it decodes; pass -1 when unknown.
+func NewRar3(dict, total int64) Decoder {
+	return &rar3{dict: windowSize(dict, total)}
+}
+
+func (d *rar3) Init(r io.Reader, size int64, solid bool) {
+	d.br.reset(byteReader(r))
+	d.w.init(d.dict, size, solid)
+	d.w.chain = true
+	if !solid {
+		d.tables, d.ppmBlock, d.ppmEsc = false, false, 2
+		d.oldTable = [rar3TableSize]byte{}
+		d.oldDist, d.lastLen = [4]int64{}, 0
+		d.progs, d.lastFilter = d.progs[:0], 0
+	}
+	d.begin, d.eof, d.err = true, false, nil
+}
+
+func (d *rar3) Read(p []byte) (int, error) {
+	for !d.w.buffered() {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.eof {
+			return 0, io.EOF
+		}
+		d.err = d.decode(d.w.pos + max(int64(len(d.w.buf))/4, rar3MaxCopy))
+		if d.err != nil && d.br.err() != nil && d.w.decoded() >= d.w.size {
+			// the file is complete: the stream of the last file may end without an end marker
+			d.err, d.eof = nil, true
+		}
+		d.w.flush()
+		if d.err == nil && d.eof && d.w.written < d.w.size {
+			d.err = fmt.Errorf("%w: stream ends after %d of %d bytes", io.ErrUnexpectedEOF, d.w.written, d.w.size)
+		}
+	}
+	return d.w.read(p), nil
+}
+
+// decode decodes symbols until the window position reaches limit or the file ends.
+func (d *rar3) decode(limit int64) error {
+	if d.begin {
+		d.begin = false
+		if !d.tables {
+			if err := d.readTables(); err != nil {
+				return err
+			}
+		}
+	}
+	for d.w.pos < limit {
+		if d.w.decoded() > d.w.size {
+			d.eof = true
+			return nil
+		}
+		if err := d.br.err(); err != nil {
+			return err
+		}
+		if d.w.full(rar3MaxCopy) {
+			d.w.flush()
+			if d.w.full(rar3MaxCopy) {
+				return fmt.Errorf("%w: filter block exceeds the dictionary", ErrCorrupt)
+			}
+		}
+		if d.ppmBlock {
+			if err := d.decodePPM(); err != nil || d.eof {
+				return err
+			}
+			continue
+		}
+		sym := d.ld.decode(&d.br)
+		switch {
+		case sym < 256:
+			d.w.putByte(byte(sym))
+		case sym >= 271:
+			sym -= 271
+			length := int(rar3LengthBase[sym]) + 3 + int(d.br.bits(uint(rar3LengthBits[sym])))
+			dist := d.distance()
+			if dist >= 0x2000 {
+				length++
+				if dist >= 0x40000 {
+					length++
+				}
+			}
+			d.insertOldDist(dist)
+			d.lastLen = length
+			d.w.copyMatch(length, dist)
+		case sym == 256:
+			if d.br.bits(1) == 1 { // new tables follow
+				d.tables = false
+				if err := d.readTables(); err != nil {
+					return err
+				}
+				continue
+			}
+			// end of file; the next file of a solid stream starts with new tables if the bit is set
+			d.tables = d.br.bits(1) == 0
+			d.eof = true
+			return nil
+		case sym == 257:
+			if err := d.readVMCode(); err != nil {
+				return err
+			}
+		case sym == 258:
+			if d.lastLen != 0 {
+				d.w.copyMatch(d.lastLen, d.oldDist[0])
+			}
+		case sym < 263: // one of the last four distances
+			i := sym - 259
+			dist := d.oldDist[i]
+			copy(d.oldDist[1:i+1], d.oldDist[:i])
+			d.oldDist[0] = dist
+			slot := d.rd.decode(&d.br)
+			length := int(rar3LengthBase[slot]) + 2 + int(d.br.bits(uint(rar3LengthBits[slot])))
+			d.lastLen = length
+			d.w.copyMatch(length, dist)
+		default: // 263..270: two bytes from a short distance
+			sym -= 263
+			dist := int64(rar3ShortBase[sym]) + 1 + int64(d.br.bits(uint(rar3ShortBits[sym])))
+			d.insertOldDist(dist)
+			d.lastLen = 2
+			d.w.copyMatch(2, dist)
+		}
+	}
+	return nil
+}
+
+func (d *rar3) insertOldDist(dist int64) {
+	copy(d.oldDist[1:], d.oldDist[:3])
+	d.oldDist[0] = dist
+}
+
+// distance reads the distance of a match. The low 4 bits of long distances have their own table, whose
+// symbol 16 repeats the last low bits 16 times.
+func (d *rar3) distance() int64 {
+	slot := d.dd.decode(&d.br)
+	dist := rar3DistBase[slot] + 1
+	n := uint(rar3DistBits[slot])
+	switch {
+	case n == 0:
+	case slot <= 9:
+		dist += int64(d.br.bits(n))
+	default:
+		if n > 4 {
+			dist += int64(d.br.bits(n-4)) << 4
+		}
+		if d.lowDistRep > 0 {
+			d.lowDistRep--
+			dist += d.lowDist
+		} else if low := d.ldd.decode(&d.br); low == 16 {
+			d.lowDistRep = 15
+			dist += d.lowDist
+		} else {
+			dist += int64(low)
+			d.lowDist = int64(low)
+		}
+	}
+	return dist
+}
+
+// readTables reads the byte aligned start of a block: a PPMd block header, or the code tables of an LZ
+// block, coded as differences to the previous tables unless the keep bit is clear.
+func (d *rar3) readTables() error {
+	d.br.align()
+	if d.br.peek(1) == 1 {
+		return d.initPPM()
+	}
+	d.ppmBlock = false
+	d.lowDist, d.lowDistRep = 0, 0
+	if d.br.bits(2)&1 == 0 {
+		d.oldTable = [rar3TableSize]byte{}
+	}
+	var lengths [rar3TableSize]byte
+	if err := readCodeLengths(&d.br, lengths[:], d.oldTable[:]); err != nil {
+		return err
+	}
+	d.ld.init(lengths[:rar3NC])
+	d.dd.init(lengths[rar3NC : rar3NC+rar3DC])
+	d.ldd.init(lengths[rar3NC+rar3DC : rar3NC+rar3DC+rar3LDC])
+	d.rd.init(lengths[rar3NC+rar3DC+rar3LDC:])
+	d.oldTable = lengths
+	d.tables = true
+	return nil
+}
+
+// initPPM reads the header of a PPMd block: the model order and reset flag, the model memory in MiB
+// when the model restarts, and the escape symbol when it changes. Unlike LZ tables it does not carry
+// over to the next file of a solid stream, which starts with a new header.
+func (d *rar3) initPPM() error {
+	flags := int(d.br.bits(8))
+	reset := flags&0x20 != 0
+	mb := 0
+	if reset {
+		mb = int(d.br.bits(8)) + 1
+	} else if d.ppm == nil || d.ppm.heap == nil {
+		return fmt.Errorf("%w: PPMd block continues a missing model", ErrCorrupt)
+	}
+	if flags&0x40 != 0 {
+		d.ppmEsc = int(d.br.bits(8))
+	}
+	if d.ppm == nil {
+		d.ppm = new(ppmModel)
+	}
+	d.ppm.rc.init(&d.br)
+	if reset {
+		order := flags&0x1f + 1
+		if order > 16 {
+			order = 16 + (order-16)*3
+		}
+		if order == 1 {
+			return fmt.Errorf("%w: PPMd order 1", ErrCorrupt)
+		}
+		d.ppm.init(order, mb)
+	}
+	if err := d.br.err(); err != nil {
+		return err
+	}
+	d.ppmBlock = true
+	return nil
+}
+
+// decodePPM decodes a symbol of a PPMd block. The escape symbol introduces a command: new tables, end of
+// file, a filter, a match or the escape symbol itself.
+func (d *rar3) decodePPM() error {
+	ch := d.ppm.decodeChar()
+	if ch < 0 {
+		return fmt.Errorf("%w: bad PPMd data", ErrCorrupt)
+	}
+	if ch != d.ppmEsc {
+		d.w.putByte(byte(ch))
+		return nil
+	}
+	switch d.ppm.decodeChar() {
+	case -1:
+		return fmt.Errorf("%w: bad PPMd data", ErrCorrupt)
+	case 0:
+		return d.readTables()
+	case 2:
+		d.eof = true
+	case 3:
+		return d.readVMCodePPM()
+	case 4:
+		var v [4]int
+		for i := range v {
+			if v[i] = d.ppm.decodeChar(); v[i] < 0 {
+				return fmt.Errorf("%w: bad PPMd data", ErrCorrupt)
+			}
+		}
+		dist := int64(v[0])<<16 | int64(v[1])<<8 | int64(v[2])
+		d.w.copyMatch(v[3]+32, dist+2)
+	case 5:
+		length := d.ppm.decodeChar()
+		if length < 0 {
+			return fmt.Errorf("%w: bad PPMd data", ErrCorrupt)
+		}
+		d.w.copyMatch(length+4, 1)
+	default:
+		d.w.putByte(byte(ch))
+	}
+	return nil
+}
+
+// readVMCode reads a filter invocation from an LZ block: a flags byte, the length of the code and the
+// code.
+func (d *rar3) readVMCode() error {
+	first := byte(d.br.bits(8))
+	n := int(first&7) + 1
+	switch n {
+	case 7:
+		n = int(d.br.bits(8)) + 7
+	case 8:
+		n = int(d.br.bits(16))
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: empty filter", ErrCorrupt)
+	}
+	code := make([]byte, n)
+	for i := range code {
+		code[i] = byte(d.br.bits(8))
+	}
+	return d.addVMCode(first, code)
+}
+
+// readVMCodePPM reads a filter invocation from a PPMd block.
+func (d *rar3) readVMCodePPM() error {
+	var b [3]int
+	for i := range b {
+		if i == 1 && b[0]&7 < 6 || i == 2 && b[0]&7 < 7 {
+			break
+		}
+		if b[i] = d.ppm.decodeChar(); b[i] < 0 {
+			return fmt.Errorf("%w: bad PPMd data", ErrCorrupt)
+		}
+	}
+	n := b[0]&7 + 1
+	switch n {
+	case 7:
+		n = b[1] + 7
+	case 8:
+		n = b[1]<<8 | b[2]
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: empty filter", ErrCorrupt)
+	}
+	code := make([]byte, n)
+	for i := range code {
+		c := d.ppm.decodeChar()
+		if c < 0 {
+			return fmt.Errorf("%w: bad PPMd data", ErrCorrupt)
+		}
+		code[i] = byte(c)
+	}
+	return d.addVMCode(byte(b[0]), code)
+}
+
+// addVMCode queues a filter invocation. Its code starts with the number of the program (a new one
+// carries its RarVM code at the end), then the block start relative to the current position, the block
+// length unless the last one of the program is reused, and the initial registers set.
+func (d *rar3) addVMCode(first byte, code []byte) error {
+	var br bitReader
+	br.reset(bytes.NewReader(code))
+	pos := d.lastFilter
+	if first&0x80 != 0 {
+		if pos = int(vmData(&br)); pos == 0 {
+			d.progs = d.progs[:0]
+			d.w.filters = d.w.filters[:0]
+		} else {
+			pos--
+		}
+	}
+	if pos > len(d.progs) || pos > maxFilters {
+		return fmt.Errorf("%w: bad filter number", ErrCorrupt)
+	}
+	d.lastFilter = pos
+	newProg := pos == len(d.progs)
+	if newProg {
+		d.progs = append(d.progs, vmParent{})
+	}
+	prog := &d.progs[pos]
+	start := int64(vmData(&br))
+	if first&0x40 != 0 {
+		start += 258
+	}
+	if first&0x20 != 0 {
+		prog.length = vmData(&br)
+	}
+	var r [7]uint32
+	r[4] = prog.length
+	if first&0x10 != 0 {
+		mask := br.bits(7)
+		for i := range r {
+			if mask&(1<<i) != 0 {
+				r[i] = vmData(&br)
+			}
+		}
+	}
+	if newProg {
+		n := int(vmData(&br))
+		if n >= 0x10000 || n == 0 || int(br.pos/8)+n > len(code) {
+			return fmt.Errorf("%w: bad filter code size", ErrCorrupt)
+		}
+		vm := make([]byte, n)
+		for i := range vm {
+			vm[i] = byte(br.bits(8))
+		}
+		if prog.typ = vmProgram(vm); prog.typ == vmNone {
+			return fmt.Errorf("%w: RarVM filter is not a standard filter", ErrCorrupt)
+		}
+	}
+	if prog.length > vmMemSize {
+		return fmt.Errorf("%w: filter block of %d bytes", ErrCorrupt, prog.length)
+	}
+	return d.w.addFilter(start, int64(prog.length), vmFilter(prog.typ, r))
+}
+
+// vmData reads a number of a filter invocation: 4 bits, 8 bits (or a negative 8 bit number), 16 or
+// 32 bits, selected by a 2 bit prefix.
+func vmData(br *bitReader) uint32 {
+	v := uint32(br.peek(16))
+	switch v & 0xc000 {
+	case 0:
+		br.skip(6)
+		return v >> 10 & 0xf
+	case 0x4000:
+		if v&0x3c00 == 0 {
+			br.skip(14)
+			return 0xffffff00 | v>>2&0xff
+		}
+		br.skip(10)
+		return v >> 6 & 0xff
+	case 0x8000:
+		br.skip(2)
+		return uint32(br.bits(16))
+	default:
+		br.skip(2)
+		return uint32(br.bits(32))
+	}
+}
@@ -0,0 +1,252 @@
+package unpack
+
+import (
+	"fmt"
+	"io"
+)
+
+// Sizes of the RAR5 code tables: main (literals, filter, repeats, match lengths), distance (RAR 5.0 and
+// RAR 7.0 with its longer distances), low distance bits, repeat lengths and the precode.
+const (
+	rar5NC  = 306
+	rar5DC  = 64
+	rar5DCX = 80
+	rar5LDC = 16
+	rar5RC  = 44
+	rar5BC  = 20
+
+	rar5MaxMatch       = 0x1004   // longest match, extra length included
+	rar5MaxFilterBlock = 0x400000 // longer filter blocks are ignored
+)
+
+// RAR5 filter types.
+const (
+	rar5FilterDelta = iota
+	rar5FilterE8
+	rar5FilterE8E9
+	rar5FilterARM
+)
+
+// rar5 decodes the RAR 5.0 and 7.0 LZ format: blocks of Huffman coded literals, matches and filters.
+type rar5 struct {
+	br       bitReader
+	w        window
+	dict     int64
+	dc       int // distance codes: rar5DC, or rar5DCX for RAR 7.0
+	ld       huffman
+	dd       huffman
+	ldd      huffman
+	rd       huffman
+	tables   bool  // code tables were read
+	blockEnd int64 // bit position where the current block ends
+	last     bool  // the current block is the last one of the file
+	oldDist  [4]int64
+	lastLen  int
+	eof      bool
+	err      error
+}
+
+// NewRar5 returns a decoder of RAR5 compressed data (algorithm version 0, or 1 for RAR 7.0) with the
+// dictionary size of its file header. total bounds the bytes the decoder will produce across all the
+// files it decodes, so small files do not allocate the whole dictionary; pass -1 when unknown.
+func NewRar5(version uint8, dict, total int64) (Decoder, error) {
+	d := &rar5{dict: windowSize(dict, total), dc: rar5DC}
+	switch version {
+	case 0:
+	case 1:
+		d.dc = rar5DCX
+	default:
+		return nil, fmt.Errorf("unknown RAR5 algorithm version %d", version)
+	}
+	return d, nil
+}
+
+func (d *rar5) Init(r io.Reader, size int64, solid bool) {
+	d.br.reset(byteReader(r))
+	d.w.init(d.dict, size, solid)
+	if !solid {
+		d.oldDist, d.lastLen, d.tables = [4]int64{}, 0, false
+	}
+	d.blockEnd, d.last, d.eof, d.err = 0, false, size == 0, nil
+}
+
+func (d *rar5) Read(p []byte) (int, error) {
+	for !d.w.buffered() {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.eof {
+			return 0, io.EOF
+		}
+		d.err = d.decode(d.w.pos + max(int64(len(d.w.buf))/4, rar5MaxMatch))
+		d.w.flush()
+		if d.err == nil && d.eof && d.w.written < d.w.size {
+			d.err = fmt.Errorf("%w: stream ends after %d of %d bytes", io.ErrUnexpectedEOF, d.w.written, d.w.size)
+		}
+	}
+	return d.w.read(p), nil
+}
+
+// decode decodes symbols until the window position reaches limit or the file ends.
+func (d *rar5) decode(limit int64) error {
+	for d.w.pos < limit {
+		if d.w.decoded() >= d.w.size {
+			d.eof = true
+			return nil
+		}
+		if d.br.pos >= d.blockEnd {
+			if d.last {
+				d.eof = true
+				return nil
+			}
+			if err := d.readBlockHeader(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.br.err(); err != nil {
+			return err
+		}
+		if d.w.full(rar5MaxMatch) {
+			d.w.flush()
+			if d.w.full(rar5MaxMatch) {
+				return fmt.Errorf("%w: filter block exceeds the dictionary", ErrCorrupt)
+			}
+		}
+		sym := d.ld.decode(&d.br)
+		switch {
+		case sym < 256:
+			d.w.putByte(byte(sym))
+		case sym >= 262:
+			length := d.slotToLength(sym - 262)
+			dist := d.distance()
+			if dist > 0x100 {
+				length++
+				if dist > 0x2000 {
+					length++
+					if dist > 0x40000 {
+						length++
+					}
+				}
+			}
+			copy(d.oldDist[1:], d.oldDist[:3])
+			d.oldDist[0], d.lastLen = dist, length
+			d.w.copyMatch(length, dist)
+		case sym == 256:
+			if err := d.readFilter(); err != nil {
+				return err
+			}
+		case sym == 257:
+			if d.lastLen != 0 {
+				d.w.copyMatch(d.lastLen, d.oldDist[0])
+			}
+		default: // 258..261: one of the last four distances
+			i := sym - 258
+			dist := d.oldDist[i]
+			copy(d.oldDist[1:i+1], d.oldDist[:i])
+			d.oldDist[0] = dist
+			length := d.slotToLength(d.rd.decode(&d.br))
+			d.lastLen = length
+			d.w.copyMatch(length, dist)
+		}
+	}
+	return nil
+}
+
+func (d *rar5) slotToLength(slot int) int {
+	if slot < 8 {
+		return 2 + slot
+	}
+	n := uint(slot/4 - 1)
+	return 2 + (4|slot&3)<<n + int(d.br.bits(n))
+}
+
+func (d *rar5) distance() int64 {
+	slot := d.dd.decode(&d.br)
+	if slot < 4 {
+		return 1 + int64(slot)
+	}
+	n := uint(slot/2 - 1)
+	dist := 1 + int64(2|slot&1)<<n
+	if n < 4 {
+		return dist + int64(d.br.bits(n))
+	}
+	if n > 4 {
+		dist += int64(d.br.bits(n-4)) << 4
+	}
+	return dist + int64(d.ldd.decode(&d.br))
+}
+
+func (d *rar5) readFilter() error {
+	start := d.filterData()
+	length := d.filterData()
+	var run func([]byte, int64) []byte
+	switch typ := d.br.bits(3); typ {
+	case rar5FilterDelta:
+		run = deltaFilter(int(d.br.bits(5)) + 1)
+	case rar5FilterE8, rar5FilterE8E9:
+		run = e8Filter(typ == rar5FilterE8E9, true)
+	case rar5FilterARM:
+		run = armFilter
+	default:
+		return fmt.Errorf("%w: unknown filter type %d", ErrCorrupt, typ)
+	}
+	if length == 0 || length > rar5MaxFilterBlock {
+		return nil
+	}
+	return d.w.addFilter(start, length, run)
+}
+
+func (d *rar5) filterData() int64 {
+	n := int(d.br.bits(2)) + 1
+	var v int64
+	for i := 0; i < n; i++ {
+		v |= int64(d.br.bits(8)) << (8 * i)
+	}
+	return v
+}
+
+// readBlockHeader reads the byte aligned header of the next block (flags, checksum and size) and its
+// code tables when present.
+func (d *rar5) readBlockHeader() error {
+	d.br.align()
+	flags := byte(d.br.bits(8))
+	sum := byte(d.br.bits(8))
+	n := int(flags>>3&3) + 1
+	if n == 4 {
+		return fmt.Errorf("%w: bad block header", ErrCorrupt)
+	}
+	var size int64
+	for i := 0; i < n; i++ {
+		size |= int64(d.br.bits(8)) << (8 * i)
+	}
+	if err := d.br.err(); err != nil {
+		return err
+	}
+	if sum != 0x5a^flags^byte(size)^byte(size>>8)^byte(size>>16) {
+		return fmt.Errorf("%w: block header checksum mismatch", ErrCorrupt)
+	}
+	d.blockEnd = d.br.pos + (size-1)*8 + int64(flags&7) + 1
+	d.last = flags&0x40 != 0
+	if flags&0x80 != 0 {
+		return d.readTables()
+	}
+	if !d.tables {
+		return fmt.Errorf("%w: block without code tables", ErrCorrupt)
+	}
+	return nil
+}
+
+// readTables reads the lengths of all code tables.
+func (d *rar5) readTables() error {
+	lengths := make([]byte, rar5NC+d.dc+rar5LDC+rar5RC)
+	if err := readCodeLengths(&d.br, lengths, nil); err != nil {
+		return err
+	}
+	d.ld.init(lengths[:rar5NC])
+	d.dd.init(lengths[rar5NC : rar5NC+d.dc])
+	d.ldd.init(lengths[rar5NC+d.dc : rar5NC+d.dc+rar5LDC])
+	d.rd.init(lengths[rar5NC+d.dc+rar5LDC:])
+	d.tables = true
+	return nil
+}
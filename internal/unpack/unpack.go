@@ -0,0 +1,47 @@
+// Package unpack implements the RAR decompression algorithms. Each decoder reads the packed stream of
+// one file at a time and keeps its dictionary between files, as solid archives require.
+package unpack
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// ErrCorrupt is returned when the packed data cannot be decoded.
+var ErrCorrupt = errors.New("corrupt compressed data")
+
+// Decoder unpacks the packed streams of consecutive files. A solid file continues with the dictionary,
+// tables and filters state left by the previous file, so the files of a solid group must be decoded in
+// archive order and each one read to its end.
+type Decoder interface {
+	// Init starts decoding a file of size unpacked bytes whose packed data is read from r.
+	Init(r io.Reader, size int64, solid bool)
+	// Read returns the unpacked data; io.EOF follows the last of the size bytes.
+	io.Reader
+}
+
+// minWindow is the smallest dictionary buffer allocated.
+const minWindow = 0x40000
+
+// windowSize returns the dictionary buffer size for a declared dictionary size and the number of bytes
+// the stream produces: a power of two covering the dictionary, or just the output when it is smaller,
+// since no match can reach further back than the start of the stream.
+func windowSize(dict, total int64) int64 {
+	need := dict
+	if total >= 0 && total < need {
+		need = total
+	}
+	n := int64(minWindow)
+	for n < need {
+		n <<= 1
+	}
+	return n
+}
+
+func byteReader(r io.Reader) io.ByteReader {
+	if br, ok := r.(io.ByteReader); ok {
+		return br
+	}
+	return bufio.NewReader(r)
+}
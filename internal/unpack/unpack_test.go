@@ -0,0 +1,1480 @@
+package unpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// bitWriter writes bits most significant first.
+type bitWriter struct {
+	buf []byte
+	n   int64 // bits written
+}
+
+func (w *bitWriter) write(v uint64, n uint) {
+	for i := int(n) - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if v>>uint(i)&1 != 0 {
+			w.buf[len(w.buf)-1] |= 0x80 >> (w.n % 8)
+		}
+		w.n++
+	}
+}
+
+// rar5Encoder writes RAR5 blocks using flat code tables: every main symbol takes 9 bits, every distance
+// and repeat length slot 6 bits and every low distance 4 bits, so symbols are written as plain numbers.
+type rar5Encoder struct {
+	out  bytes.Buffer
+	body bitWriter
+	data []byte // the decoded data the symbols produce (before filters)
+}
+
+func (e *rar5Encoder) literal(b ...byte) {
+	for _, c := range b {
+		e.body.write(uint64(c), 9)
+	}
+	e.data = append(e.data, b...)
+}
+
+// lengthSlot returns the slot, extra bits and their count coding a match length.
+func lengthSlot(length int) (slot int, extra uint64, n uint) {
+	l := length - 2
+	if l < 8 {
+		return l, 0, 0
+	}
+	for slot = 8; slot < rar5RC; slot++ {
+		n = uint(slot/4 - 1)
+		if base := (4 | slot&3) << n; l >= base && l < base+1<<n {
+			return slot, uint64(l - base), n
+		}
+	}
+	panic("length too long")
+}
+
+func (e *rar5Encoder) copyData(length int, dist int) {
+	for i := 0; i < length; i++ {
+		e.data = append(e.data, e.data[len(e.data)-dist])
+	}
+}
+
+func (e *rar5Encoder) match(length, dist int) {
+	enc := length
+	for _, lim := range []int{0x100, 0x2000, 0x40000} {
+		if dist > lim {
+			enc--
+		}
+	}
+	slot, extra, n := lengthSlot(enc)
+	e.body.write(uint64(262+slot), 9)
+	e.body.write(extra, n)
+	d := uint64(dist - 1)
+	if d < 4 {
+		e.body.write(d, 6)
+	} else {
+		for s := 4; s < rar5DC; s++ {
+			n := uint(s/2 - 1)
+			if base := uint64(2|s&1) << n; d >= base && d < base+1<<n {
+				e.body.write(uint64(s), 6)
+				if n < 4 {
+					e.body.write(d-base, n)
+				} else {
+					e.body.write((d-base)>>4, n-4)
+					e.body.write((d-base)&15, 4)
+				}
+				break
+			}
+		}
+	}
+	e.copyData(length, dist)
+}
+
+// repeat copies length bytes from the i-th most recent distance.
+func (e *rar5Encoder) repeat(i, length, dist int) {
+	e.body.write(uint64(258+i), 9)
+	slot, extra, n := lengthSlot(length)
+	e.body.write(uint64(slot), 6)
+	e.body.write(extra, n)
+	e.copyData(length, dist)
+}
+
+func (e *rar5Encoder) repeatLast(length, dist int) {
+	e.body.write(257, 9)
+	e.copyData(length, dist)
+}
+
+func writeFilterData(w *bitWriter, v int) {
+	w.write(3, 2)
+	for i := 0; i < 4; i++ {
+		w.write(uint64(v>>(8*i))&0xff, 8)
+	}
+}
+
+func (e *rar5Encoder) filter(start, length, typ, channels int) {
+	e.body.write(256, 9)
+	writeFilterData(&e.body, start)
+	writeFilterData(&e.body, length)
+	e.body.write(uint64(typ), 3)
+	if typ == rar5FilterDelta {
+		e.body.write(uint64(channels-1), 5)
+	}
+}
+
+// block closes the current block, preceded by the flat code tables when tables is set.
+func (e *rar5Encoder) block(tables, last bool) {
+	var b bitWriter
+	if tables {
+		for i := 0; i < rar5BC; i++ {
+			b.write(5, 4) // every precode symbol 5 bits long
+		}
+		for i := 0; i < rar5NC+rar5DC+rar5LDC+rar5RC; i++ {
+			l := 9
+			switch {
+			case i >= rar5NC+rar5DC+rar5LDC:
+				l = 6
+			case i >= rar5NC+rar5DC:
+				l = 4
+			case i >= rar5NC:
+				l = 6
+			}
+			b.write(uint64(l), 5)
+		}
+	}
+	for i := int64(0); i < e.body.n; i++ {
+		b.write(uint64(e.body.buf[i/8]>>(7-i%8)&1), 1)
+	}
+	e.body = bitWriter{}
+	size := len(b.buf)
+	flags := byte(b.n-int64(size-1)*8-1) | 2<<3
+	if last {
+		flags |= 0x40
+	}
+	if tables {
+		flags |= 0x80
+	}
+	e.out.WriteByte(flags)
+	e.out.WriteByte(0x5a ^ flags ^ byte(size) ^ byte(size>>8) ^ byte(size>>16))
+	e.out.Write([]byte{byte(size), byte(size >> 8), byte(size >> 16)})
+	e.out.Write(b.buf)
+}
+
+// readAll reads d in small uneven pieces.
+func readAll(d io.Reader) ([]byte, error) {
+	var out []byte
+	buf := make([]byte, 777)
+	for {
+		n, err := d.Read(buf)
+		out = append(out, buf[:n]...)
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return out, err
+		}
+	}
+}
+
+func TestHuffmanCanonical(t *testing.T) {
+	var h huffman
+	h.init([]byte{2, 1, 3, 3, 0}) // codes: 1 -> 0, 0 -> 10, 2 -> 110, 3 -> 111
+	var w bitWriter
+	for _, c := range []struct {
+		v uint64
+		n uint
+	}{{0, 1}, {2, 2}, {6, 3}, {7, 3}, {0, 1}} {
+		w.write(c.v, c.n)
+	}
+	var br bitReader
+	br.reset(bytes.NewReader(w.buf))
+	for i, want := range []int{1, 0, 2, 3, 1} {
+		if got := h.decode(&br); got != want {
+			t.Fatalf("symbol %d: got %d, want %d", i, got, want)
+		}
+	}
+	if br.pos != w.n || br.err() != nil {
+		t.Fatalf("consumed %d of %d bits: %v", br.pos, w.n, br.err())
+	}
+}
+
+func TestRar5LZ(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	noise := make([]byte, 0x50000)
+	rng.Read(noise)
+	var e rar5Encoder
+	e.literal([]byte("abcabc")...)
+	e.match(9, 3)          // overlapping copy
+	e.literal(noise...)    // push the start far back
+	e.match(40, 0x50000+5) // long distance, extra length for distances over 0x40000
+	e.match(300, 0x2001)
+	e.repeat(1, 7, 0x50000+5)
+	e.repeatLast(7, 0x50000+5)
+	e.block(true, false)
+	e.match(5, 17)
+	e.repeat(2, 33, 0x2001)
+	e.literal('z')
+	e.block(false, true) // reuses the tables of the first block
+
+	d, err := NewRar5(0, 1<<20, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Init(bytes.NewReader(e.out.Bytes()), int64(len(e.data)), false)
+	got, err := readAll(d)
+	if err != nil || !bytes.Equal(got, e.data) {
+		t.Fatalf("decoded %d bytes (want %d): %v", len(got), len(e.data), err)
+	}
+
+	// A stream ending early, and a damaged block header.
+	d.Init(bytes.NewReader(e.out.Bytes()[:len(e.out.Bytes())/2]), int64(len(e.data)), false)
+	if _, err := readAll(d); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated stream: %v", err)
+	}
+	bad := append([]byte{}, e.out.Bytes()...)
+	bad[1] ^= 1
+	d.Init(bytes.NewReader(bad), int64(len(e.data)), false)
+	if _, err := readAll(d); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("bad block checksum: %v", err)
+	}
+}
+
+func TestRar5Filters(t *testing.T) {
+	const offset = 0x10 // file offset of the filtered blocks
+	x86 := []byte{0x90, 0xe8, 0x00, 0x01, 0x00, 0x00, 0x90, 0xe9, 0xf0, 0xff, 0xff, 0xff, 0xe8, 1, 2}
+	// Encoder side of E8E9: relative operands become absolute ones.
+	e8 := append([]byte{}, x86...)
+	for _, i := range []int{2, 8} {
+		rel := binary.LittleEndian.Uint32(e8[i:])
+		binary.LittleEndian.PutUint32(e8[i:], rel+uint32(offset+i))
+	}
+	// Delta with 3 channels: each channel stored as the differences of its bytes.
+	rgb := []byte{10, 20, 30, 12, 21, 35, 11, 25, 30, 9}
+	var delta []byte
+	for ch := 0; ch < 3; ch++ {
+		var prev byte
+		for i := ch; i < len(rgb); i += 3 {
+			delta = append(delta, prev-rgb[i])
+			prev = rgb[i]
+		}
+	}
+	// ARM: BL word offsets made absolute.
+	arm := []byte{0x10, 0x00, 0x00, 0xeb, 1, 2, 3, 4, 0xff, 0xff, 0xff, 0xeb}
+	armEnc := append([]byte{}, arm...)
+	for _, i := range []int{0, 8} {
+		v := uint32(armEnc[i]) | uint32(armEnc[i+1])<<8 | uint32(armEnc[i+2])<<16
+		v += uint32(offset+len(x86)+len(rgb)+i) / 4
+		armEnc[i], armEnc[i+1], armEnc[i+2] = byte(v), byte(v>>8), byte(v>>16)
+	}
+
+	var e rar5Encoder
+	e.literal(make([]byte, offset)...)
+	e.filter(0, len(e8), rar5FilterE8E9, 0)
+	e.literal(e8...)
+	e.filter(0, len(delta), rar5FilterDelta, 3)
+	e.literal(delta...)
+	e.filter(0, len(armEnc), rar5FilterARM, 0)
+	e.literal(armEnc...)
+	e.literal(0xe8, 0, 0, 0, 0) // outside any filter
+	e.block(true, true)
+	want := bytes.Join([][]byte{make([]byte, offset), x86, rgb, arm, {0xe8, 0, 0, 0, 0}}, nil)
+
+	d, _ := NewRar5(0, 1<<17, -1)
+	d.Init(bytes.NewReader(e.out.Bytes()), int64(len(want)), false)
+	got, err := readAll(d)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("filtered output:\n got %x\nwant %x (%v)", got, want, err)
+	}
+}
+
+func TestRar5Solid(t *testing.T) {
+	var e1 rar5Encoder
+	e1.literal([]byte("solid stream, first file. ")...)
+	e1.match(6, 20)
+	e1.block(true, true)
+	var e2 rar5Encoder
+	e2.data = e1.data
+	e2.match(12, 32) // reaches into the first file
+	e2.repeatLast(12, 32)
+	e2.block(false, true) // tables of the first file
+	first, second := e1.data, e2.data[len(e1.data):]
+
+	d, _ := NewRar5(0, 1<<17, -1)
+	d.Init(bytes.NewReader(e1.out.Bytes()), int64(len(first)), false)
+	if got, err := readAll(d); err != nil || !bytes.Equal(got, first) {
+		t.Fatalf("first file: %q %v", got, err)
+	}
+	d.Init(bytes.NewReader(e2.out.Bytes()), int64(len(second)), true)
+	if got, err := readAll(d); err != nil || !bytes.Equal(got, second) {
+		t.Fatalf("solid file: %q %v", got, err)
+	}
+	// Without the solid state the tables are missing.
+	d.Init(bytes.NewReader(e2.out.Bytes()), int64(len(second)), false)
+	if _, err := readAll(d); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("non-solid decode of a solid file: %v", err)
+	}
+}
+
+func (w *bitWriter) align() {
+	for w.n%8 != 0 {
+		w.write(0, 1)
+	}
+}
+
+// rar3Encoder writes a RAR 2.9 stream using flat code tables: every main symbol takes 9 bits, every
+// distance slot 6 bits and every low distance and repeat length slot 5 bits.
+type rar3Encoder struct {
+	w       bitWriter
+	data    []byte
+	old     [rar3TableSize]byte
+	oldDist [4]int
+	lastLen int
+	lowDist int
+	lowRep  int
+}
+
+func rar3FlatLength(i int) byte {
+	switch {
+	case i < rar3NC:
+		return 9
+	case i < rar3NC+rar3DC:
+		return 6
+	}
+	return 5
+}
+
+// tables writes the flat tables, coded as differences to the previous ones when keep is set.
+func (e *rar3Encoder) tables(keep bool) {
+	e.w.align()
+	e.w.write(0, 1) // LZ block
+	if keep {
+		e.w.write(1, 1)
+	} else {
+		e.w.write(0, 1)
+		e.old = [rar3TableSize]byte{}
+	}
+	for i := 0; i < 20; i++ {
+		e.w.write(5, 4) // every precode symbol 5 bits long
+	}
+	for i := range e.old {
+		l := rar3FlatLength(i)
+		e.w.write(uint64((l-e.old[i])&15), 5)
+		e.old[i] = l
+	}
+	e.lowDist, e.lowRep = 0, 0
+}
+
+func (e *rar3Encoder) literal(b ...byte) {
+	for _, c := range b {
+		e.w.write(uint64(c), 9)
+	}
+	e.data = append(e.data, b...)
+}
+
+// rar3Slot returns the slot, extra bits and their count coding v.
+func rar3Slot(v int, base, bits []byte) (slot int, extra uint64, n uint) {
+	for s := range base {
+		if n = uint(bits[s]); v >= int(base[s]) && v < int(base[s])+1<<n {
+			return s, uint64(v - int(base[s])), n
+		}
+	}
+	panic("value out of range")
+}
+
+func (e *rar3Encoder) copyData(length, dist int) {
+	for i := 0; i < length; i++ {
+		e.data = append(e.data, e.data[len(e.data)-dist])
+	}
+}
+
+func (e *rar3Encoder) insertOldDist(dist int) {
+	copy(e.oldDist[1:], e.oldDist[:3])
+	e.oldDist[0] = dist
+}
+
+// match writes a match; long distances repeating the low bits of the previous one use the repeat
+// symbol, so the 15 long distances after it must end in the same low bits.
+func (e *rar3Encoder) match(length, dist int) {
+	enc := length
+	if dist >= 0x2000 {
+		enc--
+		if dist >= 0x40000 {
+			enc--
+		}
+	}
+	slot, extra, n := rar3Slot(enc-3, rar3LengthBase[:], rar3LengthBits[:])
+	e.w.write(uint64(271+slot), 9)
+	e.w.write(extra, n)
+	d := int64(dist - 1)
+	for s := 0; s < rar3DC; s++ {
+		base, n := rar3DistBase[s], uint(rar3DistBits[s])
+		if d < base || d >= base+1<<n {
+			continue
+		}
+		e.w.write(uint64(s), 6)
+		v := uint64(d - base)
+		if s <= 9 {
+			e.w.write(v, n)
+			break
+		}
+		if n > 4 {
+			e.w.write(v>>4, n-4)
+		}
+		switch low := int(v & 15); {
+		case e.lowRep > 0:
+			if e.lowRep--; low != e.lowDist {
+				panic("low distance bits differ from the repeated ones")
+			}
+		case low == e.lowDist:
+			e.w.write(16, 5)
+			e.lowRep = 15
+		default:
+			e.w.write(uint64(low), 5)
+			e.lowDist = low
+		}
+		break
+	}
+	e.insertOldDist(dist)
+	e.lastLen = length
+	e.copyData(length, dist)
+}
+
+// repeat copies length bytes from the i-th most recent distance.
+func (e *rar3Encoder) repeat(i, length int) {
+	dist := e.oldDist[i]
+	copy(e.oldDist[1:i+1], e.oldDist[:i])
+	e.oldDist[0] = dist
+	e.w.write(uint64(259+i), 9)
+	slot, extra, n := rar3Slot(length-2, rar3LengthBase[:], rar3LengthBits[:])
+	e.w.write(uint64(slot), 5)
+	e.w.write(extra, n)
+	e.lastLen = length
+	e.copyData(length, dist)
+}
+
+func (e *rar3Encoder) repeatLast() {
+	e.w.write(258, 9)
+	e.copyData(e.lastLen, e.oldDist[0])
+}
+
+// short copies two bytes from a distance up to 256.
+func (e *rar3Encoder) short(dist int) {
+	slot, extra, n := rar3Slot(dist-1, rar3ShortBase[:], rar3ShortBits[:])
+	e.w.write(uint64(263+slot), 9)
+	e.w.write(extra, n)
+	e.insertOldDist(dist)
+	e.lastLen = 2
+	e.copyData(2, dist)
+}
+
+// newTables ends the block, followed by new tables.
+func (e *rar3Encoder) newTables(keep bool) {
+	e.w.write(256, 9)
+	e.w.write(1, 1)
+	e.tables(keep)
+}
+
+// endFile ends the file; with newTables the next file of the solid stream starts with tables.
+func (e *rar3Encoder) endFile(newTables bool) {
+	e.w.write(256, 9)
+	e.w.write(0, 1)
+	if newTables {
+		e.w.write(1, 1)
+	} else {
+		e.w.write(0, 1)
+	}
+}
+
+func writeVMData(w *bitWriter, v uint32) {
+	switch {
+	case v < 16:
+		w.write(0, 2)
+		w.write(uint64(v), 4)
+	case v < 256:
+		w.write(1, 2)
+		w.write(uint64(v), 8)
+	case v < 1<<16:
+		w.write(2, 2)
+		w.write(uint64(v), 16)
+	default:
+		w.write(3, 2)
+		w.write(uint64(v), 32)
+	}
+}
+
+// vmCall is a filter invocation.
+type vmCall struct {
+	num    int      // program number + 1, 0 to start over with program 0, -1 for the last program
+	start  int      // block start past the current position
+	length int      // block length, -1 for the last length of the program
+	regs   []uint32 // initial r[0], r[1], ...
+	prog   []byte   // code of a new program
+}
+
+func (c vmCall) code() (first byte, code []byte) {
+	var w bitWriter
+	if c.num >= 0 {
+		first |= 0x80
+		writeVMData(&w, uint32(c.num))
+	}
+	writeVMData(&w, uint32(c.start))
+	if c.length >= 0 {
+		first |= 0x20
+		writeVMData(&w, uint32(c.length))
+	}
+	if len(c.regs) > 0 {
+		first |= 0x10
+		w.write(1<<len(c.regs)-1, 7)
+		for _, r := range c.regs {
+			writeVMData(&w, r)
+		}
+	}
+	if c.prog != nil {
+		writeVMData(&w, uint32(len(c.prog)))
+		for _, b := range c.prog {
+			w.write(uint64(b), 8)
+		}
+	}
+	return first, w.buf
+}
+
+func (e *rar3Encoder) filter(c vmCall) {
+	first, code := c.code()
+	e.w.write(257, 9)
+	switch n := len(code); {
+	case n <= 6:
+		e.w.write(uint64(first)|uint64(n-1), 8)
+	case n <= 262:
+		e.w.write(uint64(first)|6, 8)
+		e.w.write(uint64(n-7), 8)
+	default:
+		e.w.write(uint64(first)|7, 8)
+		e.w.write(uint64(n), 16)
+	}
+	for _, b := range code {
+		e.w.write(uint64(b), 8)
+	}
+}
+
+// vmStandardCode forges RarVM code with the fingerprint of the standard filter typ: its length, its
+// CRC32 (fixed by the last 4 bytes) and its leading XOR byte. The bytecode itself is never run.
+func vmStandardCode(t *testing.T, typ int) []byte {
+	for _, f := range vmStandardFilters {
+		if f.typ != typ {
+			continue
+		}
+		code := make([]byte, f.length)
+		for i := range code {
+			code[i] = byte(i * 7)
+		}
+		for c := 0; c < 1<<16; c++ {
+			code[0], code[1] = byte(c), byte(c>>8)
+			// run the CRC backwards from the target over the last 4 bytes
+			reg := ^crc32.ChecksumIEEE(code[:len(code)-4])
+			x := ^f.crc
+			for i := 0; i < 4; i++ {
+				for j, v := range crc32.IEEETable {
+					if v>>24 == x>>24 {
+						x = (x^v)<<8 | uint32(j)
+						break
+					}
+				}
+			}
+			binary.LittleEndian.PutUint32(code[len(code)-4:], x^reg)
+			if vmProgram(code) == typ {
+				return code
+			}
+		}
+	}
+	t.Fatalf("cannot forge filter %d", typ)
+	return nil
+}
+
+func TestRar3LZ(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	noise := make([]byte, 0x50000)
+	rng.Read(noise)
+	var e rar3Encoder
+	e.tables(false)
+	e.literal([]byte("abcdabcd")...)
+	e.short(4)
+	e.match(9, 3) // overlapping copy
+	e.literal(noise...)
+	e.match(40, 0x50005) // long distance, low bits coded on their own
+	e.match(250, 0x2005) // same low bits: repeated
+	e.repeat(1, 7)
+	e.repeatLast()
+	e.newTables(true) // the same tables as differences to the previous ones
+	e.match(5, 0x105)
+	e.repeat(3, 33)
+	e.short(200)
+	e.literal('z')
+	e.endFile(false)
+
+	d := NewRar3(1<<20, -1)
+	d.Init(bytes.NewReader(e.w.buf), int64(len(e.data)), false)
+	got, err := readAll(d)
+	if err != nil || !bytes.Equal(got, e.data) {
+		t.Fatalf("decoded %d bytes (want %d): %v", len(got), len(e.data), err)
+	}
+
+	// A stream ending early.
+	d.Init(bytes.NewReader(e.w.buf[:len(e.w.buf)/2]), int64(len(e.data)), false)
+	if _, err := readAll(d); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated stream: %v", err)
+	}
+}
+
+func TestRar3Filters(t *testing.T) {
+	const offset = 0x10 // file offset of the filtered blocks
+	x86 := []byte{0x90, 0xe8, 0x00, 0x01, 0x00, 0x00, 0x90, 0xe8, 0xf0, 0xff, 0xff, 0xff, 0xe9, 1, 2, 3, 4, 5}
+	e8 := append([]byte{}, x86...)
+	for _, i := range []int{2, 8} {
+		rel := binary.LittleEndian.Uint32(e8[i:])
+		binary.LittleEndian.PutUint32(e8[i:], rel+uint32(offset+i))
+	}
+	rgb := []byte{10, 20, 30, 12, 21, 35, 11, 25, 30}
+	rgb2 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9}
+	encodeDelta := func(b []byte) []byte {
+		var out []byte
+		for ch := 0; ch < 3; ch++ {
+			var prev byte
+			for i := ch; i < len(b); i += 3 {
+				out = append(out, prev-b[i])
+				prev = b[i]
+			}
+		}
+		return out
+	}
+
+	var e rar3Encoder
+	e.tables(false)
+	e.literal(make([]byte, offset)...)
+	e.filter(vmCall{num: 0, start: 0, length: len(e8), prog: vmStandardCode(t, vmE8)})
+	e.literal(e8...)
+	e.filter(vmCall{num: 2, start: 0, length: len(rgb), regs: []uint32{3}, prog: vmStandardCode(t, vmDelta)})
+	e.literal(encodeDelta(rgb)...)
+	e.filter(vmCall{num: -1, start: 0, length: -1, regs: []uint32{3}}) // the last program with its length
+	e.literal(encodeDelta(rgb2)...)
+	e.literal(0xe8, 0, 0, 0, 0) // outside any filter
+	e.endFile(false)
+	want := bytes.Join([][]byte{make([]byte, offset), x86, rgb, rgb2, {0xe8, 0, 0, 0, 0}}, nil)
+
+	d := NewRar3(1<<17, -1)
+	d.Init(bytes.NewReader(e.w.buf), int64(len(want)), false)
+	got, err := readAll(d)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("filtered output:\n got %x\nwant %x (%v)", got, want, err)
+	}
+
+	// Programs other than the standard filters cannot run.
+	e = rar3Encoder{}
+	e.tables(false)
+	e.filter(vmCall{num: 0, length: 4, prog: []byte{0, 1, 2, 3}})
+	e.literal(1, 2, 3, 4)
+	e.endFile(false)
+	d.Init(bytes.NewReader(e.w.buf), 4, false)
+	if _, err := readAll(d); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("unknown RarVM program: %v", err)
+	}
+}
+
+func TestRar3Solid(t *testing.T) {
+	var e1 rar3Encoder
+	e1.tables(false)
+	e1.literal([]byte("solid stream, first file. ")...)
+	e1.match(6, 20)
+	e1.endFile(false) // the next file continues with these tables
+	e2 := rar3Encoder{data: e1.data, old: e1.old, oldDist: e1.oldDist, lastLen: e1.lastLen}
+	e2.match(12, 32) // reaches into the first file
+	e2.repeatLast()
+	e2.endFile(true)
+	e3 := rar3Encoder{data: e2.data, old: e2.old, oldDist: e2.oldDist, lastLen: e2.lastLen}
+	e3.tables(true)
+	e3.repeat(0, 10)
+	e3.endFile(false)
+	first, second, third := e1.data, e2.data[len(e1.data):], e3.data[len(e2.data):]
+
+	d := NewRar3(1<<17, -1)
+	for i, f := range []struct {
+		packed, want []byte
+	}{{e1.w.buf, first}, {e2.w.buf, second}, {e3.w.buf, third}} {
+		d.Init(bytes.NewReader(f.packed), int64(len(f.want)), i > 0)
+		if got, err := readAll(d); err != nil || !bytes.Equal(got, f.want) {
+			t.Fatalf("file %d: %q %v", i, got, err)
+		}
+	}
+	// Without the solid state the tables are missing.
+	d.Init(bytes.NewReader(e2.w.buf), int64(len(second)), false)
+	if _, err := readAll(d); err == nil {
+		t.Fatal("non-solid decode of a solid file succeeded")
+	}
+}
+
+// ppmEncoder is the range encoder of a PPMd block, updating its model as the decoder does.
+type ppmEncoder struct {
+	m        ppmModel
+	low, rng uint32
+	out      []byte
+}
+
+// ppmBlock starts a PPMd block with the escape symbol esc; order 0 continues the model.
+func ppmBlock(e *ppmEncoder, order, esc int) []byte {
+	hdr := []byte{0x80 | 0x40, byte(esc)}
+	if order > 0 {
+		hdr = []byte{0x80 | 0x40 | 0x20 | byte(order-1), 0, byte(esc)} // 1 MiB of model memory
+		e.m.init(order, 1)
+	}
+	e.low, e.rng, e.out = 0, 0xffffffff, nil
+	return hdr
+}
+
+func (e *ppmEncoder) encode(scale uint32) {
+	rc := &e.m.rc
+	e.rng /= scale
+	e.low += e.rng * rc.lowCount
+	e.rng *= rc.highCount - rc.lowCount
+	for {
+		if e.low^(e.low+e.rng) >= ppmTop {
+			if e.rng >= ppmBot {
+				return
+			}
+			e.rng = -e.low & (ppmBot - 1)
+		}
+		e.out = append(e.out, byte(e.low>>24))
+		e.low <<= 8
+		e.rng <<= 8
+	}
+}
+
+func (e *ppmEncoder) flush() []byte {
+	for i := 0; i < 4; i++ {
+		e.out = append(e.out, byte(e.low>>24))
+		e.low <<= 8
+	}
+	return e.out
+}
+
+// encodeChar mirrors ppmModel.decodeChar.
+func (e *ppmEncoder) encodeChar(c byte) {
+	m := &e.m
+	ctx := m.minContext
+	if m.numStats(ctx) != 1 {
+		m.rc.scale = m.summFreq(ctx)
+		scale := m.rc.scale
+		p := m.stats(ctx)
+		if m.sym(p) == c {
+			m.firstHit(ctx, p)
+		} else {
+			m.prevSuccess = 0
+			hiCnt := m.freq(p)
+			i := m.numStats(ctx) - 1
+			for ; i > 0; i-- {
+				if p += stateSize; m.sym(p) == c {
+					break
+				}
+				hiCnt += m.freq(p)
+			}
+			if i == 0 {
+				m.escape1(ctx, p, hiCnt)
+			} else {
+				m.rc.lowCount, m.rc.highCount = hiCnt, hiCnt+m.freq(p)
+				m.update1(ctx, p)
+			}
+		}
+		e.encode(scale)
+	} else {
+		rs := ctx + ctxOneState
+		bs := m.binSummFor(ctx)
+		if m.sym(rs) == c {
+			m.binHit(rs, bs)
+		} else {
+			m.binEscape(rs, bs)
+		}
+		e.encode(ppmBinScale)
+	}
+	for m.foundState == 0 {
+		for {
+			m.orderFall++
+			if m.minContext = m.suffix(m.minContext); m.numStats(m.minContext) != m.numMasked {
+				break
+			}
+		}
+		ctx := m.minContext
+		see := m.escFreq2(ctx, m.numStats(ctx)-m.numMasked)
+		var ps [256]uint32
+		n, hiCnt := m.unmasked(ctx, &ps)
+		m.rc.scale += hiCnt
+		scale := m.rc.scale
+		var low uint32
+		i := 0
+		for ; i < n && m.sym(ps[i]) != c; i++ {
+			low += m.freq(ps[i])
+		}
+		if i == n {
+			m.escape2(ctx, see, ps[:n], hiCnt)
+		} else {
+			m.rc.lowCount, m.rc.highCount = low, low+m.freq(ps[i])
+			see.update()
+			m.update2(ctx, ps[i])
+		}
+		e.encode(scale)
+	}
+	if succ := m.successor(m.foundState); m.orderFall == 0 && succ > m.pText {
+		m.minContext, m.maxContext = succ, succ
+	} else {
+		m.updateModel()
+		if m.escCount == 0 {
+			m.clearMask()
+		}
+	}
+}
+
+func TestRar3PPM(t *testing.T) {
+	const esc = 0x7f
+	// Frequent symbols rescale their contexts; enough distinct contexts fill the model memory, which
+	// restarts the model.
+	rng := rand.New(rand.NewSource(4))
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog; "), 200)
+	for i := 0; i < 1<<15; i++ {
+		text = append(text, "ab"[rng.Intn(2)])
+	}
+	for i := 0; i < 1<<18; i++ {
+		text = append(text, "abcdefgh"[rng.Intn(8)])
+	}
+	var p ppmEncoder
+	var e rar3Encoder
+	e.w.buf = append(e.w.buf, ppmBlock(&p, 8, esc)...)
+	for _, c := range text {
+		p.encodeChar(c)
+	}
+	e.data = append(e.data, text...)
+	p.encodeChar(esc) // the escape symbol itself
+	p.encodeChar(1)
+	e.data = append(e.data, esc)
+	for _, c := range []byte{esc, 4, 0, 1, 0, 10} { // match of 42 bytes from 258 back
+		p.encodeChar(c)
+	}
+	e.copyData(42, 258)
+	for _, c := range []byte{esc, 5, 6} { // run of 10 bytes
+		p.encodeChar(c)
+	}
+	e.copyData(10, 1)
+	p.encodeChar(esc)
+	p.encodeChar(0) // new tables: an LZ block follows
+	e.w.buf = append(e.w.buf, p.flush()...)
+	e.w.n = int64(len(e.w.buf)) * 8
+	e.tables(false)
+	e.match(20, 100)
+	e.literal('!')
+	e.endFile(true) // the next file starts with a block header
+	first := e.data
+
+	// The next file of the solid stream continues the model in a new block.
+	e2 := rar3Encoder{data: e.data}
+	e2.w.buf = ppmBlock(&p, 0, esc)
+	for _, c := range []byte("lazy fox ") {
+		p.encodeChar(c)
+	}
+	e2.data = append(e2.data, "lazy fox "...)
+	p.encodeChar(esc)
+	p.encodeChar(2) // end of file
+	e2.w.buf = append(e2.w.buf, p.flush()...)
+	second := e2.data[len(first):]
+
+	d := NewRar3(1<<20, -1)
+	d.Init(bytes.NewReader(e.w.buf), int64(len(first)), false)
+	if got, err := readAll(d); err != nil || !bytes.Equal(got, first) {
+		t.Fatalf("first file: decoded %d of %d bytes: %v", len(got), len(first), err)
+	}
+	d.Init(bytes.NewReader(e2.w.buf), int64(len(second)), true)
+	if got, err := readAll(d); err != nil || !bytes.Equal(got, second) {
+		t.Fatalf("solid file: %q %v", got, err)
+	}
+	// A block continuing a model that does not exist.
+	d = NewRar3(1<<20, -1)
+	d.Init(bytes.NewReader(e2.w.buf), int64(len(second)), false)
+	if _, err := readAll(d); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("PPMd block without a model: %v", err)
+	}
+}
+
+// rar20Encoder writes a RAR 2.0 stream using flat code tables: every main symbol takes 9 bits, every
+// distance slot 6 bits and every repeat length slot 5 bits; audio blocks code every delta in 9 bits.
+type rar20Encoder struct {
+	w        bitWriter
+	data     []byte
+	old      [rar20MC * 4]byte
+	oldDist  [4]int
+	ptr      int
+	lastLen  int
+	lastDist int
+	audio    rar20 // predictor of audio blocks
+}
+
+// tables writes a block header with flat tables for an LZ block, or an audio block of channels
+// channels, coded as differences to the previous ones when keep is set. New LZ tables write their
+// first lengths with the repeat code and leave the last distance slots unused.
+func (e *rar20Encoder) tables(keep bool, channels int) {
+	size := rar20NC + rar20DC + rar20RC
+	if channels > 0 {
+		e.w.write(1, 1)
+		size = rar20MC * channels
+	} else {
+		e.w.write(0, 1)
+	}
+	if keep {
+		e.w.write(1, 1)
+	} else {
+		e.w.write(0, 1)
+		e.old = [rar20MC * 4]byte{}
+	}
+	if channels > 0 {
+		e.w.write(uint64(channels-1), 2)
+		e.audio.channels = channels
+		if e.audio.curChannel >= channels {
+			e.audio.curChannel = 0
+		}
+	}
+	for i := 0; i < rar20BC; i++ {
+		e.w.write(5, 4) // every precode symbol 5 bits long
+	}
+	for i := 0; i < size; i++ {
+		l := byte(9)
+		switch {
+		case channels > 0:
+		case i >= rar20NC+rar20DC:
+			l = 5
+		case i >= rar20NC:
+			l = 6
+		}
+		if i == rar20NC+44 && !keep && channels == 0 {
+			e.w.write(17, 5) // the last 4 distance slots unused
+			e.w.write(1, 3)
+			for ; i < rar20NC+48; i++ {
+				e.old[i] = 0
+			}
+			i--
+			continue
+		}
+		if i == 1 && !keep && channels == 0 {
+			e.w.write(16, 5) // 9 repeated 6 times
+			e.w.write(3, 2)
+			for ; i < 7; i++ {
+				e.old[i] = l
+			}
+			i--
+			continue
+		}
+		e.w.write(uint64((l-e.old[i])&15), 5)
+		e.old[i] = l
+	}
+}
+
+func (e *rar20Encoder) literal(b ...byte) {
+	for _, c := range b {
+		e.w.write(uint64(c), 9)
+	}
+	e.data = append(e.data, b...)
+}
+
+func (e *rar20Encoder) copyString(length, dist int) {
+	e.oldDist[e.ptr&3] = dist
+	e.ptr++
+	e.lastLen, e.lastDist = length, dist
+	for i := 0; i < length; i++ {
+		e.data = append(e.data, e.data[len(e.data)-dist])
+	}
+}
+
+func (e *rar20Encoder) match(length, dist int) {
+	enc := length
+	if dist >= 0x2000 {
+		enc--
+		if dist >= 0x40000 {
+			enc--
+		}
+	}
+	slot, extra, n := rar3Slot(enc-3, rar3LengthBase[:], rar3LengthBits[:])
+	e.w.write(uint64(270+slot), 9)
+	e.w.write(extra, n)
+	for s := 0; s < rar20DC; s++ {
+		if d := int64(dist - 1); d >= rar3DistBase[s] && d < rar3DistBase[s]+1<<rar3DistBits[s] {
+			e.w.write(uint64(s), 6)
+			e.w.write(uint64(d-rar3DistBase[s]), uint(rar3DistBits[s]))
+			break
+		}
+	}
+	e.copyString(length, dist)
+}
+
+// repeat copies length bytes from the i-th most recent distance, 1..4.
+func (e *rar20Encoder) repeat(i, length int) {
+	dist := e.oldDist[(e.ptr-i)&3]
+	enc := length
+	for _, limit := range []int{0x101, 0x2000, 0x40000} {
+		if dist >= limit {
+			enc--
+		}
+	}
+	e.w.write(uint64(256+i), 9)
+	slot, extra, n := rar3Slot(enc-2, rar3LengthBase[:], rar3LengthBits[:])
+	e.w.write(uint64(slot), 5)
+	e.w.write(extra, n)
+	e.copyString(length, dist)
+}
+
+func (e *rar20Encoder) repeatLast() {
+	e.w.write(256, 9)
+	e.copyString(e.lastLen, e.lastDist)
+}
+
+func (e *rar20Encoder) short(dist int) {
+	slot, extra, n := rar3Slot(dist-1, rar3ShortBase[:], rar3ShortBits[:])
+	e.w.write(uint64(261+slot), 9)
+	e.w.write(extra, n)
+	e.copyString(2, dist)
+}
+
+// newTables ends the block, followed by the header of the next one.
+func (e *rar20Encoder) newTables(keep bool, channels int) {
+	if e.audio.channels > 0 {
+		e.w.write(256, 9)
+	} else {
+		e.w.write(269, 9)
+	}
+	e.audio.channels = channels
+	e.tables(keep, channels)
+}
+
+// sample writes bytes of an audio block, coding each as the delta to the prediction of the decoder.
+func (e *rar20Encoder) sample(b ...byte) {
+	for _, c := range b {
+		trial := e.audio
+		delta := trial.decodeAudio(0) - c
+		e.w.write(uint64(delta), 9)
+		if got := e.audio.decodeAudio(int32(delta)); got != c {
+			panic("audio prediction differs")
+		}
+		if e.audio.curChannel++; e.audio.curChannel == e.audio.channels {
+			e.audio.curChannel = 0
+		}
+	}
+	e.data = append(e.data, b...)
+}
+
+func TestRar20(t *testing.T) {
+	rng := rand.New(rand.NewSource(20))
+	noise := make([]byte, 0x48000)
+	rng.Read(noise)
+	var wave []byte // two interleaved channels
+	for i := 0; i < 3000; i++ {
+		wave = append(wave, byte(100*math.Sin(float64(i)/40)), byte(i/7))
+	}
+	var e rar20Encoder
+	e.tables(false, 0)
+	e.literal([]byte("abcdabcd")...)
+	e.short(4)
+	e.match(9, 3) // overlapping copy
+	e.literal(noise...)
+	e.match(40, 0x48005)
+	e.match(250, 0x2005)
+	e.repeat(1, 7)
+	e.repeat(3, 100)
+	e.repeatLast()
+	e.newTables(true, 2)
+	e.sample(wave...)
+	e.newTables(false, 0)
+	e.short(200)
+	e.repeat(4, 30)
+	e.literal('z')
+
+	d := NewRar20(1<<20, -1)
+	d.Init(bytes.NewReader(e.w.buf), int64(len(e.data)), false)
+	got, err := readAll(d)
+	if err != nil || !bytes.Equal(got, e.data) {
+		t.Fatalf("decoded %d bytes (want %d): %v", len(got), len(e.data), err)
+	}
+
+	// A stream ending early.
+	d.Init(bytes.NewReader(e.w.buf[:len(e.w.buf)/2]), int64(len(e.data)), false)
+	if _, err := readAll(d); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated stream: %v", err)
+	}
+}
+
+func TestRar20Solid(t *testing.T) {
+	var e1 rar20Encoder
+	e1.tables(false, 1)
+	e1.sample([]byte("solid stream, first file, an audio block. ")...)
+	size1 := len(e1.data)
+	e1.newTables(true, 0) // stored after the end of the file, read for the next one
+	e1.w.align()
+	e2 := e1
+	e2.w = bitWriter{}
+	e2.match(12, 20) // reaches into the first file
+	e2.repeatLast()
+	e2.literal('.')
+	e3 := e2
+	e3.w = bitWriter{}
+	e3.repeat(2, 10)
+	first, second, third := e1.data[:size1], e2.data[size1:], e3.data[len(e2.data):]
+
+	d := NewRar20(1<<16, -1)
+	for i, f := range []struct {
+		packed, want []byte
+	}{{e1.w.buf, first}, {e2.w.buf, second}, {e3.w.buf, third}} {
+		d.Init(bytes.NewReader(f.packed), int64(len(f.want)), i > 0)
+		if got, err := readAll(d); err != nil || !bytes.Equal(got, f.want) {
+			t.Fatalf("file %d: %q %v", i, got, err)
+		}
+	}
+	// Without the solid state the tables are missing.
+	d.Init(bytes.NewReader(e2.w.buf), int64(len(second)), false)
+	if got, err := readAll(d); err == nil && bytes.Equal(got, second) {
+		t.Fatal("non-solid decode of a solid file succeeded")
+	}
+}
+
+// writeNum writes the code decodeNum decodes as v.
+func writeNum(w *bitWriter, v uint32, c rar15Code) {
+	var lo uint32
+	for i, hi := range c.dec {
+		n := c.start + i
+		if hi == 0xffff {
+			hi = 0x10000
+		}
+		if v >= c.pos[n] && v < c.pos[n]+(hi-lo)>>(16-n) {
+			w.write(uint64(lo>>(16-n)+v-c.pos[n]), uint(n))
+			return
+		}
+		lo = hi
+	}
+	panic("value out of range")
+}
+
+// rar15Step is one step of a RAR 1.5 stream: 'c' a literal, 's' a short match, 'r' a repeat of the
+// last match, 'o' a match at the dist-th most recent distance, 'l' a long match, 'f' a match at a
+// distance of 32 KiB or more, 'b' a toggle of the short length codes.
+type rar15Step struct {
+	kind   byte
+	c      byte
+	length int
+	dist   int
+}
+
+// rar15Encoder writes RAR 1.5 streams. Codes depend on the adaptive state, so every step is decoded by
+// a model decoder right after it is written and the following codes are chosen from its state.
+type rar15Encoder struct {
+	t     *testing.T
+	w     bitWriter
+	m     *rar15
+	data  []byte
+	steps []rar15Step
+}
+
+func newRar15Encoder(t *testing.T) *rar15Encoder {
+	m := NewRar15(1<<16, -1).(*rar15)
+	m.Init(bytes.NewReader(nil), 1<<40, false)
+	return &rar15Encoder{t: t, m: m}
+}
+
+// run writes the bits of one step and decodes them with the model.
+func (e *rar15Encoder) run(write func(w *bitWriter), decode func()) {
+	var b bitWriter
+	write(&b)
+	for i := int64(0); i < b.n; i++ {
+		e.w.write(uint64(b.buf[i/8]>>(7-i%8)&1), 1)
+	}
+	e.m.br.reset(bytes.NewReader(b.buf))
+	decode()
+	if e.m.br.pos != b.n {
+		e.t.Fatalf("model decoded %d of %d bits", e.m.br.pos, b.n)
+	}
+}
+
+// rar15FlagBits returns the flag bits selecting a step: one bit for the more frequent of literals and
+// long matches, two for the other, two for short matches.
+func rar15FlagBits(kind byte, nlzb, nhfb int) []bool {
+	switch {
+	case kind == 'c' && nlzb <= nhfb, kind == 'l' && nlzb > nhfb:
+		return []bool{true}
+	case kind == 'c', kind == 'l':
+		return []bool{false, true}
+	}
+	return []bool{false, false}
+}
+
+func rar15Counts(kind byte, nlzb, nhfb *int) {
+	switch kind {
+	case 'c':
+		if *nhfb += 16; *nhfb > 0xff {
+			*nhfb, *nlzb = 0x90, *nlzb>>1
+		}
+	case 'l':
+		if *nlzb += 16; *nlzb > 0xff {
+			*nlzb, *nhfb = 0x90, *nhfb>>1
+		}
+	}
+}
+
+// flagByte writes the flag byte starting with bits, the rest of the flag bits of step i, followed by
+// those of the steps after it.
+func (e *rar15Encoder) flagByte(i int, bits []bool) {
+	flags := append([]bool{}, bits...)
+	nlzb, nhfb := e.m.nlzb, e.m.nhfb
+	rar15Counts(e.steps[i].kind, &nlzb, &nhfb)
+	for i++; i < len(e.steps) && len(flags) < 8; i++ {
+		flags = append(flags, rar15FlagBits(e.steps[i].kind, nlzb, nhfb)...)
+		rar15Counts(e.steps[i].kind, &nlzb, &nhfb)
+	}
+	v := 0
+	for j := 0; j < 8; j++ {
+		v <<= 1
+		if j < len(flags) && flags[j] {
+			v |= 1
+		}
+	}
+	e.run(func(w *bitWriter) { writeNum(w, rar15Place(e.m.chSetC[:], v), rar15Hf2) }, e.m.getFlagsBuf)
+	if e.m.flagBuf != v {
+		e.t.Fatalf("flag byte %#x, want %#x", e.m.flagBuf, v)
+	}
+}
+
+// rar15Place returns the place of v in the high bytes of an adaptive order.
+func rar15Place(order []uint16, v int) uint32 {
+	for p, x := range order {
+		if int(x>>8) == v {
+			return uint32(p)
+		}
+	}
+	panic(fmt.Sprintf("value %#x not in the order %x", v, order))
+}
+
+func (e *rar15Encoder) copyData(length, dist int) {
+	for i := 0; i < length; i++ {
+		var c byte
+		if n := len(e.data); n >= dist {
+			c = e.data[n-dist]
+		}
+		e.data = append(e.data, c)
+	}
+}
+
+// shortCode writes the short length code of index i.
+func (e *rar15Encoder) shortCode(w *bitWriter, i int) {
+	xor, n := rar15ShortXor1[i], e.m.shortLen1(i)
+	if e.m.avrLn1 >= 37 {
+		xor, n = rar15ShortXor2[i], e.m.shortLen2(i)
+	}
+	w.write(uint64(xor>>(8-n)), n)
+}
+
+// file writes the stream of a file, continuing the state of the previous one.
+func (e *rar15Encoder) file(steps []rar15Step) []byte {
+	m := e.m
+	e.w, e.steps = bitWriter{}, steps
+	m.stMode, m.lCount = false, 0
+	e.flagByte(0, rar15FlagBits(steps[0].kind, m.nlzb, m.nhfb))
+	m.flagsCnt = 8
+	for i, s := range steps {
+		e.step(i, s)
+	}
+	return e.w.buf
+}
+
+func (e *rar15Encoder) step(i int, s rar15Step) {
+	m := e.m
+	if m.stMode {
+		switch {
+		case s.kind == 'c':
+			e.run(func(w *bitWriter) { writeNum(w, rar15Place(m.chSet[:], int(s.c))+1, m.byteCode()) }, m.huffDecode)
+			e.data = append(e.data, s.c)
+			return
+		case s.kind == 's' && (s.length == 3 || s.length == 4):
+			e.run(func(w *bitWriter) {
+				writeNum(w, 0, m.byteCode())
+				w.write(0, 1)
+				w.write(uint64(s.length-3), 1)
+				writeNum(w, uint32(s.dist>>5), rar15Hf2)
+				w.write(uint64(s.dist&31), 5)
+			}, m.huffDecode)
+			e.copyData(s.length, s.dist)
+			return
+		}
+		e.run(func(w *bitWriter) { // leave the Huffman only mode
+			writeNum(w, 0, m.byteCode())
+			w.write(1, 1)
+		}, m.huffDecode)
+	}
+	bits := rar15FlagBits(s.kind, m.nlzb, m.nhfb)
+	for j := range bits {
+		if m.flagsCnt--; m.flagsCnt < 0 {
+			e.flagByte(i, bits[j:])
+			m.flagsCnt = 7
+		}
+	}
+	length, dist := s.length, uint32(s.dist)
+	switch s.kind {
+	case 'c':
+		e.run(func(w *bitWriter) { writeNum(w, rar15Place(m.chSet[:], int(s.c)), m.byteCode()) }, m.huffDecode)
+		e.data = append(e.data, s.c)
+		return
+	case 'l':
+		e.run(func(w *bitWriter) {
+			v := length - 3
+			if dist >= m.maxDist3 {
+				v--
+			}
+			if dist <= 256 {
+				v -= 8
+			}
+			c, ok := m.longLengthCode()
+			switch {
+			case ok:
+				writeNum(w, uint32(v), c)
+			case v < 8:
+				w.write(1, uint(v+1))
+			default:
+				w.write(uint64(v), 16)
+			}
+			p := rar15Place(m.chSetB[:], int(dist>>7))
+			writeNum(w, p, m.distPlaceCode())
+			w.write(uint64(dist&0x7f), 7)
+		}, m.longLZ)
+	case 'r':
+		length, dist = m.lastLength, m.lastDist
+		e.run(func(w *bitWriter) {
+			if m.lCount == 2 {
+				w.write(1, 1)
+				return
+			}
+			e.shortCode(w, 9)
+		}, m.shortLZ)
+	case 'b':
+		e.run(func(w *bitWriter) {
+			if m.lCount == 2 {
+				w.write(0, 1)
+			}
+			e.shortCode(w, 10)
+			writeNum(w, 255, rar15L1)
+		}, m.shortLZ)
+		return
+	default:
+		if s.kind == 'o' {
+			dist = m.oldDist[(m.oldDistPtr-s.dist)&3]
+		}
+		e.run(func(w *bitWriter) {
+			if m.lCount == 2 {
+				w.write(0, 1)
+			}
+			switch s.kind {
+			case 's':
+				e.shortCode(w, length-2)
+				p := slices.Index(m.chSetA[:], uint16(dist-1))
+				writeNum(w, uint32(p), rar15Hf2)
+			case 'o':
+				e.shortCode(w, 9+s.dist)
+				v := length - 2
+				if dist > 256 {
+					v--
+				}
+				if dist >= m.maxDist3 {
+					v--
+				}
+				writeNum(w, uint32(v), rar15L1)
+			case 'f':
+				if m.buf60 == 0 {
+					e.t.Fatal("far match with the short length codes of Buf60 0")
+				}
+				e.shortCode(w, 14)
+				writeNum(w, uint32(length-5), rar15L2)
+				w.write(uint64(dist&0x7fff), 15)
+			}
+		}, m.shortLZ)
+	}
+	if m.lastLength != length || m.lastDist != dist {
+		e.t.Fatalf("step %d %c: model decoded a match of %d from %d, want %d from %d", i, s.kind, m.lastLength, m.lastDist, length, dist)
+	}
+	e.copyData(length, int(dist))
+}
+
+// rar15Steps returns random steps of every kind, producing at least size bytes after the produced ones
+// already written.
+func rar15Steps(rng *rand.Rand, produced, size int) []rar15Step {
+	const text = "the quick brown fox jumps over the lazy dog, again and again. "
+	var steps []rar15Step
+	n := produced
+	literals := func(s string) {
+		for _, c := range []byte(s) {
+			steps = append(steps, rar15Step{kind: 'c', c: c})
+		}
+		n += len(s)
+	}
+	add := func(s rar15Step) {
+		steps = append(steps, s)
+		n += s.length
+	}
+	literals(text)
+	for i := 0; i < 4; i++ {
+		add(rar15Step{kind: 'l', length: 20 + i, dist: 1 + rng.Intn(min(n, 0x7fff))})
+	}
+	for n < produced+size {
+		switch k := rng.Intn(12); {
+		case k < 3: // long runs switch to the Huffman only mode
+			start := rng.Intn(len(text))
+			literals(text[start:][:rng.Intn(len(text)-start)+1])
+		case k < 5:
+			add(rar15Step{kind: 's', length: 2 + rng.Intn(9), dist: 1 + rng.Intn(min(n, 256))})
+		case k < 7:
+			add(rar15Step{kind: 'l', length: 11 + rng.Intn(150), dist: 1 + rng.Intn(min(n, 0x7fff))})
+		case k < 9:
+			add(rar15Step{kind: 'o', length: 5 + rng.Intn(100), dist: 1 + rng.Intn(4)})
+		case k < 10:
+			steps = append(steps, rar15Step{kind: 'r'})
+		case n > 0x8000:
+			add(rar15Step{kind: 'b'})
+			for j := 0; j < 3; j++ {
+				add(rar15Step{kind: 'f', length: 5 + rng.Intn(200), dist: 0x8000 + rng.Intn(min(n, 0xffff)-0x7fff)})
+			}
+			add(rar15Step{kind: 'b'})
+		}
+	}
+	return append(steps, rar15Step{kind: 'c', c: '.'})
+}
+
+func TestRar15(t *testing.T) {
+	rng := rand.New(rand.NewSource(15))
+	e := newRar15Encoder(t)
+	packed1 := e.file(rar15Steps(rng, 0, 0x30000))
+	first := e.data
+	packed2 := e.file(rar15Steps(rng, len(first), 5000))
+	second := e.data[len(first):]
+	if !e.m.stMode && e.m.buf60 != 0 {
+		t.Log("steps end in the Huffman only mode")
+	}
+
+	d := NewRar15(1<<16, -1)
+	d.Init(bytes.NewReader(packed1), int64(len(first)), false)
+	got, err := readAll(d)
+	if err != nil || !bytes.Equal(got, first) {
+		t.Fatalf("decoded %d bytes (want %d): %v", len(got), len(first), err)
+	}
+	d.Init(bytes.NewReader(packed2), int64(len(second)), true)
+	if got, err := readAll(d); err != nil || !bytes.Equal(got, second) {
+		t.Fatalf("solid file: decoded %d bytes (want %d): %v", len(got), len(second), err)
+	}
+
+	// A stream ending early.
+	d.Init(bytes.NewReader(packed1[:len(packed1)/2]), int64(len(first)), false)
+	if _, err := readAll(d); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated stream: %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+package unpack
+
+import "hash/crc32"
+
+// RAR 2.9-4.x filters are RarVM programs stored in the packed stream. WinRAR only ever emitted a few
+// standard programs, which unrar recognises by the length and CRC32 of their code and runs natively
+// instead of interpreting the bytecode; this package does the same.
+const (
+	vmNone = iota
+	vmE8
+	vmE8E9
+	vmItanium
+	vmDelta
+	vmRGB
+	vmAudio
+)
+
+// vmMemSize is the size of the RarVM memory, bounding the block a filter processes.
+const vmMemSize = 0x40000
+
+var vmStandardFilters = [...]struct {
+	length int
+	crc    uint32
+	typ    int
+}{
+	{53, 0xad576887, vmE8},
+	{57, 0x3cd7e57e, vmE8E9},
+	{120, 0x3769893f, vmItanium},
+	{29, 0x0e06077d, vmDelta},
+	{149, 0x1c2c5dc8, vmRGB},
+	{216, 0xbc85e701, vmAudio},
+}
+
+// vmProgram identifies the standard filter of RarVM code, vmNone for any other program. The first
+// byte of the code is the XOR of the others.
+func vmProgram(code []byte) int {
+	var sum byte
+	for _, c := range code[1:] {
+		sum ^= c
+	}
+	if sum != code[0] {
+		return vmNone
+	}
+	crc := crc32.ChecksumIEEE(code)
+	for _, f := range vmStandardFilters {
+		if f.length == len(code) && f.crc == crc {
+			return f.typ
+		}
+	}
+	return vmNone
+}
+
+// vmFilter returns the function running the standard filter typ with the initial registers r of its
+// invocation (r[0] and r[1] carry the filter parameters). Filters given invalid parameters leave their
+// block unchanged, as the RarVM does.
+func vmFilter(typ int, r [7]uint32) func([]byte, int64) []byte {
+	switch typ {
+	case vmE8, vmE8E9:
+		return e8Filter(typ == vmE8E9, false)
+	case vmItanium:
+		return itaniumFilter
+	case vmDelta:
+		if r[0] == 0 || r[0] > 1024 {
+			return keepFilter
+		}
+		delta := deltaFilter(int(r[0]))
+		return func(data []byte, offset int64) []byte {
+			if len(data) > vmMemSize/2 {
+				return data
+			}
+			return delta(data, offset)
+		}
+	case vmRGB:
+		return rgbFilter(r[0], r[1])
+	case vmAudio:
+		return audioFilter(r[0])
+	}
+	return nil
+}
+
+func keepFilter(data []byte, _ int64) []byte { return data }
+
+var itaniumMasks = [16]byte{4, 4, 6, 6, 0, 0, 7, 7, 4, 4, 0, 0, 4, 4, 0, 0}
+
+// itaniumFilter undoes the transform of IA-64 branch bundles: the 20 bit target of the branch slots
+// selected by each 16 byte bundle template was made absolute, in bundle units.
+func itaniumFilter(data []byte, offset int64) []byte {
+	if len(data) < 21 {
+		return data
+	}
+	fileOffset := uint32(offset) >> 4
+	for pos := 0; pos < len(data)-21; pos += 16 {
+		if b := int(data[pos]&0x1f) - 0x10; b >= 0 {
+			mask := itaniumMasks[b]
+			for i := uint(0); i <= 2; i++ {
+				if mask&(1<<i) == 0 {
+					continue
+				}
+				start := i*41 + 5
+				if itaniumBits(data[pos:], start+37, 4) == 5 {
+					v := itaniumBits(data[pos:], start+13, 20)
+					setItaniumBits(data[pos:], (v-fileOffset)&0xfffff, start+13, 20)
+				}
+			}
+		}
+		fileOffset++
+	}
+	return data
+}
+
+// itaniumBits returns n bits of b starting at bit pos, least significant first.
+func itaniumBits(b []byte, pos, n uint) uint32 {
+	i := pos / 8
+	v := uint32(b[i]) | uint32(b[i+1])<<8 | uint32(b[i+2])<<16 | uint32(b[i+3])<<24
+	return v >> (pos & 7) & (0xffffffff >> (32 - n))
+}
+
+func setItaniumBits(b []byte, v uint32, pos, n uint) {
+	i := pos / 8
+	mask := ^((0xffffffff >> (32 - n)) << (pos & 7))
+	v <<= pos & 7
+	for j := uint(0); j < 4; j++ {
+		b[i+j] = b[i+j]&byte(mask) | byte(v)
+		mask = mask>>8 | 0xff000000
+		v >>= 8
+	}
+}
+
+// rgbFilter undoes the transform of 24 bit images of width/3 pixels: each colour channel is stored as
+// the differences to a Paeth-like prediction from the pixels on the left and above, and red and blue
+// as differences to green, starting with the byte at posR.
+func rgbFilter(width, posR uint32) func([]byte, int64) []byte {
+	return func(data []byte, _ int64) []byte {
+		n := uint32(len(data))
+		w := width - 3
+		if n > vmMemSize/2 || n < 3 || w > n || posR > 2 {
+			return data
+		}
+		out := make([]byte, n)
+		src := 0
+		for ch := uint32(0); ch < 3; ch++ {
+			var prev uint32
+			for i := ch; i < n; i += 3 {
+				pred := prev
+				if i >= w+3 {
+					up, upLeft := uint32(out[i-w]), uint32(out[i-w-3])
+					pred = prev + up - upLeft
+					pa, pb, pc := abs32(int32(pred-prev)), abs32(int32(pred-up)), abs32(int32(pred-upLeft))
+					switch {
+					case pa <= pb && pa <= pc:
+						pred = prev
+					case pb <= pc:
+						pred = up
+					default:
+						pred = upLeft
+					}
+				}
+				prev = uint32(byte(pred - uint32(data[src])))
+				out[i] = byte(prev)
+				src++
+			}
+		}
+		for i := posR; i+2 < n; i += 3 {
+			g := out[i+1]
+			out[i] += g
+			out[i+2] += g
+		}
+		return out
+	}
+}
+
+// audioFilter undoes the transform of interleaved audio channels: each sample is stored as its
+// difference to a prediction from the previous samples, with weights adapted every 32 samples.
+func audioFilter(channels uint32) func([]byte, int64) []byte {
+	return func(data []byte, _ int64) []byte {
+		n := uint32(len(data))
+		if n > vmMemSize/2 || channels > 128 || channels == 0 {
+			return data
+		}
+		out := make([]byte, n)
+		src := 0
+		for ch := uint32(0); ch < channels; ch++ {
+			var prevByte uint32
+			var prevDelta, d1, d2, d3, k1, k2, k3 int32
+			var dif [7]uint32
+			for i, count := ch, 0; i < n; i, count = i+channels, count+1 {
+				d3 = d2
+				d2 = prevDelta - d1
+				d1 = prevDelta
+				pred := 8*prevByte + uint32(k1*d1+k2*d2+k3*d3)
+				pred = pred >> 3 & 0xff
+				cur := uint32(data[src])
+				src++
+				pred -= cur
+				out[i] = byte(pred)
+				prevDelta = int32(int8(pred - prevByte))
+				prevByte = pred
+
+				d := int32(int8(cur)) * 8
+				dif[0] += abs32(d)
+				dif[1] += abs32(d - d1)
+				dif[2] += abs32(d + d1)
+				dif[3] += abs32(d - d2)
+				dif[4] += abs32(d + d2)
+				dif[5] += abs32(d - d3)
+				dif[6] += abs32(d + d3)
+				if count&0x1f != 0 {
+					continue
+				}
+				best := 0
+				for j := 1; j < len(dif); j++ {
+					if dif[j] < dif[best] {
+						best = j
+					}
+				}
+				dif = [7]uint32{}
+				switch best {
+				case 1:
+					if k1 >= -16 {
+						k1--
+					}
+				case 2:
+					if k1 < 16 {
+						k1++
+					}
+				case 3:
+					if k2 >= -16 {
+						k2--
+					}
+				case 4:
+					if k2 < 16 {
+						k2++
+					}
+				case 5:
+					if k3 >= -16 {
+						k3--
+					}
+				case 6:
+					if k3 < 16 {
+						k3++
+					}
+				}
+			}
+		}
+		return out
+	}
+}
+
+func abs32(v int32) uint32 {
+	if v < 0 {
+		return uint32(-v)
+	}
+	return uint32(v)
+}
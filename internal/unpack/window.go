@@ -0,0 +1,166 @@
+package unpack
+
+import "fmt"
+
+// maxFilters bounds the filters waiting for their data, as in unrar.
+const maxFilters = 8192
+
+// filter transforms a block of decoded data before it is output. run receives a copy of the block and
+// the file offset of its first byte and returns the output.
+type filter struct {
+	start, length int64 // window positions
+	run           func(data []byte, offset int64) []byte
+}
+
+// window is the LZ dictionary: decoded bytes are appended, matches copy earlier bytes, and flush hands
+// out the decoded data, passing the blocks covered by filters through them first. Positions count the
+// bytes decoded since the stream (the first file of a solid group) started.
+type window struct {
+	buf     []byte
+	mask    int64
+	pos     int64 // bytes decoded
+	wr      int64 // bytes flushed
+	filters []filter
+	chain   bool // a filter with the block of the previous one processes its output (RAR3)
+
+	start   int64 // position of the current file
+	size    int64 // unpacked size of the current file
+	written int64 // bytes of the current file flushed
+	out     []byte
+	off     int // bytes of out already read
+}
+
+// init prepares the window for a file. A non-solid file starts a new stream in a buffer of bufSize bytes;
+// a solid one keeps the dictionary, moved to a larger buffer if it needs one.
+func (w *window) init(bufSize, size int64, solid bool) {
+	switch {
+	case !solid:
+		if int64(len(w.buf)) != bufSize {
+			w.buf = make([]byte, bufSize)
+			w.mask = bufSize - 1
+		}
+		w.pos = 0
+	case bufSize > int64(len(w.buf)):
+		buf, mask := make([]byte, bufSize), bufSize-1
+		for i := max(w.pos-int64(len(w.buf)), 0); i < w.pos; i++ {
+			buf[i&mask] = w.buf[i&w.mask]
+		}
+		w.buf, w.mask = buf, mask
+	}
+	w.wr, w.start, w.size, w.written = w.pos, w.pos, size, 0
+	w.filters = w.filters[:0]
+	w.out, w.off = w.out[:0], 0
+}
+
+func (w *window) putByte(b byte) {
+	w.buf[w.pos&w.mask] = b
+	w.pos++
+}
+
+// copyMatch appends length bytes copied from dist bytes back.
+func (w *window) copyMatch(length int, dist int64) {
+	src, dst := (w.pos-dist)&w.mask, w.pos&w.mask
+	if dist >= int64(length) && src+int64(length) <= int64(len(w.buf)) && dst+int64(length) <= int64(len(w.buf)) {
+		copy(w.buf[dst:dst+int64(length)], w.buf[src:])
+	} else {
+		for i := 0; i < length; i++ {
+			w.buf[dst] = w.buf[src]
+			src, dst = (src+1)&w.mask, (dst+1)&w.mask
+		}
+	}
+	w.pos += int64(length)
+}
+
+// pending reports how many decoded bytes are not flushed yet.
+func (w *window) pending() int64 { return w.pos - w.wr }
+
+// full reports whether decoding more than maxMatch bytes would overwrite data not flushed yet.
+func (w *window) full(maxMatch int64) bool { return w.pending()+maxMatch > int64(len(w.buf)) }
+
+// decoded reports the number of bytes of the current file decoded so far.
+func (w *window) decoded() int64 { return w.pos - w.start }
+
+// addFilter queues a filter for the block of length bytes starting offset bytes past the current
+// position. Blocks must be queued in order.
+func (w *window) addFilter(offset, length int64, run func([]byte, int64) []byte) error {
+	if len(w.filters) >= maxFilters {
+		w.flush()
+		if len(w.filters) >= maxFilters {
+			return fmt.Errorf("%w: too many filters", ErrCorrupt)
+		}
+	}
+	if length > int64(len(w.buf)) {
+		return fmt.Errorf("%w: filter block of %d bytes exceeds the dictionary", ErrCorrupt, length)
+	}
+	w.filters = append(w.filters, filter{start: w.pos + offset, length: length, run: run})
+	return nil
+}
+
+// flush moves the decoded data to the output, up to the first filter whose block is not complete.
+func (w *window) flush() {
+	for len(w.filters) > 0 {
+		f := w.filters[0]
+		if f.start >= w.pos {
+			break
+		}
+		if f.start < w.wr { // overlaps data already flushed
+			w.filters = w.filters[1:]
+			continue
+		}
+		w.emit(w.wr, f.start)
+		end := f.start + f.length
+		if end > w.pos {
+			return
+		}
+		data := f.run(w.copyOut(f.start, end), f.start-w.start)
+		w.filters = w.filters[1:]
+		for w.chain && len(w.filters) > 0 && w.filters[0].start == f.start && w.filters[0].length == int64(len(data)) {
+			data = w.filters[0].run(data, f.start-w.start)
+			w.filters = w.filters[1:]
+		}
+		w.output(data)
+		w.wr = end
+	}
+	w.emit(w.wr, w.pos)
+}
+
+// copyOut returns a copy of the window bytes from start to end.
+func (w *window) copyOut(start, end int64) []byte {
+	b := make([]byte, end-start)
+	s := start & w.mask
+	n := copy(b, w.buf[s:])
+	copy(b[n:], w.buf)
+	return b
+}
+
+// emit outputs the window bytes from start to end.
+func (w *window) emit(start, end int64) {
+	for start < end {
+		s := start & w.mask
+		n := min(end-start, int64(len(w.buf))-s)
+		w.output(w.buf[s : s+n])
+		start += n
+	}
+	w.wr = end
+}
+
+// output appends data to the output, dropping anything past the end of the file.
+func (w *window) output(data []byte) {
+	if n := w.size - w.written; n > 0 {
+		w.out = append(w.out, data[:min(int64(len(data)), n)]...)
+	}
+	w.written += int64(len(data))
+}
+
+// read copies flushed output to p.
+func (w *window) read(p []byte) int {
+	n := copy(p, w.out[w.off:])
+	w.off += n
+	if w.off == len(w.out) {
+		w.out, w.off = w.out[:0], 0
+	}
+	return n
+}
+
+// buffered reports whether flushed output is waiting to be read.
+func (w *window) buffered() bool { return w.off < len(w.out) }
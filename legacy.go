@@ -2,7 +2,6 @@ package rarlist
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -10,138 +9,267 @@ import (
 	"github.com/javi11/rarlist/internal/util"
 )
 
-// scanLegacy performs the byte scan starting AFTER signature (caller positions reader at baseOffset+sigLen).
-func scanLegacy(br *bufio.Reader, vi *VolumeIndex, baseOffset int64) error {
-	// Reduced scan window for speed (legacy headers appear near start). 64 KiB is typically sufficient.
-	const scanLimit = 64 * 1024
-	peekBuf, _ := br.Peek(scanLimit)
-	// Early check: detect encrypted headers via main header (type 0x73) flags (0x0080)
-	if len(peekBuf) >= 7 {
-		// Scan first 64K window for a plausible main header: 2 bytes CRC, 0x73 type, flags, size
-		// We don’t require exact alignment to avoid off-by-one due to padding.
-		for i := 0; i+6 < len(peekBuf) && i < 512; i++ { // limit small scan range near start
-			if peekBuf[i+2] == 0x73 { // type
-				flags := binary.LittleEndian.Uint16(peekBuf[i+3 : i+5])
-				// Basic sanity on size: at least 7
-				if binary.LittleEndian.Uint16(peekBuf[i+5:i+7]) >= 7 {
-					if flags&0x0080 != 0 || flags&0x0200 != 0 {
-						return fmt.Errorf("%w (legacy headers encrypted)", ErrPasswordProtected)
-					}
-					break
-				}
-			}
-		}
-	}
-	searchStart := 0
-	for searchStart < len(peekBuf) {
-		pos := bytes.IndexByte(peekBuf[searchStart:], 0x74)
-		if pos < 0 {
+// legacySyncLimit bounds the search for the first block header after the signature.
+// Real archives start with MAIN_HEAD right away; the window only absorbs padding left by odd generators.
+const legacySyncLimit = 64 * 1024
+
+// parseLegacy walks the RAR 1.5/2.x block chain of a volume (caller positions br right after the signature).
+// The first block is located within legacySyncLimit bytes; from there every block is read in order using
+// HEAD_SIZE and ADD_SIZE, so bytes inside names, comments or file data are never mistaken for headers.
+// Any state left on vi by a previous parse attempt is discarded.
+func parseLegacy(br *bufio.Reader, seeker io.ReadSeeker, vi *VolumeIndex, baseOffset int64, fileSize int64, o options) error {
+	*vi = VolumeIndex{Path: vi.Path, Version: vi.Version}
+	window, _ := br.Peek(legacySyncLimit)
+	start := -1
+	for i := 0; i+7 <= len(window); i++ {
+		if legacyFirstBlockAt(window[i:]) {
+			start = i
 			break
 		}
-		typePos := searchStart + pos
-		hdrStart := typePos - 2
-		if hdrStart < 0 || hdrStart+7 > len(peekBuf) {
-			searchStart = typePos + 1
-			continue
+	}
+	if start < 0 {
+		return fmt.Errorf("legacy scan: no file header found")
+	}
+	if _, err := br.Discard(start); err != nil {
+		return err
+	}
+	pos := baseOffset + 7 + int64(start)
+	afterData := ""
+	for {
+		if fileSize > 0 && pos+7 > fileSize {
+			if afterData != "" && pos < fileSize {
+				vi.warnf(WarningDataSize, pos, "%s: %d trailing bytes after file data", afterData, fileSize-pos)
+			}
+			return nil
 		}
-		flags := binary.LittleEndian.Uint16(peekBuf[hdrStart+3 : hdrStart+5])
-		size := binary.LittleEndian.Uint16(peekBuf[hdrStart+5 : hdrStart+7])
-		if size < 32 {
-			searchStart = typePos + 1
-			continue
+		head, err := br.Peek(7)
+		if len(head) < 7 {
+			if err == io.EOF {
+				return nil
+			}
+			return err
 		}
-		headEnd := hdrStart + int(size)
-		if headEnd > len(peekBuf) {
-			// Attempt to extend peek window to cover the full header before giving up.
-			if nb, _ := br.Peek(headEnd); len(nb) >= headEnd {
-				peekBuf = nb
+		typ, flags, size := head[2], binary.LittleEndian.Uint16(head[3:5]), int64(binary.LittleEndian.Uint16(head[5:7]))
+		if !isRar3BlockType(typ) || typ == 0x72 || size < 7 || (flags&0x8000 != 0 && size < 11) {
+			if afterData != "" {
+				vi.warnf(WarningDataSize, pos, "%s: no block header after file data (type 0x%02x, size %d)", afterData, typ, size)
 			} else {
+				vi.warnf(WarningDataSize, pos, "unknown block (type 0x%02x, size %d), stopping", typ, size)
+			}
+			return nil
+		}
+		afterData = ""
+		if fileSize > 0 && pos+size > fileSize {
+			vi.warnf(WarningDataSize, pos, "block header (type 0x%02x, size %d) runs past the end of the volume", typ, size)
+			return nil
+		}
+		hdr := make([]byte, size)
+		if _, err := io.ReadFull(br, hdr); err != nil {
+			return err
+		}
+		hdrStart := pos
+		pos += size
+		if err := vi.checkRar3HeaderCRC(o, hdrStart, hdr); err != nil {
+			return err
+		}
+		var tail int64   // payload bytes following the header
+		var owner string // name of the block owning that payload
+		if flags&0x8000 != 0 {
+			tail = int64(binary.LittleEndian.Uint32(hdr[7:11]))
+		}
+		switch {
+		case typ == rar3BlockTypeMain:
+			decodeRar3MainHeader(&vi.Archive, &rar3BlockHeader{Type: typ, Flags: flags, Size: uint16(size)})
+			if flags&0x0080 != 0 || flags&0x0200 != 0 {
+				return fmt.Errorf("%w (legacy headers encrypted)", ErrPasswordProtected)
+			}
+			if vi.Archive.HasComment && flags&0x8000 == 0 && size >= 13+13 && hdr[13+2] == rar3BlockTypeComment {
+				if n := int64(binary.LittleEndian.Uint16(hdr[13+5 : 13+7])); 13+n <= size {
+					if sb, ok := decodeRar3SubBlock(hdr[13:13+n], hdrStart+13); ok {
+						vi.ServiceBlocks = append(vi.ServiceBlocks, sb)
+					}
+				}
+			}
+		case typ == rar3BlockTypeEnd:
+			body := hdr[7:]
+			if flags&0x8000 != 0 {
+				body = hdr[11:]
+			}
+			decodeRar3EndHeader(&vi.Archive, hdrStart, &rar3BlockHeader{Type: typ, Flags: flags, Size: uint16(size)}, body)
+			return nil
+		case typ == rar3BlockTypeFile || typ == rar3BlockTypeNewSub:
+			fb, cmt, err := decodeLegacyFileHeader(hdr, hdrStart)
+			if err != nil {
+				return err
+			}
+			tail, owner = fb.PackedSize, fb.Name
+			if typ == rar3BlockTypeNewSub {
+				sb := rar3NewSubBlock(fb, nil)
+				if rar3SubBlockOwnsFile(sb) && len(vi.FileBlocks) > 0 {
+					sb.FileIndex, sb.FileName = len(vi.FileBlocks)-1, vi.FileBlocks[len(vi.FileBlocks)-1].Name
+				}
+				vi.ServiceBlocks = append(vi.ServiceBlocks, sb)
 				break
 			}
+			setRar15Solid(&fb, vi)
+			vi.FileBlocks = append(vi.FileBlocks, fb)
+			if len(vi.FileBlocks) == 1 {
+				vi.TotalHeaderBytes = fb.DataPos
+			}
+			if cmt != nil {
+				cmt.FileIndex, cmt.FileName = len(vi.FileBlocks)-1, fb.Name
+				vi.ServiceBlocks = append(vi.ServiceBlocks, *cmt)
+			}
+		default: // old style sub-blocks (0x75-0x79)
+			if sb, ok := decodeRar3SubBlock(hdr, hdrStart); ok {
+				owner = sb.Name
+				if rar3SubBlockOwnsFile(sb) && len(vi.FileBlocks) > 0 {
+					sb.FileIndex, sb.FileName = len(vi.FileBlocks)-1, vi.FileBlocks[len(vi.FileBlocks)-1].Name
+				}
+				vi.ServiceBlocks = append(vi.ServiceBlocks, sb)
+			}
 		}
-		fixedStart := hdrStart + 7
-		if fixedStart+25 > headEnd {
-			searchStart = typePos + 1
+		if tail <= 0 {
 			continue
 		}
-		fixed := peekBuf[fixedStart : fixedStart+25]
-		packSize32 := binary.LittleEndian.Uint32(fixed[0:4])
-		unpSize32 := binary.LittleEndian.Uint32(fixed[4:8])
-		method := fixed[18]
-		nameSize := binary.LittleEndian.Uint16(fixed[19:21]) // Name size at offset 19-20 in RAR3
-		offset := fixedStart + 25
-		var highPack, highUnp uint32
+		if fileSize > 0 && pos+tail > fileSize {
+			vi.warnf(WarningDataSize, hdrStart, "%s: data size %d exceeds the %d bytes left in volume", owner, tail, fileSize-pos)
+			return nil
+		}
+		if err := skipRar3(br, seeker, tail); err != nil {
+			return err
+		}
+		pos += tail
+		afterData = owner
+		if afterData == "" {
+			afterData = fmt.Sprintf("block 0x%02x @%d", typ, hdrStart)
+		}
+	}
+}
+
+// legacyFirstBlockAt reports whether b starts with a plausible first block: a main header, or a file
+// header whose fixed fields and name fit inside HEAD_SIZE.
+func legacyFirstBlockAt(b []byte) bool {
+	if len(b) < 7 {
+		return false
+	}
+	flags, size := binary.LittleEndian.Uint16(b[3:5]), int(binary.LittleEndian.Uint16(b[5:7]))
+	switch b[2] {
+	case rar3BlockTypeMain:
+		return size >= 13
+	case rar3BlockTypeFile:
+		if size < 32 || len(b) < 32 {
+			return false
+		}
+		need := 32 + int(binary.LittleEndian.Uint16(b[7+19:7+21]))
 		if flags&0x0100 != 0 {
-			if offset+8 > headEnd {
-				searchStart = typePos + 1
-				continue
-			}
-			highPack = binary.LittleEndian.Uint32(peekBuf[offset : offset+4])
-			highUnp = binary.LittleEndian.Uint32(peekBuf[offset+4 : offset+8])
-			offset += 8
+			need += 8
 		}
-		if offset+int(nameSize) > headEnd {
-			searchStart = typePos + 1
-			continue
+		return need <= size
+	}
+	return false
+}
+
+// decodeLegacyFileHeader decodes a RAR 1.5/2.x FILE_HEAD from its raw bytes (HEAD_CRC up to HEAD_SIZE) found at pos.
+// A file comment embedded after the name (LHD_COMMENT, RAR 2.x) is returned as a comment ServiceBlock.
+func decodeLegacyFileHeader(hdr []byte, pos int64) (FileBlock, *ServiceBlock, error) {
+	flags := binary.LittleEndian.Uint16(hdr[3:5])
+	if len(hdr) < 32 {
+		return FileBlock{}, nil, fmt.Errorf("legacy file header too small: %d", len(hdr))
+	}
+	// PACK_SIZE(4) UNP_SIZE(4) HOST_OS(1) FILE_CRC(4) FTIME(4) UNP_VER(1) METHOD(1) NAME_SIZE(2) ATTR(4)
+	fixed := hdr[7:32]
+	packSize := uint64(binary.LittleEndian.Uint32(fixed[0:4]))
+	unpSize := uint64(binary.LittleEndian.Uint32(fixed[4:8]))
+	method := fixed[18]
+	nameSize := int(binary.LittleEndian.Uint16(fixed[19:21]))
+	opt := hdr[32:]
+	if flags&0x0100 != 0 { // LHD_LARGE
+		if len(opt) < 8 {
+			return FileBlock{}, nil, fmt.Errorf("legacy high size fields truncated")
 		}
-		nameField := peekBuf[offset : offset+int(nameSize)]
-		name := ""
-		if flags&0x0200 != 0 {
-			if zero := indexByte(nameField, 0); zero >= 0 {
-				asciiPart := nameField[:zero]
-				unicodePart := nameField[zero+1:]
-				name = util.DecodeRar3Unicode(asciiPart, unicodePart)
-			} else {
-				name = safeToString(nameField)
+		packSize |= uint64(binary.LittleEndian.Uint32(opt[0:4])) << 32
+		unpSize |= uint64(binary.LittleEndian.Uint32(opt[4:8])) << 32
+		opt = opt[8:]
+	}
+	if nameSize > len(opt) {
+		return FileBlock{}, nil, fmt.Errorf("legacy name size %d exceeds header (%d left)", nameSize, len(opt))
+	}
+	nameField := opt[:nameSize]
+	name := safeToString(nameField)
+	if flags&0x0200 != 0 { // LHD_UNICODE
+		if zero := indexByte(nameField, 0); zero >= 0 {
+			name = util.DecodeRar3Unicode(nameField[:zero], nameField[zero+1:])
+		}
+	}
+	size := int64(len(hdr))
+	fb := FileBlock{
+		Name:             name,
+		HeaderPos:        pos,
+		HeaderSize:       size,
+		DataPos:          pos + size,
+		PackedSize:       int64(packSize),
+		VolumeDataSize:   int64(packSize),
+		UnpackedSize:     int64(unpSize),
+		Stored:           method == 0x30,
+		Encrypted:        flags&0x0004 != 0,
+		ContinuedFrom:    flags&0x0001 != 0,
+		ContinuedTo:      flags&0x0002 != 0,
+		Continued:        flags&0x0002 != 0,
+		IsDir:            flags&0x00E0 == 0x00E0,
+		ModTime:          dosTime(binary.LittleEndian.Uint32(fixed[13:17])),
+		CRC32:            binary.LittleEndian.Uint32(fixed[9:13]),
+		HasCRC32:         true,
+		HostOS:           fixed[8],
+		Attributes:       uint64(binary.LittleEndian.Uint32(fixed[21:25])),
+		AlgorithmVersion: fixed[17],
+		Solid:            flags&0x0010 != 0,
+		Method:           rar3Method(method),
+		DictSize:         rar3DictSize(flags),
+	}
+	var cmt *ServiceBlock
+	rest := opt[nameSize:]
+	if flags&0x0008 != 0 && len(rest) >= 13 && rest[2] == rar3BlockTypeComment { // LHD_COMMENT
+		if n := int(binary.LittleEndian.Uint16(rest[5:7])); n <= len(rest) {
+			at := pos + size - int64(len(rest))
+			if sb, ok := decodeRar3SubBlock(rest[:n], at); ok {
+				cmt = &sb
 			}
-		} else {
-			name = safeToString(nameField)
-		}
-		packSize := (int64(highPack) << 32) | int64(packSize32)
-		unpSize := (int64(highUnp) << 32) | int64(unpSize32)
-		stored := method == 0x30
-		encrypted := (flags & 0x0004) != 0
-	// RAR3/legacy signature is 7 bytes; our detectSignature returns the sig start (baseOffset)
-	fileHeaderPos := baseOffset + 7 + int64(hdrStart)
-		fb := FileBlock{Name: name, HeaderPos: fileHeaderPos, HeaderSize: int64(size), DataPos: fileHeaderPos + int64(size), PackedSize: int64(packSize), VolumeDataSize: int64(packSize), UnpackedSize: int64(unpSize), Stored: stored, Encrypted: encrypted}
-		vi.FileBlocks = append(vi.FileBlocks, fb)
-		vi.TotalHeaderBytes = fb.DataPos
-
-		return nil
+		}
 	}
-	return fmt.Errorf("legacy scan: no file header found")
+	return fb, cmt, nil
 }
 
-// parseRarLegacySeeker reuses an already opened ReadSeeker positioned at start; it seeks to baseOffset+8 then scans.
-func parseRarLegacySeeker(rs io.ReadSeeker, vi *VolumeIndex, baseOffset int64) error {
+// parseRarLegacySeeker reuses an already opened ReadSeeker; it seeks past the signature at baseOffset and walks the blocks.
+func parseRarLegacySeeker(rs io.ReadSeeker, vi *VolumeIndex, baseOffset int64, fileSize int64, o options) error {
 	if _, err := rs.Seek(baseOffset+7, io.SeekStart); err != nil {
 		return err
 	}
-	br := bufio.NewReader(rs)
-	return scanLegacy(br, vi, baseOffset)
+	br := bufio.NewReaderSize(rs, legacySyncLimit)
+	return parseLegacy(br, rs, vi, baseOffset, fileSize, o)
 }
 
-// Legacy RAR (1.5/2.x) lenient parser opening file via FileSystem (fallback when we don't have seeker externally).
-func parseRarLegacy(fs FileSystem, path string, vi *VolumeIndex, baseOffset int64) error {
+// Legacy RAR (1.5/2.x) parser opening file via FileSystem (fallback when we don't have seeker externally).
+func parseRarLegacy(fs FileSystem, path string, vi *VolumeIndex, baseOffset int64, o options) error {
 	f, err := fs.Open(path)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = f.Close() }()
+	var fileSize int64
+	if st, err := f.Stat(); err == nil {
+		fileSize = st.Size()
+	}
 	if rs, ok := f.(io.ReadSeeker); ok {
-		return parseRarLegacySeeker(rs, vi, baseOffset)
+		return parseRarLegacySeeker(rs, vi, baseOffset, fileSize, o)
 	}
-	// Non-seeker fallback: manual discard then scan
-	var r io.Reader = f
+	// Non-seeker fallback: manual discard then walk
 	d := baseOffset + 7
-	if d < 0 {
-		d = 0
-	}
 	if d > 0 {
 		if _, err := io.CopyN(io.Discard, f, d); err != nil {
 			return err
 		}
 	}
-	br := bufio.NewReader(r)
-	return scanLegacy(br, vi, baseOffset)
+	br := bufio.NewReaderSize(f, legacySyncLimit)
+	return parseLegacy(br, nil, vi, baseOffset, fileSize, o)
 }
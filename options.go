@@ -0,0 +1,53 @@
+package rarlist
+
+// Option tunes how volumes are parsed by IndexVolumes, IndexVolumesParallel and ListFilesFS.
+type Option func(*options)
+
+type options struct {
+	sfxScanLimit int64
+	headerCRC    CRCMode
+	password     string
+}
+
+func newOptions(opts []Option) options {
+	o := options{sfxScanLimit: DefaultSFXScanLimit}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithSFXScanLimit bounds the forward search for a RAR signature in self-extracting volumes whose
+// executable stub could not be measured from its PE/ELF headers. n<=0 restores DefaultSFXScanLimit.
+func WithSFXScanLimit(n int64) Option {
+	return func(o *options) {
+		if n <= 0 {
+			n = DefaultSFXScanLimit
+		}
+		o.sfxScanLimit = n
+	}
+}
+
+// CRCMode selects what happens when a block header CRC does not match.
+type CRCMode int
+
+const (
+	CRCIgnore CRCMode = iota // header CRCs are not checked (default)
+	CRCWarn                  // mismatches are recorded as WarningHeaderCRC on the VolumeIndex
+	CRCStrict                // the first mismatch aborts parsing with an *ErrHeaderCRC
+)
+
+// WithHeaderCRC verifies every block header CRC: the RAR3 16-bit HEAD_CRC and the RAR5 header CRC32.
+func WithHeaderCRC(mode CRCMode) Option {
+	return func(o *options) { o.headerCRC = mode }
+}
+
+// WithPassword supplies the password of encrypted archives. Encrypted headers are then decrypted:
+// every RAR5 header after the archive encryption header, and every RAR 2.9-4.x block after a main
+// header with MHD_PASSWORD. ListFilesFS accepts files encrypted with RAR5 AES-256 or RAR3 AES-128
+// (see DecryptFileFS to read stored ones). Only RAR5 stores a password check value, whose mismatch
+// yields ErrWrongPassword; RAR3 has none, so a wrong password shows as an *ErrHeaderCRC on an
+// encrypted header or as a checksum mismatch of the decrypted data, never as ErrWrongPassword.
+func WithPassword(password string) Option {
+	return func(o *options) { o.password = password }
+}
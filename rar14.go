@@ -0,0 +1,134 @@
+package rarlist
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// RAR 1.3/1.4 layout: the 4 byte "RE~^" mark opens the main header (HEAD_SIZE counted from the mark),
+// followed by file headers back to back, each immediately followed by its packed data. There are no
+// block types, header CRCs or end-of-archive blocks.
+const (
+	rar14MainHeadSize = 7  // MARK(4) HEAD_SIZE(2) FLAGS(1)
+	rar14FileHeadSize = 21 // PACK_SIZE(4) UNP_SIZE(4) CRC(2) HEAD_SIZE(2) FTIME(4) ATTR(1) FLAGS(1) UNP_VER(1) NAME_SIZE(1) METHOD(1)
+)
+
+func parseRar14(br *bufio.Reader, seeker io.ReadSeeker, vi *VolumeIndex, baseOffset int64, fileSize int64) error {
+	var mh [rar14MainHeadSize]byte
+	if _, err := io.ReadFull(br, mh[:]); err != nil {
+		return fmt.Errorf("rar14 main header: %w", err)
+	}
+	headSize := int64(binary.LittleEndian.Uint16(mh[4:6]))
+	if headSize < rar14MainHeadSize {
+		return fmt.Errorf("rar14 main header too small: %d", headSize)
+	}
+	rest := make([]byte, headSize-rar14MainHeadSize)
+	if _, err := io.ReadFull(br, rest); err != nil {
+		return fmt.Errorf("rar14 main header: %w", err)
+	}
+	decodeRar14MainHeader(vi, mh[6], rest, baseOffset)
+	pos := baseOffset + headSize
+	for {
+		if fileSize > 0 && pos+rar14FileHeadSize > fileSize {
+			if pos < fileSize {
+				vi.warnf(WarningDataSize, pos, "%d trailing bytes after last file", fileSize-pos)
+			}
+			return nil
+		}
+		var fixed [rar14FileHeadSize]byte
+		if _, err := io.ReadFull(br, fixed[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		hdrSize := int64(binary.LittleEndian.Uint16(fixed[10:12]))
+		nameSize := int64(fixed[19])
+		if hdrSize < rar14FileHeadSize+nameSize {
+			vi.warnf(WarningDataSize, pos, "bad file header (size %d, name size %d), stopping", hdrSize, nameSize)
+			return nil
+		}
+		if fileSize > 0 && pos+hdrSize > fileSize {
+			vi.warnf(WarningDataSize, pos, "file header (size %d) runs past the end of the volume", hdrSize)
+			return nil
+		}
+		rest := make([]byte, hdrSize-rar14FileHeadSize)
+		if _, err := io.ReadFull(br, rest); err != nil {
+			return err
+		}
+		fb := decodeRar14FileHeader(fixed[:], rest[:nameSize], pos, hdrSize)
+		setRar15Solid(&fb, vi)
+		vi.FileBlocks = append(vi.FileBlocks, fb)
+		if len(vi.FileBlocks) == 1 {
+			vi.TotalHeaderBytes = fb.DataPos
+		}
+		pos = fb.DataPos
+		if fileSize > 0 && pos+fb.PackedSize > fileSize {
+			vi.warnf(WarningDataSize, fb.HeaderPos, "%s: PACK_SIZE %d exceeds the %d bytes left in volume", fb.Name, fb.PackedSize, fileSize-pos)
+			return nil
+		}
+		if err := skipRar3(br, seeker, fb.PackedSize); err != nil {
+			return err
+		}
+		pos += fb.PackedSize
+	}
+}
+
+// decodeRar14MainHeader records the RAR 1.4 main header flags and the archive comment stored inside it.
+func decodeRar14MainHeader(vi *VolumeIndex, flags byte, rest []byte, baseOffset int64) {
+	a := &vi.Archive
+	a.HasMainHeader = true
+	a.IsVolume = flags&0x01 != 0   // MHD_VOLUME
+	a.HasComment = flags&0x02 != 0 // MHD_COMMENT
+	a.Locked = flags&0x04 != 0     // MHD_LOCK
+	a.Solid = flags&0x08 != 0      // MHD_SOLID
+	if a.HasComment && len(rest) >= 2 {
+		n := int64(binary.LittleEndian.Uint16(rest[0:2]))
+		if n <= int64(len(rest))-2 {
+			vi.ServiceBlocks = append(vi.ServiceBlocks, ServiceBlock{
+				Name:         ServiceComment,
+				HeaderPos:    baseOffset,
+				DataPos:      baseOffset + rar14MainHeadSize + 2,
+				PackedSize:   n,
+				UnpackedSize: n,
+				Stored:       flags&0x10 == 0, // MHD_PACK_COMMENT
+				FileIndex:    -1,
+			})
+		}
+	}
+}
+
+// decodeRar14FileHeader builds a FileBlock from the fixed RAR 1.4 file header fields and the name.
+// Method 0 means stored; the dictionary is always 64 KiB.
+func decodeRar14FileHeader(fixed, name []byte, pos, hdrSize int64) FileBlock {
+	packSize := int64(binary.LittleEndian.Uint32(fixed[0:4]))
+	attr := fixed[16]
+	flags := fixed[17]
+	method := fixed[20]
+	algo := uint8(10)
+	if fixed[18] == 2 { // UNP_VER 2 marks RAR 1.3 compression
+		algo = 13
+	}
+	return FileBlock{
+		Name:             safeToString(name),
+		HeaderPos:        pos,
+		HeaderSize:       hdrSize,
+		DataPos:          pos + hdrSize,
+		PackedSize:       packSize,
+		VolumeDataSize:   packSize,
+		UnpackedSize:     int64(binary.LittleEndian.Uint32(fixed[4:8])),
+		Stored:           method == 0,
+		Encrypted:        flags&0x04 != 0,
+		ContinuedFrom:    flags&0x01 != 0,
+		ContinuedTo:      flags&0x02 != 0,
+		Continued:        flags&0x02 != 0,
+		IsDir:            attr&0x10 != 0,
+		ModTime:          dosTime(binary.LittleEndian.Uint32(fixed[12:16])),
+		Attributes:       uint64(attr),
+		AlgorithmVersion: algo,
+		Method:           method,
+		DictSize:         0x10000,
+	}
+}
@@ -5,14 +5,46 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"os"
+	"time"
+
+	"github.com/javi11/rarlist/internal/util"
 )
 
 const (
 	rar3BlockTypeFile = 0x74
 	rar3BlockTypeMain = 0x73
+	rar3BlockTypeEnd  = 0x7B
 )
 
+// isRar3BlockType reports whether t is one of the block types defined for RAR 2.x/3.x (MARK_HEAD..ENDARC_HEAD).
+func isRar3BlockType(t byte) bool { return t >= 0x72 && t <= rar3BlockTypeEnd }
+
+// rar3HeaderValid reports whether the complete block header hdr found at pos passes its CRC or, failing that
+// (and for AV and SIGN blocks, which have none), has a plausible layout: file headers long enough for their
+// name, and the header plus its payload within fileSize when known.
+func rar3HeaderValid(hdr []byte, pos, fileSize int64) bool {
+	t, flags := hdr[2], binary.LittleEndian.Uint16(hdr[3:5])
+	if t != rar3BlockTypeAV && t != rar3BlockTypeSign {
+		if want, got := rar3HeaderCRC(hdr); want == got {
+			return true
+		}
+	}
+	file := t == rar3BlockTypeFile || t == rar3BlockTypeNewSub
+	if file {
+		if n := rar3ShortCRCSpan(hdr); n == 0 || n > len(hdr) {
+			return false
+		}
+	}
+	end := pos + int64(len(hdr))
+	if flags&0x8000 != 0 || file { // file headers always start with PACK_SIZE
+		if len(hdr) < 11 {
+			return false
+		}
+		end += int64(binary.LittleEndian.Uint32(hdr[7:11]))
+	}
+	return fileSize <= 0 || end <= fileSize
+}
+
 type rar3BlockHeader struct {
 	CRC     uint16
 	Type    byte
@@ -21,7 +53,7 @@ type rar3BlockHeader struct {
 	AddSize uint32 // only if flags & 0x8000
 }
 
-func parseRar3(br *bufio.Reader, seeker io.ReadSeeker, vi *VolumeIndex, baseOffset int64, fileSize int64) error {
+func parseRar3(br *bufio.Reader, seeker io.ReadSeeker, vi *VolumeIndex, baseOffset int64, fileSize int64, o options) error {
 	pos := baseOffset
 	// RAR3 signature is 7 bytes: "Rar!\x1A\x07\x00"
 	if _, err := br.Discard(7); err != nil {
@@ -40,70 +72,240 @@ func parseRar3(br *bufio.Reader, seeker io.ReadSeeker, vi *VolumeIndex, baseOffs
 			}
 		}
 	}
+	// afterData names the file whose data ended at pos; the block found there must be a real header,
+	// otherwise the header's PACK_SIZE disagrees with the volume layout.
+	afterData := ""
+	var hdrKeys *keyCache // set when MHD_PASSWORD encrypts the headers following the main header
 	for {
+		// Stop once fewer bytes remain than a minimal block header (trailing padding / truncated volume).
+		if fileSize > 0 && pos+7 > fileSize {
+			if afterData != "" && pos < fileSize {
+				vi.warnf(WarningDataSize, pos, "%s: %d trailing bytes after file data", afterData, fileSize-pos)
+			}
+			break
+		}
 		hdrStart := pos
-		h, err := readRar3BlockHeader(br)
-		if err == io.EOF {
+		var h *rar3BlockHeader
+		var body []byte
+		var err error
+		hdrSize := int64(0) // volume bytes taken by the header, larger than HEAD_SIZE when encrypted
+		if hdrKeys != nil {
+			h, body, hdrSize, err = readRar3EncryptedHeader(br, vi, hdrStart, hdrKeys, fileSize-pos)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("encrypted header at %d: %w", hdrStart, err)
+			}
+		} else {
+			h, err = readRar3BlockHeader(br)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			hdrSize = int64(h.Size)
+		}
+		if afterData != "" && (!isRar3BlockType(h.Type) || h.Size < 7 || (h.Flags&0x8000 != 0 && h.Size < 11)) {
+			vi.warnf(WarningDataSize, hdrStart, "%s: no block header after file data (type 0x%02x, size %d)", afterData, h.Type, h.Size)
 			break
 		}
-		if err != nil {
+		// A file header cut off by the end of the volume is an error; other blocks just end the walk.
+		if h.Type != rar3BlockTypeFile && fileSize > 0 && hdrStart+hdrSize > fileSize {
+			break
+		}
+		if hdrKeys == nil {
+			if body, err = readRar3HeaderBody(br, h); err != nil {
+				return err
+			}
+		}
+		// A type byte in range is weak evidence on its own: the header found after file data must pass its
+		// CRC or, when damaged, at least have size fields that fit the volume (encrypted headers are checked
+		// when decrypted).
+		if afterData != "" && hdrKeys == nil && !rar3HeaderValid(rar3RawHeader(h, body), hdrStart, fileSize) {
+			vi.warnf(WarningDataSize, hdrStart, "%s: no valid block header after file data (type 0x%02x, size %d)", afterData, h.Type, h.Size)
+			break
+		}
+		afterData = ""
+		if err := vi.checkRar3HeaderCRC(o, hdrStart, rar3RawHeader(h, body)); err != nil {
 			return err
 		}
-		totalSize := int64(h.Size)
+		pos = hdrStart + hdrSize
+		var tail int64 // payload bytes following the header
 		if h.Flags&0x8000 != 0 {
-			totalSize += int64(h.AddSize)
+			tail = int64(h.AddSize)
+		}
+		if h.Type == rar3BlockTypeEnd { // end of archive: nothing meaningful follows
+			decodeRar3EndHeader(&vi.Archive, hdrStart, h, body)
+			break
 		}
-		// Detect encrypted headers at main archive header (RAR 3.x)
 		if h.Type == rar3BlockTypeMain {
+			decodeRar3MainHeader(&vi.Archive, h)
+			// RAR 2.x embeds the archive comment block in the main header, after HIGH_POS_AV(2) and POS_AV(4).
+			if vi.Archive.HasComment && h.Flags&0x8000 == 0 && len(body) >= 6+7 && body[6+2] == rar3BlockTypeComment {
+				if n := int(binary.LittleEndian.Uint16(body[6+5 : 6+7])); n <= len(body)-6 {
+					if sb, ok := decodeRar3SubBlock(body[6:6+n], hdrStart+13); ok {
+						vi.ServiceBlocks = append(vi.ServiceBlocks, sb)
+					}
+				}
+			}
+			// Detect encrypted headers at main archive header (RAR 3.x)
 			// In RAR 3.x, main header flag 0x0080 indicates encrypted headers (file names)
 			// Some archives also set 0x0200 to include an additional encrypt version byte.
-			if h.Flags&0x0080 != 0 || h.Flags&0x0200 != 0 {
+			if (h.Flags&0x0080 != 0 || h.Flags&0x0200 != 0) && o.password == "" {
 				return fmt.Errorf("%w (RAR3 headers encrypted)", ErrPasswordProtected)
 			}
+			if h.Flags&0x0080 != 0 {
+				vi.Archive.EncryptedHeaders = true
+				hdrKeys = newKeyCache(o.password)
+			}
+			if err := skipRar3(br, seeker, tail); err != nil {
+				return err
+			}
+			pos += tail
+			continue
+		}
+		if isRar3SubBlockType(h.Type) {
+			var sb ServiceBlock
+			if h.Type == rar3BlockTypeNewSub {
+				fb, subData, err := parseRar3FileHeader(vi, body, hdrStart, h)
+				if err != nil {
+					return err
+				}
+				fb.HeaderSize, fb.DataPos = hdrSize, pos
+				sb, tail = rar3NewSubBlock(fb, subData), fb.PackedSize
+			} else {
+				ok := false
+				if sb, ok = decodeRar3SubBlock(rar3RawHeader(h, body), hdrStart); !ok {
+					sb = ServiceBlock{HeaderType: h.Type, HeaderPos: hdrStart, DataPos: pos, FileIndex: -1}
+				} else if hdrKeys != nil && sb.DataPos >= hdrStart+int64(h.Size) { // payload after an encrypted header
+					sb.DataPos += hdrSize - int64(h.Size)
+				}
+			}
+			if rar3SubBlockOwnsFile(sb) && len(vi.FileBlocks) > 0 {
+				sb.FileIndex = len(vi.FileBlocks) - 1
+				sb.FileName = vi.FileBlocks[sb.FileIndex].Name
+			}
+			vi.ServiceBlocks = append(vi.ServiceBlocks, sb)
+			if fileSize > 0 && pos+tail > fileSize {
+				vi.warnf(WarningDataSize, hdrStart, "%s: sub-block data size %d exceeds the %d bytes left in volume", sb.Name, tail, fileSize-pos)
+				break
+			}
+			if err := skipRar3(br, seeker, tail); err != nil {
+				return err
+			}
+			pos += tail
+			if tail > 0 {
+				afterData = sb.Name
+			}
+			continue
 		}
 		if h.Type == rar3BlockTypeFile {
-			fb, err := parseRar3FileHeader(br, hdrStart, h, pos, fileSize)
+			fb, _, err := parseRar3FileHeader(vi, body, hdrStart, h)
 			if err != nil {
 				return err
 			}
+			fb.HeaderSize, fb.DataPos = hdrSize, pos
+			setRar15Solid(&fb, vi)
 			vi.FileBlocks = append(vi.FileBlocks, fb)
-		} else {
-			// skip rest of block body (already consumed header bytes?)
-			toSkip := totalSize - 7 // header struct bytes read
-			if h.Flags&0x8000 != 0 {
-				toSkip -= 4 // adjust because we counted addSize in header bytes consumed by readRar3BlockHeader
+			if len(vi.FileBlocks) == 1 {
+				vi.TotalHeaderBytes = fb.DataPos
 			}
-			if toSkip > 0 {
-				if seeker != nil {
-					if b := br.Buffered(); b > 0 { // drain buffer first
-						if int64(b) > toSkip {
-							b = int(toSkip)
-						}
-						if _, err := br.Discard(b); err != nil {
-							return err
-						}
-						toSkip -= int64(b)
-					}
-					if toSkip > 0 {
-						if _, err := seeker.Seek(toSkip, io.SeekCurrent); err == nil {
-							pos += totalSize
-							continue
-						}
-					}
-				}
-				if toSkip > 0 {
-					if _, err := br.Discard(int(toSkip)); err != nil {
-						return err
-					}
-				}
+			// Skip the file's packed data (ADD_SIZE) so the walk continues with the next header.
+			pos = fb.DataPos
+			if fileSize > 0 && pos+fb.PackedSize > fileSize { // data runs past end of volume (truncated)
+				vi.warnf(WarningDataSize, hdrStart, "%s: PACK_SIZE %d exceeds the %d bytes left in volume", fb.Name, fb.PackedSize, fileSize-pos)
+				break
 			}
+			if err := skipRar3(br, seeker, fb.PackedSize); err != nil {
+				return err
+			}
+			pos += fb.PackedSize
+			afterData = fb.Name
+			continue
 		}
-		pos += totalSize
-		// Stop condition: we only need header region until first file data.
-		if len(vi.FileBlocks) > 0 {
-			vi.TotalHeaderBytes = vi.FileBlocks[0].DataPos
+		// other blocks: skip the ADD_SIZE payload, if any
+		if fileSize > 0 && pos+tail > fileSize {
 			break
 		}
+		if err := skipRar3(br, seeker, tail); err != nil {
+			return err
+		}
+		pos += tail
+	}
+	return nil
+}
+
+// readRar3HeaderBody reads the header bytes following the common block fields (up to HEAD_SIZE).
+func readRar3HeaderBody(br *bufio.Reader, h *rar3BlockHeader) ([]byte, error) {
+	n := int(h.Size) - 7
+	if h.Flags&0x8000 != 0 {
+		n -= 4
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// decodeRar3MainHeader records the MAIN_HEAD (0x73) archive flags.
+func decodeRar3MainHeader(a *ArchiveInfo, h *rar3BlockHeader) {
+	a.HasMainHeader = true
+	a.IsVolume = h.Flags&0x0001 != 0     // MHD_VOLUME
+	a.HasComment = h.Flags&0x0002 != 0   // MHD_COMMENT
+	a.Locked = h.Flags&0x0004 != 0       // MHD_LOCK
+	a.Solid = h.Flags&0x0008 != 0        // MHD_SOLID
+	a.NewNumbering = h.Flags&0x0010 != 0 // MHD_NEWNUMBERING
+	a.HasRecovery = h.Flags&0x0040 != 0  // MHD_PROTECT
+	a.FirstVolume = h.Flags&0x0100 != 0  // MHD_FIRSTVOLUME (RAR 3.0+)
+	if a.FirstVolume {
+		a.VolumeNumber, a.HasVolumeNumber = 0, true
+	}
+}
+
+// decodeRar3EndHeader records the ENDARC_HEAD (0x7B) at pos: next-volume flag, data CRC and volume number.
+func decodeRar3EndHeader(a *ArchiveInfo, pos int64, h *rar3BlockHeader, body []byte) {
+	a.HasEnd, a.EndPos = true, pos
+	a.NextVolume = h.Flags&0x0001 != 0         // EARC_NEXT_VOLUME
+	if h.Flags&0x0002 != 0 && len(body) >= 4 { // EARC_DATACRC
+		a.DataCRC, a.HasDataCRC = binary.LittleEndian.Uint32(body[0:4]), true
+		body = body[4:]
+	}
+	if h.Flags&0x0008 != 0 && len(body) >= 2 { // EARC_VOLNUMBER
+		a.VolumeNumber, a.HasVolumeNumber = int(binary.LittleEndian.Uint16(body[0:2])), true
+	}
+}
+
+// skipRar3 advances n bytes, draining buffered bytes first and seeking the remainder when possible.
+func skipRar3(br *bufio.Reader, seeker io.ReadSeeker, n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	if seeker != nil {
+		if b := br.Buffered(); b > 0 { // drain buffer first
+			if int64(b) > n {
+				b = int(n)
+			}
+			if _, err := br.Discard(b); err != nil {
+				return err
+			}
+			n -= int64(b)
+		}
+		if n > 0 {
+			if _, err := seeker.Seek(n, io.SeekCurrent); err == nil {
+				return nil
+			}
+		}
+	}
+	if n > 0 {
+		if _, err := io.CopyN(io.Discard, br, n); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -129,176 +331,181 @@ func readRar3BlockHeader(br *bufio.Reader) (*rar3BlockHeader, error) {
 	return h, nil
 }
 
-func parseRar3FileHeader(br *bufio.Reader, hdrStart int64, bh *rar3BlockHeader, currentPos int64, fileSize int64) (FileBlock, error) {
-	// We have already read 7 or 11 bytes of header. Need to read rest of file header fixed part.
+// parseRar3FileHeader decodes a file header, or a NEWSUB header sharing its layout. For NEWSUB headers the
+// sub data between the name and the salt (e.g. the NTFS stream name) is returned as well.
+func parseRar3FileHeader(vi *VolumeIndex, rest []byte, hdrStart int64, bh *rar3BlockHeader) (FileBlock, []byte, error) {
+	// rest holds the header bytes after the 7 or 11 already decoded by readRar3BlockHeader, up to HEAD_SIZE.
 	// RAR3 file header layout after initial block header fields:
 	// PACK_SIZE (4), UNP_SIZE (4), HOST_OS(1), FILE_CRC(4), FTIME(4), UNP_VER(1), METHOD(1), NAME_SIZE(2), ATTR(4)
+	// [HIGH_PACK_SIZE(4) HIGH_UNP_SIZE(4)] FILE_NAME [SALT(8)] [EXT_TIME]
+	// With LONG_BLOCK (0x8000) set, the ADD_SIZE consumed by readRar3BlockHeader is PACK_SIZE itself.
 	var fixed [25]byte
-	if _, err := io.ReadFull(br, fixed[:]); err != nil {
-		return FileBlock{}, err
+	consumed := 7
+	if bh.Flags&0x8000 != 0 {
+		binary.LittleEndian.PutUint32(fixed[0:4], bh.AddSize)
+		consumed += 4
+	}
+	if int(bh.Size) < 7+len(fixed) {
+		return FileBlock{}, nil, fmt.Errorf("rar3 file header too small: %d", bh.Size)
+	}
+	if len(rest) < int(bh.Size)-consumed {
+		return FileBlock{}, nil, fmt.Errorf("rar3 file header truncated")
 	}
-	packSize := binary.LittleEndian.Uint32(fixed[0:4])
-	unpSize := binary.LittleEndian.Uint32(fixed[4:8])
+	off := copy(fixed[consumed-7:], rest)
+	packSize := uint64(binary.LittleEndian.Uint32(fixed[0:4]))
+	unpSize := uint64(binary.LittleEndian.Uint32(fixed[4:8]))
 	method := fixed[18]
 	// RAR3 file header structure: nameSize is at position 19-20 (0-indexed) of the fixed part
 	nameSize := binary.LittleEndian.Uint16(fixed[19:21])
+	opt := rest[off:] // optional fields following the fixed part
+
+	// LHD_LARGE: high 32 bits of packed/unpacked sizes precede the name
+	if bh.Flags&0x0100 != 0 {
+		if len(opt) < 8 {
+			return FileBlock{}, nil, fmt.Errorf("rar3 high size fields truncated")
+		}
+		packSize |= uint64(binary.LittleEndian.Uint32(opt[0:4])) << 32
+		unpSize |= uint64(binary.LittleEndian.Uint32(opt[4:8])) << 32
+		opt = opt[8:]
+	}
 
 	// If nameSize is 0, calculate based on block header size
 	if nameSize == 0 {
-		// The block Size field contains only the header size, not file data
-		// It includes: header (7 or 11) + fixed part (25) + name + optional fields
-		headerSize := int64(7)
-		if bh.Flags&0x8000 != 0 {
-			headerSize = 11
-		}
-		totalHeaderSize := int64(bh.Size) // This is just the header, not file data
 		// Remaining space for name (before any salt or other optional fields)
-		remainingBytes := totalHeaderSize - headerSize - 25
-
+		remainingBytes := len(opt)
+		if bh.Flags&0x0400 != 0 {
+			remainingBytes -= 8
+		}
 		if remainingBytes > 0 && remainingBytes < 512 { // Reasonable filename length
 			nameSize = uint16(remainingBytes)
+			vi.warnf(WarningFileName, hdrStart, "NAME_SIZE 0: name taken from the %d header bytes left", remainingBytes)
 		}
 	}
-
-	// Debug logging for name parsing
-	if debug := os.Getenv("RARINDEX_DEBUG"); debug != "" {
-		fmt.Fprintf(os.Stderr, "[rar3] fixed[19:21]=[%02x %02x], nameSize=%d\n", fixed[19], fixed[20], nameSize)
-		fmt.Fprintf(os.Stderr, "[rar3] method=0x%02x packSize=%d unpSize=%d\n", method, packSize, unpSize)
-		fmt.Fprintf(os.Stderr, "[rar3] block size=%d, flags=0x%04x\n", bh.Size, bh.Flags)
+	if int(nameSize) > len(opt) {
+		return FileBlock{}, nil, fmt.Errorf("rar3 name size %d exceeds header (%d left)", nameSize, len(opt))
 	}
 
-	// read filename
-	nameBytes := make([]byte, nameSize)
-	if _, err := io.ReadFull(br, nameBytes); err != nil {
-		return FileBlock{}, err
+	nameBytes := opt[:nameSize]
+	var salt []byte
+	if bh.Flags&0x0400 != 0 && bh.Type == rar3BlockTypeFile && len(opt)-int(nameSize) >= 8 { // LHD_SALT follows the name
+		salt = append([]byte(nil), opt[nameSize:nameSize+8]...)
+	}
+	var subData []byte
+	if bh.Type == rar3BlockTypeNewSub {
+		sub := opt[nameSize:]
+		if bh.Flags&0x0400 != 0 && len(sub) >= 8 {
+			sub = sub[:len(sub)-8]
+		}
+		if len(sub) > 0 {
+			subData = append([]byte(nil), sub...)
+		}
 	}
 
 	// Parse the filename from nameBytes
 	var name string
-	if len(nameBytes) > 0 {
-		// Check for RAR format variation with extra bytes before filename
-		// Pattern: control char (< 32) followed by nulls, then actual filename
-		startIdx := 0
-		if len(nameBytes) > 4 && nameBytes[0] < 32 {
-			// Check if we have the pattern: [control_char 00 00 00] before filename
-			hasExtraBytes := true
-			for i := 1; i < 4 && i < len(nameBytes); i++ {
-				if nameBytes[i] != 0 {
-					hasExtraBytes = false
-					break
-				}
-			}
-			if hasExtraBytes {
-				// Skip the first 4 bytes to get to the actual filename
-				startIdx = 4
-			}
+	if bh.Flags&0x0200 != 0 && len(nameBytes) > 0 {
+		// LHD_UNICODE: ASCII name, zero byte, then the encoded Unicode form. Without the zero byte the name is UTF-8.
+		if zero := indexByte(nameBytes, 0); zero >= 0 {
+			name = util.DecodeRar3Unicode(nameBytes[:zero], nameBytes[zero+1:])
+		} else {
+			name = safeToString(nameBytes)
 		}
-
-		// Extract filename starting from the determined index
-		if startIdx < len(nameBytes) {
-			// Look for null terminator from the start position
-			nullPos := -1
-			for i := startIdx; i < len(nameBytes); i++ {
-				if nameBytes[i] == 0 {
-					nullPos = i
-					break
-				}
-			}
-
-			if nullPos > startIdx {
-				name = string(nameBytes[startIdx:nullPos])
-			} else if startIdx == 0 {
-				// Original logic for backward compatibility
-				// Clean the filename by removing control characters
-				cleanBytes := make([]byte, 0, len(nameBytes))
-				for _, b := range nameBytes {
-					if b >= 32 && b <= 126 { // printable ASCII characters
-						cleanBytes = append(cleanBytes, b)
-					}
-				}
-				name = string(cleanBytes)
-			} else {
-				// Use remaining bytes after skipping extra bytes
-				name = string(nameBytes[startIdx:])
-			}
+	} else {
+		// Without LHD_UNICODE the name is in the code page of the archiving system, taken as it is, except
+		// for the control byte and three zeros some writers put before it.
+		n := nameBytes
+		if len(n) > 4 && n[0] < 32 && n[1] == 0 && n[2] == 0 && n[3] == 0 {
+			vi.warnf(WarningFileName, hdrStart, "%q: 4 bytes before the name skipped", n[:4])
+			n = n[4:]
 		}
+		if zero := indexByte(n, 0); zero >= 0 {
+			vi.warnf(WarningFileName, hdrStart, "%q: name cut at a zero byte", n[:zero])
+			n = n[:zero]
+		}
+		name = string(n)
 	}
 
-	// Debug logging for parsed name
-	if debug := os.Getenv("RARINDEX_DEBUG"); debug != "" {
-		fmt.Fprintf(os.Stderr, "[rar3] raw name bytes: %v\n", nameBytes)
-		fmt.Fprintf(os.Stderr, "[rar3] parsed name='%s'\n", name)
-	}
-	headerSize := int64(7) // initial block header
-	if bh.Flags&0x8000 != 0 {
-		headerSize += 4
-	}
-	headerSize += 25 + int64(nameSize)
-	// RAR3 may have salt if flags & 0x400
-	if bh.Flags&0x0400 != 0 { // salt present
-		if _, err := br.Discard(8); err != nil {
-			return FileBlock{}, err
-		}
-		headerSize += 8
-	}
-	dataPos := hdrStart + headerSize // Data starts immediately after header
-	// In RAR3, method byte interpretation for solid archives:
-	// - Solid archives: all files may share same packed size and compression method
-	// - Check if this might be a solid archive (multiple files with same packed size)
-	// - For solid archives with storage method (-m0), treat as stored despite method byte
-	// - Method byte 0x30 ('0') = explicitly stored
-	// - If packSize == unpSize, definitely stored
-	methodType := method & 0x0F // Extract lower 4 bits for method type
-
-	// Heuristic: if method shows compression but unrar says -m0, this might be a
-	// solid archive where individual file headers show compression method but
-	// the actual data is stored. We'll be permissive here.
-	stored := (packSize == unpSize) || (method == 0x30) || (methodType == 0)
-
-	// For now, assume files in archives that report -m0 are actually stored
-	// even if method byte suggests compression (solid archive case)
-	if methodType == 1 && method == 0x81 {
-		// This is likely a solid archive with storage method
-		stored = true
-	}
+	// Salt (0x0400) and extended time (0x1000) follow the name; both live inside HEAD_SIZE,
+	// so the data always starts right after the declared header size.
+	headerSize := int64(bh.Size)
+	dataPos := hdrStart + headerSize
+	// Method byte 0x30 ('0') stores the data, 0x31-0x35 compress it.
+	stored := method == 0x30
 
 	encrypted := (bh.Flags & 0x0004) != 0
 
-	// Calculate actual volume data size: The packSize from header is total across all volumes.
-	// For multi-volume archives, we need to calculate the actual data size in this specific volume.
-	// This is done by: total file size - data start position - RAR format trailing bytes
-	// Note: dataPos already accounts for the 2-byte RAR format marker
-	volumeDataSize := fileSize - dataPos - 20 // Subtract 20 bytes for RAR format trailing markers
-
-	// Use the calculated volume size if it looks like a real multi-volume archive
-	// (i.e., significant data after headers), otherwise use header packed size.
-	// This handles both real multi-volume files and synthetic test files correctly.
-	if volumeDataSize <= 0 || volumeDataSize > int64(packSize)*100 || packSize < 1000 {
-		// Fallback to header packed size if:
-		// 1. No data after headers (test files)
-		// 2. Calculated size is suspiciously large compared to header (corrupted data)
-		// 3. Small packed size suggests test file or single volume
-		volumeDataSize = int64(packSize)
-	}
-
-	// Debug logging for compression method detection and volume size calculation
-	if debug := os.Getenv("RARINDEX_DEBUG"); debug != "" {
-		fmt.Fprintf(os.Stderr, "[rar3] file=%s method=0x%02x methodType=%d packed=%d unpacked=%d stored=%v\n", name, method, methodType, packSize, unpSize, stored)
-		fmt.Fprintf(os.Stderr, "[rar3]   headerPos=%d headerSize=%d dataPos=%d currentPos=%d\n", hdrStart, headerSize, dataPos, currentPos)
-		fmt.Fprintf(os.Stderr, "[rar3]   fileSize=%d calculated=%d final=%d (header_packed=%d)\n", fileSize, fileSize-dataPos, volumeDataSize, packSize)
-	}
+	// Each split piece carries its own PACK_SIZE: the amount of data stored in this volume.
+	// parseRar3 cross-checks it against the position of the following header.
+	volumeDataSize := int64(packSize)
 	return FileBlock{
 		Name:           name,
 		HeaderPos:      hdrStart,
 		HeaderSize:     headerSize,
 		DataPos:        dataPos,
-		PackedSize:     int64(packSize),    // Keep original header value for extraction
-		VolumeDataSize: volumeDataSize,     // Actual volume data size for reporting
-		Continued:      unpSize > packSize, // simplistic heuristic
+		PackedSize:     int64(packSize), // Keep original header value for extraction
+		VolumeDataSize: volumeDataSize,  // Data size stored in this volume
+		Continued:      bh.Flags&0x0002 != 0,
+		ContinuedFrom:  bh.Flags&0x0001 != 0, // LHD_SPLIT_BEFORE
+		ContinuedTo:    bh.Flags&0x0002 != 0, // LHD_SPLIT_AFTER
 		UnpackedSize:   int64(unpSize),
 		Stored:         stored,
 		Encrypted:      encrypted,
-	}, nil
+		Salt:           salt,
+		// LHD_WINDOWMASK bits 5-7: 0b111 marks a directory, otherwise dictionary 64 KiB << n.
+		IsDir:            bh.Flags&0x00E0 == 0x00E0,
+		ModTime:          dosTime(binary.LittleEndian.Uint32(fixed[13:17])),
+		CRC32:            binary.LittleEndian.Uint32(fixed[9:13]),
+		HasCRC32:         true,
+		HostOS:           fixed[8],
+		Attributes:       uint64(binary.LittleEndian.Uint32(fixed[21:25])),
+		AlgorithmVersion: fixed[17],
+		Solid:            bh.Flags&0x0010 != 0, // LHD_SOLID
+		Method:           rar3Method(method),
+		DictSize:         rar3DictSize(bh.Flags),
+	}, subData, nil
+}
+
+// setRar15Solid applies the solid rule of files packed by RAR 1.5 and older (UNP_VER below 20), whose
+// headers carry no solid flag of their own: in a solid archive every file after the first compressed one
+// continues the stream. A volume is assumed to start with the rest of a split file, so a file starting
+// exactly at the beginning of a later volume is taken as the start of a new stream.
+func setRar15Solid(fb *FileBlock, vi *VolumeIndex) {
+	if fb.AlgorithmVersion >= 20 {
+		return
+	}
+	fb.Solid = false
+	for _, prev := range vi.FileBlocks {
+		if vi.Archive.Solid && !prev.Stored && !prev.IsDir {
+			fb.Solid = true
+			break
+		}
+	}
+}
+
+// rar3Method maps the METHOD byte ('0' store .. '5' best) to 0..5.
+func rar3Method(m byte) uint8 {
+	if m >= 0x30 && m <= 0x35 {
+		return m - 0x30
+	}
+	return m
+}
+
+// rar3DictSize decodes the dictionary size from file header flags bits 5-7 (0 for directories).
+func rar3DictSize(flags uint16) int64 {
+	n := (flags >> 5) & 0x07
+	if n == 0x07 {
+		return 0
+	}
+	return int64(0x10000) << n
+}
+
+// dosTime converts an MS-DOS date/time value (as stored in RAR 1.5-3.x headers) to local time.
+func dosTime(v uint32) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Date(int(v>>25)+1980, time.Month((v>>21)&0x0F), int((v>>16)&0x1F),
+		int((v>>11)&0x1F), int((v>>5)&0x3F), int(v&0x1F)*2, 0, time.Local)
 }
 
 // Helpers shared with legacy parsing
@@ -0,0 +1,140 @@
+package rarlist
+
+import (
+	"encoding/binary"
+)
+
+// RAR 2.x/3.x sub-block types: old style dedicated blocks (0x75-0x79) and the RAR 3.x NEWSUB block.
+const (
+	rar3BlockTypeComment = 0x75 // COMM_HEAD: archive comment, data inside the header
+	rar3BlockTypeAV      = 0x76 // AV_HEAD: authenticity information, data inside the header
+	rar3BlockTypeSub     = 0x77 // SUB_HEAD: OS/2 EA, Unix owner, NTFS ACL/stream, ... data after the header
+	rar3BlockTypeProtect = 0x78 // PROTECT_HEAD: recovery record, data after the header
+	rar3BlockTypeSign    = 0x79 // SIGN_HEAD: archive signature, data inside the header
+	rar3BlockTypeNewSub  = 0x7A // NEWSUB_HEAD: service block laid out like a file header
+)
+
+// isRar3SubBlockType reports whether t is a sub-block decoded into a ServiceBlock.
+func isRar3SubBlockType(t byte) bool { return t >= rar3BlockTypeComment && t <= rar3BlockTypeNewSub }
+
+// rar3OldSubTypes maps SUB_HEAD sub-types to the names their NEWSUB successors use.
+var rar3OldSubTypes = map[uint16]string{
+	0x100: ServiceOS2EA,     // EA_HEAD
+	0x101: ServiceUnixOwner, // UO_HEAD
+	0x102: ServiceMacInfo,   // MAC_HEAD
+	0x103: ServiceBeOSEA,    // BEEA_HEAD
+	0x104: ServiceACL,       // NTACL_HEAD
+	0x105: ServiceStream,    // STREAM_HEAD
+}
+
+// rar3RawHeader reassembles the bytes of a block header (HEAD_CRC up to HEAD_SIZE) from its decoded
+// common fields and the body returned by readRar3HeaderBody.
+func rar3RawHeader(h *rar3BlockHeader, body []byte) []byte {
+	raw := make([]byte, 7, int(h.Size))
+	binary.LittleEndian.PutUint16(raw[0:2], h.CRC)
+	raw[2] = h.Type
+	binary.LittleEndian.PutUint16(raw[3:5], h.Flags)
+	binary.LittleEndian.PutUint16(raw[5:7], h.Size)
+	if h.Flags&0x8000 != 0 {
+		raw = binary.LittleEndian.AppendUint32(raw, h.AddSize)
+	}
+	return append(raw, body...)
+}
+
+// decodeRar3SubBlock decodes an old style sub-block (0x75-0x79) from its raw header bytes found at pos.
+// Payloads stored inside the header start right after the fixed fields; SUB_HEAD and PROTECT_HEAD
+// payloads follow the header and span ADD_SIZE bytes. ok is false for other or truncated blocks.
+func decodeRar3SubBlock(hdr []byte, pos int64) (sb ServiceBlock, ok bool) {
+	if len(hdr) < 7 {
+		return sb, false
+	}
+	flags := binary.LittleEndian.Uint16(hdr[3:5])
+	size := int64(len(hdr))
+	var addSize int64
+	if flags&0x8000 != 0 && len(hdr) >= 11 {
+		addSize = int64(binary.LittleEndian.Uint32(hdr[7:11]))
+	}
+	sb = ServiceBlock{HeaderType: hdr[2], HeaderPos: pos, FileIndex: -1}
+	inHeader := func(fixed int64) {
+		sb.DataPos, sb.PackedSize = pos+fixed, size-fixed
+	}
+	switch hdr[2] {
+	case rar3BlockTypeComment: // UNP_SIZE(2) UNP_VER(1) METHOD(1) COMM_CRC(2)
+		if size < 13 {
+			return sb, false
+		}
+		sb.Name = ServiceComment
+		inHeader(13)
+		sb.UnpackedSize = int64(binary.LittleEndian.Uint16(hdr[7:9]))
+		sb.Stored = hdr[10] == 0x30
+	case rar3BlockTypeAV: // UNP_VER(1) METHOD(1) AV_VER(1) AV_INFO_CRC(4)
+		if size < 14 {
+			return sb, false
+		}
+		sb.Name = ServiceAuthenticity
+		inHeader(14)
+		sb.UnpackedSize = sb.PackedSize
+		sb.Stored = hdr[8] == 0x30
+	case rar3BlockTypeSub: // DATA_SIZE(4) SUB_TYPE(2) LEVEL(1) [UNP_SIZE(4) UNP_VER(1) METHOD(1) CRC(4) [NAME_SIZE(2) NAME]]
+		if size < 14 || flags&0x8000 == 0 {
+			return sb, false
+		}
+		subType := binary.LittleEndian.Uint16(hdr[11:13])
+		if sb.Name = rar3OldSubTypes[subType]; sb.Name == "" {
+			sb.Name = "SUB"
+		}
+		sb.DataPos, sb.PackedSize = pos+size, addSize
+		if size >= 20 {
+			sb.UnpackedSize = int64(binary.LittleEndian.Uint32(hdr[14:18]))
+			sb.Stored = hdr[19] == 0x30
+		}
+		if sb.Name == ServiceStream && size >= 26 {
+			if n := int64(binary.LittleEndian.Uint16(hdr[24:26])); 26+n <= size {
+				sb.Data = append([]byte(nil), hdr[26:26+n]...)
+			}
+		}
+	case rar3BlockTypeProtect: // DATA_SIZE(4) VERSION(1) REC_SECTORS(2) TOTAL_BLOCKS(4) MARK(8)
+		if flags&0x8000 == 0 {
+			return sb, false
+		}
+		sb.Name = ServiceRecovery
+		sb.DataPos, sb.PackedSize, sb.UnpackedSize = pos+size, addSize, addSize
+		sb.Stored = true
+		if size >= 26 {
+			sb.Data = append([]byte(nil), hdr[11:26]...)
+		}
+	case rar3BlockTypeSign: // CREATION_TIME(4) ARC_NAME_SIZE(2) USER_NAME_SIZE(2)
+		if size < 15 {
+			return sb, false
+		}
+		sb.Name = ServiceSignature
+		inHeader(15)
+		sb.UnpackedSize = sb.PackedSize
+		sb.Stored = true
+	default:
+		return sb, false
+	}
+	return sb, true
+}
+
+// rar3NewSubBlock converts a NEWSUB header, parsed like a file header, into a ServiceBlock.
+func rar3NewSubBlock(fb FileBlock, subData []byte) ServiceBlock {
+	return ServiceBlock{Name: fb.Name, HeaderType: rar3BlockTypeNewSub, HeaderPos: fb.HeaderPos, DataPos: fb.DataPos, PackedSize: fb.PackedSize,
+		UnpackedSize: fb.UnpackedSize, Stored: fb.Stored, Encrypted: fb.Encrypted, Data: subData, FileIndex: -1}
+}
+
+// rar3SubBlockOwnsFile reports whether sb belongs to the file header preceding it rather than to the archive.
+// RAR 3.x writes no per-file comments, so only archive-level names are excluded.
+func rar3SubBlockOwnsFile(sb ServiceBlock) bool {
+	switch sb.HeaderType {
+	case rar3BlockTypeSub:
+		return true
+	case rar3BlockTypeNewSub:
+		switch sb.Name {
+		case ServiceComment, ServiceAuthenticity, ServiceRecovery, ServiceSignature:
+			return false
+		}
+		return true
+	}
+	return false
+}
@@ -2,64 +2,102 @@ package rarlist
 
 import (
 	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"os"
+	"time"
 
 	"github.com/javi11/rarlist/internal/parse"
 )
 
+// rar5MaxHeadSize caps the header size accepted before reading a header.
+const rar5MaxHeadSize = 2 * 1024 * 1024
+
 // testHookParseRar5 allows tests to invoke parseRar5 directly (not exported in build tags) for edge coverage.
 var testHookParseRar5 = parseRar5
 
 // parseRar5 implements spec-based parsing and collects all file headers.
-func parseRar5(br *bufio.Reader, seeker io.ReadSeeker, vi *VolumeIndex, baseOffset int64, fileSize int64) error {
+func parseRar5(br *bufio.Reader, seeker io.ReadSeeker, vi *VolumeIndex, baseOffset int64, fileSize int64, o options) error {
 	if _, err := br.Discard(8); err != nil {
 		return fmt.Errorf("discard signature: %w", err)
 	}
 	pos := baseOffset + 8
-	debug := os.Getenv("RARINDEX_DEBUG") != ""
-	logDebug := func(format string, a ...any) {
-		if debug {
-			fmt.Fprintf(os.Stderr, "[rar5] "+format+"\n", a...)
-		}
-	}
+	var hdrCipher cipher.Block // set once the archive encryption header is read
 	for {
 		if fileSize > 0 && pos >= fileSize {
 			return nil
 		}
 		hdrStart := pos
 		var crc [4]byte
-		if _, err := io.ReadFull(br, crc[:]); err != nil {
-			if errors.Is(err, io.EOF) {
+		var sizeBytes, headData []byte
+		var headSize uint64
+		var headSizeLen int64
+		if hdrCipher != nil {
+			plain, raw, err := readRar5EncryptedHeader(br, hdrCipher, fileSize-pos)
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				return fmt.Errorf("encrypted header at %d: %w", hdrStart, err)
+			}
+			if plain == nil { // zero size or truncated: stop like for plain headers
+				vi.warnf(WarningDataSize, hdrStart, "unusable encrypted header, stopping")
 				return nil
 			}
-			return fmt.Errorf("read block crc at %d: %w", pos, err)
-		}
-		pos += 4
-		headSize, headSizeLen, err := parse.ReadVarint(br)
-		if err != nil {
-			return fmt.Errorf("read headSize at %d: %w", pos, err)
-		}
-		pos += headSizeLen
-		if headSize == 0 { // tolerant: treat as end marker / padding
-			logDebug("zero headSize encountered at %d -> stop", hdrStart)
-			return nil
-		}
-		if headSize > 2*1024*1024 {
-			return fmt.Errorf("suspicious headSize %d at %d", headSize, hdrStart)
-		}
-		if fileSize > 0 && pos+int64(headSize) > fileSize { // truncated / misaligned -> stop gracefully
-			logDebug("headSize exceeds remaining file (%d) at %d -> stop", headSize, hdrStart)
-			return nil
-		}
-		headData := make([]byte, headSize)
-		if _, err := io.ReadFull(br, headData); err != nil {
-			return fmt.Errorf("read headData size=%d at %d: %w", headSize, hdrStart, err)
+			pos += raw
+			v, n, _ := parse.ReadVarintFromSlice(plain[4:])
+			copy(crc[:], plain)
+			headSize, headSizeLen, sizeBytes = v, n, plain[4:4+n]
+			headData = plain[4+n : 4+n+int64(v)]
+		} else {
+			if _, err := io.ReadFull(br, crc[:]); err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil
+				}
+				return fmt.Errorf("read block crc at %d: %w", pos, err)
+			}
+			pos += 4
+			// keep the raw headSize bytes: the header CRC32 covers them along with the header data
+			sizeBytes, _ = br.Peek(10)
+			sizeBytes = append([]byte(nil), sizeBytes...)
+			var err error
+			headSize, headSizeLen, err = parse.ReadVarint(br)
+			if err != nil {
+				return fmt.Errorf("read headSize at %d: %w", pos, err)
+			}
+			pos += headSizeLen
+			if headSize == 0 { // tolerant: treat as end marker / padding
+				vi.warnf(WarningDataSize, hdrStart, "zero header size, stopping")
+				return nil
+			}
+			if headSize > rar5MaxHeadSize {
+				return fmt.Errorf("suspicious headSize %d at %d", headSize, hdrStart)
+			}
+			if fileSize > 0 && pos+int64(headSize) > fileSize { // truncated / misaligned -> stop gracefully
+				vi.warnf(WarningDataSize, hdrStart, "header size %d runs past the end of the volume", headSize)
+				return nil
+			}
+			headData = make([]byte, headSize)
+			if _, err := io.ReadFull(br, headData); err != nil {
+				return fmt.Errorf("read headData size=%d at %d: %w", headSize, hdrStart, err)
+			}
+			pos += int64(headSize)
 		}
-		pos += int64(headSize)
 		cur := 0
+		if o.headerCRC != CRCIgnore && int(headSizeLen) <= len(sizeBytes) {
+			c := crc32.Update(crc32.ChecksumIEEE(sizeBytes[:headSizeLen]), crc32.IEEETable, headData)
+			var blockType uint8
+			if t, _, e := parse.ReadVarintFromSlice(headData); e == nil {
+				blockType = uint8(t)
+			}
+			if err := vi.headerCRCMismatch(o, hdrStart, blockType, binary.LittleEndian.Uint32(crc[:]), c); err != nil {
+				return err
+			}
+		}
 		readVar := func() (uint64, int, error) {
 			v, n, e := parse.ReadVarintFromSlice(headData[cur:])
 			if e != nil {
@@ -99,13 +137,35 @@ func parseRar5(br *bufio.Reader, seeker io.ReadSeeker, vi *VolumeIndex, baseOffs
 			}
 			blockSpecificEnd -= int(extraAreaSize)
 		}
-		if debug {
-			logDebug("hdr @%d type=%d flags=%#x headSize=%d extra=%d data=%d cur=%d blockSpecificEnd=%d", hdrStart, blockType, flags, headSize, extraAreaSize, dataSize, cur, blockSpecificEnd)
+		if blockType == 1 { // Main archive header
+			if blockSpecificEnd < cur {
+				return fmt.Errorf("blockSpecificEnd<cur")
+			}
+			if err := decodeRar5MainHeader(&vi.Archive, headData[cur:blockSpecificEnd]); err != nil {
+				return err
+			}
 		}
 		if blockType == 4 { // Archive encryption header: all subsequent headers are encrypted
-			return fmt.Errorf("%w (RAR5 headers encrypted)", ErrPasswordProtected)
+			vi.Archive.EncryptedHeaders = true
+			if o.password == "" {
+				return fmt.Errorf("%w (RAR5 headers encrypted)", ErrPasswordProtected)
+			}
+			if blockSpecificEnd < cur {
+				return fmt.Errorf("blockSpecificEnd<cur")
+			}
+			e, ok := decodeRar5Encryption(headData[cur:blockSpecificEnd], false)
+			if !ok {
+				return fmt.Errorf("malformed archive encryption header at %d", hdrStart)
+			}
+			k, err := rar5PasswordKeys(e, o.password)
+			if err != nil {
+				return fmt.Errorf("%w (RAR5 headers encrypted)", err)
+			}
+			if hdrCipher, err = aes.NewCipher(k.key[:]); err != nil {
+				return err
+			}
 		}
-		if blockType == 2 { // File header
+		if blockType == 2 || blockType == 3 { // File header, or service header (same layout)
 			if blockSpecificEnd < cur {
 				return fmt.Errorf("blockSpecificEnd<cur")
 			}
@@ -127,27 +187,31 @@ func parseRar5(br *bufio.Reader, seeker io.ReadSeeker, vi *VolumeIndex, baseOffs
 			if err != nil {
 				return fmt.Errorf("unpackedSize: %w", err)
 			}
-			_, _, err = readFileVar()
+			attrs, _, err := readFileVar()
 			if err != nil {
 				return fmt.Errorf("fileAttr: %w", err)
 			} // Attributes
-			if fileFlags&0x0002 != 0 { // mtime
+			var mtime time.Time
+			if fileFlags&0x0002 != 0 { // mtime (Unix time, 32 bit)
 				if len(bs)-bcur < 4 {
 					return fmt.Errorf("mtime truncated")
 				}
+				mtime = time.Unix(int64(binary.LittleEndian.Uint32(bs[bcur:bcur+4])), 0)
 				bcur += 4
 			}
+			var dataCRC uint32
 			if fileFlags&0x0004 != 0 { // CRC32
 				if len(bs)-bcur < 4 {
 					return fmt.Errorf("crc32 truncated")
 				}
+				dataCRC = binary.LittleEndian.Uint32(bs[bcur : bcur+4])
 				bcur += 4
 			}
 			compInfo, _, err := readFileVar()
 			if err != nil {
 				return fmt.Errorf("compInfo: %w", err)
 			}
-			_, _, err = readFileVar()
+			hostOS, _, err := readFileVar()
 			if err != nil {
 				return fmt.Errorf("hostOS: %w", err)
 			}
@@ -160,48 +224,51 @@ func parseRar5(br *bufio.Reader, seeker io.ReadSeeker, vi *VolumeIndex, baseOffs
 			}
 			nameBytes := bs[bcur : bcur+int(nameLen)]
 			bcur += int(nameLen)
-			stored := compInfo == 0
-			// Detect encryption via extra area records (type 0x01 = File encryption)
-			encrypted := false
+			algo, solid, method, dict := decodeRar5CompInfo(compInfo)
+			stored := method == 0
+			fb := FileBlock{HeaderPos: hdrStart, HeaderSize: pos - hdrStart, DataPos: pos, PackedSize: int64(dataSize), VolumeDataSize: int64(dataSize), Name: string(nameBytes), UnpackedSize: int64(unpSizeVal), Stored: stored}
+			fb.IsDir = fileFlags&0x0001 != 0
+			fb.ModTime = mtime
+			fb.CRC32, fb.HasCRC32 = dataCRC, fileFlags&0x0004 != 0
+			fb.HostOS = uint8(hostOS)
+			fb.Attributes = attrs
+			fb.AlgorithmVersion, fb.Solid, fb.Method, fb.DictSize = algo, solid, method, dict
+			// Extra area records: encryption, hash, precise times, version, redirection, owner
+			var serviceData []byte
 			if extraAreaSize > 0 {
-				extra := headData[blockSpecificEnd:int(headSize)]
-				ecur := 0
-				for ecur < len(extra) {
-					sz, n, e := parse.ReadVarintFromSlice(extra[ecur:])
-					if e != nil {
-						// Malformed extras: ignore gracefully
-						break
-					}
-					ecur += int(n)
-					if ecur >= len(extra) {
-						break
-					}
-					typ, n2, e := parse.ReadVarintFromSlice(extra[ecur:])
-					if e != nil {
-						break
-					}
-					ecur += int(n2)
-					if typ == 0x01 { // File encryption record
-						encrypted = true
-					}
-					// size counts from Type field. We already consumed type varint (n2), so skip remaining
-					remain := int(sz) - int(n2)
-					if remain < 0 || ecur+remain > len(extra) {
-						break
-					}
-					ecur += remain
-				}
+				serviceData = parseRar5FileExtra(headData[blockSpecificEnd:int(headSize)], &fb)
 			}
-			fb := FileBlock{HeaderPos: hdrStart, HeaderSize: 4 + headSizeLen + int64(headSize), DataPos: hdrStart + 4 + headSizeLen + int64(headSize), PackedSize: int64(dataSize), VolumeDataSize: int64(dataSize), Name: string(nameBytes), UnpackedSize: int64(unpSizeVal), Stored: stored, Encrypted: encrypted}
-			vi.FileBlocks = append(vi.FileBlocks, fb)
-			if vi.TotalHeaderBytes == 0 {
-				vi.TotalHeaderBytes = fb.DataPos
-			}
-			if debug {
-				logDebug("file name=%s unpacked=%d packed=%d stored=%v enc=%v", fb.Name, unpSizeVal, dataSize, stored, fb.Encrypted)
+			// Split flags live in the common header flags: 0x0008 data continues from previous volume, 0x0010 in next volume.
+			fb.ContinuedFrom = flags&0x0008 != 0
+			fb.ContinuedTo = flags&0x0010 != 0
+			fb.Continued = fb.ContinuedTo
+			if blockType == 3 {
+				sb := ServiceBlock{Name: fb.Name, HeaderType: 3, HeaderPos: fb.HeaderPos, DataPos: fb.DataPos, PackedSize: fb.PackedSize, UnpackedSize: fb.UnpackedSize, Stored: fb.Stored, Encrypted: fb.Encrypted, Data: serviceData, FileIndex: -1}
+				// 0x0020: block depends on the preceding file header (NTFS streams, ACLs)
+				if flags&0x0020 != 0 && len(vi.FileBlocks) > 0 {
+					sb.FileIndex = len(vi.FileBlocks) - 1
+					sb.FileName = vi.FileBlocks[sb.FileIndex].Name
+				}
+				vi.ServiceBlocks = append(vi.ServiceBlocks, sb)
+			} else {
+				vi.FileBlocks = append(vi.FileBlocks, fb)
+				if vi.TotalHeaderBytes == 0 {
+					vi.TotalHeaderBytes = fb.DataPos
+				}
 			}
 		}
 		if blockType == 5 { // end of archive
+			if blockSpecificEnd < cur {
+				return fmt.Errorf("blockSpecificEnd<cur")
+			}
+			vi.Archive.HasEnd = true
+			if len(headData[cur:blockSpecificEnd]) > 0 { // tolerate end headers without the flags field
+				endFlags, _, err := parse.ReadVarintFromSlice(headData[cur:blockSpecificEnd])
+				if err != nil {
+					return fmt.Errorf("endFlags: %w", err)
+				}
+				vi.Archive.NextVolume = endFlags&0x0001 != 0 // archive is volume and not the last one
+			}
 			return nil
 		}
 		// Skip data
@@ -238,3 +305,83 @@ func parseRar5(br *bufio.Reader, seeker io.ReadSeeker, vi *VolumeIndex, baseOffs
 		}
 	}
 }
+
+// decodeRar5MainHeader records the main archive header fields: archive flags and volume number.
+func decodeRar5MainHeader(a *ArchiveInfo, bs []byte) error {
+	archFlags, n, err := parse.ReadVarintFromSlice(bs)
+	if err != nil {
+		return fmt.Errorf("archiveFlags: %w", err)
+	}
+	a.HasMainHeader = true
+	a.IsVolume = archFlags&0x0001 != 0
+	a.Solid = archFlags&0x0004 != 0
+	a.HasRecovery = archFlags&0x0008 != 0
+	a.Locked = archFlags&0x0010 != 0
+	if archFlags&0x0002 != 0 { // volume number field present (absent for the first volume)
+		vol, _, err := parse.ReadVarintFromSlice(bs[n:])
+		if err != nil {
+			return fmt.Errorf("volumeNumber: %w", err)
+		}
+		a.VolumeNumber, a.HasVolumeNumber = int(vol), true
+	} else if a.IsVolume {
+		a.VolumeNumber, a.HasVolumeNumber = 0, true
+		a.FirstVolume = true
+	}
+	return nil
+}
+
+// decodeRar5CompInfo splits the file header compression information field into
+// algorithm version (bits 0-5), solid flag (bit 6), method (bits 7-9) and dictionary size.
+// Dictionary size is 128 KiB << bits 10-14; RAR 7 (version 1) adds a 1/32 fraction in bits 15-19.
+func decodeRar5CompInfo(ci uint64) (version uint8, solid bool, method uint8, dictSize int64) {
+	version = uint8(ci & 0x3F)
+	solid = ci&0x0040 != 0
+	method = uint8((ci >> 7) & 0x07)
+	bits := (ci >> 10) & 0x0F
+	if version >= 1 {
+		bits = (ci >> 10) & 0x1F
+	}
+	dictSize = int64(0x20000) << bits
+	if version >= 1 {
+		dictSize += dictSize / 32 * int64((ci>>15)&0x1F)
+	}
+	return
+}
+
+// readRar5EncryptedHeader reads a header of an archive with encrypted headers: a 16 byte IV, then the
+// CRC32, size varint and header data encrypted with AES-256-CBC and padded to the AES block size.
+// It returns the plain CRC32, size and header data with the number of volume bytes consumed, or a nil
+// block when the size is zero or runs past remain (when remain is known).
+func readRar5EncryptedHeader(br *bufio.Reader, block cipher.Block, remain int64) ([]byte, int64, error) {
+	const bs = aes.BlockSize
+	var iv [bs]byte
+	if _, err := io.ReadFull(br, iv[:]); err != nil {
+		return nil, 0, err
+	}
+	plain := make([]byte, bs)
+	if _, err := io.ReadFull(br, plain); err != nil {
+		return nil, 0, fmt.Errorf("read first block: %w", err)
+	}
+	dec := cipher.NewCBCDecrypter(block, iv[:])
+	dec.CryptBlocks(plain, plain)
+	headSize, n, err := parse.ReadVarintFromSlice(plain[4:])
+	if err != nil {
+		return nil, 0, fmt.Errorf("headSize: %w", err)
+	}
+	if headSize == 0 {
+		return nil, 0, nil
+	}
+	if headSize > rar5MaxHeadSize {
+		return nil, 0, fmt.Errorf("suspicious headSize %d", headSize)
+	}
+	total := (4 + n + int64(headSize) + bs - 1) / bs * bs
+	if remain > 0 && bs+total > remain {
+		return nil, 0, nil
+	}
+	plain = append(plain, make([]byte, total-bs)...)
+	if _, err := io.ReadFull(br, plain[bs:]); err != nil {
+		return nil, 0, fmt.Errorf("read header size=%d: %w", headSize, err)
+	}
+	dec.CryptBlocks(plain[bs:], plain[bs:])
+	return plain, bs + total, nil
+}
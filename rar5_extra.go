@@ -0,0 +1,341 @@
+package rarlist
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/javi11/rarlist/internal/parse"
+)
+
+// RAR5 file/service header extra record types.
+const (
+	rar5ExtraEncryption  = 0x01
+	rar5ExtraHash        = 0x02
+	rar5ExtraTime        = 0x03
+	rar5ExtraVersion     = 0x04
+	rar5ExtraRedirection = 0x05
+	rar5ExtraUnixOwner   = 0x06
+	rar5ExtraService     = 0x07
+)
+
+// HashBlake2sp is the only hash type defined for the RAR5 file hash record.
+const HashBlake2sp = 0
+
+// FileHash is the RAR5 file hash extra record (0x02).
+type FileHash struct {
+	Type uint64 `json:"type"` // HashBlake2sp
+	Sum  []byte `json:"sum"`  // 32 byte BLAKE2sp digest of the unpacked data
+}
+
+// FileTimes holds the high precision times from the RAR5 file time extra record (0x03).
+// Absent times are zero.
+type FileTimes struct {
+	ModTime    time.Time `json:"modTime"`
+	CreateTime time.Time `json:"createTime"`
+	AccessTime time.Time `json:"accessTime"`
+}
+
+// Encryption describes RAR5 AES-256 encryption parameters: the file encryption extra record (0x01),
+// whose layout the archive encryption header shares without the IV.
+type Encryption struct {
+	Version          uint64 `json:"version"`  // 0: AES-256
+	KDFCount         uint8  `json:"kdfCount"` // binary logarithm of the PBKDF2-HMAC-SHA256 iterations
+	Salt             []byte `json:"salt"`
+	IV               []byte `json:"iv,omitempty"`
+	CheckValue       []byte `json:"checkValue,omitempty"` // 8 byte password check followed by a 4 byte SHA-256 checksum
+	TweakedChecksums bool   `json:"tweakedChecksums"`     // CRC32 and BLAKE2sp are converted to password dependent MACs
+}
+
+// RedirectionType identifies the kind of link stored in a redirection record.
+type RedirectionType uint64
+
+const (
+	RedirUnixSymlink    RedirectionType = 1
+	RedirWindowsSymlink RedirectionType = 2
+	RedirJunction       RedirectionType = 3
+	RedirHardLink       RedirectionType = 4
+	RedirFileCopy       RedirectionType = 5
+)
+
+func (t RedirectionType) String() string {
+	switch t {
+	case RedirUnixSymlink:
+		return "unix-symlink"
+	case RedirWindowsSymlink:
+		return "windows-symlink"
+	case RedirJunction:
+		return "junction"
+	case RedirHardLink:
+		return "hardlink"
+	case RedirFileCopy:
+		return "filecopy"
+	}
+	return fmt.Sprintf("redirection(%d)", uint64(t))
+}
+
+// Redirection is the RAR5 file system redirection extra record (0x05).
+type Redirection struct {
+	Type   RedirectionType `json:"type"`
+	IsDir  bool            `json:"isDir"` // link target is a directory
+	Target string          `json:"target"`
+}
+
+// UnixOwner is the RAR5 Unix owner extra record (0x06). Names and ids are each optional.
+type UnixOwner struct {
+	User   string `json:"user,omitempty"`
+	Group  string `json:"group,omitempty"`
+	UID    uint64 `json:"uid"`
+	GID    uint64 `json:"gid"`
+	HasUID bool   `json:"hasUID"`
+	HasGID bool   `json:"hasGID"`
+}
+
+// parseRar5FileExtra walks the extra area of a file or service header and records every known record on fb.
+// The service data record (only used by service headers) is returned as is.
+// Malformed or unknown records are ignored; a truncated record stops the walk.
+func parseRar5FileExtra(extra []byte, fb *FileBlock) (serviceData []byte) {
+	ecur := 0
+	for ecur < len(extra) {
+		sz, n, e := parse.ReadVarintFromSlice(extra[ecur:])
+		if e != nil {
+			// Malformed extras: ignore gracefully
+			return serviceData
+		}
+		ecur += int(n)
+		// size counts from the Type field to the end of the record
+		if sz == 0 || sz > uint64(len(extra)-ecur) {
+			return serviceData
+		}
+		rec := extra[ecur : ecur+int(sz)]
+		ecur += int(sz)
+		typ, n2, e := parse.ReadVarintFromSlice(rec)
+		if e != nil {
+			return serviceData
+		}
+		body := rec[n2:]
+		switch typ {
+		case rar5ExtraEncryption:
+			fb.Encrypted = true
+			if e, ok := decodeRar5Encryption(body, true); ok {
+				fb.Encryption = e
+			}
+		case rar5ExtraHash:
+			if h, ok := decodeRar5Hash(body); ok {
+				fb.Hash = h
+			}
+		case rar5ExtraTime:
+			if t, ok := decodeRar5Times(body); ok {
+				fb.Times = t
+				if !t.ModTime.IsZero() {
+					fb.ModTime = t.ModTime
+				}
+			}
+		case rar5ExtraVersion:
+			r := sliceReader{b: body}
+			r.varint() // flags, none defined
+			if v, ok := r.varint(); ok {
+				fb.Version = v
+			}
+		case rar5ExtraRedirection:
+			if rd, ok := decodeRar5Redirection(body); ok {
+				fb.Redirection = rd
+			}
+		case rar5ExtraUnixOwner:
+			if o, ok := decodeRar5UnixOwner(body); ok {
+				fb.Owner = o
+			}
+		case rar5ExtraService:
+			serviceData = append([]byte(nil), body...)
+		}
+	}
+	return serviceData
+}
+
+// decodeRar5Encryption decodes an encryption record; withIV is false for the archive encryption header.
+func decodeRar5Encryption(b []byte, withIV bool) (*Encryption, bool) {
+	r := sliceReader{b: b}
+	version, ok1 := r.varint()
+	flags, ok2 := r.varint()
+	count, ok3 := r.bytes(1)
+	salt, ok4 := r.bytes(16)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return nil, false
+	}
+	e := &Encryption{Version: version, KDFCount: count[0], Salt: append([]byte(nil), salt...), TweakedChecksums: flags&0x0002 != 0}
+	if withIV {
+		iv, ok := r.bytes(16)
+		if !ok {
+			return nil, false
+		}
+		e.IV = append([]byte(nil), iv...)
+	}
+	if flags&0x0001 != 0 { // password check data present
+		check, ok := r.bytes(12)
+		if !ok {
+			return nil, false
+		}
+		e.CheckValue = append([]byte(nil), check...)
+	}
+	return e, true
+}
+
+func decodeRar5Hash(b []byte) (*FileHash, bool) {
+	r := sliceReader{b: b}
+	typ, ok := r.varint()
+	if !ok {
+		return nil, false
+	}
+	if typ != HashBlake2sp {
+		return &FileHash{Type: typ, Sum: append([]byte(nil), r.rest()...)}, true
+	}
+	sum, ok := r.bytes(32)
+	if !ok {
+		return nil, false
+	}
+	return &FileHash{Type: typ, Sum: append([]byte(nil), sum...)}, true
+}
+
+func decodeRar5Times(b []byte) (*FileTimes, bool) {
+	r := sliceReader{b: b}
+	flags, ok := r.varint()
+	if !ok {
+		return nil, false
+	}
+	unix := flags&0x0001 != 0
+	present := []bool{flags&0x0002 != 0, flags&0x0004 != 0, flags&0x0008 != 0} // mtime, ctime, atime
+	var times [3]time.Time
+	for i, p := range present {
+		if !p {
+			continue
+		}
+		if unix {
+			v, ok := r.uint32()
+			if !ok {
+				return nil, false
+			}
+			times[i] = time.Unix(int64(v), 0)
+		} else {
+			v, ok := r.uint64()
+			if !ok {
+				return nil, false
+			}
+			times[i] = fileTime(v)
+		}
+	}
+	if unix && flags&0x0010 != 0 { // nanoseconds follow, one per present time
+		for i, p := range present {
+			if !p {
+				continue
+			}
+			ns, ok := r.uint32()
+			if !ok || ns >= 1e9 { // a nanosecond count past one second is malformed
+				return nil, false
+			}
+			times[i] = times[i].Add(time.Duration(ns))
+		}
+	}
+	return &FileTimes{ModTime: times[0], CreateTime: times[1], AccessTime: times[2]}, true
+}
+
+func decodeRar5Redirection(b []byte) (*Redirection, bool) {
+	r := sliceReader{b: b}
+	typ, ok1 := r.varint()
+	flags, ok2 := r.varint()
+	nameLen, ok3 := r.varint()
+	if !ok1 || !ok2 || !ok3 {
+		return nil, false
+	}
+	name, ok := r.bytes(int(nameLen))
+	if !ok {
+		return nil, false
+	}
+	return &Redirection{Type: RedirectionType(typ), IsDir: flags&0x0001 != 0, Target: string(name)}, true
+}
+
+func decodeRar5UnixOwner(b []byte) (*UnixOwner, bool) {
+	r := sliceReader{b: b}
+	flags, ok := r.varint()
+	if !ok {
+		return nil, false
+	}
+	o := &UnixOwner{}
+	readName := func() (string, bool) {
+		n, ok := r.varint()
+		if !ok {
+			return "", false
+		}
+		s, ok := r.bytes(int(n))
+		return string(s), ok
+	}
+	if flags&0x0001 != 0 {
+		if o.User, ok = readName(); !ok {
+			return nil, false
+		}
+	}
+	if flags&0x0002 != 0 {
+		if o.Group, ok = readName(); !ok {
+			return nil, false
+		}
+	}
+	if flags&0x0004 != 0 {
+		if o.UID, o.HasUID = r.varint(); !o.HasUID {
+			return nil, false
+		}
+	}
+	if flags&0x0008 != 0 {
+		if o.GID, o.HasGID = r.varint(); !o.HasGID {
+			return nil, false
+		}
+	}
+	return o, true
+}
+
+// fileTime converts a Windows FILETIME (100ns ticks since 1601-01-01 UTC) to time.Time.
+func fileTime(v uint64) time.Time {
+	const epochDiff = 116444736000000000 // 1601-01-01 to 1970-01-01 in 100ns ticks
+	ticks := int64(v - epochDiff)
+	return time.Unix(ticks/10000000, (ticks%10000000)*100)
+}
+
+// sliceReader decodes little-endian integers and RAR5 varints from a header slice.
+type sliceReader struct {
+	b   []byte
+	off int
+}
+
+func (r *sliceReader) varint() (uint64, bool) {
+	v, n, err := parse.ReadVarintFromSlice(r.b[r.off:])
+	if err != nil {
+		return 0, false
+	}
+	r.off += int(n)
+	return v, true
+}
+
+func (r *sliceReader) bytes(n int) ([]byte, bool) {
+	if n < 0 || n > len(r.b)-r.off {
+		return nil, false
+	}
+	b := r.b[r.off : r.off+n]
+	r.off += n
+	return b, true
+}
+
+func (r *sliceReader) uint32() (uint32, bool) {
+	b, ok := r.bytes(4)
+	if !ok {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(b), true
+}
+
+func (r *sliceReader) uint64() (uint64, bool) {
+	b, ok := r.bytes(8)
+	if !ok {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(b), true
+}
+
+func (r *sliceReader) rest() []byte { return r.b[r.off:] }
@@ -3,11 +3,27 @@ package rarlist
 import (
 	"bufio"
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/javi11/rarlist/internal/blake2sp"
+	"github.com/javi11/rarlist/internal/rar3kdf"
 )
 
 func encodeVarint(x uint64) []byte {
@@ -322,34 +338,34 @@ func TestRar3HighSizeAndSalt(t *testing.T) {
 	sig := append([]byte("Rar!\x1A\x07\x00"), 0x00)
 	// First add a dummy comment block (type 0x75) size 7 (header only) no addsize.
 	comment := []byte{0x00, 0x00, 0x75, 0x00, 0x00, 0x07, 0x00}
-	// File block with flags high size (0x8000 for addsize? actually high sizes in file header legacy use 0x0100) and salt (0x0400)
+	// File block with LONG_BLOCK (0x8000, PACK_SIZE doubles as ADD_SIZE), high size (0x0100) and salt (0x0400)
 	name := "big.bin"
 	nameLen := len(name)
 	packSize := uint64(0x00000001_FFFFFFFF) // high pack
 	unpSize := uint64(0x00000002_FFFFFFFF)
 	// Build file header
 	fixedSize := 25
-	headerSize := 7 + 4 + fixedSize + 8 + nameLen + 8 // header + addsize + fixed + name + salt
-	// block header (with addsize flag 0x8000 and salt flag 0x0400 and high size flag 0x0100)
+	headerSize := 7 + fixedSize + 8 + nameLen + 8 // header + fixed + high sizes + name + salt
 	flags := uint16(0x8000 | 0x0400 | 0x0100)
 	bh := []byte{0x00, 0x00, 0x74, byte(flags), byte(flags >> 8), byte(headerSize & 0xFF), byte(headerSize >> 8)}
-	addSize := make([]byte, 4)
-	addSize[0] = byte(packSize) // arbitrary just to fill (not used by our parser for file header)
 	fileFixed := make([]byte, fixedSize)
 	// low sizes
-	fileFixed[0] = byte(packSize)
-	fileFixed[4] = byte(unpSize)
+	binary.LittleEndian.PutUint32(fileFixed[0:4], uint32(packSize))
+	binary.LittleEndian.PutUint32(fileFixed[4:8], uint32(unpSize))
 	fileFixed[18] = 0x30 // method stored
 	fileFixed[19] = byte(nameLen)
 	fileFixed[20] = 0x00
+	high := make([]byte, 8)
+	binary.LittleEndian.PutUint32(high[0:4], uint32(packSize>>32))
+	binary.LittleEndian.PutUint32(high[4:8], uint32(unpSize>>32))
 	nameBytes := []byte(name)
 	salt := []byte{1, 2, 3, 4, 5, 6, 7, 8}
 	buf := bytes.NewBuffer(nil)
 	buf.Write(sig)
 	buf.Write(comment)
 	buf.Write(bh)
-	buf.Write(addSize)
 	buf.Write(fileFixed)
+	buf.Write(high)
 	buf.Write(nameBytes)
 	buf.Write(salt)
 	p := writeTemp(t, "rar3_high_salt.rar", buf.Bytes())
@@ -360,6 +376,16 @@ func TestRar3HighSizeAndSalt(t *testing.T) {
 	if len(vols[0].FileBlocks) != 1 {
 		t.Fatalf("expected 1 file block got %d", len(vols[0].FileBlocks))
 	}
+	fb := vols[0].FileBlocks[0]
+	if fb.Name != name {
+		t.Fatalf("name mismatch: %q", fb.Name)
+	}
+	if fb.PackedSize != int64(packSize) || fb.UnpackedSize != int64(unpSize) {
+		t.Fatalf("64-bit sizes: packed=%d unpacked=%d", fb.PackedSize, fb.UnpackedSize)
+	}
+	if want := int64(len(sig) + len(comment) + headerSize); fb.DataPos != want {
+		t.Fatalf("data pos want %d got %d", want, fb.DataPos)
+	}
 }
 
 func TestUnsupportedVersionError(t *testing.T) {
@@ -480,7 +506,7 @@ func TestRar5TruncatedHeadData(t *testing.T) {
 	defer func() { _ = f.Close() }()
 	br := bufio.NewReader(f)
 	vi := &VolumeIndex{Path: p, Version: VersionRar5}
-	if err := testHookParseRar5(br, f, vi, 0, int64(len(buf.Bytes()))); err != nil {
+	if err := testHookParseRar5(br, f, vi, 0, int64(len(buf.Bytes())), options{}); err != nil {
 		// Should not be hard error; parser returns nil when headSize exceeds file boundary.
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -490,22 +516,20 @@ func TestRar3FileHeaderAddSize(t *testing.T) {
 	sig := append([]byte("Rar!\x1A\x07\x00"), 0x00)
 	name := "add.bin"
 	nameLen := len(name)
-	// size field counts header (without addsize). We'll build: block header(7) + fixed(25) + name
+	// size field counts the whole header: block header(7) + fixed(25) + name
 	size := 7 + 25 + nameLen
-	flags := uint16(0x8000) // addsize present
+	flags := uint16(0x8000) // LONG_BLOCK: PACK_SIZE is the block's ADD_SIZE
 	// Block header
 	bh := []byte{0x00, 0x00, 0x74, byte(flags), byte(flags >> 8), byte(size & 0xFF), byte(size >> 8)}
-	addSize := []byte{0x04, 0x00, 0x00, 0x00} // 4 bytes of add data
 	fixed := make([]byte, 25)
-	fixed[0] = 1              // packSize
-	fixed[4] = 1              // unpSize
+	fixed[0] = 4              // packSize (== ADD_SIZE, 4 bytes of data)
+	fixed[4] = 4              // unpSize
 	fixed[19] = byte(nameLen) // name size LE at offset 19
 	fixed[20] = 0x00
 	fixed[18] = 0x30
 	buf := bytes.NewBuffer(nil)
 	buf.Write(sig)
 	buf.Write(bh)
-	buf.Write(addSize)
 	buf.Write(fixed)
 	buf.Write([]byte(name))
 	buf.Write([]byte{0xDE, 0xAD, 0xBE, 0xEF}) // addsize payload
@@ -517,6 +541,9 @@ func TestRar3FileHeaderAddSize(t *testing.T) {
 	if len(vols[0].FileBlocks) != 1 || vols[0].FileBlocks[0].Name != name {
 		t.Fatalf("unexpected blocks: %+v", vols[0].FileBlocks)
 	}
+	if fb := vols[0].FileBlocks[0]; fb.DataPos != int64(len(sig)+size) || fb.PackedSize != 4 {
+		t.Fatalf("unexpected data pos/size: %+v", fb)
+	}
 }
 
 func TestRar5MultipleFiles(t *testing.T) {
@@ -854,6 +881,9 @@ func TestRar3ExtraBytesBeforeName(t *testing.T) {
 	if idx[0].FileBlocks[0].Name != actualName {
 		t.Fatalf("name mismatch: got %q want %q", idx[0].FileBlocks[0].Name, actualName)
 	}
+	if w := idx[0].Warnings; len(w) == 0 || w[0].Kind != WarningFileName {
+		t.Fatalf("warnings: %v", w)
+	}
 }
 
 func TestRar3DataOffsetCalculation(t *testing.T) {
@@ -902,3 +932,2044 @@ func TestRar3DataOffsetCalculation(t *testing.T) {
 		}
 	}
 }
+
+func TestRar3MultipleFilesWalk(t *testing.T) {
+	sig := append([]byte("Rar!\x1A\x07\x00"), 0x00)
+	buf := bytes.NewBuffer(nil)
+	buf.Write(sig)
+	buf.Write(buildRar3FileHeader("one.txt", 3, 3))
+	buf.Write([]byte{1, 2, 3})
+	secondHdr := int64(buf.Len())
+	buf.Write(buildRar3FileHeader("two.txt", 4, 4))
+	buf.Write([]byte{4, 5, 6, 7})
+	buf.Write(buildRar3FileHeader("three.txt", 2, 2))
+	buf.Write([]byte{8, 9})
+	buf.Write([]byte{0x00, 0x00, 0x7B, 0x00, 0x00, 0x07, 0x00}) // end of archive
+	p := writeTemp(t, "rar3_multi.rar", buf.Bytes())
+	vols, err := IndexVolumes(defaultFS, []string{p})
+	if err != nil {
+		t.Fatalf("index rar3 multi: %v", err)
+	}
+	fbs := vols[0].FileBlocks
+	if len(fbs) != 3 {
+		t.Fatalf("expected 3 file blocks got %d", len(fbs))
+	}
+	if fbs[0].Name != "one.txt" || fbs[1].Name != "two.txt" || fbs[2].Name != "three.txt" {
+		t.Fatalf("unexpected names: %q %q %q", fbs[0].Name, fbs[1].Name, fbs[2].Name)
+	}
+	if fbs[1].HeaderPos != secondHdr {
+		t.Fatalf("second header pos want %d got %d", secondHdr, fbs[1].HeaderPos)
+	}
+	if vols[0].TotalHeaderBytes != fbs[0].DataPos {
+		t.Fatalf("TotalHeaderBytes should match first data pos")
+	}
+	raw := buf.Bytes()
+	if got := raw[fbs[1].DataPos : fbs[1].DataPos+fbs[1].PackedSize]; !bytes.Equal(got, []byte{4, 5, 6, 7}) {
+		t.Fatalf("second file data mismatch: %v", got)
+	}
+	agg := AggregateFiles(vols)
+	if len(agg) != 3 {
+		t.Fatalf("expected 3 aggregated files got %d", len(agg))
+	}
+}
+
+func TestRar3UnicodeNameAndExtTime(t *testing.T) {
+	sig := append([]byte("Rar!\x1A\x07\x00"), 0x00)
+	// Unicode name: ASCII part, zero byte, then encoded form (flags 0x04: ascii, low byte, ascii)
+	nameField := append([]byte("ab"), 0x00, 0x04, 'Z')
+	extTime := []byte{0x00, 0xF0, 0x01, 0x02, 0x03} // EXT_TIME flags + mtime remainder bytes
+	flags := uint16(0x8000 | 0x0200 | 0x1000)
+	size := 7 + 25 + len(nameField) + len(extTime)
+	hdr := []byte{0x00, 0x00, 0x74, byte(flags), byte(flags >> 8), byte(size), 0x00}
+	fixed := make([]byte, 25)
+	fixed[0] = 3 // packSize
+	fixed[4] = 3 // unpSize
+	fixed[18] = 0x30
+	fixed[19] = byte(len(nameField))
+	buf := bytes.NewBuffer(nil)
+	buf.Write(sig)
+	buf.Write(hdr)
+	buf.Write(fixed)
+	buf.Write(nameField)
+	buf.Write(extTime)
+	buf.Write([]byte{7, 8, 9})
+	p := writeTemp(t, "rar3_unicode.rar", buf.Bytes())
+	vols, err := IndexVolumes(defaultFS, []string{p})
+	if err != nil {
+		t.Fatalf("index rar3 unicode: %v", err)
+	}
+	fb := vols[0].FileBlocks[0]
+	if fb.Name != "aZb" {
+		t.Fatalf("unicode name want aZb got %q", fb.Name)
+	}
+	if fb.HeaderSize != int64(size) || fb.DataPos != int64(len(sig)+size) {
+		t.Fatalf("header size/data pos from HEAD_SIZE: %+v", fb)
+	}
+	if got := buf.Bytes()[fb.DataPos : fb.DataPos+fb.PackedSize]; !bytes.Equal(got, []byte{7, 8, 9}) {
+		t.Fatalf("data mismatch %v", got)
+	}
+}
+
+func TestRar3VolumeDataSizeFromHeader(t *testing.T) {
+	sig := append([]byte("Rar!\x1A\x07\x00"), 0x00)
+	endArc := []byte{0x00, 0x00, 0x7B, 0x00, 0x00, 0x07, 0x00}
+	data := bytes.Repeat([]byte{0xAB}, 200)
+	// Volume 1 holds 120 bytes of the file, volume 2 the remaining 80; each header carries its own PACK_SIZE.
+	v1 := append(append(append(append([]byte{}, sig...), buildRar3FileHeader("split.bin", 120, 200)...), data[:120]...), endArc...)
+	v2 := append(append(append(append([]byte{}, sig...), buildRar3FileHeader("split.bin", 80, 200)...), data[120:]...), endArc...)
+	p1 := writeTemp(t, "s.part1.rar", v1)
+	p2 := writeTemp(t, "s.part2.rar", v2)
+	vols, err := IndexVolumes(defaultFS, []string{p1, p2})
+	if err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	for i, v := range vols {
+		if len(v.Warnings) != 0 {
+			t.Fatalf("volume %d: unexpected warnings %v", i, v.Warnings)
+		}
+	}
+	if vols[0].FileBlocks[0].VolumeDataSize != 120 || vols[1].FileBlocks[0].VolumeDataSize != 80 {
+		t.Fatalf("volume data sizes: %d %d", vols[0].FileBlocks[0].VolumeDataSize, vols[1].FileBlocks[0].VolumeDataSize)
+	}
+	agg := AggregateFiles(vols)
+	if len(agg) != 1 || agg[0].TotalPackedSize != 200 {
+		t.Fatalf("aggregate: %+v", agg)
+	}
+}
+
+func TestRar3VolumeDataSizeMismatchWarnings(t *testing.T) {
+	sig := append([]byte("Rar!\x1A\x07\x00"), 0x00)
+	endArc := []byte{0x00, 0x00, 0x7B, 0x00, 0x00, 0x07, 0x00}
+	// Header claims 10 bytes but 16 follow before the end block: the walk lands inside data.
+	short := append(append(append(append([]byte{}, sig...), buildRar3FileHeader("short.bin", 10, 10)...), bytes.Repeat([]byte{0x11}, 16)...), endArc...)
+	// Header claims more data than the volume holds.
+	long := append(append(append([]byte{}, sig...), buildRar3FileHeader("long.bin", 100, 100)...), bytes.Repeat([]byte{0x22}, 30)...)
+	// Header claims 10 bytes and a block type byte sits at that offset, but what follows is not a header:
+	// its CRC fails and its ADD_SIZE runs past the volume.
+	fake := []byte{0x11, 0x11, 0x7A, 0x00, 0x80, 0x0B, 0x00, 0xFF, 0xFF, 0x00, 0x00}
+	typeByte := append(append(append(append(append([]byte{}, sig...), buildRar3FileHeader("type.bin", 10, 10)...), bytes.Repeat([]byte{0x33}, 10)...), fake...), endArc...)
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{{"short.rar", short}, {"long.rar", long}, {"type-byte.rar", typeByte}} {
+		p := writeTemp(t, tc.name, tc.data)
+		vols, err := IndexVolumes(defaultFS, []string{p})
+		if err != nil {
+			t.Fatalf("%s: index: %v", tc.name, err)
+		}
+		v := vols[0]
+		if len(v.Warnings) != 1 || v.Warnings[0].Kind != WarningDataSize {
+			t.Fatalf("%s: expected one data-size warning, got %v", tc.name, v.Warnings)
+		}
+		fb := v.FileBlocks[0]
+		if fb.VolumeDataSize != fb.PackedSize {
+			t.Fatalf("%s: volume data size should stay the header value, got %d", tc.name, fb.VolumeDataSize)
+		}
+	}
+}
+
+// setRar3Flags overwrites HEAD_FLAGS of a header built by buildRar3FileHeader.
+func setRar3Flags(h []byte, flags uint16) []byte {
+	binary.LittleEndian.PutUint16(h[3:5], flags)
+	return h
+}
+
+func TestAggregateSplitChain(t *testing.T) {
+	sig := append([]byte("Rar!\x1A\x07\x00"), 0x00)
+	first := setRar3Flags(buildRar3FileHeader("chain.bin", 2, 6), 0x0002)  // split after
+	middle := setRar3Flags(buildRar3FileHeader("chain.bin", 2, 6), 0x0003) // split before + after
+	last := setRar3Flags(buildRar3FileHeader("chain.bin", 2, 6), 0x0001)   // split before
+	p1 := writeTemp(t, "c.part1.rar", append(append(append([]byte{}, sig...), first...), 1, 2))
+	p2 := writeTemp(t, "c.part2.rar", append(append(append([]byte{}, sig...), middle...), 3, 4))
+	p3 := writeTemp(t, "c.part3.rar", append(append(append([]byte{}, sig...), last...), 5, 6))
+	vols, err := IndexVolumes(defaultFS, []string{p1, p2, p3})
+	if err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	if fb := vols[1].FileBlocks[0]; !fb.ContinuedFrom || !fb.ContinuedTo {
+		t.Fatalf("middle part flags not decoded: %+v", fb)
+	}
+	agg := AggregateFiles(vols)
+	if len(agg) != 1 || len(agg[0].Parts) != 3 || agg[0].Incomplete {
+		t.Fatalf("complete chain: %+v", agg)
+	}
+	// A volume without the file sits between the pieces: the continuation does not come from the next volume.
+	other := writeTemp(t, "other.rar", append(append([]byte{}, sig...), buildRar3FileHeader("other.bin", 0, 0)...))
+	otherVols, err := IndexVolumes(defaultFS, []string{other})
+	if err != nil {
+		t.Fatalf("index other: %v", err)
+	}
+	agg = AggregateFiles([]*VolumeIndex{vols[0], otherVols[0], vols[2]})
+	if len(agg) != 2 || !agg[0].Incomplete || agg[1].Incomplete {
+		t.Fatalf("broken chain should be incomplete: %+v", agg)
+	}
+	// Missing last volume: chain still pending at the end.
+	agg = AggregateFiles(vols[:2])
+	if len(agg) != 1 || !agg[0].Incomplete {
+		t.Fatalf("truncated chain should be incomplete: %+v", agg)
+	}
+	// Missing first volume.
+	agg = AggregateFiles(vols[1:])
+	if len(agg) != 1 || !agg[0].Incomplete || len(agg[0].Parts) != 2 {
+		t.Fatalf("headless chain should be incomplete: %+v", agg)
+	}
+}
+
+func TestRar5SplitFlags(t *testing.T) {
+	sig := []byte("Rar!\x1A\x07\x01\x00")
+	name := []byte("split5.bin")
+	fs := bytes.NewBuffer(nil)
+	fs.Write(encodeVarint(0)) // file flags
+	fs.Write(encodeVarint(4)) // unpacked size
+	fs.Write(encodeVarint(0)) // attributes
+	fs.Write(encodeVarint(0)) // compInfo (stored)
+	fs.Write(encodeVarint(0)) // host OS
+	fs.Write(encodeVarint(uint64(len(name))))
+	fs.Write(name)
+	core := bytes.NewBuffer(nil)
+	core.Write(encodeVarint(2))
+	core.Write(encodeVarint(0x0002 | 0x0010)) // data size + continues in next volume
+	core.Write(encodeVarint(2))
+	core.Write(fs.Bytes())
+	buf := bytes.NewBuffer(nil)
+	buf.Write(sig)
+	buf.Write([]byte{0, 0, 0, 0})
+	buf.Write(encodeVarint(uint64(core.Len())))
+	buf.Write(core.Bytes())
+	buf.Write([]byte{1, 2})
+	p := writeTemp(t, "split5.part1.rar", buf.Bytes())
+	vols, err := IndexVolumes(defaultFS, []string{p})
+	if err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	fb := vols[0].FileBlocks[0]
+	if fb.ContinuedFrom || !fb.ContinuedTo || !fb.Continued {
+		t.Fatalf("rar5 split flags: %+v", fb)
+	}
+	if agg := AggregateFiles(vols); !agg[0].Incomplete {
+		t.Fatalf("single split volume should be incomplete")
+	}
+}
+
+func TestRar3MainAndEndHeaders(t *testing.T) {
+	sig := []byte("Rar!\x1A\x07\x00")
+	// MAIN_HEAD: volume, comment, lock, solid, new numbering, protect, first volume; body HighPosAV(2) PosAV(4)
+	mainFlags := uint16(0x0001 | 0x0002 | 0x0004 | 0x0008 | 0x0010 | 0x0040 | 0x0100)
+	main := []byte{0x00, 0x00, 0x73, byte(mainFlags), byte(mainFlags >> 8), 13, 0x00, 0, 0, 0, 0, 0, 0}
+	file := setRar3Flags(buildRar3FileHeader("vol.bin", 3, 9), 0x0002)
+	// ENDARC_HEAD: next volume, data CRC, volume number
+	endFlags := uint16(0x0001 | 0x0002 | 0x0008)
+	end := []byte{0x00, 0x00, 0x7B, byte(endFlags), byte(endFlags >> 8), 13, 0x00}
+	end = binary.LittleEndian.AppendUint32(end, 0xCAFEBABE)
+	end = binary.LittleEndian.AppendUint16(end, 0)
+	buf := bytes.NewBuffer(nil)
+	buf.Write(sig)
+	buf.Write(main)
+	buf.Write(file)
+	buf.Write([]byte{1, 2, 3})
+	buf.Write(end)
+	p := writeTemp(t, "meta.part1.rar", buf.Bytes())
+	vols, err := IndexVolumes(defaultFS, []string{p})
+	if err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	a := vols[0].Archive
+	if !a.HasMainHeader || !a.IsVolume || !a.HasComment || !a.Locked || !a.Solid || !a.NewNumbering || !a.HasRecovery || !a.FirstVolume {
+		t.Fatalf("main header flags not decoded: %+v", a)
+	}
+	if !a.HasEnd || !a.NextVolume || !a.HasDataCRC || a.DataCRC != 0xCAFEBABE || !a.HasVolumeNumber || a.VolumeNumber != 0 {
+		t.Fatalf("end header not decoded: %+v", a)
+	}
+	if len(vols[0].FileBlocks) != 1 || vols[0].FileBlocks[0].Name != "vol.bin" {
+		t.Fatalf("file block after main header: %+v", vols[0].FileBlocks)
+	}
+}
+
+// rar5Block wraps header content (type, flags, ...) with a zero CRC and the headSize varint.
+func rar5Block(fields ...[]byte) []byte {
+	core := bytes.Join(fields, nil)
+	return append(append([]byte{0, 0, 0, 0}, encodeVarint(uint64(len(core)))...), core...)
+}
+
+func TestRar5MainAndEndHeaders(t *testing.T) {
+	sig := []byte("Rar!\x1A\x07\x01\x00")
+	mkVol := func(name string, volNum int, last bool) string {
+		buf := bytes.NewBuffer(nil)
+		buf.Write(sig)
+		archFlags := uint64(0x0001 | 0x0004 | 0x0008 | 0x0010) // volume, solid, recovery, locked
+		if volNum > 0 {
+			buf.Write(rar5Block(encodeVarint(1), encodeVarint(0), encodeVarint(archFlags|0x0002), encodeVarint(uint64(volNum))))
+		} else {
+			buf.Write(rar5Block(encodeVarint(1), encodeVarint(0), encodeVarint(archFlags)))
+		}
+		endFlags := uint64(0x0001)
+		if last {
+			endFlags = 0
+		}
+		buf.Write(rar5Block(encodeVarint(5), encodeVarint(0), encodeVarint(endFlags)))
+		return writeTemp(t, name, buf.Bytes())
+	}
+	p1 := mkVol("set.part1.rar", 0, false)
+	p2 := mkVol("set.part2.rar", 1, false)
+	p3 := mkVol("set.part3.rar", 2, true)
+	vols, err := IndexVolumes(defaultFS, []string{p3, p1, p2})
+	if err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	a := vols[1].Archive
+	if !a.HasMainHeader || !a.IsVolume || !a.Solid || !a.HasRecovery || !a.Locked || !a.FirstVolume || !a.HasVolumeNumber || a.VolumeNumber != 0 {
+		t.Fatalf("first volume main header: %+v", a)
+	}
+	if !a.HasEnd || !a.NextVolume {
+		t.Fatalf("first volume end header: %+v", a)
+	}
+	if a3 := vols[0].Archive; a3.VolumeNumber != 2 || a3.NextVolume || a3.FirstVolume {
+		t.Fatalf("last volume: %+v", a3)
+	}
+	if err := CheckVolumeSet(vols); !errors.Is(err, ErrIncompleteVolumeSet) {
+		t.Fatalf("unordered set should fail check, got %v", err)
+	}
+	ordered := OrderVolumes(vols)
+	if ordered[0].Path != p1 || ordered[1].Path != p2 || ordered[2].Path != p3 {
+		t.Fatalf("unexpected order: %s %s %s", ordered[0].Path, ordered[1].Path, ordered[2].Path)
+	}
+	if err := CheckVolumeSet(ordered); err != nil {
+		t.Fatalf("ordered set: %v", err)
+	}
+	if err := CheckVolumeSet(ordered[:2]); !errors.Is(err, ErrIncompleteVolumeSet) {
+		t.Fatalf("missing last volume should fail, got %v", err)
+	}
+}
+
+// rar5FileHeader builds a RAR5 file header block; fileSpecific holds fields from fileFlags up to the name.
+func rar5FileHeader(hdrFlags uint64, dataSize int, fileSpecific []byte, extra []byte) []byte {
+	fields := [][]byte{encodeVarint(2), encodeVarint(hdrFlags)}
+	if hdrFlags&0x0001 != 0 {
+		fields = append(fields, encodeVarint(uint64(len(extra))))
+	}
+	if hdrFlags&0x0002 != 0 {
+		fields = append(fields, encodeVarint(uint64(dataSize)))
+	}
+	fields = append(fields, fileSpecific, extra)
+	return rar5Block(fields...)
+}
+
+func TestRar5FileDetails(t *testing.T) {
+	sig := []byte("Rar!\x1A\x07\x01\x00")
+	mtime := uint32(1700000000)
+	compInfo := uint64(0) | 0x0040 | 3<<7 | 5<<10 // version 0, solid, method 3, 4 MiB dictionary
+	file := bytes.NewBuffer(nil)
+	file.Write(encodeVarint(0x0002 | 0x0004)) // mtime + CRC32
+	file.Write(encodeVarint(10))
+	file.Write(encodeVarint(0o100644)) // attributes
+	file.Write(binary.LittleEndian.AppendUint32(nil, mtime))
+	file.Write(binary.LittleEndian.AppendUint32(nil, 0xDEADBEEF))
+	file.Write(encodeVarint(compInfo))
+	file.Write(encodeVarint(1)) // Unix
+	file.Write(encodeVarint(8))
+	file.WriteString("dir/a.md")
+	dir := bytes.NewBuffer(nil)
+	dir.Write(encodeVarint(0x0001)) // directory
+	dir.Write(encodeVarint(0))
+	dir.Write(encodeVarint(0o40755))
+	dir.Write(encodeVarint(0))
+	dir.Write(encodeVarint(1))
+	dir.Write(encodeVarint(3))
+	dir.WriteString("dir")
+	buf := bytes.NewBuffer(nil)
+	buf.Write(sig)
+	buf.Write(rar5FileHeader(0, 0, dir.Bytes(), nil))
+	buf.Write(rar5FileHeader(0x0002, 4, file.Bytes(), nil))
+	buf.Write([]byte{1, 2, 3, 4})
+	p := writeTemp(t, "details5.rar", buf.Bytes())
+	vols, err := IndexVolumes(defaultFS, []string{p})
+	if err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	fbs := vols[0].FileBlocks
+	if len(fbs) != 2 || !fbs[0].IsDir || fbs[1].IsDir {
+		t.Fatalf("dir flag: %+v", fbs)
+	}
+	fb := fbs[1]
+	if !fb.ModTime.Equal(time.Unix(int64(mtime), 0)) || !fb.HasCRC32 || fb.CRC32 != 0xDEADBEEF {
+		t.Fatalf("mtime/crc: %v %v %x", fb.ModTime, fb.HasCRC32, fb.CRC32)
+	}
+	if fb.HostOS != 1 || fb.Attributes != 0o100644 {
+		t.Fatalf("host/attrs: %d %o", fb.HostOS, fb.Attributes)
+	}
+	if fb.AlgorithmVersion != 0 || !fb.Solid || fb.Method != 3 || fb.DictSize != 4<<20 || fb.Stored {
+		t.Fatalf("compression info: %+v", fb)
+	}
+	agg := AggregateFiles(vols)
+	if len(agg) != 2 || !agg[0].IsDir || agg[1].IsDir {
+		t.Fatalf("aggregate dir flag: %+v", agg)
+	}
+}
+
+func TestRar3FileDetails(t *testing.T) {
+	sig := append([]byte("Rar!\x1A\x07\x00"), 0x00)
+	h := buildRar3FileHeader("d.bin", 0, 0)
+	h[7+8] = 3                                                  // HOST_OS Unix
+	binary.LittleEndian.PutUint32(h[7+9:], 0x12345678)          // FILE_CRC
+	binary.LittleEndian.PutUint32(h[7+13:], 0x5A2B6C00)         // FTIME 2025-01-11 13:32:00
+	h[7+17] = 29                                                // UNP_VER
+	binary.LittleEndian.PutUint32(h[7+21:], 0o100644)           // ATTR
+	dir := setRar3Flags(buildRar3FileHeader("d", 0, 0), 0x00E0) // directory
+	p := writeTemp(t, "details3.rar", append(append(append([]byte{}, sig...), h...), dir...))
+	vols, err := IndexVolumes(defaultFS, []string{p})
+	if err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	fb := vols[0].FileBlocks[0]
+	if fb.HostOS != 3 || fb.CRC32 != 0x12345678 || !fb.HasCRC32 || fb.AlgorithmVersion != 29 || fb.Attributes != 0o100644 {
+		t.Fatalf("rar3 details: %+v", fb)
+	}
+	if y, m, d := fb.ModTime.Date(); y != 2025 || m != time.January || d != 11 || fb.ModTime.Hour() != 13 || fb.ModTime.Minute() != 32 {
+		t.Fatalf("dos time: %v", fb.ModTime)
+	}
+	if fb.IsDir || fb.DictSize != 64<<10 || !vols[0].FileBlocks[1].IsDir {
+		t.Fatalf("dir/dict: %+v", vols[0].FileBlocks)
+	}
+}
+
+// rar5Extra encodes one extra area record (size, type, body).
+func rar5Extra(typ uint64, body ...[]byte) []byte {
+	rec := append(encodeVarint(typ), bytes.Join(body, nil)...)
+	return append(encodeVarint(uint64(len(rec))), rec...)
+}
+
+func TestRar5FileExtraRecords(t *testing.T) {
+	sig := []byte("Rar!\x1A\x07\x01\x00")
+	sum := bytes.Repeat([]byte{0x5A}, 32)
+	mtime, ctime := uint32(1700000000), uint32(1600000000)
+	extra := bytes.NewBuffer(nil)
+	extra.Write(rar5Extra(0x02, encodeVarint(0), sum))
+	extra.Write(rar5Extra(0x03, encodeVarint(0x0001|0x0002|0x0004|0x0010),
+		binary.LittleEndian.AppendUint32(nil, mtime), binary.LittleEndian.AppendUint32(nil, ctime),
+		binary.LittleEndian.AppendUint32(nil, 123), binary.LittleEndian.AppendUint32(nil, 456)))
+	extra.Write(rar5Extra(0x04, encodeVarint(0), encodeVarint(7)))
+	extra.Write(rar5Extra(0x05, encodeVarint(1), encodeVarint(0), encodeVarint(6), []byte("target")))
+	extra.Write(rar5Extra(0x06, encodeVarint(0x0001|0x0002|0x0004|0x0008), encodeVarint(4), []byte("user"), encodeVarint(5), []byte("staff"), encodeVarint(1000), encodeVarint(20)))
+	file := bytes.NewBuffer(nil)
+	file.Write(encodeVarint(0))
+	file.Write(encodeVarint(0))
+	file.Write(encodeVarint(0))
+	file.Write(encodeVarint(0))
+	file.Write(encodeVarint(1))
+	file.Write(encodeVarint(4))
+	file.WriteString("link")
+	buf := bytes.NewBuffer(nil)
+	buf.Write(sig)
+	buf.Write(rar5FileHeader(0x0001|0x0002, 0, file.Bytes(), extra.Bytes()))
+	// FILETIME based time record on a second file
+	winTime := bytes.NewBuffer(nil)
+	winTime.Write(rar5Extra(0x03, encodeVarint(0x0002), binary.LittleEndian.AppendUint64(nil, 116444736000000000+10000000)))
+	file2 := bytes.NewBuffer(nil)
+	file2.Write(encodeVarint(0))
+	file2.Write(encodeVarint(0))
+	file2.Write(encodeVarint(0))
+	file2.Write(encodeVarint(0))
+	file2.Write(encodeVarint(0))
+	file2.Write(encodeVarint(3))
+	file2.WriteString("win")
+	buf.Write(rar5FileHeader(0x0001|0x0002, 0, file2.Bytes(), winTime.Bytes()))
+	p := writeTemp(t, "extra5.rar", buf.Bytes())
+	vols, err := IndexVolumes(defaultFS, []string{p})
+	if err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	fb := vols[0].FileBlocks[0]
+	if fb.Hash == nil || fb.Hash.Type != HashBlake2sp || !bytes.Equal(fb.Hash.Sum, sum) {
+		t.Fatalf("hash: %+v", fb.Hash)
+	}
+	if fb.Times == nil || !fb.Times.ModTime.Equal(time.Unix(int64(mtime), 123)) || !fb.Times.CreateTime.Equal(time.Unix(int64(ctime), 456)) || !fb.Times.AccessTime.IsZero() {
+		t.Fatalf("times: %+v", fb.Times)
+	}
+	if !fb.ModTime.Equal(fb.Times.ModTime) {
+		t.Fatalf("ModTime should take precise mtime: %v", fb.ModTime)
+	}
+	if fb.Version != 7 {
+		t.Fatalf("version: %d", fb.Version)
+	}
+	if fb.Redirection == nil || fb.Redirection.Type != RedirUnixSymlink || fb.Redirection.Target != "target" || fb.Redirection.IsDir {
+		t.Fatalf("redirection: %+v", fb.Redirection)
+	}
+	if o := fb.Owner; o == nil || o.User != "user" || o.Group != "staff" || !o.HasUID || o.UID != 1000 || !o.HasGID || o.GID != 20 {
+		t.Fatalf("owner: %+v", fb.Owner)
+	}
+	if w := vols[0].FileBlocks[1].Times; w == nil || !w.ModTime.Equal(time.Unix(1, 0)) {
+		t.Fatalf("filetime: %+v", w)
+	}
+}
+
+// TestRar5TimeNanoseconds checks that a Unix time record with a nanosecond field of a second or more is
+// rejected as malformed.
+func TestRar5TimeNanoseconds(t *testing.T) {
+	for _, tc := range []struct {
+		ns uint32
+		ok bool
+	}{{999999999, true}, {1000000000, false}, {0xFFFFFFFF, false}} {
+		rec := append(encodeVarint(0x0001|0x0002|0x0010), binary.LittleEndian.AppendUint32(nil, 1700000000)...)
+		rec = binary.LittleEndian.AppendUint32(rec, tc.ns)
+		times, ok := decodeRar5Times(rec)
+		if ok != tc.ok {
+			t.Fatalf("ns %d: ok = %v", tc.ns, ok)
+		}
+		if ok && !times.ModTime.Equal(time.Unix(1700000000, int64(tc.ns))) {
+			t.Fatalf("ns %d: mtime %v", tc.ns, times.ModTime)
+		}
+	}
+}
+
+func TestRar5ServiceHeaders(t *testing.T) {
+	sig := []byte("Rar!\x1A\x07\x01\x00")
+	svc := func(name string, hdrFlags uint64, payload, extra []byte) []byte {
+		fs := bytes.NewBuffer(nil)
+		fs.Write(encodeVarint(0))
+		fs.Write(encodeVarint(uint64(len(payload))))
+		fs.Write(encodeVarint(0))
+		fs.Write(encodeVarint(0)) // stored
+		fs.Write(encodeVarint(0))
+		fs.Write(encodeVarint(uint64(len(name))))
+		fs.WriteString(name)
+		fields := [][]byte{encodeVarint(3), encodeVarint(hdrFlags | 0x0002)}
+		if hdrFlags&0x0001 != 0 {
+			fields = append(fields, encodeVarint(uint64(len(extra))))
+		}
+		fields = append(fields, encodeVarint(uint64(len(payload))), fs.Bytes(), extra)
+		return append(rar5Block(fields...), payload...)
+	}
+	file := bytes.NewBuffer(nil)
+	file.Write(encodeVarint(0))
+	file.Write(encodeVarint(2))
+	file.Write(encodeVarint(0))
+	file.Write(encodeVarint(0))
+	file.Write(encodeVarint(0))
+	file.Write(encodeVarint(5))
+	file.WriteString("f.bin")
+	buf := bytes.NewBuffer(nil)
+	buf.Write(sig)
+	cmtPos := int64(buf.Len())
+	buf.Write(svc("CMT", 0, []byte("hello comment"), nil))
+	buf.Write(rar5FileHeader(0x0002, 2, file.Bytes(), nil))
+	buf.Write([]byte{9, 9})
+	buf.Write(svc("STM", 0x0001|0x0020, []byte("stream-data"), rar5Extra(0x07, []byte(":Zone.Identifier"))))
+	buf.Write(svc("QO", 0, []byte{1, 2, 3}, nil))
+	buf.Write(svc("RR", 0, bytes.Repeat([]byte{0xEE}, 16), nil))
+	buf.Write(rar5Block(encodeVarint(5), encodeVarint(0), encodeVarint(0)))
+	p := writeTemp(t, "svc5.rar", buf.Bytes())
+	vols, err := IndexVolumes(defaultFS, []string{p})
+	if err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	v := vols[0]
+	if len(v.FileBlocks) != 1 || v.FileBlocks[0].Name != "f.bin" {
+		t.Fatalf("service headers must not show up as files: %+v", v.FileBlocks)
+	}
+	sbs := v.ServiceBlocks
+	if len(sbs) != 4 || sbs[0].Name != ServiceComment || sbs[1].Name != ServiceStream || sbs[2].Name != ServiceQuickOpen || sbs[3].Name != ServiceRecovery {
+		t.Fatalf("service blocks: %+v", sbs)
+	}
+	raw := buf.Bytes()
+	cmt := sbs[0]
+	if cmt.HeaderPos != cmtPos || cmt.FileIndex != -1 || !cmt.Stored || string(raw[cmt.DataPos:cmt.DataPos+cmt.PackedSize]) != "hello comment" {
+		t.Fatalf("comment block: %+v", cmt)
+	}
+	stm := sbs[1]
+	if stm.FileIndex != 0 || stm.FileName != "f.bin" || string(stm.Data) != ":Zone.Identifier" || string(raw[stm.DataPos:stm.DataPos+stm.PackedSize]) != "stream-data" {
+		t.Fatalf("stream block: %+v", stm)
+	}
+	if sbs[3].FileIndex != -1 || sbs[3].PackedSize != 16 {
+		t.Fatalf("recovery block: %+v", sbs[3])
+	}
+}
+
+func TestRar3SubBlocks(t *testing.T) {
+	sig := []byte("Rar!\x1A\x07\x00")
+	// MAIN_HEAD with an embedded RAR 2.x comment block (stored)
+	cmt := []byte{0x00, 0x00, 0x75, 0x00, 0x00, 13 + 5, 0x00, 5, 0, 20, 0x30, 0, 0}
+	cmt = append(cmt, "hello"...)
+	main := append([]byte{0x00, 0x00, 0x73, 0x02, 0x00, byte(13 + len(cmt)), 0x00, 0, 0, 0, 0, 0, 0}, cmt...)
+	// NEWSUB_HEAD: file header layout with a service name and sub data (stream name) after it
+	newSub := func(name, subData string, payload []byte) []byte {
+		h := buildRar3FileHeader(name, uint32(len(payload)), uint32(len(payload)))
+		h[2] = 0x7A
+		h = append(h, subData...)
+		h[5] = byte(len(h))
+		return append(h, payload...)
+	}
+	// SUB_HEAD (NTFS stream, old style): DATA_SIZE SUB_TYPE LEVEL UNP_SIZE UNP_VER METHOD CRC NAME_SIZE NAME
+	oldStm := []byte{0x00, 0x00, 0x77, 0x00, 0x80, 0, 0x00, 4, 0, 0, 0, 0x05, 0x01, 0}
+	oldStm = append(oldStm, 4, 0, 0, 0, 20, 0x30, 0, 0, 0, 0, 3, 0)
+	oldStm = append(oldStm, ":s2"...)
+	oldStm[5] = byte(len(oldStm))
+	oldStm = append(oldStm, "abcd"...)
+	// PROTECT_HEAD: DATA_SIZE VERSION REC_SECTORS TOTAL_BLOCKS MARK
+	protect := []byte{0x00, 0x00, 0x78, 0x00, 0x80, 26, 0x00, 8, 0, 0, 0, 1, 2, 0, 1, 0, 0, 0}
+	protect = append(protect, "Protect!"...)
+	protect = append(protect, bytes.Repeat([]byte{0xEE}, 8)...)
+	buf := bytes.NewBuffer(nil)
+	buf.Write(sig)
+	buf.Write(main)
+	buf.Write(newSub("CMT", "", []byte("archive comment")))
+	buf.Write(buildRar3FileHeader("f.bin", 2, 2))
+	buf.Write([]byte{9, 9})
+	buf.Write(newSub("STM", ":Zone.Identifier", []byte("stream")))
+	buf.Write(oldStm)
+	buf.Write(protect)
+	buf.Write([]byte{0x00, 0x00, 0x7B, 0x00, 0x00, 7, 0x00})
+	p := writeTemp(t, "sub3.rar", buf.Bytes())
+	vols, err := IndexVolumes(defaultFS, []string{p})
+	if err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	v := vols[0]
+	if len(v.FileBlocks) != 1 || v.FileBlocks[0].Name != "f.bin" || !v.Archive.HasEnd || len(v.Warnings) != 0 {
+		t.Fatalf("sub-blocks must not show up as files: %+v %v", v.FileBlocks, v.Warnings)
+	}
+	sbs := v.ServiceBlocks
+	if len(sbs) != 5 {
+		t.Fatalf("service blocks: %+v", sbs)
+	}
+	raw := buf.Bytes()
+	payload := func(sb ServiceBlock) string { return string(raw[sb.DataPos : sb.DataPos+sb.PackedSize]) }
+	if sb := sbs[0]; sb.Name != ServiceComment || sb.HeaderType != 0x75 || !sb.Stored || sb.FileIndex != -1 || payload(sb) != "hello" {
+		t.Fatalf("embedded comment: %+v", sb)
+	}
+	if sb := sbs[1]; sb.Name != ServiceComment || sb.HeaderType != 0x7A || !sb.Stored || sb.FileIndex != -1 || payload(sb) != "archive comment" {
+		t.Fatalf("newsub comment: %+v", sb)
+	}
+	if sb := sbs[2]; sb.Name != ServiceStream || sb.FileIndex != 0 || sb.FileName != "f.bin" || string(sb.Data) != ":Zone.Identifier" || payload(sb) != "stream" {
+		t.Fatalf("newsub stream: %+v", sb)
+	}
+	if sb := sbs[3]; sb.Name != ServiceStream || sb.HeaderType != 0x77 || !sb.Stored || sb.FileIndex != 0 || string(sb.Data) != ":s2" || payload(sb) != "abcd" {
+		t.Fatalf("old stream: %+v", sb)
+	}
+	if sb := sbs[4]; sb.Name != ServiceRecovery || sb.HeaderType != 0x78 || sb.FileIndex != -1 || sb.PackedSize != 8 || payload(sb) != string(bytes.Repeat([]byte{0xEE}, 8)) {
+		t.Fatalf("protect: %+v", sb)
+	}
+}
+
+func TestLegacyWalkAllBlocks(t *testing.T) {
+	sig := append([]byte("Rar!\x1A\x07\x00"), 0x00)
+	filler := []byte{0x01, 0x02, 0x03} // garbage before the first block forces the legacy fallback
+	// RAR 2.x main header with an embedded comment that contains a stray 0x74
+	cmt := []byte{0x00, 0x00, 0x75, 0x00, 0x00, 13 + 4, 0x00, 4, 0, 20, 0x30, 0, 0, 't', 0x74, 0x74, 't'}
+	main := append([]byte{0x00, 0x00, 0x73, 0x02, 0x00, byte(13 + len(cmt)), 0x00, 0, 0, 0, 0, 0, 0}, cmt...)
+	// first file: name with a 0x74 byte, data that looks like a file header
+	fake := buildRar3FileHeader("fake.bin", 0, 0)
+	f1 := buildRar3FileHeader("a\x74b", uint32(len(fake)), uint32(len(fake)))
+	// second file: RAR 2.x file comment embedded after the name (LHD_COMMENT)
+	fcmt := []byte{0x00, 0x00, 0x75, 0x00, 0x00, 13 + 3, 0x00, 3, 0, 20, 0x30, 0, 0, 'f', 'c', 'm'}
+	f2 := setRar3Flags(append(buildRar3FileHeader("second.txt", 3, 3), fcmt...), 0x0008)
+	f2[5] = byte(len(f2))
+	end := []byte{0x00, 0x00, 0x7B, 0x00, 0x00, 7, 0x00}
+	buf := bytes.NewBuffer(nil)
+	buf.Write(sig)
+	buf.Write(filler)
+	buf.Write(main)
+	f1Pos := int64(buf.Len())
+	buf.Write(f1)
+	buf.Write(fake)
+	f2Pos := int64(buf.Len())
+	buf.Write(f2)
+	buf.Write([]byte("xyz"))
+	buf.Write(end)
+	p := writeTemp(t, "legacy_walk.rar", buf.Bytes())
+	vols, err := IndexVolumes(defaultFS, []string{p})
+	if err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	v := vols[0]
+	fbs := v.FileBlocks
+	if len(fbs) != 2 || fbs[0].Name != "a\x74b" || fbs[1].Name != "second.txt" {
+		t.Fatalf("legacy walk files: %+v", fbs)
+	}
+	if fbs[0].HeaderPos != f1Pos || fbs[1].HeaderPos != f2Pos || fbs[1].DataPos != f2Pos+int64(len(f2)) || v.TotalHeaderBytes != fbs[0].DataPos {
+		t.Fatalf("legacy walk offsets: %+v", fbs)
+	}
+	if !v.Archive.HasMainHeader || !v.Archive.HasEnd || len(v.Warnings) != 0 {
+		t.Fatalf("legacy walk archive: %+v %v", v.Archive, v.Warnings)
+	}
+	raw := buf.Bytes()
+	sbs := v.ServiceBlocks
+	if len(sbs) != 2 || sbs[0].FileIndex != -1 || string(raw[sbs[0].DataPos:sbs[0].DataPos+sbs[0].PackedSize]) != "t\x74\x74t" {
+		t.Fatalf("archive comment: %+v", sbs)
+	}
+	if sbs[1].FileIndex != 1 || sbs[1].FileName != "second.txt" || string(raw[sbs[1].DataPos:sbs[1].DataPos+sbs[1].PackedSize]) != "fcm" {
+		t.Fatalf("file comment: %+v", sbs[1])
+	}
+}
+
+// rar14Volume builds a RAR 1.4 volume: main header (with optional comment) and one file header per entry.
+func rar14Volume(mainFlags byte, comment string, files ...[]byte) []byte {
+	main := []byte("RE~^")
+	size := 7
+	if comment != "" {
+		size += 2 + len(comment)
+	}
+	main = binary.LittleEndian.AppendUint16(main, uint16(size))
+	main = append(main, mainFlags)
+	if comment != "" {
+		main = binary.LittleEndian.AppendUint16(main, uint16(len(comment)))
+		main = append(main, comment...)
+	}
+	return append(main, bytes.Join(files, nil)...)
+}
+
+// rar14File builds a RAR 1.4 file header followed by its data.
+func rar14File(name string, flags, method byte, unpSize int, data []byte) []byte {
+	h := binary.LittleEndian.AppendUint32(nil, uint32(len(data)))
+	h = binary.LittleEndian.AppendUint32(h, uint32(unpSize))
+	h = binary.LittleEndian.AppendUint16(h, 0)
+	h = binary.LittleEndian.AppendUint16(h, uint16(21+len(name)))
+	h = binary.LittleEndian.AppendUint32(h, 0x5A2B6C00)
+	h = append(h, 0x20, flags, 2, byte(len(name)), method)
+	h = append(h, name...)
+	return append(h, data...)
+}
+
+func TestRar14Archive(t *testing.T) {
+	dir := t.TempDir()
+	v1 := rar14Volume(0x01|0x02, "old comment",
+		rar14File("A.TXT", 0, 0, 3, []byte("abc")),
+		rar14File("B.BIN", 0x02, 0, 7, []byte("1234")))
+	v2 := rar14Volume(0x01, "", rar14File("B.BIN", 0x01, 0, 7, []byte("567")))
+	p1, p2 := filepath.Join(dir, "old.rar"), filepath.Join(dir, "old.r00")
+	if err := os.WriteFile(p1, v1, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p2, v2, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	vols, err := IndexVolumes(defaultFS, []string{p1, p2})
+	if err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	v := vols[0]
+	if v.Version != VersionRar14 || !v.Archive.IsVolume || !v.Archive.HasComment || len(v.Warnings) != 0 {
+		t.Fatalf("rar14 volume: %+v", v)
+	}
+	if len(v.ServiceBlocks) != 1 || string(v1[v.ServiceBlocks[0].DataPos:v.ServiceBlocks[0].DataPos+v.ServiceBlocks[0].PackedSize]) != "old comment" {
+		t.Fatalf("rar14 comment: %+v", v.ServiceBlocks)
+	}
+	fbs := v.FileBlocks
+	if len(fbs) != 2 || fbs[0].Name != "A.TXT" || !fbs[0].Stored || string(v1[fbs[0].DataPos:fbs[0].DataPos+fbs[0].PackedSize]) != "abc" {
+		t.Fatalf("rar14 files: %+v", fbs)
+	}
+	if !fbs[1].ContinuedTo || fbs[1].AlgorithmVersion != 13 || fbs[1].ModTime.Year() != 2025 {
+		t.Fatalf("rar14 file fields: %+v", fbs[1])
+	}
+	files, err := ListFiles(p1)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(files) != 2 || files[1].Name != "B.BIN" || len(files[1].Parts) != 2 || files[1].Incomplete || files[1].TotalPackedSize != 7 {
+		t.Fatalf("rar14 aggregate: %+v", files)
+	}
+	// RAR 1.3 compression (UNP_VER 2) is unpacked as RAR 1.5; older entries are reported like in the other versions
+	packed := rar14File("C.TXT", 0, 3, 10, []byte("xx"))
+	if _, err := ListFiles(writeTemp(t, "packed.rar", rar14Volume(0, "", packed))); err != nil {
+		t.Fatalf("RAR 1.3 compressed entry: %v", err)
+	}
+	packed[18] = 1
+	if _, err := ListFiles(writeTemp(t, "packed10.rar", rar14Volume(0, "", packed))); !errors.Is(err, ErrCompressedNotSupported) {
+		t.Fatalf("expected compressed error, got %v", err)
+	}
+}
+
+func TestSFXLargeStub(t *testing.T) {
+	archive := append([]byte{}, []byte("Rar!\x1A\x07\x01\x00")...)
+	file := bytes.NewBuffer(nil)
+	file.Write(encodeVarint(0))
+	file.Write(encodeVarint(4))
+	file.Write(encodeVarint(0))
+	file.Write(encodeVarint(0))
+	file.Write(encodeVarint(0))
+	file.Write(encodeVarint(5))
+	file.WriteString("s.bin")
+	archive = append(archive, rar5FileHeader(0x0002, 4, file.Bytes(), nil)...)
+	archive = append(archive, "DATA"...)
+	const stubSize = 200 * 1024
+	// PE: DOS header -> "PE\0\0" + COFF header (1 section, no optional header) -> section table
+	pe := make([]byte, stubSize)
+	copy(pe, "MZ")
+	binary.LittleEndian.PutUint32(pe[0x3C:], 0x40)
+	copy(pe[0x40:], "PE\x00\x00")
+	binary.LittleEndian.PutUint16(pe[0x40+6:], 1)
+	sec := pe[0x40+24:]
+	binary.LittleEndian.PutUint32(sec[16:], stubSize-0x200) // SizeOfRawData
+	binary.LittleEndian.PutUint32(sec[20:], 0x200)          // PointerToRawData
+	// ELF64 LE: one section whose contents end where the section header table starts
+	elf := make([]byte, stubSize)
+	copy(elf, "\x7fELF\x02\x01\x01")
+	binary.LittleEndian.PutUint64(elf[0x28:], stubSize-64) // e_shoff
+	binary.LittleEndian.PutUint16(elf[0x3A:], 64)          // e_shentsize
+	binary.LittleEndian.PutUint16(elf[0x3C:], 1)           // e_shnum
+	sh := elf[stubSize-64:]
+	binary.LittleEndian.PutUint32(sh[4:], 1)          // SHT_PROGBITS
+	binary.LittleEndian.PutUint64(sh[0x18:], 0x100)   // sh_offset
+	binary.LittleEndian.PutUint64(sh[0x20:], 0x10000) // sh_size
+	for _, tc := range []struct {
+		name string
+		stub []byte
+		opts []Option
+		ok   bool
+	}{
+		{"pe", pe, []Option{WithSFXScanLimit(1024)}, true},
+		{"elf", elf, []Option{WithSFXScanLimit(1024)}, true},
+		{"plain-scan", make([]byte, stubSize), nil, true},
+		{"plain-scan-limited", make([]byte, stubSize), []Option{WithSFXScanLimit(64 * 1024)}, false},
+	} {
+		data := append(append([]byte{}, tc.stub...), archive...)
+		p := writeTemp(t, tc.name+".exe", data)
+		vols, err := IndexVolumes(defaultFS, []string{p}, tc.opts...)
+		if !tc.ok {
+			if err == nil {
+				t.Fatalf("%s: expected signature not found", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: index: %v", tc.name, err)
+		}
+		fb := vols[0].FileBlocks[0]
+		if vols[0].Version != VersionRar5 || fb.HeaderPos != stubSize+8 || string(data[fb.DataPos:fb.DataPos+fb.PackedSize]) != "DATA" {
+			t.Fatalf("%s: offsets %+v", tc.name, fb)
+		}
+	}
+}
+
+// TestRar14MarkOffset checks that the short RAR 1.4 mark is only trusted at the start of a volume or of
+// an executable overlay, not anywhere in leading data.
+func TestRar14MarkOffset(t *testing.T) {
+	vol := rar14Volume(0, "", rar14File("A.TXT", 0, 0, 3, []byte("abc")))
+	const stubSize = 0x400
+	pe := make([]byte, stubSize)
+	copy(pe, "MZ")
+	binary.LittleEndian.PutUint32(pe[0x3C:], 0x40)
+	copy(pe[0x40:], "PE\x00\x00")
+	binary.LittleEndian.PutUint16(pe[0x40+6:], 1)
+	sec := pe[0x40+24:]
+	binary.LittleEndian.PutUint32(sec[16:], stubSize-0x200) // SizeOfRawData
+	binary.LittleEndian.PutUint32(sec[20:], 0x200)          // PointerToRawData
+	for _, tc := range []struct {
+		name string
+		stub []byte
+		ok   bool
+	}{
+		{"plain", nil, true},
+		{"text", []byte("readme: RE~^ is the old mark\n"), false},
+		{"zeros", make([]byte, 100), false},
+		{"pe", pe, true},
+	} {
+		data := append(append([]byte{}, tc.stub...), vol...)
+		vols, err := IndexVolumes(defaultFS, []string{writeTemp(t, tc.name+".rar", data)})
+		if !tc.ok {
+			if err == nil {
+				t.Fatalf("%s: RAR 1.4 mark accepted past offset 0: %+v", tc.name, vols[0])
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: index: %v", tc.name, err)
+		}
+		if vols[0].Version != VersionRar14 || len(vols[0].FileBlocks) != 1 || vols[0].FileBlocks[0].HeaderPos <= int64(len(tc.stub)) {
+			t.Fatalf("%s: %+v", tc.name, vols[0])
+		}
+	}
+}
+
+// TestSFXShortELFEntries feeds ELF64 headers whose table entry sizes are too small for the fields read
+// from them: the tables are ignored instead of being indexed out of range.
+func TestSFXShortELFEntries(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		off, entOff int
+	}{
+		{"program-headers", 0x20, 0x36}, // e_phoff, e_phentsize
+		{"section-headers", 0x28, 0x3A}, // e_shoff, e_shentsize
+	} {
+		elf := make([]byte, 256)
+		copy(elf, "\x7fELF\x02\x01\x01")
+		binary.LittleEndian.PutUint64(elf[tc.off:], 64)
+		binary.LittleEndian.PutUint16(elf[tc.entOff:], 32)  // entry size
+		binary.LittleEndian.PutUint16(elf[tc.entOff+2:], 1) // entry count
+		if _, _, err := findSFXSignature(bytes.NewReader(elf), DefaultSFXScanLimit); err == nil {
+			t.Fatalf("%s: expected signature not found", tc.name)
+		}
+	}
+}
+
+// rar3SetCRC stores the HEAD_CRC of a complete RAR3 block header.
+func rar3SetCRC(h []byte) []byte {
+	binary.LittleEndian.PutUint16(h[0:2], uint16(crc32.ChecksumIEEE(h[2:])))
+	return h
+}
+
+// rar5SetCRC stores the header CRC32 of a block built by rar5Block.
+func rar5SetCRC(b []byte) []byte {
+	binary.LittleEndian.PutUint32(b[0:4], crc32.ChecksumIEEE(b[4:]))
+	return b
+}
+
+func TestHeaderCRCModes(t *testing.T) {
+	sig3 := []byte("Rar!\x1A\x07\x00")
+	main3 := rar3SetCRC([]byte{0x00, 0x00, 0x73, 0x00, 0x00, 13, 0x00, 0, 0, 0, 0, 0, 0})
+	good3 := rar3SetCRC(buildRar3FileHeader("good.bin", 1, 1))
+	bad3 := rar3SetCRC(buildRar3FileHeader("bad.bin", 1, 1))
+	bad3[0] ^= 0xFF
+	bad3Pos := int64(len(sig3) + len(main3) + len(good3) + 1)
+	rar3 := bytes.Join([][]byte{sig3, main3, good3, {1}, bad3, {2}}, nil)
+
+	file := bytes.NewBuffer(nil)
+	file.Write(encodeVarint(0))
+	file.Write(encodeVarint(1))
+	file.Write(encodeVarint(0))
+	file.Write(encodeVarint(0))
+	file.Write(encodeVarint(0))
+	file.Write(encodeVarint(1))
+	file.WriteString("f")
+	good5 := rar5SetCRC(rar5FileHeader(0x0002, 1, file.Bytes(), nil))
+	bad5 := rar5SetCRC(rar5FileHeader(0x0002, 1, file.Bytes(), nil))
+	bad5[1] ^= 0xFF
+	sig5 := []byte("Rar!\x1A\x07\x01\x00")
+	bad5Pos := int64(len(sig5) + len(good5) + 1)
+	rar5 := bytes.Join([][]byte{sig5, good5, {1}, bad5, {2}}, nil)
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		pos  int64
+		typ  uint8
+	}{{"crc3.rar", rar3, bad3Pos, 0x74}, {"crc5.rar", rar5, bad5Pos, 2}} {
+		p := writeTemp(t, tc.name, tc.data)
+		vols, err := IndexVolumes(defaultFS, []string{p})
+		if err != nil || len(vols[0].FileBlocks) != 2 || len(vols[0].Warnings) != 0 {
+			t.Fatalf("%s: default mode must not check CRCs: %v %+v", tc.name, err, vols)
+		}
+		vols, err = IndexVolumes(defaultFS, []string{p}, WithHeaderCRC(CRCWarn))
+		if err != nil {
+			t.Fatalf("%s: lenient: %v", tc.name, err)
+		}
+		if w := vols[0].Warnings; len(w) != 1 || w[0].Kind != WarningHeaderCRC || w[0].Offset != tc.pos || len(vols[0].FileBlocks) != 2 {
+			t.Fatalf("%s: lenient warnings: %v", tc.name, w)
+		}
+		_, err = IndexVolumes(defaultFS, []string{p}, WithHeaderCRC(CRCStrict))
+		var crcErr *ErrHeaderCRC
+		if !errors.As(err, &crcErr) || crcErr.Volume != p || crcErr.Offset != tc.pos || crcErr.BlockType != tc.typ {
+			t.Fatalf("%s: strict: %v", tc.name, err)
+		}
+	}
+}
+
+func TestVerifyStoredFiles(t *testing.T) {
+	sig := append([]byte("Rar!\x1A\x07\x00"), 0x00)
+	// RAR3 two-volume set: the first part carries the CRC of its own data, the last the whole file CRC.
+	data := []byte("hello world!")
+	rar3Part := func(flags uint16, piece []byte, crc uint32) []byte {
+		h := setRar3Flags(buildRar3FileHeader("v.bin", uint32(len(piece)), uint32(len(data))), flags)
+		binary.LittleEndian.PutUint32(h[16:20], crc) // FILE_CRC
+		h[24] = 29                                   // UNP_VER
+		return append(h, piece...)
+	}
+	// the data CRC covers the volume from its first byte up to the end block
+	vol1 := append(append([]byte{}, sig...), rar3Part(0x0002, data[:6], crc32.ChecksumIEEE(data[:6]))...)
+	end := []byte{0x00, 0x00, 0x7B, 0x03, 0x00, 11, 0x00} // next volume + data CRC
+	end = binary.LittleEndian.AppendUint32(end, crc32.ChecksumIEEE(vol1))
+	vol1 = append(vol1, end...)
+	vol2 := append(append([]byte{}, sig...), rar3Part(0x0001, data[6:], crc32.ChecksumIEEE(data))...)
+	p1 := writeTemp(t, "v.part1.rar", vol1)
+	p2 := filepath.Join(filepath.Dir(p1), "v.part2.rar")
+	if err := os.WriteFile(p2, vol2, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	rep, err := VerifyAll(p1)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if !rep.OK || len(rep.Files) != 1 || !rep.Files[0].Checked || len(rep.Files[0].Parts) != 2 {
+		t.Fatalf("intact set should verify: %+v", rep)
+	}
+	if pc := rep.Files[0].Parts[0]; !pc.Checked || !pc.OK {
+		t.Fatalf("first part should be checked on its own: %+v", pc)
+	}
+	if vc := rep.Volumes[0]; vc.Path != p1 || !vc.Checked || !vc.OK || rep.Volumes[1].Checked {
+		t.Fatalf("volume data CRC: %+v", rep.Volumes)
+	}
+	// The data CRC covers the headers too: a changed file name fails it.
+	renamed := append([]byte{}, vol1...)
+	renamed[len(sig)+32] = 'w'
+	vols, err := IndexVolumes(defaultFS, []string{writeTemp(t, "renamed.rar", renamed)})
+	if err != nil {
+		t.Fatalf("index renamed: %v", err)
+	}
+	if vc := verifyVolumeDataCRC(defaultFS, vols[0]); !vc.Checked || vc.OK {
+		t.Fatalf("volume data CRC over a changed header: %+v", vc)
+	}
+	// Corrupt the second piece: only the last part and the file fail.
+	bad := append([]byte{}, vol2...)
+	bad[len(bad)-1] ^= 0xFF
+	if err := os.WriteFile(p2, bad, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	rep, err = VerifyAll(p1)
+	if err != nil {
+		t.Fatalf("verify corrupt: %v", err)
+	}
+	fc := rep.Files[0]
+	if rep.OK || fc.OK || fc.Err != nil || !fc.Parts[0].OK || fc.Parts[1].OK {
+		t.Fatalf("corrupt last part not reported: %+v", fc)
+	}
+	if !rep.Volumes[0].OK {
+		t.Fatalf("untouched volume should still pass: %+v", rep.Volumes[0])
+	}
+
+	// RAR5: CRC32 field plus BLAKE2sp hash record.
+	rar5Sig := []byte("Rar!\x1A\x07\x01\x00")
+	body := []byte("blake2sp payload")
+	rar5File := func(name string, sum []byte) []byte {
+		spec := bytes.Join([][]byte{encodeVarint(0x0004), encodeVarint(uint64(len(body))), encodeVarint(0),
+			binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(body)),
+			encodeVarint(0), encodeVarint(0), encodeVarint(uint64(len(name))), []byte(name)}, nil)
+		return append(rar5FileHeader(0x0001|0x0002, len(body), spec, rar5Extra(0x02, encodeVarint(0), sum)), body...)
+	}
+	good := blake2sp.Sum(body)
+	p := writeTemp(t, "b2.rar", bytes.Join([][]byte{rar5Sig, rar5File("good.bin", good[:]), rar5File("bad.bin", make([]byte, 32))}, nil))
+	vols, err = IndexVolumes(defaultFS, []string{p})
+	if err != nil {
+		t.Fatalf("index rar5: %v", err)
+	}
+	agg := AggregateFiles(vols)
+	if fc := VerifyFile(agg[0]); !fc.OK || !fc.Checked {
+		t.Fatalf("rar5 good file: %+v", fc)
+	}
+	if fc := VerifyFile(agg[1]); fc.OK || !fc.Checked || fc.Parts[0].OK {
+		t.Fatalf("rar5 hash mismatch not reported: %+v", fc)
+	}
+	if fc := VerifyFile(AggregatedFile{Name: "c.bin", Parts: []AggregatedFilePart{{Path: p}}}); fc.OK || !errors.Is(fc.Err, ErrCompressedNotSupported) {
+		t.Fatalf("compressed file should be skipped: %+v", fc)
+	}
+}
+
+func TestRecoveryRecordRepair(t *testing.T) {
+	sig := []byte("Rar!\x1A\x07\x00")
+	main := []byte{0x00, 0x00, 0x73, 0x00, 0x00, 13, 0x00, 0, 0, 0, 0, 0, 0}
+	payload := make([]byte, 1800)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	protected := bytes.Join([][]byte{sig, main, buildRar3FileHeader("data.bin", 0, 0), payload}, nil)
+	binary.LittleEndian.PutUint32(protected[len(sig)+len(main)+7:], uint32(len(payload)))   // PACK_SIZE
+	binary.LittleEndian.PutUint32(protected[len(sig)+len(main)+7+4:], uint32(len(payload))) // UNP_SIZE
+	// "RR" NEWSUB: sector CRCs then two interleaved XOR parity sectors over everything before it.
+	const recSectors = 2
+	sectors := (len(protected) + 511) / 512
+	padded := append(append([]byte{}, protected...), make([]byte, sectors*512-len(protected))...)
+	var rrData []byte
+	for i := 0; i < sectors; i++ {
+		rrData = binary.LittleEndian.AppendUint16(rrData, uint16(crc32.ChecksumIEEE(padded[i*512:(i+1)*512])))
+	}
+	parity := make([]byte, recSectors*512)
+	for i := 0; i < sectors; i++ {
+		for k := 0; k < 512; k++ {
+			parity[(i%recSectors)*512+k] ^= padded[i*512+k]
+		}
+	}
+	rrData = append(rrData, parity...)
+	subData := append([]byte("Protect+"), binary.LittleEndian.AppendUint64(binary.LittleEndian.AppendUint32(nil, recSectors), uint64(sectors))...)
+	rr := append(buildRar3FileHeader("RR", 0, 0), subData...)
+	rr[2], rr[5] = 0x7A, byte(len(rr))
+	binary.LittleEndian.PutUint32(rr[7:11], uint32(len(rrData)))
+	binary.LittleEndian.PutUint32(rr[11:15], uint32(len(rrData)))
+	vol := bytes.Join([][]byte{protected, rr, rrData}, nil)
+
+	check := func(data []byte) (*VolumeIndex, RecoveryReport) {
+		t.Helper()
+		p := writeTemp(t, "rr.rar", data)
+		vols, err := IndexVolumes(defaultFS, []string{p})
+		if err != nil {
+			t.Fatalf("index: %v", err)
+		}
+		rep, err := CheckRecovery(vols[0])
+		if err != nil {
+			t.Fatalf("check: %v", err)
+		}
+		return vols[0], rep
+	}
+	vi, rep := check(vol)
+	rec, ok := FindRecoveryRecord(vi)
+	if !ok || !rec.Repairable || rec.RecSectors != recSectors || rec.Sectors != int64(sectors) || rec.HeaderPos != int64(len(protected)) {
+		t.Fatalf("recovery record: %+v", rec)
+	}
+	if len(rep.Damaged) != 0 {
+		t.Fatalf("intact volume reported damage: %+v", rep)
+	}
+	// Two consecutive damaged sectors use different parity sectors and can be rebuilt in place.
+	bad := append([]byte{}, vol...)
+	bad[600] ^= 0xFF
+	bad[1100] ^= 0x0F
+	vi, rep = check(bad)
+	if len(rep.Damaged) != 2 || rep.Damaged[0] != 512 || rep.Damaged[1] != 1024 {
+		t.Fatalf("damaged sectors: %+v", rep)
+	}
+	f, err := os.OpenFile(vi.Path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err = RepairVolume(vi, f)
+	_ = f.Close()
+	if err != nil || len(rep.Repaired) != 2 || len(rep.Unrepairable) != 0 {
+		t.Fatalf("repair: %+v %v", rep, err)
+	}
+	if got, _ := os.ReadFile(vi.Path); !bytes.Equal(got, vol) {
+		t.Fatalf("volume not restored")
+	}
+	// Sectors 1 and 3 share a parity sector: detected but not repairable.
+	bad = append([]byte{}, vol...)
+	bad[600] ^= 0xFF
+	bad[1600] ^= 0xFF
+	vi, _ = check(bad)
+	if f, err = os.OpenFile(vi.Path, os.O_RDWR, 0); err != nil {
+		t.Fatal(err)
+	}
+	rep, err = RepairVolume(vi, f)
+	_ = f.Close()
+	if err != nil || len(rep.Repaired) != 0 || len(rep.Unrepairable) != 2 {
+		t.Fatalf("shared parity slot should be unrepairable: %+v %v", rep, err)
+	}
+	if _, err := RepairVolume(&VolumeIndex{Path: vi.Path}, nil); !errors.Is(err, ErrNoRecoveryRecord) {
+		t.Fatalf("missing record: %v", err)
+	}
+	// A volume cut inside the sector CRCs is reported, not checked against zeroed CRCs.
+	p := writeTemp(t, "rr-short.rar", vol[:len(protected)+len(rr)+sectors])
+	vi.Path = p
+	if _, err := CheckRecovery(vi); err == nil {
+		t.Fatalf("truncated sector CRCs should fail")
+	}
+	// RAR5 records are located only.
+	rr5 := &VolumeIndex{Path: p, Version: VersionRar5, ServiceBlocks: []ServiceBlock{{Name: ServiceRecovery, FileIndex: -1, Stored: true, Data: []byte{3}}}}
+	if rec, ok := FindRecoveryRecord(rr5); !ok || rec.Repairable || rec.Percent != 3 {
+		t.Fatalf("rar5 record: %+v", rec)
+	}
+	if _, err := CheckRecovery(rr5); !errors.Is(err, ErrRecoveryUnsupported) {
+		t.Fatalf("rar5 record check: %v", err)
+	}
+}
+
+type memSink map[string]*bytes.Buffer
+
+func (m memSink) open(path string) (io.WriteCloser, error) {
+	m[path] = &bytes.Buffer{}
+	return nopWriteCloser{m[path]}, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// revParity computes the recovery data of a volume set with the package's own erasure solver, treating
+// the parity positions as the unknowns.
+func revParity(t *testing.T, version string, data [][]byte, nr int, size int64) [][]byte {
+	t.Helper()
+	nd := len(data)
+	srcs := make([]io.Reader, nd+nr)
+	for i, d := range data {
+		srcs[i] = bytes.NewReader(d)
+	}
+	unknown, rows := []int{}, []int{}
+	dsts := map[int]io.Writer{}
+	out := make([]*bytes.Buffer, nr)
+	for r := range out {
+		out[r] = &bytes.Buffer{}
+		unknown, dsts[nd+r] = append(unknown, nd+r), out[r]
+	}
+	var err error
+	if version == VersionRar5 {
+		f := gf65536()
+		for r := 0; r < nr; r++ {
+			rows = append(rows, r)
+		}
+		err = solveErasures(f, 2, rows, func(r, pos int) uint32 {
+			if pos < nd {
+				return f.inv(uint32(r+nd) ^ uint32(pos))
+			}
+			if pos == nd+r {
+				return 1
+			}
+			return 0
+		}, srcs, unknown, dsts, size)
+	} else {
+		f := gf256()
+		for r := 1; r <= nr; r++ {
+			rows = append(rows, r)
+		}
+		err = solveErasures(f, 1, rows, func(row, pos int) uint32 { return f.pow(row * (nd + nr - 1 - pos)) }, srcs, unknown, dsts, size)
+	}
+	if err != nil {
+		t.Fatalf("parity: %v", err)
+	}
+	res := make([][]byte, nr)
+	for r := range out {
+		res[r] = out[r].Bytes()
+	}
+	return res
+}
+
+func TestRebuildFromRecoveryVolumes(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, b []byte) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	pattern := func(n, seed int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(i*seed + seed)
+		}
+		return b
+	}
+
+	// RAR3: three volumes, the last one shorter and ending with ENDARC; two .rev files.
+	sig := []byte("Rar!\x1A\x07\x00")
+	end := rar3SetCRC([]byte{0x00, 0x00, 0x7B, 0x00, 0x00, 7, 0x00})
+	vol3 := func(flags uint16, payload []byte) []byte {
+		h := setRar3Flags(buildRar3FileHeader("big.bin", 0, 0), flags)
+		binary.LittleEndian.PutUint32(h[7:11], uint32(len(payload)))
+		vol := bytes.Join([][]byte{sig, rar3SetCRC(h), payload}, nil)
+		if flags&0x0002 == 0 { // last volume: plain end block
+			return append(vol, end...)
+		}
+		// EARC_NEXT_VOLUME + EARC_DATACRC, the CRC32 of the volume up to the end block
+		return append(vol, rar3SetCRC(binary.LittleEndian.AppendUint32([]byte{0, 0, 0x7B, 0x03, 0x00, 11, 0x00}, crc32.ChecksumIEEE(vol)))...)
+	}
+	data3 := [][]byte{vol3(0x0002, pattern(3000, 3)), vol3(0x0003, pattern(3000, 5)), vol3(0x0001, pattern(1200, 7))}
+	size3 := int64(len(data3[0]))
+	for r, par := range revParity(t, VersionRar3, data3, 2, size3) {
+		rev := append(par, byte(len(data3)-1), 1, byte(r))
+		write(fmt.Sprintf("r3.part%d.rev", r+1), binary.LittleEndian.AppendUint32(rev, crc32.ChecksumIEEE(rev)))
+	}
+	first := write("r3.part1.rar", data3[0])
+	revs, err := DiscoverRecoveryVolumes(first)
+	if err != nil || len(revs) != 2 {
+		t.Fatalf("discover rev: %v %v", revs, err)
+	}
+	if rv, err := ParseRecoveryVolume(revs[1]); err != nil || rv.Version != VersionRar3 || rv.DataCount != 3 || rv.RecCount != 2 || rv.RecNum != 1 {
+		t.Fatalf("rev3 header: %+v %v", rv, err)
+	}
+	sink := memSink{}
+	rebuilt, err := RebuildVolumes(first, sink.open)
+	if err != nil || len(rebuilt) != 2 {
+		t.Fatalf("rebuild rar3: %v %v", rebuilt, err)
+	}
+	for i, p := range []string{filepath.Join(dir, "r3.part2.rar"), filepath.Join(dir, "r3.part3.rar")} {
+		if got := sink[p]; got == nil || !bytes.Equal(got.Bytes(), data3[i+1]) {
+			t.Fatalf("rar3 volume %s not rebuilt exactly (%d bytes)", p, len(sink[p].Bytes()))
+		}
+	}
+	// Intact volumes whose end blocks carry a data CRC are kept: only the deleted one is rebuilt.
+	write("r3.part1.rar", data3[0])
+	write("r3.part3.rar", data3[2])
+	sink = memSink{}
+	rebuilt, err = RebuildVolumes(first, sink.open)
+	if p := filepath.Join(dir, "r3.part2.rar"); err != nil || len(rebuilt) != 1 || rebuilt[0] != p || !bytes.Equal(sink[p].Bytes(), data3[1]) {
+		t.Fatalf("rebuild one deleted rar3 volume: %v %v", rebuilt, err)
+	}
+	flipped := append([]byte{}, data3[0]...)
+	flipped[100] ^= 0xFF
+	write("r3.part1.rar", flipped)
+	write("r3.part2.rar", data3[1])
+	sink = memSink{}
+	rebuilt, err = RebuildVolumes(first, sink.open)
+	if err != nil || len(rebuilt) != 1 || rebuilt[0] != first || !bytes.Equal(sink[first].Bytes(), data3[0]) {
+		t.Fatalf("rebuild rar3 volume failing its data CRC: %v %v", rebuilt, err)
+	}
+	write("r3.part1.rar", data3[0])
+	// A truncated volume is rebuilt like a missing one; a .rev failing its CRC is not used.
+	write("r3.part2.rar", data3[1])
+	write("r3.part3.rar", data3[2][:900])
+	rev1 := filepath.Join(dir, "r3.part1.rev")
+	revData, _ := os.ReadFile(rev1)
+	revData[5] ^= 0xFF
+	write("r3.part1.rev", revData)
+	sink = memSink{}
+	rebuilt, err = RebuildVolumes(first, sink.open)
+	if p := filepath.Join(dir, "r3.part3.rar"); err != nil || len(rebuilt) != 1 || rebuilt[0] != p || !bytes.Equal(sink[p].Bytes(), data3[2]) {
+		t.Fatalf("rebuild truncated rar3 volume: %v %v", rebuilt, err)
+	}
+	write("r3.part1.rar", data3[0][:len(data3[0])-1])
+	if _, err := RebuildVolumes(first, memSink{}.open); !errors.Is(err, ErrIncompleteVolumeSet) {
+		t.Fatalf("short rar3 volume with one usable .rev: %v", err)
+	}
+
+	// RAR5: odd sized volumes, the first missing and the third damaged.
+	data5 := [][]byte{pattern(2001, 11), pattern(2001, 13), pattern(999, 17)}
+	size5 := int64(2002)
+	info := []byte{}
+	for _, d := range data5 {
+		info = binary.LittleEndian.AppendUint64(info, uint64(len(d)))
+		info = binary.LittleEndian.AppendUint32(info, crc32.ChecksumIEEE(d))
+	}
+	for r, par := range revParity(t, VersionRar5, data5, 2, size5) {
+		hdr := binary.LittleEndian.AppendUint32([]byte{1, 3, 0, 2, 0, byte(3 + r), 0}, crc32.ChecksumIEEE(par))
+		hdr = append(hdr, info...)
+		sizeField := binary.LittleEndian.AppendUint32(nil, uint32(len(hdr)))
+		crc := crc32.Update(crc32.ChecksumIEEE(sizeField), crc32.IEEETable, hdr)
+		write(fmt.Sprintf("r5.part%d.rev", 4+r), bytes.Join([][]byte{[]byte("Rar!\x1ARev"), binary.LittleEndian.AppendUint32(nil, crc), sizeField, hdr, par}, nil))
+	}
+	write("r5.part2.rar", data5[1])
+	damaged := append([]byte{}, data5[2]...)
+	damaged[10] ^= 0xFF
+	write("r5.part3.rar", damaged)
+	sink = memSink{}
+	rebuilt, err = RebuildVolumes(filepath.Join(dir, "r5.part1.rar"), sink.open)
+	if err != nil || len(rebuilt) != 2 {
+		t.Fatalf("rebuild rar5: %v %v", rebuilt, err)
+	}
+	for _, i := range []int{0, 2} {
+		p := filepath.Join(dir, fmt.Sprintf("r5.part%d.rar", i+1))
+		if got := sink[p]; got == nil || !bytes.Equal(got.Bytes(), data5[i]) {
+			t.Fatalf("rar5 volume %s not rebuilt exactly", p)
+		}
+	}
+	// Three damaged volumes are more than two recovery volumes can rebuild.
+	write("r5.part2.rar", data5[2])
+	if _, err := RebuildVolumes(filepath.Join(dir, "r5.part1.rar"), memSink{}.open); !errors.Is(err, ErrIncompleteVolumeSet) {
+		t.Fatalf("too many missing volumes: %v", err)
+	}
+	// Parity failing REV_CRC leaves one recovery volume for two damaged volumes.
+	write("r5.part2.rar", data5[1])
+	rev4 := filepath.Join(dir, "r5.part4.rev")
+	revData, _ = os.ReadFile(rev4)
+	revData[len(revData)-1] ^= 0xFF
+	write("r5.part4.rev", revData)
+	if _, err := RebuildVolumes(filepath.Join(dir, "r5.part1.rar"), memSink{}.open); !errors.Is(err, ErrIncompleteVolumeSet) {
+		t.Fatalf("damaged rev5 should not be used: %v", err)
+	}
+}
+
+func TestDecryptRar5StoredFile(t *testing.T) {
+	const password, count = "secret", 10
+	salt, iv := bytes.Repeat([]byte{7}, 16), bytes.Repeat([]byte{9}, 16)
+	// Keys from the standard PBKDF2: the AES key after 2^count rounds, the check value 32 rounds later.
+	key, _ := pbkdf2.Key(sha256.New, password, salt, 1<<count, 32)
+	v2, _ := pbkdf2.Key(sha256.New, password, salt, 1<<count+32, 32)
+	check := make([]byte, 8)
+	for i, b := range v2 {
+		check[i%8] ^= b
+	}
+	sum := sha256.Sum256(check)
+	record := rar5Extra(0x01, encodeVarint(0), encodeVarint(0x0001), []byte{count}, salt, iv, check, sum[:4])
+
+	plain := make([]byte, 100)
+	for i := range plain {
+		plain[i] = byte(i * 7)
+	}
+	enc := append(append([]byte{}, plain...), make([]byte, 12)...) // padded to the AES block size
+	block, _ := aes.NewCipher(key)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(enc, enc)
+
+	sig := []byte("Rar!\x1A\x07\x01\x00")
+	part := func(flags uint64, piece []byte) []byte {
+		spec := bytes.Join([][]byte{encodeVarint(0), encodeVarint(uint64(len(plain))), encodeVarint(0),
+			encodeVarint(0), encodeVarint(1), encodeVarint(7), []byte("enc.bin")}, nil)
+		return append(rar5FileHeader(0x0001|0x0002|flags, len(piece), spec, record), piece...)
+	}
+	p1 := writeTemp(t, "enc.part1.rar", append(append([]byte{}, sig...), part(0x0010, enc[:50])...))
+	if err := os.WriteFile(filepath.Join(filepath.Dir(p1), "enc.part2.rar"), append(append([]byte{}, sig...), part(0x0008, enc[50:])...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ListFiles(p1); !errors.Is(err, ErrPasswordProtected) {
+		t.Fatalf("no password: %v", err)
+	}
+	if _, err := ListFiles(p1, WithPassword("wrong")); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("wrong password: %v", err)
+	}
+	files, err := ListFiles(p1, WithPassword(password))
+	if err != nil || len(files) != 1 || len(files[0].Parts) != 2 {
+		t.Fatalf("list with password: %+v %v", files, err)
+	}
+	if e := files[0].Parts[0].Encryption; e == nil || e.KDFCount != count || !bytes.Equal(e.IV, iv) || len(e.CheckValue) != 12 {
+		t.Fatalf("encryption record: %+v", e)
+	}
+	if _, err := DecryptFile(files[0], "wrong"); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("decrypt with wrong password: %v", err)
+	}
+	r, err := DecryptFile(files[0], password)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("decrypted contents: %x %v", got, err)
+	}
+	// Random access across the volume boundary and from the end.
+	buf := make([]byte, 20)
+	if n, err := r.ReadAt(buf, 45); n != 20 || err != nil || !bytes.Equal(buf, plain[45:65]) {
+		t.Fatalf("ReadAt: %d %v %x", n, err, buf)
+	}
+	if _, err := r.Seek(-10, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(r); !bytes.Equal(got, plain[90:]) {
+		t.Fatalf("tail after seek: %x", got)
+	}
+}
+
+func TestRar5EncryptedHeaders(t *testing.T) {
+	const password, count = "hp-secret", 8
+	salt := bytes.Repeat([]byte{3}, 16)
+	key, _ := pbkdf2.Key(sha256.New, password, salt, 1<<count, 32)
+	v2, _ := pbkdf2.Key(sha256.New, password, salt, 1<<count+32, 32)
+	check := make([]byte, 8)
+	for i, b := range v2 {
+		check[i%8] ^= b
+	}
+	sum := sha256.Sum256(check)
+	block, _ := aes.NewCipher(key)
+	// encrypted headers: IV, then the CRC32/size/header padded to 16 bytes
+	ivSeed := byte(0)
+	encrypt := func(hdr []byte) []byte {
+		ivSeed++
+		iv := bytes.Repeat([]byte{ivSeed}, 16)
+		padded := append(append([]byte{}, hdr...), make([]byte, (16-len(hdr)%16)%16)...)
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+		return append(iv, padded...)
+	}
+	payload := []byte("stored behind encrypted headers")
+	spec := bytes.Join([][]byte{encodeVarint(0x0004), encodeVarint(uint64(len(payload))), encodeVarint(0),
+		binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(payload)), encodeVarint(0), encodeVarint(1),
+		encodeVarint(9), []byte("plain.txt")}, nil)
+	encHeader := rar5SetCRC(rar5Block(encodeVarint(4), encodeVarint(0), encodeVarint(0), encodeVarint(0x0001), []byte{count}, salt, check, sum[:4]))
+	main := encrypt(rar5SetCRC(rar5Block(encodeVarint(1), encodeVarint(0), encodeVarint(0))))
+	file := encrypt(rar5SetCRC(rar5FileHeader(0x0002, len(payload), spec, nil)))
+	end := encrypt(rar5SetCRC(rar5Block(encodeVarint(5), encodeVarint(0), encodeVarint(0))))
+	archive := bytes.Join([][]byte{[]byte("Rar!\x1A\x07\x01\x00"), encHeader, main, file, payload, end}, nil)
+	p := writeTemp(t, "hp.rar", archive)
+
+	if _, err := ListFiles(p); !errors.Is(err, ErrPasswordProtected) {
+		t.Fatalf("no password: %v", err)
+	}
+	if _, err := ListFiles(p, WithPassword("nope")); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("wrong password: %v", err)
+	}
+	vols, err := IndexVolumes(defaultFS, []string{p}, WithPassword(password), WithHeaderCRC(CRCStrict))
+	if err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	v := vols[0]
+	if !v.Archive.EncryptedHeaders || !v.Archive.HasMainHeader || !v.Archive.HasEnd || len(v.FileBlocks) != 1 {
+		t.Fatalf("decrypted headers: %+v", v)
+	}
+	fb := v.FileBlocks[0]
+	dataPos := int64(8 + len(encHeader) + len(main) + len(file))
+	if fb.Name != "plain.txt" || fb.HeaderPos != dataPos-int64(len(file)) || fb.DataPos != dataPos || fb.HeaderSize != int64(len(file)) {
+		t.Fatalf("file block positions: %+v (data at %d)", fb, dataPos)
+	}
+	files, err := ListFiles(p, WithPassword(password))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("list: %+v %v", files, err)
+	}
+	if fc := VerifyFile(files[0]); !fc.OK || !fc.Checked {
+		t.Fatalf("data located from raw offsets should verify: %+v", fc)
+	}
+}
+
+func TestRar3AESEncryption(t *testing.T) {
+	const password = "rar3-pass"
+	hdrSalt, fileSalt := []byte("HDRSALT!"), []byte("filesalt")
+	encrypt := func(salt, plain []byte) []byte {
+		key, iv := rar3kdf.Keys(password, salt)
+		block, _ := aes.NewCipher(key[:])
+		out := append(append([]byte{}, plain...), make([]byte, (16-len(plain)%16)%16)...)
+		cipher.NewCBCEncrypter(block, iv[:]).CryptBlocks(out, out)
+		return out
+	}
+	plain := []byte("encrypted stored data of forty bytes....")
+	data := encrypt(fileSalt, plain)
+	// LHD_PASSWORD + LHD_SALT file header, UNP_VER 29, salt after the name
+	fh := setRar3Flags(buildRar3FileHeader("secret.txt", uint32(len(data)), uint32(len(plain))), 0x0004|0x0400)
+	fh[5] += 8
+	fh[7+17] = 29
+	binary.LittleEndian.PutUint32(fh[16:20], crc32.ChecksumIEEE(plain))
+	fh = rar3SetCRC(append(fh, fileSalt...))
+	mainHdr := rar3SetCRC([]byte{0, 0, 0x73, 0x80, 0x00, 13, 0, 0, 0, 0, 0, 0, 0}) // MHD_PASSWORD
+	end := rar3SetCRC([]byte{0, 0, 0x7B, 0, 0, 7, 0})
+	encFile := append(append([]byte{}, hdrSalt...), encrypt(hdrSalt, fh)...)
+	encEnd := append(append([]byte{}, hdrSalt...), encrypt(hdrSalt, end)...)
+	sig := []byte("Rar!\x1A\x07\x00")
+	p := writeTemp(t, "hp3.rar", bytes.Join([][]byte{sig, mainHdr, encFile, data, encEnd}, nil))
+
+	if _, err := ListFiles(p); !errors.Is(err, ErrPasswordProtected) {
+		t.Fatalf("no password: %v", err)
+	}
+	// no password check value: the garbage header fails its CRC
+	var crcErr *ErrHeaderCRC
+	if _, err := ListFiles(p, WithPassword("wrong")); !errors.As(err, &crcErr) || errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("wrong password: %v", err)
+	}
+	vols, err := IndexVolumes(defaultFS, []string{p}, WithPassword(password), WithHeaderCRC(CRCStrict))
+	if err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	v := vols[0]
+	if !v.Archive.EncryptedHeaders || !v.Archive.HasEnd || len(v.FileBlocks) != 1 {
+		t.Fatalf("decrypted headers: %+v", v)
+	}
+	fb := v.FileBlocks[0]
+	dataPos := int64(len(sig) + len(mainHdr) + len(encFile))
+	if fb.Name != "secret.txt" || !fb.Encrypted || fb.DataPos != dataPos || fb.HeaderSize != int64(len(encFile)) || !bytes.Equal(fb.Salt, fileSalt) {
+		t.Fatalf("file block: %+v (data at %d)", fb, dataPos)
+	}
+	files, err := ListFiles(p, WithPassword(password))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("list: %+v %v", files, err)
+	}
+	r, err := DecryptFile(files[0], password)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, plain) || crc32.ChecksumIEEE(got) != fb.CRC32 {
+		t.Fatalf("decrypted contents: %q %v", got, err)
+	}
+	buf := make([]byte, 8)
+	if _, err := r.ReadAt(buf, 20); err != nil || !bytes.Equal(buf, plain[20:28]) {
+		t.Fatalf("ReadAt: %q %v", buf, err)
+	}
+}
+
+// rar5Match is a match in a rar5Packed stream: length 2..9 bytes from dist 1..4 bytes back.
+type rar5Match struct{ length, dist int }
+
+// rar5Packed builds one compressed RAR5 block from literal strings and matches, coded with flat tables:
+// 9 bit main symbols, 6 bit distance and repeat slots, 4 bit low distances. Without tables the block
+// reuses those of the previous file of a solid stream.
+func rar5Packed(tables bool, ops ...any) []byte {
+	var bits []byte // one bit per byte
+	put := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, byte(v>>i&1))
+		}
+	}
+	if tables {
+		for i := 0; i < 20; i++ {
+			put(5, 4) // precode lengths
+		}
+		for i := 0; i < 306+64+16+44; i++ {
+			l := 6
+			if i < 306 {
+				l = 9
+			} else if i >= 370 && i < 386 {
+				l = 4
+			}
+			put(l, 5)
+		}
+	}
+	for _, op := range ops {
+		switch op := op.(type) {
+		case string:
+			for _, c := range []byte(op) {
+				put(int(c), 9)
+			}
+		case rar5Match:
+			put(262+op.length-2, 9)
+			put(op.dist-1, 6)
+		}
+	}
+	body := make([]byte, (len(bits)+7)/8)
+	for i, b := range bits {
+		body[i/8] |= b << (7 - i%8)
+	}
+	flags := byte((len(bits)-1)%8) | 1<<3 | 0x40 // bits in the last byte, 2 size bytes, last block
+	if tables {
+		flags |= 0x80
+	}
+	size := len(body)
+	return append([]byte{flags, 0x5a ^ flags ^ byte(size) ^ byte(size>>8), byte(size), byte(size >> 8)}, body...)
+}
+
+func TestUnpackRar5Compressed(t *testing.T) {
+	first := strings.Repeat("abcd", 5)
+	second := "abcdabcd\n"
+	packed1 := rar5Packed(true, "abcd", rar5Match{8, 4}, rar5Match{8, 4})
+	packed2 := rar5Packed(false, rar5Match{8, 4}, "\n") // continues the dictionary of the first file
+
+	sig := []byte("Rar!\x1A\x07\x01\x00")
+	header := func(name, content string, crc uint32, compInfo uint64, flags uint64, piece []byte) []byte {
+		spec := bytes.Join([][]byte{encodeVarint(0x0004), encodeVarint(uint64(len(content))), encodeVarint(0),
+			binary.LittleEndian.AppendUint32(nil, crc), encodeVarint(compInfo), encodeVarint(1),
+			encodeVarint(uint64(len(name))), []byte(name)}, nil)
+		return append(rar5FileHeader(0x0002|flags, len(piece), spec, nil), piece...)
+	}
+	const method3 = 3 << 7 // RAR 5.0 algorithm, 128 KiB dictionary
+	half := len(packed1) / 2
+	vol1 := append(append([]byte{}, sig...), header("a.txt", first, crc32.ChecksumIEEE(packed1[:half]), method3, 0x0010, packed1[:half])...)
+	vol2 := append(append([]byte{}, sig...), header("a.txt", first, crc32.ChecksumIEEE([]byte(first)), method3, 0x0008, packed1[half:])...)
+	vol2 = append(vol2, header("b.txt", second, crc32.ChecksumIEEE([]byte(second)), method3|0x0040, 0, packed2)...)
+	p1 := writeTemp(t, "lz.part1.rar", vol1)
+	if err := os.WriteFile(filepath.Join(filepath.Dir(p1), "lz.part2.rar"), vol2, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ListFiles(p1)
+	if err != nil || len(files) != 2 || len(files[0].Parts) != 2 {
+		t.Fatalf("list compressed files: %+v %v", files, err)
+	}
+	a, b := files[0], files[1]
+	if a.Version != VersionRar5 || a.AllStored || a.Parts[0].Method != 3 || a.Parts[0].DictSize != 128<<10 || !b.Parts[0].Solid {
+		t.Fatalf("compression metadata: %+v %+v", a, b)
+	}
+	r, err := UnpackFile(a)
+	if err != nil {
+		t.Fatalf("unpack: %v", err)
+	}
+	if got, err := io.ReadAll(r); err != nil || string(got) != first {
+		t.Fatalf("unpacked across volumes: %q %v", got, err)
+	}
+	if _, err := UnpackFile(b); !errors.Is(err, ErrCompressedNotSupported) {
+		t.Fatalf("solid file on its own: %v", err)
+	}
+	bad := a
+	bad.Parts = append([]AggregatedFilePart{}, a.Parts...)
+	bad.Parts[1].CRC32 ^= 1
+	r, _ = UnpackFile(bad)
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("CRC32 mismatch: %v", err)
+	}
+
+	// The extractor unpacks the skipped first file to continue the solid stream.
+	x, err := NewExtractor(p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if af, err := x.Next(); err != nil || af.Name != "a.txt" {
+		t.Fatalf("first entry: %+v %v", af, err)
+	}
+	if af, err := x.Next(); err != nil || af.Name != "b.txt" {
+		t.Fatalf("second entry: %+v %v", af, err)
+	}
+	if got, err := io.ReadAll(x); err != nil || string(got) != second {
+		t.Fatalf("solid file: %q %v", got, err)
+	}
+	if _, err := x.Next(); err != io.EOF {
+		t.Fatalf("end of entries: %v", err)
+	}
+}
+
+// TestUnpackArchives unpacks the compressed files of the archives in testdata and checks them against
+// the CRC32 of their headers.
+func TestUnpackArchives(t *testing.T) {
+	for _, c := range []struct {
+		archive, name string
+		size          int64
+		crc           uint32
+	}{
+		{"rar5-lz.rar", "asd.go", 187, 0x230ceab5},
+		{"rar5-sample.rar", "testdata/already-compressed.jpg", 8944, 0xfb777666},
+		{"rar5-split.part01.rar", "test.txt", 8895, 0xe00c6191},
+		{"rar29.rar", "ppm.txt", 3874, 0x2fd558e1},
+		{"rar29.rar", "lz.bin", 8812, 0x64a3ce99},
+		{"rar29.rar", "filters.bin", 57, 0x4d6b8c2b},
+		{"rar20.rar", "audio.bin", 14747, 0xdfc22ca2},
+	} {
+		files, err := ListFiles(filepath.Join("testdata", c.archive))
+		if err != nil {
+			t.Fatalf("%s: %v", c.archive, err)
+		}
+		i := slices.IndexFunc(files, func(af AggregatedFile) bool { return af.Name == c.name })
+		if i < 0 || files[i].AllStored {
+			t.Fatalf("%s: no compressed %s in %+v", c.archive, c.name, files)
+		}
+		r, err := UnpackFile(files[i])
+		if err != nil {
+			t.Fatalf("%s: unpack: %v", c.name, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || int64(len(got)) != c.size || crc32.ChecksumIEEE(got) != c.crc {
+			t.Fatalf("%s: %d bytes, CRC32 %08x, %v", c.name, len(got), crc32.ChecksumIEEE(got), err)
+		}
+	}
+}
+
+// rar3Match is a match in a rar3Packed stream: length 3..10 bytes from dist 1..4 bytes back.
+type rar3Match struct{ length, dist int }
+
+// rar3Packed builds a compressed RAR 2.9 stream of one file from literal strings and matches, coded
+// with flat tables: 9 bit main symbols, 6 bit distance slots, 5 bit low distances and repeat lengths.
+// Without tables the file reuses those of the previous file of a solid stream.
+func rar3Packed(tables bool, ops ...any) []byte {
+	var bits []byte // one bit per byte
+	put := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, byte(v>>i&1))
+		}
+	}
+	if tables {
+		put(0, 2) // LZ block, new tables
+		for i := 0; i < 20; i++ {
+			put(5, 4) // precode lengths
+		}
+		for i := 0; i < 299+60+17+28; i++ {
+			l := 5
+			if i < 299 {
+				l = 9
+			} else if i < 359 {
+				l = 6
+			}
+			put(l, 5)
+		}
+	}
+	for _, op := range ops {
+		switch op := op.(type) {
+		case string:
+			for _, c := range []byte(op) {
+				put(int(c), 9)
+			}
+		case rar3Match:
+			put(271+op.length-3, 9)
+			put(op.dist-1, 6)
+		}
+	}
+	put(256, 9) // end of file, the next one keeps the tables
+	put(0, 2)
+	body := make([]byte, (len(bits)+7)/8)
+	for i, b := range bits {
+		body[i/8] |= b << (7 - i%8)
+	}
+	return body
+}
+
+func TestUnpackRar3Compressed(t *testing.T) {
+	first := strings.Repeat("abcd", 5)
+	second := "abcdabcd\n"
+	packed1 := rar3Packed(true, "abcd", rar3Match{8, 4}, rar3Match{8, 4})
+	packed2 := rar3Packed(false, rar3Match{8, 4}, "\n") // continues the dictionary of the first file
+
+	sig := []byte("Rar!\x1A\x07\x00")
+	header := func(name, content string, crc uint32, flags uint16, piece []byte) []byte {
+		h := setRar3Flags(buildRar3FileHeader(name, uint32(len(piece)), uint32(len(content))), flags)
+		binary.LittleEndian.PutUint32(h[16:20], crc)
+		h[7+17] = 29   // UNP_VER
+		h[7+18] = 0x33 // method 3
+		return append(rar3SetCRC(h), piece...)
+	}
+	half := len(packed1) / 2
+	vol1 := append(append([]byte{}, sig...), header("a.txt", first, crc32.ChecksumIEEE(packed1[:half]), 0x0002, packed1[:half])...)
+	vol2 := append(append([]byte{}, sig...), header("a.txt", first, crc32.ChecksumIEEE([]byte(first)), 0x0001, packed1[half:])...)
+	vol2 = append(vol2, header("b.txt", second, crc32.ChecksumIEEE([]byte(second)), 0x0010, packed2)...)
+	p1 := writeTemp(t, "lz3.part1.rar", vol1)
+	if err := os.WriteFile(filepath.Join(filepath.Dir(p1), "lz3.part2.rar"), vol2, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ListFiles(p1)
+	if err != nil || len(files) != 2 || len(files[0].Parts) != 2 {
+		t.Fatalf("list compressed files: %+v %v", files, err)
+	}
+	a, b := files[0], files[1]
+	if a.Version != VersionRar3 || a.AllStored || a.Parts[0].Method != 3 || a.Parts[0].AlgorithmVersion != 29 || !b.Parts[0].Solid {
+		t.Fatalf("compression metadata: %+v %+v", a, b)
+	}
+	r, err := UnpackFile(a)
+	if err != nil {
+		t.Fatalf("unpack: %v", err)
+	}
+	if got, err := io.ReadAll(r); err != nil || string(got) != first {
+		t.Fatalf("unpacked across volumes: %q %v", got, err)
+	}
+	if _, err := UnpackFile(b); !errors.Is(err, ErrCompressedNotSupported) {
+		t.Fatalf("solid file on its own: %v", err)
+	}
+
+	// The extractor continues the solid stream.
+	x, err := NewExtractor(p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{first, second} {
+		if _, err := x.Next(); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := io.ReadAll(x); err != nil || string(got) != want {
+			t.Fatalf("extracted: %q %v", got, err)
+		}
+	}
+	if _, err := x.Next(); err != io.EOF {
+		t.Fatalf("end of entries: %v", err)
+	}
+}
+
+// rar20Packed builds a compressed RAR 2.0 stream of one file from literal strings and matches (lengths
+// up to 10, distances up to 4), coded with flat tables: 9 bit main symbols, 6 bit distance slots and 5
+// bit repeat lengths.
+func rar20Packed(ops ...any) []byte {
+	var bits []byte // one bit per byte
+	put := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, byte(v>>i&1))
+		}
+	}
+	put(0, 2) // LZ block, new tables
+	for i := 0; i < 19; i++ {
+		put(5, 4) // precode lengths
+	}
+	for i := 0; i < 298+48+28; i++ {
+		l := 5
+		if i < 298 {
+			l = 9
+		} else if i < 346 {
+			l = 6
+		}
+		put(l, 5)
+	}
+	for _, op := range ops {
+		switch op := op.(type) {
+		case string:
+			for _, c := range []byte(op) {
+				put(int(c), 9)
+			}
+		case rar3Match:
+			put(270+op.length-3, 9)
+			put(op.dist-1, 6)
+		}
+	}
+	body := make([]byte, (len(bits)+7)/8)
+	for i, b := range bits {
+		body[i/8] |= b << (7 - i%8)
+	}
+	return body
+}
+
+func TestUnpackLegacyCompressed(t *testing.T) {
+	sig := []byte("Rar!\x1A\x07\x00")
+	header := func(name, content string, unpVer byte, packed []byte) []byte {
+		h := buildRar3FileHeader(name, uint32(len(packed)), uint32(len(content)))
+		binary.LittleEndian.PutUint32(h[16:20], crc32.ChecksumIEEE([]byte(content)))
+		h[7+17] = unpVer
+		h[7+18] = 0x33 // method 3
+		return append(rar3SetCRC(h), packed...)
+	}
+
+	// RAR 2.0 (UNP_VER 20)
+	text := "abcdabcdabcd!"
+	p := writeTemp(t, "lz20.rar", append(append([]byte{}, sig...), header("a.txt", text, 20, rar20Packed("abcd", rar3Match{8, 4}, "!"))...))
+	files, err := ListFiles(p)
+	if err != nil || len(files) != 1 || files[0].AllStored || files[0].Parts[0].AlgorithmVersion != 20 {
+		t.Fatalf("list RAR 2.0 file: %+v %v", files, err)
+	}
+	r, err := UnpackFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || string(got) != text {
+		t.Fatalf("unpacked RAR 2.0 file: %q %v", got, err)
+	}
+
+	// RAR 1.5 (UNP_VER 15): the files of a solid archive continue the stream without a flag of their own.
+	// The streams were written with the RAR 1.5 encoder of the internal/unpack tests.
+	first, second := "old archives, old archi!\n", "more old archives\n"
+	packed1, _ := hex.DecodeString("0faff59e924f43ecbd1d98d6981b0be6e2ff188b5960")
+	packed2, _ := hex.DecodeString("1ee051ca8103c640")
+	main := rar3SetCRC([]byte{0x00, 0x00, 0x73, 0x08, 0x00, 13, 0x00, 0, 0, 0, 0, 0, 0}) // MHD_SOLID
+	vol := bytes.Join([][]byte{sig, main, header("one.txt", first, 15, packed1), header("two.txt", second, 15, packed2)}, nil)
+	p = writeTemp(t, "lz15.rar", vol)
+	files, err = ListFiles(p)
+	if err != nil || len(files) != 2 || files[0].Parts[0].Solid || !files[1].Parts[0].Solid {
+		t.Fatalf("list RAR 1.5 files: %+v %v", files, err)
+	}
+	if _, err := UnpackFile(files[1]); !errors.Is(err, ErrCompressedNotSupported) {
+		t.Fatalf("solid file on its own: %v", err)
+	}
+	x, err := NewExtractor(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{first, second} {
+		if _, err := x.Next(); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := io.ReadAll(x); err != nil || string(got) != want {
+			t.Fatalf("extracted: %q %v", got, err)
+		}
+	}
+}
+
+func TestRegisterDecompressor(t *testing.T) {
+	// RAR 1.4 compression (UNP_VER 10) has no native unpacker
+	packed := rar14File("OLD.TXT", 0, 3, 10, []byte("ab"))
+	packed[18] = 1
+	p := writeTemp(t, "old10.rar", rar14Volume(0, "", packed))
+	if _, err := ListFiles(p); !errors.Is(err, ErrCompressedNotSupported) {
+		t.Fatalf("expected compressed error, got %v", err)
+	}
+	var seen AggregatedFile
+	RegisterDecompressor(VersionRar14, 3, DecompressorFunc(func(r io.Reader, af AggregatedFile) (io.Reader, error) {
+		seen = af
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(bytes.Repeat(b, 5)), nil
+	}))
+	t.Cleanup(func() { RegisterDecompressor(VersionRar14, 3, nil) })
+	files, err := ListFiles(p)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("list with decompressor: %+v %v", files, err)
+	}
+	r, err := UnpackFile(files[0])
+	if err != nil {
+		t.Fatalf("unpack: %v", err)
+	}
+	if got, err := io.ReadAll(r); err != nil || string(got) != "ababababab" || seen.Name != "OLD.TXT" {
+		t.Fatalf("decompressed: %q %v (%+v)", got, err, seen)
+	}
+	// other methods are still rejected, and errors of the decompressor are returned with the file name
+	packed[20] = 5 // METHOD
+	if _, err := ListFiles(writeTemp(t, "old10m5.rar", rar14Volume(0, "", packed))); !errors.Is(err, ErrCompressedNotSupported) {
+		t.Fatalf("expected compressed error for method 5, got %v", err)
+	}
+	boom := errors.New("boom")
+	RegisterDecompressor(VersionRar14, 3, DecompressorFunc(func(io.Reader, AggregatedFile) (io.Reader, error) { return nil, boom }))
+	if _, err := UnpackFile(files[0]); !errors.Is(err, boom) || !strings.Contains(err.Error(), "OLD.TXT") {
+		t.Fatalf("expected decompressor error, got %v", err)
+	}
+	RegisterDecompressor(VersionRar14, 3, nil)
+	if _, err := ListFiles(p); !errors.Is(err, ErrCompressedNotSupported) {
+		t.Fatalf("expected compressed error after unregistering, got %v", err)
+	}
+}
+
+// countingFS counts the volumes opened through it.
+type countingFS struct {
+	mu    sync.Mutex
+	opens map[string]int
+}
+
+func (c *countingFS) Stat(p string) (fs.FileInfo, error) { return os.Stat(p) }
+
+func (c *countingFS) Open(p string) (fs.File, error) {
+	c.mu.Lock()
+	c.opens[p]++
+	c.mu.Unlock()
+	return os.Open(p)
+}
+
+// eofFS opens files whose ReadAt reports io.EOF along with a read ending at the end of the file, as the
+// io.ReaderAt contract allows.
+type eofFS struct{}
+
+func (eofFS) Stat(p string) (fs.FileInfo, error) { return os.Stat(p) }
+
+func (eofFS) Open(p string) (fs.File, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return eofFile{f}, nil
+}
+
+type eofFile struct{ *os.File }
+
+func (f eofFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	if st, serr := f.Stat(); err == nil && serr == nil && off+int64(n) == st.Size() {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func TestOpenStoredFile(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("0123456789abcdefghij")
+	v1 := rar14Volume(0x01, "", rar14File("A.TXT", 0, 0, 3, []byte("abc")), rar14File("S.BIN", 0x02, 0, len(data), data[:7]))
+	v2 := rar14Volume(0x01, "", rar14File("S.BIN", 0x03, 0, len(data), data[7:15]))
+	v3 := rar14Volume(0, "", rar14File("S.BIN", 0x01, 0, len(data), data[15:]))
+	for i, v := range [][]byte{v1, v2, v3} {
+		name := "split.rar"
+		if i > 0 {
+			name = fmt.Sprintf("split.r%02d", i-1)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), v, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := ListFiles(filepath.Join(dir, "split.rar"))
+	if err != nil || len(files) != 2 || len(files[1].Parts) != 3 {
+		t.Fatalf("list: %+v %v", files, err)
+	}
+	cfs := &countingFS{opens: map[string]int{}}
+	r, err := OpenFile(cfs, files[1])
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	var _ io.ReadSeekCloser = r
+	var _ io.ReaderAt = r
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) || r.Size() != int64(len(data)) {
+		t.Fatalf("read all: %q %v", got, err)
+	}
+	if pos, err := r.Seek(-6, io.SeekEnd); err != nil || pos != 14 {
+		t.Fatalf("seek: %d %v", pos, err)
+	}
+	buf := make([]byte, 4)
+	if n, err := io.ReadFull(r, buf); err != nil || string(buf[:n]) != "efgh" {
+		t.Fatalf("read after seek: %q %v", buf[:n], err)
+	}
+	// concurrent reads at every offset and length, crossing both volume boundaries
+	var wg sync.WaitGroup
+	errs := make(chan error, len(data))
+	for off := range data {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 1; off+n <= len(data); n++ {
+				p := make([]byte, n)
+				if _, err := r.ReadAt(p, int64(off)); err != nil || !bytes.Equal(p, data[off:off+n]) {
+					errs <- fmt.Errorf("ReadAt(%d, %d) = %q, %v", n, off, p, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n, err := r.ReadAt(make([]byte, 8), 16); n != 4 || err != io.EOF {
+		t.Fatalf("short ReadAt: %d %v", n, err)
+	}
+	for path, n := range cfs.opens {
+		if n != 1 {
+			t.Fatalf("%s opened %d times", path, n)
+		}
+	}
+	if len(cfs.opens) != 3 {
+		t.Fatalf("expected 3 volumes opened, got %v", cfs.opens)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	// the last part ends at the end of its volume
+	er, err := OpenFile(eofFS{}, files[1])
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if got, err := io.ReadAll(er); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read all with io.EOF at the end of the volume: %q %v", got, err)
+	}
+	_ = er.Close()
+	if _, err := r.ReadAt(buf, 0); !errors.Is(err, fs.ErrClosed) {
+		t.Fatalf("expected closed error, got %v", err)
+	}
+	// files that are not plain stored data are refused
+	if _, err := OpenFile(defaultFS, AggregatedFile{Name: "c.bin", Parts: []AggregatedFilePart{{Path: "x"}}}); !errors.Is(err, ErrCompressedNotSupported) {
+		t.Fatalf("expected compressed error, got %v", err)
+	}
+	if _, err := OpenFile(defaultFS, AggregatedFile{Name: "i.bin", AllStored: true, Incomplete: true, Parts: []AggregatedFilePart{{Path: "x", Stored: true}}}); !errors.Is(err, ErrIncompleteVolumeSet) {
+		t.Fatalf("expected incomplete error, got %v", err)
+	}
+}
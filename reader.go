@@ -0,0 +1,230 @@
+package rarlist
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"sync"
+)
+
+// partReader reads the packed data of a file's parts as one contiguous stream, opening the volume
+// holding each requested range. With handles set, volumes stay open between reads until close.
+type partReader struct {
+	fs    FileSystem
+	parts []AggregatedFilePart
+	start []int64 // stream offset of each part, plus the total size
+
+	mu      sync.Mutex
+	handles map[string]*volumeHandle // nil when every read opens its volume
+	closed  bool
+}
+
+func newPartReader(fs FileSystem, parts []AggregatedFilePart) *partReader {
+	r := &partReader{fs: fs, parts: parts, start: make([]int64, len(parts)+1)}
+	for i, p := range parts {
+		r.start[i+1] = r.start[i] + p.PackedSize
+	}
+	return r
+}
+
+func (r *partReader) size() int64 { return r.start[len(r.parts)] }
+
+func (r *partReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	n := 0
+	for len(p) > 0 {
+		if off >= r.size() {
+			return n, io.EOF
+		}
+		i := sort.Search(len(r.parts), func(i int) bool { return r.start[i+1] > off })
+		part := r.parts[i]
+		k := min(int64(len(p)), r.start[i+1]-off)
+		if err := r.readVolumeAt(part.Path, p[:k], part.DataOffset+off-r.start[i]); err != nil {
+			return n, err
+		}
+		n, off, p = n+int(k), off+k, p[k:]
+	}
+	return n, nil
+}
+
+func (r *partReader) readVolumeAt(path string, p []byte, off int64) error {
+	if r.handles == nil {
+		return readVolumeAt(r.fs, path, p, off)
+	}
+	h, err := r.handle(path)
+	if err != nil {
+		return err
+	}
+	if h == nil { // the volume can only be read sequentially: open it again for each read
+		return readVolumeAt(r.fs, path, p, off)
+	}
+	return h.readAt(path, p, off)
+}
+
+// handle returns the open handle of a volume, opening it on first use; it is nil for volumes that
+// are neither io.ReaderAt nor io.Seeker.
+func (r *partReader) handle(path string) (*volumeHandle, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, fs.ErrClosed
+	}
+	if h, ok := r.handles[path]; ok {
+		return h, nil
+	}
+	f, err := r.fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var h *volumeHandle
+	switch f.(type) {
+	case io.ReaderAt, io.Seeker:
+		h = &volumeHandle{f: f}
+	default:
+		_ = f.Close()
+	}
+	r.handles[path] = h
+	return h, nil
+}
+
+// close closes the cached volume handles; later reads fail with fs.ErrClosed.
+func (r *partReader) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return fs.ErrClosed
+	}
+	r.closed = true
+	var first error
+	for _, h := range r.handles {
+		if h == nil {
+			continue
+		}
+		if err := h.f.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	clear(r.handles)
+	return first
+}
+
+// volumeHandle is an open volume shared by concurrent reads.
+type volumeHandle struct {
+	mu sync.Mutex // serializes the Seek and Read of volumes without ReadAt
+	f  fs.File
+}
+
+func (h *volumeHandle) readAt(path string, p []byte, off int64) error {
+	if _, ok := h.f.(io.ReaderAt); ok {
+		return readFileAt(h.f, path, p, off)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return readFileAt(h.f, path, p, off)
+}
+
+// readVolumeAt fills p with the volume bytes at off.
+func readVolumeAt(fs FileSystem, path string, p []byte, off int64) error {
+	f, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	return readFileAt(f, path, p, off)
+}
+
+// readFileAt fills p with the bytes at off of an open volume, reading past the bytes before off when
+// it can neither read at an offset nor seek.
+func readFileAt(f fs.File, path string, p []byte, off int64) error {
+	if ra, ok := f.(io.ReaderAt); ok {
+		// a read ending exactly at the end of the input may report io.EOF along with all of p
+		if n, err := ra.ReadAt(p, off); err != nil && (err != io.EOF || n < len(p)) {
+			return fmt.Errorf("%s: reading %d bytes at %d: %w", path, len(p), off, err)
+		}
+		return nil
+	}
+	var err error
+	if s, ok := f.(io.Seeker); ok {
+		_, err = s.Seek(off, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, f, off)
+	}
+	if err == nil {
+		_, err = io.ReadFull(f, p)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: reading %d bytes at %d: %w", path, len(p), off, err)
+	}
+	return nil
+}
+
+// StoredReader reads the contents of a stored file straight from its volumes, with random access
+// across the parts of a split file. Volumes are opened on first use and kept open until Close. ReadAt
+// may be called concurrently; Read and Seek share the offset of the reader and may not.
+type StoredReader struct {
+	src *partReader
+	off int64
+}
+
+// OpenFile returns a reader of the contents of a stored file whose logical offsets are mapped onto
+// the data of its parts, crossing volume boundaries transparently. Compressed, encrypted and
+// incomplete files report ErrCompressedNotSupported, ErrPasswordProtected and ErrIncompleteVolumeSet:
+// read them with UnpackFileFS or DecryptFileFS. Directories read as empty.
+func OpenFile(fs FileSystem, af AggregatedFile) (*StoredReader, error) {
+	switch {
+	case af.IsDir || len(af.Parts) == 0:
+		return &StoredReader{src: newPartReader(fs, nil)}, nil
+	case !af.AllStored:
+		return nil, fmt.Errorf("%w: %s", ErrCompressedNotSupported, af.Name)
+	case af.AnyEncrypted:
+		return nil, fmt.Errorf("%w: %s", ErrPasswordProtected, af.Name)
+	case af.Incomplete:
+		return nil, fmt.Errorf("%w: %s", ErrIncompleteVolumeSet, af.Name)
+	}
+	src := newPartReader(fs, af.Parts)
+	src.handles = map[string]*volumeHandle{}
+	return &StoredReader{src: src}, nil
+}
+
+// Size returns the size of the file.
+func (s *StoredReader) Size() int64 { return s.src.size() }
+
+// ReadAt implements io.ReaderAt.
+func (s *StoredReader) ReadAt(p []byte, off int64) (int, error) { return s.src.ReadAt(p, off) }
+
+// Read implements io.Reader.
+func (s *StoredReader) Read(p []byte) (int, error) {
+	if s.off >= s.src.size() {
+		return 0, io.EOF
+	}
+	n, err := s.src.ReadAt(p, s.off)
+	s.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (s *StoredReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.off
+	case io.SeekEnd:
+		offset += s.src.size()
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	s.off = offset
+	return offset, nil
+}
+
+// Close closes the volumes opened by the reader.
+func (s *StoredReader) Close() error { return s.src.close() }
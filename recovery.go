@@ -0,0 +1,174 @@
+package rarlist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// rar3RecoverySectorSize is the unit protected by RAR 2.x/3.x recovery records.
+const rar3RecoverySectorSize = 512
+
+// RecoveryRecord describes the recovery record of a volume.
+//
+// RAR 2.x/3.x records (PROTECT_HEAD or the "RR" NEWSUB block) protect the volume bytes preceding the
+// record in 512 byte sectors. Their data holds the low 16 bits of each sector's CRC32 followed by
+// RecSectors parity sectors, sector i being XORed into parity sector i%RecSectors; a damaged run of up
+// to RecSectors consecutive sectors can be rebuilt. RAR5 records use an undocumented Reed-Solomon
+// layout: they are located and described, but not checked or repaired.
+type RecoveryRecord struct {
+	Path       string `json:"path"`
+	Version    string `json:"version"`
+	HeaderPos  int64  `json:"headerPos"`
+	DataPos    int64  `json:"dataPos"`
+	DataSize   int64  `json:"dataSize"`
+	Percent    int    `json:"percent,omitempty"` // RAR5 recovery record size relative to the archive
+	RecSectors int    `json:"recSectors"`        // RAR3 parity sectors
+	Sectors    int64  `json:"sectors"`           // RAR3 sectors protected, counted from the start of the volume
+	Repairable bool   `json:"repairable"`        // layout understood and consistent with the record size
+}
+
+// RecoveryReport lists the protected sectors (by volume offset) whose CRC did not match.
+type RecoveryReport struct {
+	Path         string  `json:"path"`
+	Damaged      []int64 `json:"damaged"`
+	Repaired     []int64 `json:"repaired"`
+	Unrepairable []int64 `json:"unrepairable"`
+}
+
+// FindRecoveryRecord returns the recovery record of a volume, if its headers list one.
+func FindRecoveryRecord(vi *VolumeIndex) (RecoveryRecord, bool) {
+	for _, sb := range vi.ServiceBlocks {
+		if sb.Name != ServiceRecovery || sb.FileIndex >= 0 {
+			continue
+		}
+		rr := RecoveryRecord{Path: vi.Path, Version: vi.Version, HeaderPos: sb.HeaderPos, DataPos: sb.DataPos, DataSize: sb.PackedSize}
+		d := sb.Data
+		switch sb.HeaderType {
+		case rar3BlockTypeProtect: // VERSION(1) REC_SECTORS(2) TOTAL_BLOCKS(4) MARK(8)
+			if len(d) >= 7 {
+				rr.RecSectors = int(binary.LittleEndian.Uint16(d[1:3]))
+				rr.Sectors = int64(binary.LittleEndian.Uint32(d[3:7]))
+			}
+		case rar3BlockTypeNewSub: // MARK "Protect+"(8) REC_SECTORS(4) TOTAL_BLOCKS(8)
+			if len(d) >= 20 && bytes.HasPrefix(d, []byte("Protect+")) {
+				rr.RecSectors = int(binary.LittleEndian.Uint32(d[8:12]))
+				rr.Sectors = int64(binary.LittleEndian.Uint64(d[12:20]))
+			}
+		default: // RAR5: the service data record starts with the recovery percent
+			if len(d) > 0 {
+				rr.Percent = int(d[0])
+			}
+		}
+		rr.Repairable = rr.RecSectors > 0 && rr.Sectors > 0 && !sb.Encrypted && sb.Stored &&
+			rr.DataSize == rr.Sectors*2+int64(rr.RecSectors)*rar3RecoverySectorSize &&
+			rr.Sectors == (rr.HeaderPos+rar3RecoverySectorSize-1)/rar3RecoverySectorSize
+		return rr, true
+	}
+	return RecoveryRecord{}, false
+}
+
+// CheckRecoveryFS compares every sector protected by the volume's recovery record with its stored CRC.
+func CheckRecoveryFS(fs FileSystem, vi *VolumeIndex) (RecoveryReport, error) {
+	return repairVolume(fs, vi, nil)
+}
+
+// CheckRecovery is a convenience using the default filesystem.
+func CheckRecovery(vi *VolumeIndex) (RecoveryReport, error) {
+	return CheckRecoveryFS(defaultFS, vi)
+}
+
+// RepairVolumeFS rebuilds damaged sectors from the recovery record and writes them to dst at their
+// volume offsets. Pass the volume itself opened for writing to repair it in place, or a copy of it.
+// Sectors sharing a parity sector with another damaged sector are reported as unrepairable.
+func RepairVolumeFS(fs FileSystem, vi *VolumeIndex, dst io.WriterAt) (RecoveryReport, error) {
+	return repairVolume(fs, vi, dst)
+}
+
+// RepairVolume is a convenience using the default filesystem.
+func RepairVolume(vi *VolumeIndex, dst io.WriterAt) (RecoveryReport, error) {
+	return RepairVolumeFS(defaultFS, vi, dst)
+}
+
+func repairVolume(fs FileSystem, vi *VolumeIndex, dst io.WriterAt) (RecoveryReport, error) {
+	rep := RecoveryReport{Path: vi.Path}
+	rr, ok := FindRecoveryRecord(vi)
+	if !ok {
+		return rep, fmt.Errorf("%w: %s", ErrNoRecoveryRecord, vi.Path)
+	}
+	if !rr.Repairable {
+		return rep, fmt.Errorf("%w: %s (%s)", ErrRecoveryUnsupported, vi.Path, vi.Version)
+	}
+	f, err := fs.Open(vi.Path)
+	if err != nil {
+		return rep, err
+	}
+	defer func() { _ = f.Close() }()
+	rs, ok := f.(io.ReadSeeker)
+	if !ok {
+		return rep, fmt.Errorf("recovery: %s is not seekable", vi.Path)
+	}
+	// recovery data: sector CRCs, then the parity sectors
+	crcs := make([]byte, rr.Sectors*2)
+	if n, err := readAtSeeker(rs, crcs, rr.DataPos); err != nil || n < len(crcs) {
+		return rep, fmt.Errorf("recovery: sector CRCs truncated: %v", err)
+	}
+	acc := make([]byte, rr.RecSectors*rar3RecoverySectorSize) // parity XOR every current sector of the slot
+	if n, err := readAtSeeker(rs, acc, rr.DataPos+int64(len(crcs))); err != nil || n < len(acc) {
+		return rep, fmt.Errorf("recovery: parity sectors truncated: %v", err)
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return rep, err
+	}
+	br := bufio.NewReaderSize(rs, 64*1024)
+	damaged := map[int64][]byte{}            // sector -> current contents
+	slotDamage := make([]int, rr.RecSectors) // damaged sectors per parity slot
+	sector := make([]byte, rar3RecoverySectorSize)
+	for i := int64(0); i < rr.Sectors; i++ {
+		n := int64(rar3RecoverySectorSize)
+		if rest := rr.HeaderPos - i*rar3RecoverySectorSize; rest < n {
+			n = rest
+			clear(sector)
+		}
+		if _, err := io.ReadFull(br, sector[:n]); err != nil {
+			return rep, err
+		}
+		slot := acc[(i%int64(rr.RecSectors))*rar3RecoverySectorSize:][:rar3RecoverySectorSize]
+		for k := range slot {
+			slot[k] ^= sector[k]
+		}
+		if uint16(crc32.ChecksumIEEE(sector)) != binary.LittleEndian.Uint16(crcs[i*2:]) {
+			rep.Damaged = append(rep.Damaged, i*rar3RecoverySectorSize)
+			damaged[i] = append([]byte(nil), sector...)
+			slotDamage[i%int64(rr.RecSectors)]++
+		}
+	}
+	if dst == nil {
+		return rep, nil
+	}
+	for _, off := range rep.Damaged {
+		i := off / rar3RecoverySectorSize
+		if slotDamage[i%int64(rr.RecSectors)] > 1 {
+			rep.Unrepairable = append(rep.Unrepairable, off)
+			continue
+		}
+		fixed := damaged[i]
+		slot := acc[(i%int64(rr.RecSectors))*rar3RecoverySectorSize:][:rar3RecoverySectorSize]
+		for k := range fixed {
+			fixed[k] ^= slot[k]
+		}
+		if uint16(crc32.ChecksumIEEE(fixed)) != binary.LittleEndian.Uint16(crcs[i*2:]) {
+			rep.Unrepairable = append(rep.Unrepairable, off) // parity itself damaged
+			continue
+		}
+		n := min(int64(rar3RecoverySectorSize), rr.HeaderPos-off)
+		if _, err := dst.WriteAt(fixed[:n], off); err != nil {
+			return rep, err
+		}
+		rep.Repaired = append(rep.Repaired, off)
+	}
+	return rep, nil
+}
@@ -0,0 +1,619 @@
+package rarlist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+// RAR3 .rev files end with a 7 byte trailer: DATA_COUNT-1(1) REC_COUNT-1(1) REC_NUM-1(1) CRC32(4).
+const rev3TrailerSize = 7
+
+// rev5Sig opens RAR5 .rev files; it is followed by HEADER_CRC32(4) HEADER_SIZE(4) and the header.
+var rev5Sig = []byte("Rar!\x1ARev")
+
+// RecoveryVolume is the header of a .rev recovery volume.
+//
+// Recovery volumes hold Reed-Solomon parity computed across the data volumes, position by position,
+// data volumes shorter than the longest one being padded with zeros. RAR3 uses a GF(2^8) code (one
+// byte per symbol), RAR5 a Cauchy matrix over GF(2^16) (little endian 16 bit symbols).
+type RecoveryVolume struct {
+	Path      string `json:"path"`
+	Version   string `json:"version"`   // VersionRar3 or VersionRar5
+	DataCount int    `json:"dataCount"` // data volumes in the set
+	RecCount  int    `json:"recCount"`  // recovery volumes in the set
+	RecNum    int    `json:"recNum"`    // 0-based position among the recovery volumes
+	DataPos   int64  `json:"dataPos"`   // start of the parity data
+	DataSize  int64  `json:"dataSize"`  // parity bytes (the size of the largest data volume)
+	CRC       uint32 `json:"crc"`       // CRC32 of the file: RAR3 all but its last 4 bytes, RAR5 the parity data
+
+	// RAR5 only: size and CRC32 of every data volume.
+	VolumeSizes []int64  `json:"volumeSizes,omitempty"`
+	VolumeCRCs  []uint32 `json:"volumeCRCs,omitempty"`
+}
+
+// VolumeSink receives a rebuilt volume: it returns the writer the volume contents are streamed to,
+// closed once the volume is complete.
+type VolumeSink func(path string) (io.WriteCloser, error)
+
+// ParseRecoveryVolume reads the header of a .rev file.
+func ParseRecoveryVolume(path string) (RecoveryVolume, error) {
+	return ParseRecoveryVolumeFS(defaultFS, path)
+}
+
+// ParseRecoveryVolumeFS works like ParseRecoveryVolume on the provided FileSystem.
+func ParseRecoveryVolumeFS(fs FileSystem, path string) (RecoveryVolume, error) {
+	rv := RecoveryVolume{Path: path}
+	f, err := fs.Open(path)
+	if err != nil {
+		return rv, err
+	}
+	defer func() { _ = f.Close() }()
+	st, err := f.Stat()
+	if err != nil {
+		return rv, err
+	}
+	rs, ok := f.(io.ReadSeeker)
+	if !ok {
+		return rv, fmt.Errorf("recovery volume %s is not seekable", path)
+	}
+	var head [16]byte
+	if n, _ := readAtSeeker(rs, head[:], 0); n == len(head) && bytes.HasPrefix(head[:], rev5Sig) {
+		return rv, parseRev5(rs, &rv, head[:], st.Size())
+	}
+	return rv, parseRev3(rs, &rv, st.Size())
+}
+
+// parseRev5 decodes VERSION(1) DATA_COUNT(2) REC_COUNT(2) REC_NUM(2) REV_CRC(4), then FILE_SIZE(8) CRC32(4)
+// per data volume. REC_NUM counts data volumes first, so recovery volumes start at DATA_COUNT.
+func parseRev5(rs io.ReadSeeker, rv *RecoveryVolume, head []byte, size int64) error {
+	hdrSize := int64(binary.LittleEndian.Uint32(head[12:16]))
+	if hdrSize < 11 || hdrSize > 1<<20 {
+		return fmt.Errorf("rev5 %s: bad header size %d", rv.Path, hdrSize)
+	}
+	hdr := make([]byte, hdrSize)
+	if n, err := readAtSeeker(rs, hdr, int64(len(head))); err != nil || int64(n) < hdrSize {
+		return fmt.Errorf("rev5 %s: header truncated", rv.Path)
+	}
+	if crc32.Update(crc32.ChecksumIEEE(head[12:16]), crc32.IEEETable, hdr) != binary.LittleEndian.Uint32(head[8:12]) {
+		return fmt.Errorf("rev5 %s: header CRC mismatch", rv.Path)
+	}
+	if hdr[0] != 1 {
+		return fmt.Errorf("rev5 %s: unsupported version %d", rv.Path, hdr[0])
+	}
+	rv.Version = VersionRar5
+	rv.DataCount = int(binary.LittleEndian.Uint16(hdr[1:3]))
+	rv.RecCount = int(binary.LittleEndian.Uint16(hdr[3:5]))
+	recNum := int(binary.LittleEndian.Uint16(hdr[5:7]))
+	rv.CRC = binary.LittleEndian.Uint32(hdr[7:11])
+	if rv.DataCount == 0 || rv.RecCount == 0 || recNum < rv.DataCount || recNum >= rv.DataCount+rv.RecCount ||
+		hdrSize < 11+12*int64(rv.DataCount) {
+		return fmt.Errorf("rev5 %s: inconsistent header (data %d, recovery %d, number %d)", rv.Path, rv.DataCount, rv.RecCount, recNum)
+	}
+	rv.RecNum = recNum - rv.DataCount
+	for i, b := 0, hdr[11:]; i < rv.DataCount; i, b = i+1, b[12:] {
+		rv.VolumeSizes = append(rv.VolumeSizes, int64(binary.LittleEndian.Uint64(b[0:8])))
+		rv.VolumeCRCs = append(rv.VolumeCRCs, binary.LittleEndian.Uint32(b[8:12]))
+	}
+	rv.DataPos = int64(len(head)) + hdrSize
+	rv.DataSize = size - rv.DataPos
+	return nil
+}
+
+// parseRev3 decodes the trailer of a RAR3 .rev file; the parity data fills the rest of the file.
+func parseRev3(rs io.ReadSeeker, rv *RecoveryVolume, size int64) error {
+	var t [rev3TrailerSize]byte
+	if size <= rev3TrailerSize {
+		return fmt.Errorf("rev3 %s: file too small", rv.Path)
+	}
+	if n, err := readAtSeeker(rs, t[:], size-rev3TrailerSize); err != nil || n < len(t) {
+		return fmt.Errorf("rev3 %s: trailer truncated", rv.Path)
+	}
+	rv.Version = VersionRar3
+	rv.DataCount, rv.RecCount, rv.RecNum = int(t[0])+1, int(t[1])+1, int(t[2])
+	rv.CRC = binary.LittleEndian.Uint32(t[3:7])
+	if rv.DataCount+rv.RecCount > 255 || rv.RecNum >= rv.RecCount {
+		return fmt.Errorf("rev3 %s: inconsistent trailer (data %d, recovery %d, number %d)", rv.Path, rv.DataCount, rv.RecCount, rv.RecNum+1)
+	}
+	rv.DataSize = size - rev3TrailerSize
+	return nil
+}
+
+// RebuildVolumes is a convenience using the default filesystem.
+func RebuildVolumes(first string, sink VolumeSink) ([]string, error) {
+	return RebuildVolumesFS(defaultFS, first, sink)
+}
+
+// RebuildVolumesFS recreates the missing data volumes of the set whose first volume is first (which may
+// itself be missing) from the .rev files next to it whose CRC32 matches, streaming each to sink. Damaged
+// volumes are rebuilt as well: RAR5 ones whose size or CRC32 differs from the recovery header, RAR3 ones
+// of the wrong size or failing a header or data CRC. It returns the rebuilt paths; nothing is written
+// when the set is complete.
+func RebuildVolumesFS(fs FileSystem, first string, sink VolumeSink) ([]string, error) {
+	paths, err := DiscoverRecoveryVolumesFS(fs, first)
+	if err != nil {
+		return nil, err
+	}
+	var set []RecoveryVolume
+	seen := map[int]bool{}
+	for _, p := range paths {
+		rv, err := ParseRecoveryVolumeFS(fs, p)
+		if err != nil {
+			continue // damaged or foreign .rev files are not used
+		}
+		if ok, err := recoveryVolumeIntact(fs, rv); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		if len(set) > 0 && (rv.Version != set[0].Version || rv.DataCount != set[0].DataCount ||
+			rv.RecCount != set[0].RecCount || rv.DataSize != set[0].DataSize) {
+			continue
+		}
+		if !seen[rv.RecNum] {
+			seen[rv.RecNum] = true
+			set = append(set, rv)
+		}
+	}
+	if len(set) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoRecoveryVolumes, first)
+	}
+	ref := set[0]
+	var bad []int
+	for i := 0; i < ref.DataCount; i++ {
+		ok, err := dataVolumeIntact(fs, volumeName(first, i), ref, i)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			bad = append(bad, i)
+		}
+	}
+	if len(bad) == 0 {
+		return nil, nil
+	}
+	if len(bad) > len(set) {
+		return nil, fmt.Errorf("%w: %d volumes to rebuild, %d recovery volumes", ErrIncompleteVolumeSet, len(bad), len(set))
+	}
+
+	nd, nr := ref.DataCount, ref.RecCount
+	srcs := make([]io.Reader, nd+nr)
+	var closers []io.Closer
+	defer func() {
+		for _, c := range closers {
+			_ = c.Close()
+		}
+	}()
+	open := func(path string, off, n int64) (io.Reader, error) {
+		f, err := fs.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		closers = append(closers, f)
+		if off > 0 {
+			if s, ok := f.(io.Seeker); ok {
+				_, err = s.Seek(off, io.SeekStart)
+			} else {
+				_, err = io.CopyN(io.Discard, f, off)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return io.LimitReader(f, n), nil
+	}
+	isBad := map[int]bool{}
+	for _, i := range bad {
+		isBad[i] = true
+	}
+	for i := 0; i < nd; i++ {
+		if !isBad[i] {
+			r, err := open(volumeName(first, i), 0, ref.DataSize)
+			if err != nil {
+				return nil, err
+			}
+			srcs[i] = r
+		}
+	}
+	for _, rv := range set {
+		r, err := open(rv.Path, rv.DataPos, rv.DataSize)
+		if err != nil {
+			return nil, err
+		}
+		srcs[nd+rv.RecNum] = r
+	}
+
+	dsts := map[int]io.Writer{}
+	var rebuilt []string
+	for _, i := range bad {
+		p := volumeName(first, i)
+		w, err := sink(p)
+		if err != nil {
+			return rebuilt, err
+		}
+		closers = append(closers, w)
+		switch {
+		case ref.Version == VersionRar5:
+			dsts[i] = &limitWriter{w: w, n: ref.VolumeSizes[i]}
+		case i == nd-1: // the last RAR3 volume is shorter than the parity: stop after its end block
+			dsts[i] = &rar3EndWriter{w: w}
+		default:
+			dsts[i] = w
+		}
+		rebuilt = append(rebuilt, p)
+	}
+
+	var err2 error
+	if ref.Version == VersionRar5 {
+		// rows: parity equations of the first recovery volumes available, one per volume to rebuild;
+		// the other recovery volumes have no coefficient in them and are not read
+		rows := make([]int, len(bad))
+		for k := range rows {
+			rows[k] = set[k].RecNum
+		}
+		f := gf65536()
+		coef := func(r, pos int) uint32 {
+			switch {
+			case pos < nd:
+				return f.inv(uint32(r+nd) ^ uint32(pos))
+			case pos == nd+r:
+				return 1
+			}
+			return 0
+		}
+		err2 = solveErasures(f, 2, rows, coef, srcs, bad, dsts, ref.DataSize)
+	} else {
+		// the codeword is data then parity, highest degree first; it vanishes at alpha^1..alpha^nr
+		unknown := append([]int(nil), bad...)
+		for r := 0; r < nr; r++ {
+			if srcs[nd+r] == nil {
+				unknown = append(unknown, nd+r)
+			}
+		}
+		rows := make([]int, len(unknown))
+		for k := range rows {
+			rows[k] = k + 1
+		}
+		n := nd + nr
+		f := gf256()
+		coef := func(row, pos int) uint32 { return f.pow(row * (n - 1 - pos)) }
+		err2 = solveErasures(f, 1, rows, coef, srcs, unknown, dsts, ref.DataSize)
+	}
+	if err2 != nil {
+		return rebuilt, err2
+	}
+	return rebuilt, nil
+}
+
+// recoveryVolumeIntact checks the CRC32 stored in a .rev file against its contents.
+func recoveryVolumeIntact(fs FileSystem, rv RecoveryVolume) (bool, error) {
+	off, n := rv.DataPos, rv.DataSize
+	if rv.Version == VersionRar3 {
+		off, n = 0, rv.DataSize+rev3TrailerSize-4
+	}
+	h := crc32.NewIEEE()
+	if err := copyVolumeRange(fs, rv.Path, off, n, h); err != nil {
+		return false, err
+	}
+	return h.Sum32() == rv.CRC, nil
+}
+
+// dataVolumeIntact reports whether data volume i exists and, for RAR5, matches the recorded size and
+// CRC32. RAR3 recovery volumes record neither: the volume must have the size of the parity (any but the
+// last), valid header CRCs, no block running past its end and, when its end block stores one, a
+// matching data CRC.
+func dataVolumeIntact(fs FileSystem, path string, ref RecoveryVolume, i int) (bool, error) {
+	st, err := fs.Stat(path)
+	if err != nil {
+		return false, nil
+	}
+	if ref.Version != VersionRar5 {
+		if st.Size() > ref.DataSize || (i < ref.DataCount-1 && st.Size() != ref.DataSize) {
+			return false, nil
+		}
+		vi, err := indexSingle(fs, path, options{sfxScanLimit: DefaultSFXScanLimit, headerCRC: CRCStrict})
+		if errors.Is(err, ErrPasswordProtected) { // encrypted headers: only the size can be checked
+			return true, nil
+		}
+		if err != nil {
+			return false, nil
+		}
+		for _, w := range vi.Warnings {
+			if w.Kind == WarningDataSize {
+				return false, nil
+			}
+		}
+		return verifyVolumeDataCRC(fs, vi).OK, nil
+	}
+	if st.Size() != ref.VolumeSizes[i] {
+		return false, nil
+	}
+	h := crc32.NewIEEE()
+	if err := copyVolumeRange(fs, path, 0, st.Size(), h); err != nil {
+		return false, err
+	}
+	return h.Sum32() == ref.VolumeCRCs[i], nil
+}
+
+// solveErasures recovers the symbols at the unknown positions of every codeword. Codewords are read
+// position by position from srcs (nil for unknown or unused positions); each row names a parity
+// equation sum(coef(row, pos) * symbol[pos]) == 0, one per unknown position. Recovered symbols are
+// written to dsts (unknown positions without a writer are only solved for).
+func solveErasures(f *galoisField, width int, rows []int, coef func(row, pos int) uint32, srcs []io.Reader, unknown []int, dsts map[int]io.Writer, length int64) error {
+	m := len(unknown)
+	a := make([][]uint32, m)
+	for r := range a {
+		a[r] = make([]uint32, m)
+		for e, pos := range unknown {
+			a[r][e] = coef(rows[r], pos)
+		}
+	}
+	ainv, ok := f.invert(a)
+	if !ok {
+		return errors.New("recovery volumes: singular decoding matrix")
+	}
+	type known struct {
+		src  io.Reader
+		coef []uint32
+	}
+	var ks []known
+	for pos, src := range srcs {
+		if src == nil {
+			continue
+		}
+		c := make([]uint32, m)
+		used := false
+		for r := range c {
+			c[r] = coef(rows[r], pos)
+			used = used || c[r] != 0
+		}
+		if used {
+			ks = append(ks, known{src: src, coef: c})
+		}
+	}
+	const chunk = 64 * 1024
+	buf := make([]byte, chunk)
+	sym := make([]uint32, chunk/width)
+	rhs := make([][]uint32, m)
+	for r := range rhs {
+		rhs[r] = make([]uint32, chunk/width)
+	}
+	for off := int64(0); off < length; off += chunk {
+		n := int(min(chunk, length-off))
+		ns := (n + width - 1) / width
+		for r := range rhs {
+			clear(rhs[r][:ns])
+		}
+		for _, k := range ks {
+			if err := readPadded(k.src, buf[:ns*width]); err != nil {
+				return err
+			}
+			toSymbols(sym[:ns], buf, width)
+			for r, c := range k.coef {
+				f.mulAdd(rhs[r][:ns], sym[:ns], c)
+			}
+		}
+		for e, pos := range unknown {
+			w := dsts[pos]
+			if w == nil {
+				continue
+			}
+			clear(sym[:ns])
+			for r := range rhs {
+				f.mulAdd(sym[:ns], rhs[r][:ns], ainv[e][r])
+			}
+			fromSymbols(buf, sym[:ns], width)
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readPadded fills b from r, zero padding past the end of r.
+func readPadded(r io.Reader, b []byte) error {
+	n, err := io.ReadFull(r, b)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		clear(b[n:])
+		return nil
+	}
+	return err
+}
+
+func toSymbols(sym []uint32, b []byte, width int) {
+	for i := range sym {
+		if width == 2 {
+			sym[i] = uint32(binary.LittleEndian.Uint16(b[i*2:]))
+		} else {
+			sym[i] = uint32(b[i])
+		}
+	}
+}
+
+func fromSymbols(b []byte, sym []uint32, width int) {
+	for i, s := range sym {
+		if width == 2 {
+			binary.LittleEndian.PutUint16(b[i*2:], uint16(s))
+		} else {
+			b[i] = byte(s)
+		}
+	}
+}
+
+// galoisField is GF(2^bits) with log/antilog tables.
+type galoisField struct {
+	order uint32   // size of the multiplicative group, 2^bits-1
+	exp   []uint32 // exp[i] = alpha^i, doubled so sums of two logs need no reduction
+	log   []uint32
+}
+
+func newGaloisField(bits uint, poly uint32) *galoisField {
+	q := uint32(1) << bits
+	f := &galoisField{order: q - 1, exp: make([]uint32, 2*(q-1)), log: make([]uint32, q)}
+	x := uint32(1)
+	for i := uint32(0); i < q-1; i++ {
+		f.exp[i], f.exp[i+q-1] = x, x
+		f.log[x] = i
+		x <<= 1
+		if x&q != 0 {
+			x ^= poly
+		}
+	}
+	return f
+}
+
+// RAR3 recovery volumes use x^8+x^4+x^3+x^2+1, RAR5 x^16+x^12+x^3+x+1.
+var (
+	gf256   = sync.OnceValue(func() *galoisField { return newGaloisField(8, 0x11D) })
+	gf65536 = sync.OnceValue(func() *galoisField { return newGaloisField(16, 0x1100B) })
+)
+
+func (f *galoisField) mul(a, b uint32) uint32 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return f.exp[f.log[a]+f.log[b]]
+}
+
+func (f *galoisField) inv(a uint32) uint32 {
+	if a == 0 {
+		return 0
+	}
+	return f.exp[f.order-f.log[a]]
+}
+
+// pow returns alpha^n.
+func (f *galoisField) pow(n int) uint32 { return f.exp[uint32(n)%f.order] }
+
+// mulAdd adds c*src to dst element-wise.
+func (f *galoisField) mulAdd(dst, src []uint32, c uint32) {
+	if c == 0 {
+		return
+	}
+	lc := f.log[c]
+	for i, s := range src {
+		if s != 0 {
+			dst[i] ^= f.exp[f.log[s]+lc]
+		}
+	}
+}
+
+// invert returns the inverse of the square matrix a (Gauss-Jordan elimination); a is modified.
+func (f *galoisField) invert(a [][]uint32) ([][]uint32, bool) {
+	n := len(a)
+	inv := make([][]uint32, n)
+	for i := range inv {
+		inv[i] = make([]uint32, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for r := col; r < n; r++ {
+			if a[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		s := f.inv(a[col][col])
+		for j := 0; j < n; j++ {
+			a[col][j], inv[col][j] = f.mul(a[col][j], s), f.mul(inv[col][j], s)
+		}
+		for r := 0; r < n; r++ {
+			if r == col || a[r][col] == 0 {
+				continue
+			}
+			c := a[r][col]
+			for j := 0; j < n; j++ {
+				a[r][j] ^= f.mul(c, a[col][j])
+				inv[r][j] ^= f.mul(c, inv[col][j])
+			}
+		}
+	}
+	return inv, true
+}
+
+// limitWriter forwards the first n bytes written and drops the rest.
+type limitWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	k := int64(len(p))
+	if k > l.n {
+		k = l.n
+	}
+	if k > 0 {
+		if _, err := l.w.Write(p[:k]); err != nil {
+			return 0, err
+		}
+		l.n -= k
+	}
+	return len(p), nil
+}
+
+// rar3EndWriter forwards a rebuilt RAR 1.5-4.x volume up to the end of its block chain: the end of
+// archive block, or the first offset not holding a block header (the zero padding up to the parity size).
+type rar3EndWriter struct {
+	w    io.Writer
+	pos  int64  // bytes consumed
+	next int64  // offset of the next block header
+	hdr  []byte // header bytes collected at next
+	done bool
+}
+
+func (t *rar3EndWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && !t.done {
+		if t.pos < t.next { // block data
+			k := min(int64(len(p)), t.next-t.pos)
+			if _, err := t.w.Write(p[:k]); err != nil {
+				return 0, err
+			}
+			t.pos, p = t.pos+k, p[k:]
+			continue
+		}
+		need := 7
+		if len(t.hdr) >= 7 {
+			need = int(binary.LittleEndian.Uint16(t.hdr[5:7]))
+		}
+		k := min(need-len(t.hdr), len(p))
+		t.hdr = append(t.hdr, p[:k]...)
+		t.pos, p = t.pos+int64(k), p[k:]
+		if len(t.hdr) < need {
+			continue
+		}
+		typ, flags, size := t.hdr[2], binary.LittleEndian.Uint16(t.hdr[3:5]), int(binary.LittleEndian.Uint16(t.hdr[5:7]))
+		if need == 7 && (!isRar3BlockType(typ) || size < 7 || (flags&0x8000 != 0 && size < 11)) {
+			t.done = true // padding
+			break
+		}
+		if len(t.hdr) < size {
+			continue
+		}
+		if _, err := t.w.Write(t.hdr); err != nil {
+			return 0, err
+		}
+		var tail int64
+		file := typ == rar3BlockTypeFile || typ == rar3BlockTypeNewSub
+		if (flags&0x8000 != 0 || file) && size >= 11 { // file data follows PACK_SIZE, like in the parser
+			tail = int64(binary.LittleEndian.Uint32(t.hdr[7:11]))
+		}
+		if file && flags&0x0100 != 0 && size >= 36 {
+			tail |= int64(binary.LittleEndian.Uint32(t.hdr[32:36])) << 32
+		}
+		t.next, t.hdr = t.pos+tail, t.hdr[:0]
+		t.done = typ == rar3BlockTypeEnd
+	}
+	return n, nil
+}
@@ -0,0 +1,221 @@
+package rarlist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultSFXScanLimit is how far into a volume the fallback search looks for a RAR signature
+// (the largest SFX module size accepted by unrar).
+const DefaultSFXScanLimit = 4 << 20
+
+// sfxScanChunk is the read size of the forward signature scan.
+const sfxScanChunk = 64 * 1024
+
+// matchSignature reports the archive version whose signature starts b. The short RAR 1.4 mark is
+// only matched when allow14 is set.
+func matchSignature(b []byte, allow14 bool) (string, bool) {
+	switch {
+	case bytes.HasPrefix(b, rarrSigV5):
+		return VersionRar5, true
+	case bytes.HasPrefix(b, rarrSigV3):
+		return VersionRar3, true
+	case allow14 && bytes.HasPrefix(b, rarrSigV14):
+		return VersionRar14, true
+	}
+	return VersionUnknown, false
+}
+
+// findSFXSignature locates the archive appended to a self-extracting executable. The end of the PE or
+// ELF image (where the overlay starts) is tried first; otherwise, or if nothing is found there, the
+// first limit bytes are scanned. The RAR 1.4 mark is only accepted right at the overlay start.
+func findSFXSignature(rs io.ReadSeeker, limit int64) (string, int64, error) {
+	if overlay, ok := exeOverlayOffset(rs); ok {
+		var head [8]byte
+		if n, _ := readAtSeeker(rs, head[:], overlay); n > 0 {
+			if v, ok := matchSignature(head[:n], true); ok {
+				return v, overlay, nil
+			}
+		}
+		if v, off, err := scanSignature(rs, overlay, limit); err == nil {
+			return v, off, nil
+		}
+	}
+	if v, off, err := scanSignature(rs, 0, limit); err == nil {
+		return v, off, nil
+	}
+	return VersionUnknown, 0, fmt.Errorf("RAR signature not found in first %d bytes", limit)
+}
+
+// scanSignature searches [from, from+limit) for a RAR3 or RAR5 signature.
+func scanSignature(rs io.ReadSeeker, from, limit int64) (string, int64, error) {
+	const overlap = 7 // longest signature minus one
+	buf := make([]byte, sfxScanChunk+overlap)
+	for off := from; off < from+limit; off += sfxScanChunk {
+		n, err := readAtSeeker(rs, buf, off)
+		for i := 0; i < n && off+int64(i) < from+limit; i++ {
+			if buf[i] != 'R' {
+				continue
+			}
+			if v, ok := matchSignature(buf[i:n], false); ok {
+				return v, off + int64(i), nil
+			}
+		}
+		if err != nil || n < len(buf) {
+			break
+		}
+	}
+	return VersionUnknown, 0, errors.New("RAR signature not found")
+}
+
+// readAtSeeker reads up to len(p) bytes at off, returning fewer at end of file.
+func readAtSeeker(rs io.ReadSeeker, p []byte, off int64) (int, error) {
+	if ra, ok := rs.(io.ReaderAt); ok {
+		n, err := ra.ReadAt(p, off)
+		if err == io.EOF {
+			err = nil
+		}
+		return n, err
+	}
+	if _, err := rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(rs, p)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
+
+// exeOverlayOffset returns the offset right after the PE or ELF image, where SFX archives are appended.
+func exeOverlayOffset(rs io.ReadSeeker) (int64, bool) {
+	var magic [4]byte
+	if n, _ := readAtSeeker(rs, magic[:], 0); n < 4 {
+		return 0, false
+	}
+	switch {
+	case magic[0] == 'M' && magic[1] == 'Z':
+		return peOverlayOffset(rs)
+	case string(magic[:]) == "\x7fELF":
+		return elfOverlayOffset(rs)
+	}
+	return 0, false
+}
+
+// peOverlayOffset returns the end of the last PE section's raw data.
+func peOverlayOffset(rs io.ReadSeeker) (int64, bool) {
+	var dos [64]byte
+	if n, _ := readAtSeeker(rs, dos[:], 0); n < len(dos) {
+		return 0, false
+	}
+	lfanew := int64(binary.LittleEndian.Uint32(dos[0x3C:]))
+	if lfanew <= 0 || lfanew > 1<<20 {
+		return 0, false
+	}
+	// "PE\0\0" signature followed by the 20 byte COFF file header
+	var nt [24]byte
+	if n, _ := readAtSeeker(rs, nt[:], lfanew); n < len(nt) || string(nt[0:4]) != "PE\x00\x00" {
+		return 0, false
+	}
+	sections := int(binary.LittleEndian.Uint16(nt[6:8]))
+	optSize := int64(binary.LittleEndian.Uint16(nt[20:22]))
+	if sections == 0 || sections > 96 {
+		return 0, false
+	}
+	table := make([]byte, sections*40)
+	if n, _ := readAtSeeker(rs, table, lfanew+24+optSize); n < len(table) {
+		return 0, false
+	}
+	var end int64
+	for i := 0; i < sections; i++ {
+		s := table[i*40 : (i+1)*40]
+		size := int64(binary.LittleEndian.Uint32(s[16:20])) // SizeOfRawData
+		ptr := int64(binary.LittleEndian.Uint32(s[20:24]))  // PointerToRawData
+		if size > 0 && ptr+size > end {
+			end = ptr + size
+		}
+	}
+	return end, end > 0
+}
+
+// elfOverlayOffset returns the end of the furthest ELF structure: program and section header tables,
+// segments and sections with file contents.
+func elfOverlayOffset(rs io.ReadSeeker) (int64, bool) {
+	var eh [64]byte
+	n, _ := readAtSeeker(rs, eh[:], 0)
+	if n < 52 {
+		return 0, false
+	}
+	var bo binary.ByteOrder
+	switch eh[5] {
+	case 1:
+		bo = binary.LittleEndian
+	case 2:
+		bo = binary.BigEndian
+	default:
+		return 0, false
+	}
+	is64 := eh[4] == 2
+	if is64 && n < 64 {
+		return 0, false
+	}
+	var phoff, shoff int64
+	var phentsize, phnum, shentsize, shnum int64
+	if is64 {
+		phoff, shoff = int64(bo.Uint64(eh[0x20:])), int64(bo.Uint64(eh[0x28:]))
+		phentsize, phnum = int64(bo.Uint16(eh[0x36:])), int64(bo.Uint16(eh[0x38:]))
+		shentsize, shnum = int64(bo.Uint16(eh[0x3A:])), int64(bo.Uint16(eh[0x3C:]))
+	} else {
+		phoff, shoff = int64(bo.Uint32(eh[0x1C:])), int64(bo.Uint32(eh[0x20:]))
+		phentsize, phnum = int64(bo.Uint16(eh[0x2A:])), int64(bo.Uint16(eh[0x2C:]))
+		shentsize, shnum = int64(bo.Uint16(eh[0x2E:])), int64(bo.Uint16(eh[0x30:]))
+	}
+	// smallest Elf64_Phdr/Elf64_Shdr or Elf32_Phdr/Elf32_Shdr holding the fields read below
+	minPhent, minShent := int64(32), int64(40)
+	if is64 {
+		minPhent, minShent = 56, 64
+	}
+	var end int64
+	extend := func(off, size int64) {
+		if off >= 0 && size > 0 && off+size > end {
+			end = off + size
+		}
+	}
+	extend(phoff, phentsize*phnum)
+	extend(shoff, shentsize*shnum)
+	// segments: p_offset/p_filesz
+	if phoff > 0 && phnum > 0 && phentsize >= minPhent && phnum*phentsize <= 1<<20 {
+		tab := make([]byte, phnum*phentsize)
+		if n, _ := readAtSeeker(rs, tab, phoff); n == len(tab) {
+			for i := int64(0); i < phnum; i++ {
+				p := tab[i*phentsize:]
+				if is64 {
+					extend(int64(bo.Uint64(p[8:])), int64(bo.Uint64(p[0x20:])))
+				} else {
+					extend(int64(bo.Uint32(p[4:])), int64(bo.Uint32(p[0x10:])))
+				}
+			}
+		}
+	}
+	// sections: sh_offset/sh_size, except SHT_NOBITS (8) which occupies no file space
+	if shoff > 0 && shnum > 0 && shentsize >= minShent && shnum*shentsize <= 1<<20 {
+		tab := make([]byte, shnum*shentsize)
+		if n, _ := readAtSeeker(rs, tab, shoff); n == len(tab) {
+			for i := int64(0); i < shnum; i++ {
+				s := tab[i*shentsize:]
+				if bo.Uint32(s[4:]) == 8 {
+					continue
+				}
+				if is64 {
+					extend(int64(bo.Uint64(s[0x18:])), int64(bo.Uint64(s[0x20:])))
+				} else {
+					extend(int64(bo.Uint32(s[0x10:])), int64(bo.Uint32(s[0x14:])))
+				}
+			}
+		}
+	}
+	return end, end > 0
+}
@@ -1,6 +1,10 @@
 package rarlist
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 // VolumeIndex holds header size accounting for a volume file.
 type VolumeIndex struct {
@@ -8,8 +12,90 @@ type VolumeIndex struct {
 	Version          string
 	TotalHeaderBytes int64 // bytes from start of file up to first file payload (for a stored file)
 	FileBlocks       []FileBlock
+	Warnings         []Warning // non-fatal inconsistencies found while parsing
+	Archive          ArchiveInfo
+	ServiceBlocks    []ServiceBlock // RAR5 service headers / RAR3 sub-blocks (comments, streams, ACLs, recovery records)
+}
+
+// Service block names as stored in RAR5 service headers and RAR3 NEWSUB blocks.
+const (
+	ServiceComment   = "CMT" // archive comment
+	ServiceQuickOpen = "QO"  // quick open data
+	ServiceACL       = "ACL" // NTFS access control list
+	ServiceStream    = "STM" // NTFS alternate data stream
+	ServiceRecovery  = "RR"  // recovery record
+
+	ServiceAuthenticity = "AV"   // RAR3 authenticity information
+	ServiceUnixOwner    = "UOW"  // RAR3 Unix owner
+	ServiceOS2EA        = "EA2"  // RAR3 OS/2 extended attributes
+	ServiceBeOSEA       = "EABE" // RAR3 BeOS extended attributes
+	ServiceMacInfo      = "MAC"  // RAR 2.x Macintosh file type/creator (old style sub-block only)
+	ServiceSignature    = "SIGN" // RAR 2.x archive signature (old style block only)
+)
+
+// ServiceBlock describes a non-file data block. Its payload lives at DataPos and, like stored
+// file data, spans PackedSize bytes of the volume.
+type ServiceBlock struct {
+	Name         string `json:"name"`       // ServiceComment, ServiceStream, ...
+	HeaderType   uint8  `json:"headerType"` // raw block type: RAR5 3, RAR3 0x75..0x7A
+	HeaderPos    int64  `json:"headerPos"`
+	DataPos      int64  `json:"dataPos"`
+	PackedSize   int64  `json:"packedSize"`
+	UnpackedSize int64  `json:"unpackedSize"`
+	Stored       bool   `json:"stored"`
+	Encrypted    bool   `json:"encrypted"`
+	FileIndex    int    `json:"fileIndex"` // index into FileBlocks of the owning file, -1 for archive-level blocks
+	FileName     string `json:"fileName,omitempty"`
+	Data         []byte `json:"data,omitempty"` // service data record (e.g. the NTFS stream name for STM, recovery record parameters for RR)
+}
+
+// ArchiveInfo holds archive attributes decoded from the main and end-of-archive headers of a volume.
+type ArchiveInfo struct {
+	HasMainHeader bool `json:"hasMainHeader"`
+	IsVolume      bool `json:"isVolume"` // part of a multi-volume set
+	Solid         bool `json:"solid"`
+	Locked        bool `json:"locked"`
+	HasRecovery   bool `json:"hasRecovery"`  // recovery record present
+	FirstVolume   bool `json:"firstVolume"`  // RAR3 MHD_FIRSTVOLUME, or RAR5 volume without a volume number
+	NewNumbering  bool `json:"newNumbering"` // RAR3 name.partN.rar numbering scheme
+	HasComment    bool `json:"hasComment"`
+
+	EncryptedHeaders bool `json:"encryptedHeaders"` // RAR5 archive encryption header or RAR3 MHD_PASSWORD: later headers are AES encrypted
+
+	HasVolumeNumber bool `json:"hasVolumeNumber"`
+	VolumeNumber    int  `json:"volumeNumber"` // 0-based position within the set, valid if HasVolumeNumber
+
+	HasEnd     bool   `json:"hasEnd"`     // end-of-archive block seen
+	EndPos     int64  `json:"endPos"`     // volume offset of the end-of-archive block, valid if HasEnd
+	NextVolume bool   `json:"nextVolume"` // end block says another volume follows
+	HasDataCRC bool   `json:"hasDataCRC"`
+	DataCRC    uint32 `json:"dataCRC"` // RAR3 CRC32 of the volume from its first byte up to the end block
 }
 
+// WarningKind classifies a Warning.
+type WarningKind string
+
+const (
+	// WarningDataSize reports a header data size that disagrees with the volume layout
+	// (data running past the end of the volume, or no header where the next one should start).
+	WarningDataSize WarningKind = "data-size"
+	// WarningHeaderCRC reports a block header whose stored CRC does not match its contents
+	// (only recorded when header CRC checking is enabled, see WithHeaderCRC).
+	WarningHeaderCRC WarningKind = "header-crc"
+	// WarningFileName reports a RAR3 file name that was guessed (NAME_SIZE 0), stripped of a leading
+	// control byte and zeros, or cut at a zero byte.
+	WarningFileName WarningKind = "file-name"
+)
+
+// Warning describes a non-fatal inconsistency recorded on a VolumeIndex.
+type Warning struct {
+	Kind    WarningKind `json:"kind"`
+	Offset  int64       `json:"offset"` // volume offset the warning refers to
+	Message string      `json:"message"`
+}
+
+func (w Warning) String() string { return fmt.Sprintf("%s @%d: %s", w.Kind, w.Offset, w.Message) }
+
 // FileBlock represents a file header encountered (RAR3 or RAR5 simplified)
 type FileBlock struct {
 	Name           string
@@ -18,16 +104,48 @@ type FileBlock struct {
 	DataPos        int64 // where the file's data would start within this volume
 	PackedSize     int64 // size stored (for extraction - uses header value for compatibility)
 	VolumeDataSize int64 // actual data size in this specific volume (for reporting)
-	Continued      bool  // continues in next volume
+	Continued      bool  // continues in next volume (same as ContinuedTo, kept for compatibility)
+	ContinuedFrom  bool  // data continues from the previous volume (RAR3 LHD_SPLIT_BEFORE / RAR5 flag 0x0008)
+	ContinuedTo    bool  // data continues in the next volume (RAR3 LHD_SPLIT_AFTER / RAR5 flag 0x0010)
 	UnpackedSize   int64 // original size (if available)
 	Stored         bool  // true if file data is stored (no compression)
 	Encrypted      bool  // true if file data is encrypted/password-protected
+
+	IsDir            bool      // directory entry
+	ModTime          time.Time // modification time (zero if not stored)
+	CRC32            uint32    // CRC32 from the header (packed data CRC for non-final split parts)
+	HasCRC32         bool      // CRC32 field present
+	HostOS           uint8     // raw host OS id (RAR5: 0 Windows, 1 Unix; RAR3: 0 DOS, 1 OS/2, 2 Win32, 3 Unix, ...)
+	Attributes       uint64    // raw host-specific file attributes
+	AlgorithmVersion uint8     // RAR5 compression algorithm version (0 = RAR 5.0, 1 = RAR 7.0); RAR 1.5-3.x UNP_VER
+	Solid            bool      // data continues the solid stream of the previous file
+	Method           uint8     // compression method, 0 (store) .. 5 (best)
+	DictSize         int64     // dictionary size in bytes needed to unpack
+
+	// RAR5 extra area records (nil / zero when absent)
+	Hash        *FileHash    // BLAKE2sp hash of the unpacked data
+	Times       *FileTimes   // high precision modification/creation/access times
+	Version     uint64       // file version number
+	Redirection *Redirection // symlink, junction, hard link or file copy
+	Owner       *UnixOwner   // Unix user/group
+	Encryption  *Encryption  // AES-256 parameters of encrypted data
+	Salt        []byte       // RAR 2.9-4.x salt of encrypted data (LHD_SALT), nil when unsalted
 }
 
 func (v *VolumeIndex) DataOffset() int64 { return v.TotalHeaderBytes }
 
+func (v *VolumeIndex) warnf(kind WarningKind, offset int64, format string, a ...any) {
+	v.Warnings = append(v.Warnings, Warning{Kind: kind, Offset: offset, Message: fmt.Sprintf(format, a...)})
+}
+
 // Sentinel errors surfaced by high-level APIs like ListFiles/ListFilesFS.
 var (
 	ErrPasswordProtected      = errors.New("password protected")
+	ErrWrongPassword          = errors.New("wrong password")
 	ErrCompressedNotSupported = errors.New("compressed file unsupported")
+	ErrChecksumMismatch       = errors.New("checksum mismatch")
+	ErrIncompleteVolumeSet    = errors.New("incomplete volume set")
+	ErrNoRecoveryRecord       = errors.New("no recovery record")
+	ErrRecoveryUnsupported    = errors.New("recovery record format not supported")
+	ErrNoRecoveryVolumes      = errors.New("no usable recovery volumes")
 )
@@ -0,0 +1,210 @@
+package rarlist
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/javi11/rarlist/internal/blake2sp"
+)
+
+// PartCheck is the verification result of one AggregatedFilePart.
+// Checked is false when the header carries no checksum usable for this part; OK is false only when a
+// checksum mismatched or the data could not be read.
+type PartCheck struct {
+	Path       string `json:"path"`
+	DataOffset int64  `json:"dataOffset"`
+	Checked    bool   `json:"checked"` // the last part reports the whole-file comparison
+	OK         bool   `json:"ok"`
+}
+
+// FileCheck is the verification result of one AggregatedFile.
+type FileCheck struct {
+	Name    string      `json:"name"`
+	Parts   []PartCheck `json:"parts"`
+	Checked bool        `json:"checked"` // a whole-file CRC32 or BLAKE2sp was compared
+	OK      bool        `json:"ok"`
+	Err     error       `json:"-"` // why the data could not be verified (encrypted, compressed, incomplete, I/O)
+}
+
+// VolumeCheck is the verification result of the RAR3 end-of-archive data CRC of one volume.
+type VolumeCheck struct {
+	Path    string `json:"path"`
+	Checked bool   `json:"checked"` // the end block carries a data CRC
+	OK      bool   `json:"ok"`
+	Err     error  `json:"-"`
+}
+
+// VerifyReport gathers the file and volume checks of a volume set.
+type VerifyReport struct {
+	Files   []FileCheck   `json:"files"`
+	Volumes []VolumeCheck `json:"volumes"`
+	OK      bool          `json:"ok"` // every file and volume passed
+}
+
+// VerifyFileFS streams the parts of a stored file and compares them with the header checksums:
+// the CRC32 (RAR3 FILE_CRC, RAR5 data CRC32) and the RAR5 BLAKE2sp hash record. Parts continuing in
+// the next volume are checked on their own; the last part's checksum is compared with the whole file.
+// Encrypted, compressed and incomplete files are not read and report the matching sentinel error.
+func VerifyFileFS(fs FileSystem, af AggregatedFile) FileCheck {
+	fc := FileCheck{Name: af.Name, OK: true}
+	for _, p := range af.Parts {
+		fc.Parts = append(fc.Parts, PartCheck{Path: p.Path, DataOffset: p.DataOffset, OK: true})
+	}
+	switch {
+	case af.IsDir || len(af.Parts) == 0:
+		return fc
+	case af.AnyEncrypted:
+		fc.Err = fmt.Errorf("%w: %s", ErrPasswordProtected, af.Name)
+	case !af.AllStored:
+		fc.Err = fmt.Errorf("%w: %s", ErrCompressedNotSupported, af.Name)
+	case af.Incomplete:
+		fc.Err = fmt.Errorf("%w: %s", ErrIncompleteVolumeSet, af.Name)
+	}
+	if fc.Err != nil {
+		fc.OK = false
+		return fc
+	}
+	last := len(af.Parts) - 1
+	whole := newChecksum(af.Parts[last])
+	for i, p := range af.Parts {
+		w := whole.writer()
+		var part *checksum
+		if i < last {
+			part = newChecksum(p)
+			w = io.MultiWriter(w, part.writer())
+		}
+		if err := copyVolumeRange(fs, p.Path, p.DataOffset, p.PackedSize, w); err != nil {
+			fc.Parts[i].OK, fc.OK = false, false
+			fc.Err = fmt.Errorf("%s: %w", p.Path, err)
+			return fc
+		}
+		if part != nil && part.active() {
+			fc.Parts[i].Checked, fc.Parts[i].OK = true, part.match()
+			fc.OK = fc.OK && fc.Parts[i].OK
+		}
+	}
+	if whole.active() {
+		ok := whole.match()
+		fc.Checked, fc.Parts[last].Checked, fc.Parts[last].OK = true, true, ok
+		fc.OK = fc.OK && ok
+	}
+	return fc
+}
+
+// VerifyFile is a convenience using the default filesystem.
+func VerifyFile(af AggregatedFile) FileCheck {
+	return VerifyFileFS(defaultFS, af)
+}
+
+// VerifyAllFS indexes the volume set starting at first and verifies every file (see VerifyFileFS)
+// and, for RAR3 volumes whose end block stores one, the CRC32 of each volume up to that end block.
+// The returned error only reports discovery or indexing failures.
+func VerifyAllFS(fs FileSystem, first string, opts ...Option) (VerifyReport, error) {
+	vols, err := DiscoverVolumesFS(fs, first)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	idx, err := IndexVolumesParallel(fs, vols, 0, opts...)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	rep := VerifyReport{OK: true}
+	for _, af := range AggregateFiles(idx) {
+		fc := VerifyFileFS(fs, af)
+		rep.OK = rep.OK && fc.OK
+		rep.Files = append(rep.Files, fc)
+	}
+	for _, v := range idx {
+		vc := verifyVolumeDataCRC(fs, v)
+		rep.OK = rep.OK && vc.OK
+		rep.Volumes = append(rep.Volumes, vc)
+	}
+	return rep, nil
+}
+
+// VerifyAll is a convenience using the default filesystem.
+func VerifyAll(first string, opts ...Option) (VerifyReport, error) {
+	return VerifyAllFS(defaultFS, first, opts...)
+}
+
+// verifyVolumeDataCRC compares the RAR3 ENDARC data CRC with the CRC32 of the volume from its first
+// byte up to the end block, as unrar defines it.
+func verifyVolumeDataCRC(fs FileSystem, v *VolumeIndex) VolumeCheck {
+	vc := VolumeCheck{Path: v.Path, OK: true}
+	if !v.Archive.HasDataCRC {
+		return vc
+	}
+	h := crc32.NewIEEE()
+	if err := copyVolumeRange(fs, v.Path, 0, v.Archive.EndPos, h); err != nil {
+		vc.OK, vc.Err = false, err
+		return vc
+	}
+	vc.Checked, vc.OK = true, h.Sum32() == v.Archive.DataCRC
+	return vc
+}
+
+// checksum accumulates the CRC32 and BLAKE2sp requested by a part header.
+type checksum struct {
+	crc    hash.Hash32 // nil when the header has no CRC32
+	want   uint32
+	b2     hash.Hash // nil when there is no BLAKE2sp record
+	wantB2 []byte
+}
+
+func newChecksum(p AggregatedFilePart) *checksum {
+	c := &checksum{}
+	if p.HasCRC32 {
+		c.crc, c.want = crc32.NewIEEE(), p.CRC32
+	}
+	if p.Hash != nil && p.Hash.Type == HashBlake2sp && len(p.Hash.Sum) == blake2sp.Size {
+		c.b2, c.wantB2 = blake2sp.New(), p.Hash.Sum
+	}
+	return c
+}
+
+func (c *checksum) active() bool { return c.crc != nil || c.b2 != nil }
+
+func (c *checksum) writer() io.Writer {
+	switch {
+	case c.crc != nil && c.b2 != nil:
+		return io.MultiWriter(c.crc, c.b2)
+	case c.crc != nil:
+		return c.crc
+	case c.b2 != nil:
+		return c.b2
+	}
+	return io.Discard
+}
+
+func (c *checksum) match() bool {
+	if c.crc != nil && c.crc.Sum32() != c.want {
+		return false
+	}
+	if c.b2 != nil && !bytes.Equal(c.b2.Sum(nil), c.wantB2) {
+		return false
+	}
+	return true
+}
+
+// copyVolumeRange copies n bytes starting at off in the volume at path to w.
+func copyVolumeRange(fs FileSystem, path string, off, n int64, w io.Writer) error {
+	f, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	if s, ok := f.(io.Seeker); ok {
+		if _, err := s.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+	} else if _, err := io.CopyN(io.Discard, f, off); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, f, n); err != nil {
+		return fmt.Errorf("reading %d bytes at %d: %w", n, off, err)
+	}
+	return nil
+}
@@ -6,9 +6,11 @@ const (
 	VersionUnknown = "UNKNOWN"
 	VersionRar3    = "RAR3"
 	VersionRar5    = "RAR5"
+	VersionRar14   = "RAR14" // RAR 1.3/1.4 ("RE~^" signature)
 )
 
 var (
-	rarrSigV3 = []byte("Rar!\x1A\x07\x00")     // RAR 1.5/2.x/3.x signature (7 bytes + 0x00)
-	rarrSigV5 = []byte("Rar!\x1A\x07\x01\x00") // RAR5 signature
+	rarrSigV3  = []byte("Rar!\x1A\x07\x00")     // RAR 1.5/2.x/3.x signature (7 bytes + 0x00)
+	rarrSigV5  = []byte("Rar!\x1A\x07\x01\x00") // RAR5 signature
+	rarrSigV14 = []byte("RE~^")                 // RAR 1.3/1.4 signature
 )